@@ -35,6 +35,20 @@ func TestAllocationServeConn(t *testing.T) {
 	}
 }
 
+func TestAllocationWriteString(t *testing.T) {
+	var ctx RequestCtx
+	ctx.WriteString("warm up the body buffer") //nolint:errcheck
+
+	n := testing.AllocsPerRun(100, func() {
+		ctx.Response.body.Reset()
+		ctx.WriteString("foobar") //nolint:errcheck
+	})
+
+	if n != 0 {
+		t.Fatalf("expected 0 allocations, got %f", n)
+	}
+}
+
 func TestAllocationClient(t *testing.T) {
 	ln, err := net.Listen("tcp4", "127.0.0.1:0")
 	if err != nil {
@@ -82,3 +96,50 @@ func TestAllocationURI(t *testing.T) {
 		t.Fatalf("expected 0 allocations, got %f", n)
 	}
 }
+
+func TestAllocationResponseReset(t *testing.T) {
+	var resp Response
+
+	n := testing.AllocsPerRun(100, func() {
+		resp.SetStatusCode(StatusNotFound)
+		resp.Header.Set("X-Foo", "bar")
+		resp.Header.SetContentType("text/plain")
+		resp.SetBodyString("not found")
+		resp.Reset()
+	})
+
+	if n != 0 {
+		t.Fatalf("expected 0 allocations, got %f", n)
+	}
+}
+
+func TestAllocationContentTypeParam(t *testing.T) {
+	var h ResponseHeader
+	h.SetContentType(" text/plain ;  foo=bar;CharSet=\"iso-8859-1\" ; baz")
+
+	n := testing.AllocsPerRun(100, func() {
+		h.ContentTypeParam("charset")
+	})
+
+	if n != 0 {
+		t.Fatalf("expected 0 allocations, got %f", n)
+	}
+}
+
+var allocationSinkString string
+
+func TestAllocationArgsQueryString(t *testing.T) {
+	var a Args
+	a.Parse("foo=bar&baz=x%20y")
+	a.QueryString()
+
+	// The cached query string is reused, so only String conversion allocates.
+	n := testing.AllocsPerRun(100, func() {
+		a.QueryString()
+		allocationSinkString = a.String()
+	})
+
+	if n > 1 {
+		t.Fatalf("expected at most 1 allocation, got %f", n)
+	}
+}
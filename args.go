@@ -46,8 +46,13 @@ var argsPool = &sync.Pool{
 type Args struct {
 	noCopy noCopy //nolint:unused,structcheck
 
-	args []argsKV
-	buf  []byte
+	args   []argsKV
+	buf    []byte
+	keyBuf []byte
+
+	// bufValid is set if buf contains query string for the current args.
+	// It must be cleared on every args mutation.
+	bufValid bool
 }
 
 type argsKV struct {
@@ -59,6 +64,7 @@ type argsKV struct {
 // Reset clears query args.
 func (a *Args) Reset() {
 	a.args = a.args[:0]
+	a.bufValid = false
 }
 
 // CopyTo copies all args to dst.
@@ -80,8 +86,56 @@ func (a *Args) Len() int {
 	return len(a.args)
 }
 
+// Equal returns true if a and b contain the same args regardless
+// of their order.
+//
+// Args are compared as multisets of key-value pairs, so repeated
+// keys must be repeated the same number of times with the same values.
+// See also EqualOrdered.
+func (a *Args) Equal(b *Args) bool {
+	if len(a.args) != len(b.args) {
+		return false
+	}
+	for i := range a.args {
+		kv := &a.args[i]
+		if countArgs(a.args, kv) != countArgs(b.args, kv) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualOrdered returns true if a and b contain the same args
+// in the same order.
+func (a *Args) EqualOrdered(b *Args) bool {
+	if len(a.args) != len(b.args) {
+		return false
+	}
+	for i := range a.args {
+		if !equalArgsKV(&a.args[i], &b.args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func countArgs(args []argsKV, kv *argsKV) int {
+	n := 0
+	for i := range args {
+		if equalArgsKV(&args[i], kv) {
+			n++
+		}
+	}
+	return n
+}
+
+func equalArgsKV(x, y *argsKV) bool {
+	return x.noValue == y.noValue && bytes.Equal(x.key, y.key) && bytes.Equal(x.value, y.value)
+}
+
 // Parse parses the given string containing query args.
 func (a *Args) Parse(s string) {
+	a.bufValid = false
 	a.buf = append(a.buf[:0], s...)
 	a.ParseBytes(a.buf)
 }
@@ -110,9 +164,16 @@ func (a *Args) String() string {
 
 // QueryString returns query string for the args.
 //
+// The query string is cached until args are modified, so repeated calls
+// don't re-encode args.
+//
 // The returned value is valid until the next call to Args methods.
+// It mustn't be modified.
 func (a *Args) QueryString() []byte {
-	a.buf = a.AppendBytes(a.buf[:0])
+	if !a.bufValid {
+		a.buf = a.AppendBytes(a.buf[:0])
+		a.bufValid = true
+	}
 	return a.buf
 }
 
@@ -120,6 +181,7 @@ func (a *Args) QueryString() []byte {
 //
 // For example args.Sort(bytes.Compare)
 func (a *Args) Sort(f func(x, y []byte) int) {
+	a.bufValid = false
 	sort.SliceStable(a.args, func(i, j int) bool {
 		n := f(a.args[i].key, a.args[j].key)
 		if n == 0 {
@@ -132,14 +194,40 @@ func (a *Args) Sort(f func(x, y []byte) int) {
 // AppendBytes appends query string to dst and returns the extended dst.
 func (a *Args) AppendBytes(dst []byte) []byte {
 	for i, n := 0, len(a.args); i < n; i++ {
-		kv := &a.args[i]
-		dst = AppendQuotedArg(dst, kv.key)
-		if !kv.noValue {
-			dst = append(dst, '=')
-			if len(kv.value) > 0 {
-				dst = AppendQuotedArg(dst, kv.value)
-			}
+		dst = appendArgsKV(dst, &a.args[i])
+		if i+1 < n {
+			dst = append(dst, '&')
 		}
+	}
+	return dst
+}
+
+// AppendBytesSorted appends query string with args sorted by key
+// and then by value to dst and returns the extended dst.
+// Args without value precede args with empty value.
+//
+// Unlike Sort it doesn't change the order of args, so it may be used
+// for building cache keys from normalized query strings.
+func (a *Args) AppendBytesSorted(dst []byte) []byte {
+	n := len(a.args)
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		x, y := &a.args[idx[i]], &a.args[idx[j]]
+		if n := bytes.Compare(x.key, y.key); n != 0 {
+			return n < 0
+		}
+		if n := bytes.Compare(x.value, y.value); n != 0 {
+			return n < 0
+		}
+		// Args without value go first, so the result doesn't depend
+		// on the order of 'foo' and 'foo=' args.
+		return x.noValue && !y.noValue
+	})
+	for i, j := range idx {
+		dst = appendArgsKV(dst, &a.args[j])
 		if i+1 < n {
 			dst = append(dst, '&')
 		}
@@ -147,6 +235,17 @@ func (a *Args) AppendBytes(dst []byte) []byte {
 	return dst
 }
 
+func appendArgsKV(dst []byte, kv *argsKV) []byte {
+	dst = AppendQuotedArg(dst, kv.key)
+	if !kv.noValue {
+		dst = append(dst, '=')
+		if len(kv.value) > 0 {
+			dst = AppendQuotedArg(dst, kv.value)
+		}
+	}
+	return dst
+}
+
 // WriteTo writes query string to w.
 //
 // WriteTo implements io.WriterTo interface.
@@ -157,11 +256,13 @@ func (a *Args) WriteTo(w io.Writer) (int64, error) {
 
 // Del deletes argument with the given key from query args.
 func (a *Args) Del(key string) {
+	a.bufValid = false
 	a.args = delAllArgs(a.args, key)
 }
 
 // DelBytes deletes argument with the given key from query args.
 func (a *Args) DelBytes(key []byte) {
+	a.bufValid = false
 	a.args = delAllArgs(a.args, b2s(key))
 }
 
@@ -169,6 +270,7 @@ func (a *Args) DelBytes(key []byte) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) Add(key, value string) {
+	a.bufValid = false
 	a.args = appendArg(a.args, key, value, argsHasValue)
 }
 
@@ -176,6 +278,7 @@ func (a *Args) Add(key, value string) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesK(key []byte, value string) {
+	a.bufValid = false
 	a.args = appendArg(a.args, b2s(key), value, argsHasValue)
 }
 
@@ -183,6 +286,7 @@ func (a *Args) AddBytesK(key []byte, value string) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesV(key string, value []byte) {
+	a.bufValid = false
 	a.args = appendArg(a.args, key, b2s(value), argsHasValue)
 }
 
@@ -190,6 +294,7 @@ func (a *Args) AddBytesV(key string, value []byte) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesKV(key, value []byte) {
+	a.bufValid = false
 	a.args = appendArg(a.args, b2s(key), b2s(value), argsHasValue)
 }
 
@@ -197,6 +302,7 @@ func (a *Args) AddBytesKV(key, value []byte) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddNoValue(key string) {
+	a.bufValid = false
 	a.args = appendArg(a.args, key, "", argsNoValue)
 }
 
@@ -204,26 +310,31 @@ func (a *Args) AddNoValue(key string) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesKNoValue(key []byte) {
+	a.bufValid = false
 	a.args = appendArg(a.args, b2s(key), "", argsNoValue)
 }
 
 // Set sets 'key=value' argument.
 func (a *Args) Set(key, value string) {
+	a.bufValid = false
 	a.args = setArg(a.args, key, value, argsHasValue)
 }
 
 // SetBytesK sets 'key=value' argument.
 func (a *Args) SetBytesK(key []byte, value string) {
+	a.bufValid = false
 	a.args = setArg(a.args, b2s(key), value, argsHasValue)
 }
 
 // SetBytesV sets 'key=value' argument.
 func (a *Args) SetBytesV(key string, value []byte) {
+	a.bufValid = false
 	a.args = setArg(a.args, key, b2s(value), argsHasValue)
 }
 
 // SetBytesKV sets 'key=value' argument.
 func (a *Args) SetBytesKV(key, value []byte) {
+	a.bufValid = false
 	a.args = setArgBytes(a.args, key, value, argsHasValue)
 }
 
@@ -231,21 +342,39 @@ func (a *Args) SetBytesKV(key, value []byte) {
 //
 // Only key in argumemt, like key1&key2
 func (a *Args) SetNoValue(key string) {
+	a.bufValid = false
 	a.args = setArg(a.args, key, "", argsNoValue)
 }
 
 // SetBytesKNoValue sets 'key' argument.
 func (a *Args) SetBytesKNoValue(key []byte) {
+	a.bufValid = false
 	a.args = setArg(a.args, b2s(key), "", argsNoValue)
 }
 
 // Peek returns query arg value for the given key.
 //
+// Keys are stored decoded, so the key must be passed in decoded form,
+// e.g. "foo bar" for 'foo%20bar=baz' or 'foo+bar=baz' query string.
+// Use PeekEncoded for looking up encoded keys.
+//
 // Returned value is valid until the next Args call.
 func (a *Args) Peek(key string) []byte {
 	return peekArgStr(a.args, key)
 }
 
+// PeekEncoded returns query arg value for the given percent-encoded
+// or plus-encoded key.
+//
+// The key is decoded the same way as query string keys are decoded
+// when parsing, so both "foo%20bar" and "foo+bar" match "foo bar" key.
+//
+// Returned value is valid until the next Args call.
+func (a *Args) PeekEncoded(key string) []byte {
+	a.keyBuf = decodeArgAppend(a.keyBuf[:0], s2b(key))
+	return peekArgBytes(a.args, a.keyBuf)
+}
+
 // PeekBytes returns query arg value for the given key.
 //
 // Returned value is valid until the next Args call.
@@ -270,10 +399,20 @@ func (a *Args) PeekMultiBytes(key []byte) [][]byte {
 }
 
 // Has returns true if the given key exists in Args.
+//
+// The key must be passed in decoded form. Use HasEncoded
+// for looking up encoded keys.
 func (a *Args) Has(key string) bool {
 	return hasArg(a.args, key)
 }
 
+// HasEncoded returns true if the given percent-encoded or plus-encoded
+// key exists in Args.
+func (a *Args) HasEncoded(key string) bool {
+	a.keyBuf = decodeArgAppend(a.keyBuf[:0], s2b(key))
+	return hasArg(a.args, b2s(a.keyBuf))
+}
+
 // HasBytes returns true if the given key exists in Args.
 func (a *Args) HasBytes(key []byte) bool {
 	return hasArg(a.args, b2s(key))
@@ -335,16 +474,50 @@ func (a *Args) GetUfloatOrZero(key string) float64 {
 	return f
 }
 
+// GetIntOrDefault returns int value for the given key.
+//
+// def is returned if the value is missing or cannot be parsed.
+func (a *Args) GetIntOrDefault(key string, def int) int {
+	value := a.Peek(key)
+	neg := len(value) > 0 && value[0] == '-'
+	if neg {
+		value = value[1:]
+	}
+	n, err := ParseUint(value)
+	if err != nil {
+		return def
+	}
+	if neg {
+		return -n
+	}
+	return n
+}
+
+// GetStr returns string value for the given key.
+//
+// Empty string is returned if the value is missing.
+func (a *Args) GetStr(key string) string {
+	return string(a.Peek(key))
+}
+
 // GetBool returns boolean value for the given key.
 //
-// true is returned for "1", "t", "T", "true", "TRUE", "True", "y", "yes", "Y", "YES", "Yes",
-// otherwise false is returned.
+// true is returned for "1", "t", "true", "y", "yes" and "on"
+// in any case, otherwise false is returned.
 func (a *Args) GetBool(key string) bool {
-	switch b2s(a.Peek(key)) {
+	value := a.Peek(key)
+	var b [4]byte
+	if len(value) > len(b) {
+		return false
+	}
+	for i, c := range value {
+		b[i] = toLowerTable[c]
+	}
+	switch string(b[:len(value)]) {
 	// Support the same true cases as strconv.ParseBool
 	// See: https://github.com/golang/go/blob/4e1b11e2c9bdb0ddea1141eed487be1a626ff5be/src/strconv/atob.go#L12
-	// and Y and Yes versions.
-	case "1", "t", "T", "true", "TRUE", "True", "y", "yes", "Y", "YES", "Yes":
+	// and y, yes and on versions.
+	case "1", "t", "true", "y", "yes", "on":
 		return true
 	default:
 		return false
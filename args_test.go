@@ -3,6 +3,7 @@ package fasthttp
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/url"
 	"reflect"
 	"strings"
@@ -35,6 +36,106 @@ func testDecodeArgAppend(t *testing.T, s, expectedResult string) {
 	}
 }
 
+func TestArgsAppendBytesSorted(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Parse("z=1&a=b%20c&z=&a=a&m&z=0&a=b%20c")
+	unsorted := a.String()
+
+	var sorted Args
+	a.CopyTo(&sorted)
+	sorted.Sort(bytes.Compare)
+	expected := sorted.String()
+
+	if s := string(a.AppendBytesSorted(nil)); s != expected {
+		t.Fatalf("unexpected result: %q. Expecting %q", s, expected)
+	}
+	if s := string(a.AppendBytesSorted([]byte("prefix?"))); s != "prefix?"+expected {
+		t.Fatalf("unexpected result: %q. Expecting %q", s, "prefix?"+expected)
+	}
+	if s := a.String(); s != unsorted {
+		t.Fatalf("unexpected args order: %q. Expecting %q", s, unsorted)
+	}
+	if expected != "a=a&a=b+c&a=b+c&m&z=&z=0&z=1" {
+		t.Fatalf("unexpected sorted args %q", expected)
+	}
+}
+
+func TestArgsAddMultiValue(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Set("x", "1")
+	a.Add("x", "2")
+	a.AddBytesK([]byte("x"), "3")
+	a.AddBytesV("y", []byte("a b"))
+	a.AddBytesKV([]byte("x"), []byte("4&5"))
+
+	expectedS := "x=1&x=2&x=3&y=a+b&x=4%265"
+	if s := a.String(); s != expectedS {
+		t.Fatalf("unexpected query string: %q. Expecting %q", s, expectedS)
+	}
+	expectArgsPeekMulti(t, &a, "x", []string{"1", "2", "3", "4&5"})
+
+	// All the values must survive encoding.
+	var u URI
+	u.Parse(nil, []byte("http://foobar.com/"))
+	a.CopyTo(u.QueryArgs())
+	var u1 URI
+	u1.Parse(nil, u.FullURI())
+	a1 := u1.QueryArgs()
+	expectArgsPeekMulti(t, a1, "x", []string{"1", "2", "3", "4&5"})
+	expectArgsPeekMulti(t, a1, "y", []string{"a b"})
+
+	// Set overwrites only the first value.
+	a1.Set("x", "0")
+	expectArgsPeekMulti(t, a1, "x", []string{"0", "2", "3", "4&5"})
+}
+
+func expectArgsPeekMulti(t *testing.T, a *Args, key string, expectedValues []string) {
+	values := a.PeekMulti(key)
+	if len(values) != len(expectedValues) {
+		t.Fatalf("unexpected number of values for %q: %d. Expecting %d", key, len(values), len(expectedValues))
+	}
+	for i, v := range values {
+		if string(v) != expectedValues[i] {
+			t.Fatalf("unexpected value #%d for %q: %q. Expecting %q", i, key, v, expectedValues[i])
+		}
+	}
+}
+
+func TestArgsAppendBytesSortedNoValue(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Add("foo", "bar")
+	a.Add("foo", "baz")
+	a.Add("foo", "1")
+	a.Add("ba", "23")
+	a.Add("foo", "")
+	a.AddNoValue("foo")
+	expectedS := "foo=bar&foo=baz&foo=1&ba=23&foo=&foo"
+
+	if sorted := string(a.AppendBytesSorted(nil)); sorted != "ba=23&foo&foo=&foo=1&foo=bar&foo=baz" {
+		t.Fatalf("unexpected sorted result: %q. Expecting %q", sorted, "ba=23&foo&foo=&foo=1&foo=bar&foo=baz")
+	}
+	if s := a.String(); s != expectedS {
+		t.Fatalf("AppendBytesSorted mustn't change the order of args: %q. Expecting %q", s, expectedS)
+	}
+
+	// The result mustn't depend on the order of args with and without value.
+	var a1, a2 Args
+	a1.AddNoValue("a")
+	a1.Add("a", "")
+	a2.Add("a", "")
+	a2.AddNoValue("a")
+	s1, s2 := string(a1.AppendBytesSorted(nil)), string(a2.AppendBytesSorted(nil))
+	if s1 != s2 || s1 != "a&a=" {
+		t.Fatalf("unexpected sorted results: %q and %q. Expecting %q", s1, s2, "a&a=")
+	}
+}
+
 func TestArgsAdd(t *testing.T) {
 	t.Parallel()
 
@@ -248,6 +349,28 @@ func TestArgsWriteTo(t *testing.T) {
 	}
 }
 
+func TestArgsWriteToBuffer(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Add("foo", "bar")
+	a.Add("baz", "привет")
+	a.AddNoValue("empty")
+
+	var w io.WriterTo = &a
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("unexpected n: %d. Expecting %d", n, buf.Len())
+	}
+	if buf.String() != a.String() {
+		t.Fatalf("unexpected result %q. Expecting %q", buf.String(), a.String())
+	}
+}
+
 func TestArgsGetBool(t *testing.T) {
 	t.Parallel()
 
@@ -258,9 +381,21 @@ func TestArgsGetBool(t *testing.T) {
 	testArgsGetBool(t, "1", true)
 	testArgsGetBool(t, "y", true)
 	testArgsGetBool(t, "yes", true)
+	testArgsGetBool(t, "YES", true)
+	testArgsGetBool(t, "True", true)
+	testArgsGetBool(t, "tRuE", true)
+	testArgsGetBool(t, "on", true)
+	testArgsGetBool(t, "ON", true)
+	testArgsGetBool(t, "off", false)
+	testArgsGetBool(t, "false", false)
 
 	testArgsGetBool(t, "123", false)
 	testArgsGetBool(t, "foobar", false)
+
+	var a Args
+	if a.GetBool("missing") {
+		t.Fatalf("unexpected true value for missing key")
+	}
 }
 
 func testArgsGetBool(t *testing.T, value string, expectedResult bool) {
@@ -273,6 +408,44 @@ func testArgsGetBool(t *testing.T, value string, expectedResult bool) {
 	}
 }
 
+func TestArgsGetStr(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Parse("foo=bar&empty=")
+
+	if v := a.GetStr("foo"); v != "bar" {
+		t.Fatalf("unexpected value %q. Expecting %q", v, "bar")
+	}
+	if v := a.GetStr("empty"); v != "" {
+		t.Fatalf("unexpected value %q. Expecting empty string", v)
+	}
+	if v := a.GetStr("missing"); v != "" {
+		t.Fatalf("unexpected value %q. Expecting empty string", v)
+	}
+}
+
+func TestArgsGetIntOrDefault(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Parse("a=123&b=-45&c=0&d=foo&e=&f=-")
+
+	for key, expected := range map[string]int{
+		"a":       123,
+		"b":       -45,
+		"c":       0,
+		"d":       7,
+		"e":       7,
+		"f":       7,
+		"missing": 7,
+	} {
+		if v := a.GetIntOrDefault(key, 7); v != expected {
+			t.Fatalf("unexpected value %d for key %q. Expecting %d", v, key, expected)
+		}
+	}
+}
+
 func TestArgsUint(t *testing.T) {
 	t.Parallel()
 
@@ -568,6 +741,119 @@ func testArgsHasNot(t *testing.T, a *Args, s string, unexpectedKeys ...string) {
 	}
 }
 
+func TestArgsQueryStringCache(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Parse("foo=bar&baz=x%20y")
+	expectArgsQueryString(t, &a, "foo=bar&baz=x+y")
+
+	// The cached query string must be returned until args are modified.
+	qs := a.QueryString()
+	if qs2 := a.QueryString(); &qs2[0] != &qs[0] {
+		t.Fatalf("expecting cached query string")
+	}
+	a.Set("foo", "aaa")
+	expectArgsQueryString(t, &a, "foo=aaa&baz=x+y")
+	a.Add("xxx", "yyy")
+	expectArgsQueryString(t, &a, "foo=aaa&baz=x+y&xxx=yyy")
+	a.SetNoValue("empty")
+	expectArgsQueryString(t, &a, "foo=aaa&baz=x+y&xxx=yyy&empty")
+	a.SetUint("num", 123)
+	expectArgsQueryString(t, &a, "foo=aaa&baz=x+y&xxx=yyy&empty&num=123")
+	a.Del("baz")
+	expectArgsQueryString(t, &a, "foo=aaa&xxx=yyy&empty&num=123")
+	a.Sort(bytes.Compare)
+	expectArgsQueryString(t, &a, "empty&foo=aaa&num=123&xxx=yyy")
+	a.Parse("a=1")
+	expectArgsQueryString(t, &a, "a=1")
+	a.ParseBytes([]byte("b=2&c"))
+	expectArgsQueryString(t, &a, "b=2&c")
+
+	var b Args
+	a.CopyTo(&b)
+	expectArgsQueryString(t, &b, "b=2&c")
+
+	a.Reset()
+	expectArgsQueryString(t, &a, "")
+}
+
+func expectArgsQueryString(t *testing.T, a *Args, expectedQueryString string) {
+	if s := a.QueryString(); string(s) != expectedQueryString {
+		t.Fatalf("unexpected query string: %q. Expecting %q", s, expectedQueryString)
+	}
+	if s := a.String(); s != expectedQueryString {
+		t.Fatalf("unexpected string: %q. Expecting %q", s, expectedQueryString)
+	}
+}
+
+func TestArgsEqual(t *testing.T) {
+	t.Parallel()
+
+	testArgsEqual(t, "", "", true, true)
+	testArgsEqual(t, "a=1&b=2", "a=1&b=2", true, true)
+
+	// different order
+	testArgsEqual(t, "a=1&b=2&c=3", "c=3&a=1&b=2", true, false)
+
+	// differ by one value
+	testArgsEqual(t, "a=1&b=2", "a=1&b=3", false, false)
+	testArgsEqual(t, "a=1&b=2", "a=1", false, false)
+
+	// repeated keys
+	testArgsEqual(t, "a=1&a=2&b=3", "a=2&b=3&a=1", true, false)
+	testArgsEqual(t, "a=1&a=1&a=2", "a=1&a=2&a=2", false, false)
+
+	// keys without values
+	testArgsEqual(t, "a&b=", "b=&a", true, false)
+	testArgsEqual(t, "a", "a=", false, false)
+}
+
+func testArgsEqual(t *testing.T, s1, s2 string, equal, equalOrdered bool) {
+	var a1, a2 Args
+	a1.Parse(s1)
+	a2.Parse(s2)
+	if a1.Equal(&a2) != equal || a2.Equal(&a1) != equal {
+		t.Fatalf("unexpected Equal result for %q and %q. Expecting %v", s1, s2, equal)
+	}
+	if a1.EqualOrdered(&a2) != equalOrdered || a2.EqualOrdered(&a1) != equalOrdered {
+		t.Fatalf("unexpected EqualOrdered result for %q and %q. Expecting %v", s1, s2, equalOrdered)
+	}
+}
+
+func TestArgsEncodedKeys(t *testing.T) {
+	t.Parallel()
+
+	var a Args
+	a.Parse("foo%20bar=baz&a+b=c")
+
+	// keys are stored decoded
+	if v := a.Peek("foo bar"); string(v) != "baz" {
+		t.Fatalf("unexpected value %q. Expecting %q", v, "baz")
+	}
+	if a.Has("foo%20bar") {
+		t.Fatalf("unexpected encoded key %q found via Has", "foo%20bar")
+	}
+
+	for _, key := range []string{"foo%20bar", "foo+bar", "foo bar"} {
+		if v := a.PeekEncoded(key); string(v) != "baz" {
+			t.Fatalf("unexpected value for %q: %q. Expecting %q", key, v, "baz")
+		}
+		if !a.HasEncoded(key) {
+			t.Fatalf("missing key %q", key)
+		}
+	}
+	if !a.HasEncoded("a%20b") {
+		t.Fatalf("missing key %q", "a%20b")
+	}
+	if a.HasEncoded("foo%2Bbar") {
+		t.Fatalf("unexpected key %q", "foo%2Bbar")
+	}
+	if v := a.PeekEncoded("baz"); v != nil {
+		t.Fatalf("unexpected value %q. Expecting nil", v)
+	}
+}
+
 func testArgsParse(t *testing.T, a *Args, s string, expectedLen int, expectedArgs ...string) {
 	a.Parse(s)
 	if a.Len() != expectedLen {
@@ -193,6 +193,23 @@ type Client struct {
 	// Default Dial is used if not set.
 	Dial DialFunc
 
+	// UnixSocketPaths maps host names to unix socket paths.
+	//
+	// Requests to the mapped hosts are sent over unix socket connections
+	// to the corresponding paths instead of TCP, e.g. the following
+	// client sends requests for http://docker/containers/json
+	// to /var/run/docker.sock:
+	//
+	//     c := &fasthttp.Client{
+	//         UnixSocketPaths: map[string]string{
+	//             "docker": "/var/run/docker.sock",
+	//         },
+	//     }
+	//
+	// Host names must match uri host, including port if present.
+	// Dial is ignored for the mapped hosts.
+	UnixSocketPaths map[string]string
+
 	// Attempt to connect to both ipv4 and ipv6 addresses if set to true.
 	//
 	// This option is used only if default TCP dialer is used,
@@ -202,6 +219,19 @@ type Client struct {
 	// since unfortunately ipv6 remains broken in many networks worldwide :)
 	DialDualStack bool
 
+	// Whether to enable tcp keep-alive on connections to hosts.
+	//
+	// This option is used only if default TCP dialer is used,
+	// i.e. if Dial is blank.
+	//
+	// By default tcp keep-alive settings are left untouched.
+	TCPKeepalive bool
+
+	// Period between tcp keep-alive messages.
+	//
+	// TCP keep-alive period is determined by operation system by default.
+	TCPKeepalivePeriod time.Duration
+
 	// TLS config for https connections.
 	//
 	// Default TLS config is used if not set.
@@ -257,6 +287,14 @@ type Client struct {
 	// By default response body size is unlimited.
 	MaxResponseBodySize int
 
+	// Maximum response header size.
+	//
+	// The client returns ErrHeaderTooLarge if this limit is greater than 0
+	// and response headers are greater than the limit.
+	//
+	// By default response header size is limited only by ReadBufferSize.
+	MaxResponseHeaderSize int
+
 	// Header names are passed as-is without normalization
 	// if this option is set.
 	//
@@ -484,12 +522,18 @@ func (c *Client) Do(req *Request, resp *Response) error {
 	}
 	hc := m[string(host)]
 	if hc == nil {
+		dial := c.Dial
+		if path, ok := c.UnixSocketPaths[string(host)]; ok {
+			dial = unixSocketDial(path)
+		}
 		hc = &HostClient{
 			Addr:                          addMissingPort(string(host), isTLS),
 			Name:                          c.Name,
 			NoDefaultUserAgentHeader:      c.NoDefaultUserAgentHeader,
-			Dial:                          c.Dial,
+			Dial:                          dial,
 			DialDualStack:                 c.DialDualStack,
+			TCPKeepalive:                  c.TCPKeepalive,
+			TCPKeepalivePeriod:            c.TCPKeepalivePeriod,
 			IsTLS:                         isTLS,
 			TLSConfig:                     c.TLSConfig,
 			MaxConns:                      c.MaxConnsPerHost,
@@ -501,6 +545,7 @@ func (c *Client) Do(req *Request, resp *Response) error {
 			ReadTimeout:                   c.ReadTimeout,
 			WriteTimeout:                  c.WriteTimeout,
 			MaxResponseBodySize:           c.MaxResponseBodySize,
+			MaxResponseHeaderSize:         c.MaxResponseHeaderSize,
 			DisableHeaderNamesNormalizing: c.DisableHeaderNamesNormalizing,
 			DisablePathNormalizing:        c.DisablePathNormalizing,
 			MaxConnWaitTimeout:            c.MaxConnWaitTimeout,
@@ -610,6 +655,14 @@ type TransportFunc func(*Request, *Response) error
 type HostClient struct {
 	noCopy noCopy //nolint:unused,structcheck
 
+	// Connection statistics returned by Stats.
+	// Accessed atomically, so they must be the first fields for 64-bit
+	// alignment on 32-bit platforms.
+	dialsCount       uint64
+	requestsCount    uint64
+	connsReusedCount uint64
+	connsClosedCount uint64
+
 	// Comma-separated list of upstream HTTP server host addresses,
 	// which are passed to Dial in a round-robin manner.
 	//
@@ -643,6 +696,19 @@ type HostClient struct {
 	// since unfortunately ipv6 remains broken in many networks worldwide :)
 	DialDualStack bool
 
+	// Whether to enable tcp keep-alive on connections to the host.
+	//
+	// This option is used only if default TCP dialer is used,
+	// i.e. if Dial is blank.
+	//
+	// By default tcp keep-alive settings are left untouched.
+	TCPKeepalive bool
+
+	// Period between tcp keep-alive messages.
+	//
+	// TCP keep-alive period is determined by operation system by default.
+	TCPKeepalivePeriod time.Duration
+
 	// Whether to use TLS (aka SSL or HTTPS) for host connections.
 	IsTLS bool
 
@@ -703,6 +769,14 @@ type HostClient struct {
 	// By default response body size is unlimited.
 	MaxResponseBodySize int
 
+	// Maximum response header size.
+	//
+	// The client returns ErrHeaderTooLarge if this limit is greater than 0
+	// and response headers are greater than the limit.
+	//
+	// By default response header size is limited only by ReadBufferSize.
+	MaxResponseHeaderSize int
+
 	// Header names are passed as-is without normalization
 	// if this option is set.
 	//
@@ -749,8 +823,35 @@ type HostClient struct {
 	RetryIf RetryIfFunc
 
 	// Transport defines a transport-like mechanism that wraps every request/response.
+	//
+	// Request.SetTimeout is ignored if Transport is set.
 	Transport TransportFunc
 
+	// SignRequest is called before sending every request, including retries.
+	//
+	// Host, User-Agent and Content-Length headers are already filled in
+	// when SignRequest is called, so the signature may cover the exact
+	// bytes sent to the server. Content-Length is filled in only if it is
+	// sent, i.e. it is missing for GET and HEAD requests without body
+	// and for requests with body streams. So sign the header value
+	// returned by Header.Peek(HeaderContentLength) instead of
+	// Header.ContentLength().
+	//
+	// The request isn't sent if SignRequest returns non-nil error.
+	// The error is returned to the caller.
+	SignRequest func(req *Request) error
+
+	// OnResponse is called after reading every response
+	// successfully.
+	//
+	// It may be used for response verification (e.g. signature checks)
+	// or for modifying the response before returning it to the caller.
+	// Do* methods return the error returned by OnResponse.
+	// Such requests aren't retried.
+	//
+	// OnResponse isn't called for Upgrade responses.
+	OnResponse func(req *Request, resp *Response) error
+
 	clientName  atomic.Value
 	lastUseTime uint32
 
@@ -988,12 +1089,17 @@ func doRequestFollowRedirectsBuffer(req *Request, dst []byte, url string, c clie
 
 func doRequestFollowRedirects(req *Request, resp *Response, url string, maxRedirectsCount int, c clientDoer) (statusCode int, body []byte, err error) {
 	redirectsCount := 0
+	var host []byte
 
 	for {
 		req.SetRequestURI(url)
 		if err := req.parseURI(); err != nil {
 			return 0, nil, err
 		}
+		if redirectsCount > 0 && !bytes.Equal(req.uri.Host(), host) {
+			// Do not send the explicitly set Host header to another host.
+			req.Header.SetHost("")
+		}
 
 		if err = c.Do(req, resp); err != nil {
 			break
@@ -1013,6 +1119,7 @@ func doRequestFollowRedirects(req *Request, resp *Response, url string, maxRedir
 			err = ErrMissingLocation
 			break
 		}
+		host = append(host[:0], req.uri.Host()...)
 		url = getRedirectURL(url, location)
 	}
 
@@ -1187,6 +1294,8 @@ func clientDoDeadline(req *Request, resp *Response, deadline time.Time, c client
 		// Not calling resp.copyToSkipBody(respCopy) here to avoid
 		// unexpected messing with headers
 		respCopy.SkipBody = resp.SkipBody
+		respCopy.MaxDecompressedBodySize = resp.MaxDecompressedBodySize
+		respCopy.PartialBodyOnTimeout = resp.PartialBodyOnTimeout
 	}
 
 	// Note that the request continues execution on ErrTimeout until
@@ -1274,9 +1383,14 @@ func (c *HostClient) Do(req *Request, resp *Response) error {
 	attempts := 0
 	hasBodyStream := req.IsBodyStream()
 
+	var deadline time.Time
+	if req.connTimeout > 0 {
+		deadline = time.Now().Add(req.connTimeout)
+	}
+
 	atomic.AddInt32(&c.pendingRequests, 1)
 	for {
-		retry, err = c.do(req, resp)
+		retry, err = c.do(req, resp, deadline)
 		if err == nil || !retry {
 			break
 		}
@@ -1322,14 +1436,17 @@ func isIdempotent(req *Request) bool {
 	return req.Header.IsGet() || req.Header.IsHead() || req.Header.IsPut()
 }
 
-func (c *HostClient) do(req *Request, resp *Response) (bool, error) {
+func (c *HostClient) do(req *Request, resp *Response, deadline time.Time) (bool, error) {
 	nilResp := false
 	if resp == nil {
 		nilResp = true
 		resp = AcquireResponse()
 	}
 
-	ok, err := c.doNonNilReqResp(req, resp)
+	ok, err := c.doNonNilReqResp(req, resp, deadline)
+	if err == nil && c.OnResponse != nil {
+		err = c.OnResponse(req, resp)
+	}
 
 	if nilResp {
 		ReleaseResponse(resp)
@@ -1338,7 +1455,7 @@ func (c *HostClient) do(req *Request, resp *Response) (bool, error) {
 	return ok, err
 }
 
-func (c *HostClient) doNonNilReqResp(req *Request, resp *Response) (bool, error) {
+func (c *HostClient) doNonNilReqResp(req *Request, resp *Response, deadline time.Time) (bool, error) {
 	if req == nil {
 		panic("BUG: req cannot be nil")
 	}
@@ -1352,25 +1469,20 @@ func (c *HostClient) doNonNilReqResp(req *Request, resp *Response) (bool, error)
 	req.secureErrorLogMessage = c.SecureErrorLogMessage
 	req.Header.secureErrorLogMessage = c.SecureErrorLogMessage
 
-	if c.IsTLS != bytes.Equal(req.uri.Scheme(), strHTTPS) {
-		return false, ErrHostClientRedirectToDifferentScheme
-	}
-
-	atomic.StoreUint32(&c.lastUseTime, uint32(time.Now().Unix()-startTimeUnix))
-
 	// Free up resources occupied by response before sending the request,
 	// so the GC may reclaim these resources (e.g. response body).
 
-	// backing up SkipBody in case it was set explicitly
+	// backing up the response options in case they were set explicitly
 	customSkipBody := resp.SkipBody
+	customMaxDecompressedBodySize := resp.MaxDecompressedBodySize
+	customPartialBodyOnTimeout := resp.PartialBodyOnTimeout
 	resp.Reset()
 	resp.SkipBody = customSkipBody
+	resp.MaxDecompressedBodySize = customMaxDecompressedBodySize
+	resp.PartialBodyOnTimeout = customPartialBodyOnTimeout
 
-	req.URI().DisablePathNormalizing = c.DisablePathNormalizing
-
-	userAgentOld := req.Header.UserAgent()
-	if len(userAgentOld) == 0 {
-		req.Header.userAgent = append(req.Header.userAgent[:0], c.getClientName()...)
+	if err := c.prepareRequest(req); err != nil {
+		return false, err
 	}
 
 	if c.Transport != nil {
@@ -1378,7 +1490,7 @@ func (c *HostClient) doNonNilReqResp(req *Request, resp *Response) (bool, error)
 		return err == nil, err
 	}
 
-	cc, err := c.acquireConn(req.timeout, req.ConnectionClose())
+	cc, err := c.acquireConnDeadline(req, deadline)
 	if err != nil {
 		return false, err
 	}
@@ -1386,75 +1498,292 @@ func (c *HostClient) doNonNilReqResp(req *Request, resp *Response) (bool, error)
 
 	resp.parseNetConn(conn)
 
-	if c.WriteTimeout > 0 {
-		// Set Deadline every time, since golang has fixed the performance issue
-		// See https://github.com/golang/go/issues/15133#issuecomment-271571395 for details
-		currentTime := time.Now()
-		if err = conn.SetWriteDeadline(currentTime.Add(c.WriteTimeout)); err != nil {
-			c.closeConn(cc)
-			return true, err
-		}
-	}
-
 	resetConnection := false
 	if c.MaxConnDuration > 0 && time.Since(cc.createdTime) > c.MaxConnDuration && !req.ConnectionClose() {
 		req.SetConnectionClose()
 		resetConnection = true
 	}
 
-	bw := c.acquireWriter(conn)
-	err = req.Write(bw)
+	err = c.writeRequest(conn, req, deadline)
 
 	if resetConnection {
 		req.Header.ResetConnectionClose()
 	}
 
-	if err == nil {
-		err = bw.Flush()
-	}
 	if err != nil {
-		c.releaseWriter(bw)
 		c.closeConn(cc)
 		return true, err
 	}
-	c.releaseWriter(bw)
 
-	if c.ReadTimeout > 0 {
+	if err = c.setReadDeadline(conn, deadline); err != nil {
+		c.closeConn(cc)
+		return true, err
+	}
+
+	if customSkipBody || req.Header.IsHead() {
+		resp.SkipBody = true
+	}
+
+	br := c.acquireReader(conn)
+	if err = c.readResponse(br, resp); err != nil {
+		c.releaseReader(br)
+		c.closeConn(cc)
+		if _, ok := err.(*ErrPartialBody); ok {
+			// The caller asked for the partial body via
+			// Response.PartialBodyOnTimeout, so don't hide it
+			// behind ErrTimeout and don't retry.
+			return false, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return false, ErrTimeout
+		}
+		// Don't retry in case of ErrBodyTooLarge or ErrHeaderTooLarge
+		// since we will just get the same again.
+		retry := err != ErrBodyTooLarge && err != ErrHeaderTooLarge
+		return retry, err
+	}
+	c.releaseReader(br)
+
+	if resetConnection || req.ConnectionClose() || resp.ConnectionClose() ||
+		resp.Header.StatusCode() == StatusSwitchingProtocols {
+		// The connection cannot be reused after switching protocols.
+		// Use Upgrade for obtaining the upgraded connection.
+		c.closeConn(cc)
+		return false, err
+	}
+
+	if c.ReadTimeout > 0 || c.WriteTimeout > 0 || !deadline.IsZero() {
+		// Clear deadlines, so they don't affect the idle connection
+		// and requests without timeouts reusing it.
+		if err = conn.SetDeadline(zeroTime); err != nil {
+			c.closeConn(cc)
+			return false, nil
+		}
+	}
+	c.releaseConn(cc)
+
+	return false, err
+}
+
+// signRequest fills in the headers derived from req uri and body
+// and calls SignRequest if it is set.
+func (c *HostClient) signRequest(req *Request) error {
+	if c.SignRequest == nil {
+		return nil
+	}
+	if err := req.prepareURIHeaders(); err != nil {
+		return err
+	}
+	if req.bodyStream == nil {
+		if _, _, err := req.prepareBody(); err != nil {
+			return err
+		}
+	}
+	return c.SignRequest(req)
+}
+
+// prepareRequest updates req with the client settings
+// before sending it.
+func (c *HostClient) prepareRequest(req *Request) error {
+	if c.IsTLS != bytes.Equal(req.URI().Scheme(), strHTTPS) {
+		return ErrHostClientRedirectToDifferentScheme
+	}
+
+	atomic.StoreUint32(&c.lastUseTime, uint32(time.Now().Unix()-startTimeUnix))
+	atomic.AddUint64(&c.requestsCount, 1)
+
+	req.URI().DisablePathNormalizing = c.DisablePathNormalizing
+
+	userAgentOld := req.Header.UserAgent()
+	if len(userAgentOld) == 0 {
+		req.Header.userAgent = append(req.Header.userAgent[:0], c.getClientName()...)
+	}
+
+	return c.signRequest(req)
+}
+
+// acquireConnDeadline acquires connection for sending req.
+//
+// Waiting for a free connection is limited by the request timeout
+// and the given deadline.
+func (c *HostClient) acquireConnDeadline(req *Request, deadline time.Time) (*clientConn, error) {
+	reqTimeout := req.timeout
+	if !deadline.IsZero() {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, ErrTimeout
+		}
+		if reqTimeout <= 0 || timeout < reqTimeout {
+			reqTimeout = timeout
+		}
+	}
+	return c.acquireConn(reqTimeout, req.ConnectionClose())
+}
+
+// writeRequest writes req to conn.
+//
+// The write deadline is limited by the given deadline.
+func (c *HostClient) writeRequest(conn net.Conn, req *Request, deadline time.Time) error {
+	if c.WriteTimeout > 0 || !deadline.IsZero() {
 		// Set Deadline every time, since golang has fixed the performance issue
 		// See https://github.com/golang/go/issues/15133#issuecomment-271571395 for details
-		currentTime := time.Now()
-		if err = conn.SetReadDeadline(currentTime.Add(c.ReadTimeout)); err != nil {
-			c.closeConn(cc)
-			return true, err
+		writeDeadline := deadline
+		if c.WriteTimeout > 0 {
+			writeDeadline = limitDeadline(time.Now().Add(c.WriteTimeout), deadline)
+		}
+		if err := conn.SetWriteDeadline(writeDeadline); err != nil {
+			return err
 		}
 	}
 
-	if customSkipBody || req.Header.IsHead() {
-		resp.SkipBody = true
+	bw := c.acquireWriter(conn)
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	c.releaseWriter(bw)
+	return err
+}
+
+// setReadDeadline sets the deadline for reading the response from conn.
+//
+// The read deadline is limited by the given deadline.
+func (c *HostClient) setReadDeadline(conn net.Conn, deadline time.Time) error {
+	if c.ReadTimeout > 0 || !deadline.IsZero() {
+		// Set Deadline every time, since golang has fixed the performance issue
+		// See https://github.com/golang/go/issues/15133#issuecomment-271571395 for details
+		readDeadline := deadline
+		if c.ReadTimeout > 0 {
+			readDeadline = limitDeadline(time.Now().Add(c.ReadTimeout), deadline)
+		}
+		return conn.SetReadDeadline(readDeadline)
 	}
+	return nil
+}
+
+// readResponse reads resp from br according to the client limits.
+func (c *HostClient) readResponse(br *bufio.Reader, resp *Response) error {
 	if c.DisableHeaderNamesNormalizing {
 		resp.Header.DisableNormalizing()
 	}
+	resp.Header.maxHeaderSize = c.MaxResponseHeaderSize
+	return resp.ReadLimitBody(br, c.MaxResponseBodySize)
+}
+
+// Upgrade sends the given protocol upgrade request and returns
+// the connection switched to the new protocol together with
+// the StatusSwitchingProtocols response.
+//
+// The request must contain the Upgrade header with the protocol
+// to switch to, otherwise ErrUpgradeHeaderRequired is returned.
+// 'Connection: Upgrade' header is set automatically.
+//
+// The returned connection is removed from the HostClient pool.
+// It must be closed by the caller after use. Bytes sent by the server
+// after the response are read from the returned connection first.
+//
+// ErrUpgradeRejected is returned together with the response
+// if the server responds with another status code.
+//
+// The request timeout set via Request.SetTimeout and MaxConnWaitTimeout
+// are honored the same way as in Do.
+//
+// The returned response may be released with ReleaseResponse.
+func (c *HostClient) Upgrade(req *Request) (net.Conn, *Response, error) {
+	if c.Transport != nil {
+		return nil, nil, errUpgradeTransport
+	}
+	if len(req.Header.Peek(HeaderUpgrade)) == 0 {
+		return nil, nil, ErrUpgradeHeaderRequired
+	}
+	req.Header.Set(HeaderConnection, "Upgrade")
+
+	req.secureErrorLogMessage = c.SecureErrorLogMessage
+	req.Header.secureErrorLogMessage = c.SecureErrorLogMessage
+
+	if err := c.prepareRequest(req); err != nil {
+		return nil, nil, err
+	}
+
+	var deadline time.Time
+	if req.connTimeout > 0 {
+		deadline = time.Now().Add(req.connTimeout)
+	}
+
+	cc, err := c.acquireConnDeadline(req, deadline)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := cc.c
+
+	if err = c.writeRequest(conn, req, deadline); err != nil {
+		c.closeConn(cc)
+		return nil, nil, err
+	}
+	if err = c.setReadDeadline(conn, deadline); err != nil {
+		c.closeConn(cc)
+		return nil, nil, err
+	}
+
+	resp := AcquireResponse()
+	resp.secureErrorLogMessage = c.SecureErrorLogMessage
+	resp.Header.secureErrorLogMessage = c.SecureErrorLogMessage
+	resp.parseNetConn(conn)
 
 	br := c.acquireReader(conn)
-	if err = resp.ReadLimitBody(br, c.MaxResponseBodySize); err != nil {
+	if err = c.readResponse(br, resp); err != nil {
 		c.releaseReader(br)
 		c.closeConn(cc)
-		// Don't retry in case of ErrBodyTooLarge since we will just get the same again.
-		retry := err != ErrBodyTooLarge
-		return retry, err
+		ReleaseResponse(resp)
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, nil, ErrTimeout
+		}
+		return nil, nil, err
+	}
+	if resp.StatusCode() != StatusSwitchingProtocols {
+		c.releaseReader(br)
+		c.closeConn(cc)
+		return nil, resp, ErrUpgradeRejected
 	}
-	c.releaseReader(br)
 
-	if resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
+	if err = conn.SetDeadline(zeroTime); err != nil {
+		c.releaseReader(br)
 		c.closeConn(cc)
-	} else {
-		c.releaseConn(cc)
+		ReleaseResponse(resp)
+		return nil, nil, err
 	}
 
-	return false, err
+	// Remove the connection from the pool accounting
+	// without closing it.
+	c.decConnsCount()
+	releaseClientConn(cc)
+
+	if br.Buffered() == 0 {
+		c.releaseReader(br)
+		return conn, resp, nil
+	}
+	return &upgradedConn{Conn: conn, br: br}, resp, nil
+}
+
+// upgradedConn reads the bytes buffered while reading
+// the upgrade response before reading from Conn.
+type upgradedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(p)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(p)
 }
 
+var errUpgradeTransport = errors.New("upgrade isn't supported with HostClient.Transport")
+
 var (
 	// ErrNoFreeConns is returned when no free connections available
 	// to the given host.
@@ -1472,6 +1801,14 @@ var (
 	// to broken server.
 	ErrConnectionClosed = errors.New("the server closed connection before returning the first response byte. " +
 		"Make sure the server returns 'Connection: close' response header before closing the connection")
+
+	// ErrUpgradeRejected is returned from HostClient.Upgrade if the server
+	// doesn't respond with StatusSwitchingProtocols.
+	ErrUpgradeRejected = errors.New("the server rejected the protocol upgrade")
+
+	// ErrUpgradeHeaderRequired is returned from HostClient.Upgrade
+	// if the request doesn't contain the Upgrade header.
+	ErrUpgradeHeaderRequired = errors.New("missing required Upgrade header in upgrade request")
 )
 
 type timeoutError struct{}
@@ -1527,6 +1864,7 @@ func (c *HostClient) acquireConn(reqTimeout time.Duration, connectionClose bool)
 	c.connsLock.Unlock()
 
 	if cc != nil {
+		atomic.AddUint64(&c.connsReusedCount, 1)
 		return cc, nil
 	}
 	if !createConn {
@@ -1688,6 +2026,7 @@ func (c *HostClient) connsCleaner() {
 }
 
 func (c *HostClient) closeConn(cc *clientConn) {
+	atomic.AddUint64(&c.connsClosedCount, 1)
 	c.decConnsCount()
 	cc.c.Close()
 	releaseClientConn(cc)
@@ -1727,6 +2066,45 @@ func (c *HostClient) ConnsCount() int {
 	return c.connsCount
 }
 
+// HostClientStats contains HostClient connection statistics.
+type HostClientStats struct {
+	// Dials is the number of established connections.
+	Dials uint64
+
+	// Requests is the number of request attempts including retries.
+	Requests uint64
+
+	// ConnsReused is the number of times a keep-alive connection
+	// has been reused for a request.
+	ConnsReused uint64
+
+	// ConnsClosed is the number of closed connections.
+	ConnsClosed uint64
+
+	// Conns is the number of open connections including idle ones.
+	Conns int
+
+	// IdleConns is the number of idle connections in the pool.
+	IdleConns int
+}
+
+// Stats returns a snapshot of HostClient connection statistics.
+func (c *HostClient) Stats() HostClientStats {
+	st := HostClientStats{
+		Dials:       atomic.LoadUint64(&c.dialsCount),
+		Requests:    atomic.LoadUint64(&c.requestsCount),
+		ConnsReused: atomic.LoadUint64(&c.connsReusedCount),
+		ConnsClosed: atomic.LoadUint64(&c.connsClosedCount),
+	}
+
+	c.connsLock.Lock()
+	st.Conns = c.connsCount
+	st.IdleConns = len(c.conns)
+	c.connsLock.Unlock()
+
+	return st
+}
+
 func acquireClientConn(conn net.Conn) *clientConn {
 	v := clientConnPool.Get()
 	if v == nil {
@@ -1768,7 +2146,9 @@ func (c *HostClient) releaseConn(cc *clientConn) {
 			}
 		}
 	}
-	if !delivered {
+	if delivered {
+		atomic.AddUint64(&c.connsReusedCount, 1)
+	} else {
 		c.conns = append(c.conns, cc)
 	}
 }
@@ -1910,8 +2290,9 @@ func (c *HostClient) dialHostHard() (conn net.Conn, err error) {
 	for n > 0 {
 		addr := c.nextAddr()
 		tlsConfig := c.cachedTLSConfig(addr)
-		conn, err = dialAddr(addr, c.Dial, c.DialDualStack, c.IsTLS, tlsConfig, c.WriteTimeout)
+		conn, err = dialAddr(addr, c.Dial, c.DialDualStack, c.TCPKeepalive, c.TCPKeepalivePeriod, c.IsTLS, tlsConfig, c.WriteTimeout)
 		if err == nil {
+			atomic.AddUint64(&c.dialsCount, 1)
 			return conn, nil
 		}
 		if time.Since(deadline) >= 0 {
@@ -1978,8 +2359,20 @@ func tlsClientHandshake(rawConn net.Conn, tlsConfig *tls.Config, timeout time.Du
 	}
 }
 
-func dialAddr(addr string, dial DialFunc, dialDualStack, isTLS bool, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
-	if dial == nil {
+// unixSocketDial returns DialFunc establishing connections
+// to the unix socket at the given path regardless of addr.
+//
+// Like Dial, it gives up after DefaultDialTimeout.
+func unixSocketDial(path string) DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return net.DialTimeout("unix", path, DefaultDialTimeout)
+	}
+}
+
+func dialAddr(addr string, dial DialFunc, dialDualStack, tcpKeepalive bool, tcpKeepalivePeriod time.Duration,
+	isTLS bool, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	isDefaultDial := dial == nil
+	if isDefaultDial {
 		if dialDualStack {
 			dial = DialDualStack
 		} else {
@@ -1994,6 +2387,12 @@ func dialAddr(addr string, dial DialFunc, dialDualStack, isTLS bool, tlsConfig *
 	if conn == nil {
 		panic("BUG: DialFunc returned (nil, nil)")
 	}
+	if isDefaultDial && tcpKeepalive {
+		if err = setTCPKeepalive(conn, true, tcpKeepalivePeriod); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
 	_, isTLSAlready := conn.(*tls.Conn)
 	if isTLS && !isTLSAlready {
 		if timeout == 0 {
@@ -2020,8 +2419,11 @@ func (c *HostClient) getClientName() []byte {
 }
 
 func addMissingPort(addr string, isTLS bool) string {
-	n := strings.Index(addr, ":")
-	if n >= 0 {
+	if n := len(addr); n > 1 && addr[0] == '[' && addr[n-1] == ']' {
+		// Bracketed IPv6 literal without port, e.g. [::1].
+		// JoinHostPort below brackets it again.
+		addr = addr[1 : n-1]
+	} else if strings.Contains(addr, ":") {
 		return addr
 	}
 	port := 80
@@ -2217,6 +2619,19 @@ type PipelineClient struct {
 	// since unfortunately ipv6 remains broken in many networks worldwide :)
 	DialDualStack bool
 
+	// Whether to enable tcp keep-alive on connections to the host.
+	//
+	// This option is used only if default TCP dialer is used,
+	// i.e. if Dial is blank.
+	//
+	// By default tcp keep-alive settings are left untouched.
+	TCPKeepalive bool
+
+	// Period between tcp keep-alive messages.
+	//
+	// TCP keep-alive period is determined by operation system by default.
+	TCPKeepalivePeriod time.Duration
+
 	// Response header names are passed as-is without normalization
 	// if this option is set.
 	//
@@ -2296,6 +2711,8 @@ type pipelineConnClient struct {
 	MaxBatchDelay                 time.Duration
 	Dial                          DialFunc
 	DialDualStack                 bool
+	TCPKeepalive                  bool
+	TCPKeepalivePeriod            time.Duration
 	DisableHeaderNamesNormalizing bool
 	DisablePathNormalizing        bool
 	IsTLS                         bool
@@ -2542,6 +2959,8 @@ func (c *PipelineClient) newConnClient() *pipelineConnClient {
 		MaxBatchDelay:                 c.MaxBatchDelay,
 		Dial:                          c.Dial,
 		DialDualStack:                 c.DialDualStack,
+		TCPKeepalive:                  c.TCPKeepalive,
+		TCPKeepalivePeriod:            c.TCPKeepalivePeriod,
 		DisableHeaderNamesNormalizing: c.DisableHeaderNamesNormalizing,
 		DisablePathNormalizing:        c.DisablePathNormalizing,
 		IsTLS:                         c.IsTLS,
@@ -2606,7 +3025,7 @@ func (c *pipelineConnClient) init() {
 
 func (c *pipelineConnClient) worker() error {
 	tlsConfig := c.cachedTLSConfig()
-	conn, err := dialAddr(c.Addr, c.Dial, c.DialDualStack, c.IsTLS, tlsConfig, c.WriteTimeout)
+	conn, err := dialAddr(c.Addr, c.Dial, c.DialDualStack, c.TCPKeepalive, c.TCPKeepalivePeriod, c.IsTLS, tlsConfig, c.WriteTimeout)
 	if err != nil {
 		return err
 	}
@@ -3,7 +3,12 @@ package fasthttp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -68,6 +73,754 @@ func TestCloseIdleConnections(t *testing.T) {
 	}
 }
 
+func TestHostClientMaxIdleConnDuration(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		MaxIdleConnDuration: 50 * time.Millisecond,
+	}
+
+	connsLen := func() int {
+		c.connsLock.Lock()
+		defer c.connsLock.Unlock()
+
+		return len(c.conns)
+	}
+
+	if _, _, err := c.Get(nil, "http://foobar/"); err != nil {
+		t.Fatal(err)
+	}
+	if conns := connsLen(); conns != 1 {
+		t.Fatalf("expected 1 conns got %d", conns)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for connsLen() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connection hasn't been closed after %s", c.MaxIdleConnDuration)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostClientStats(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, _, err := c.Get(nil, "http://foobar/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := c.Stats()
+	expected := HostClientStats{
+		Dials:       1,
+		Requests:    n,
+		ConnsReused: n - 1,
+		Conns:       1,
+		IdleConns:   1,
+	}
+	if st != expected {
+		t.Fatalf("unexpected stats %+v. Expecting %+v", st, expected)
+	}
+
+	c.CloseIdleConnections()
+	st = c.Stats()
+	if st.ConnsClosed != 1 || st.Conns != 0 || st.IdleConns != 0 {
+		t.Fatalf("unexpected stats after closing idle connections: %+v", st)
+	}
+}
+
+func TestHostClientRequestSetTimeout(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	resp := AcquireResponse()
+	defer ReleaseResponse(resp)
+
+	req.SetRequestURI("http://foobar/slow")
+	req.SetTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if err := c.Do(req, resp); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Fatalf("the request hasn't been aborted on timeout, took %s", d)
+	}
+
+	// The deadline must be cleared before returning the connection
+	// to the pool.
+	req.SetRequestURI("http://foobar/fast")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	req.SetRequestURI("http://foobar/slow")
+	req.SetTimeout(0)
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if st := c.Stats(); st.Dials != 2 || st.ConnsReused != 1 {
+		t.Fatalf("expecting the connection to be reused: %+v", st)
+	}
+}
+
+func TestHostClientUpgrade(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Request.Header.Peek(HeaderUpgrade)) != "echo" {
+				ctx.SetStatusCode(StatusBadRequest)
+				return
+			}
+			ctx.SetStatusCode(StatusSwitchingProtocols)
+			ctx.Response.Header.Set(HeaderConnection, "Upgrade")
+			ctx.Response.Header.Set(HeaderUpgrade, "echo")
+			ctx.Hijack(func(c net.Conn) {
+				c.Write([]byte("hello")) //nolint:errcheck
+				io.Copy(c, c)            //nolint:errcheck
+			})
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.SetRequestURI("http://foobar/")
+	if _, _, err := c.Upgrade(req); err != ErrUpgradeHeaderRequired {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrUpgradeHeaderRequired)
+	}
+
+	req.Header.Set(HeaderUpgrade, "echo")
+	conn, resp, err := c.Upgrade(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode() != StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), StatusSwitchingProtocols)
+	}
+	ReleaseResponse(resp)
+
+	if _, err := conn.Write([]byte("foobar")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b := make([]byte, len("hellofoobar"))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(b) != "hellofoobar" {
+		t.Fatalf("unexpected data %q. Expecting %q", b, "hellofoobar")
+	}
+	if n := c.ConnsCount(); n != 0 {
+		t.Fatalf("unexpected connections count %d. Expecting 0", n)
+	}
+
+	if v := string(req.Header.Peek(HeaderConnection)); v != "Upgrade" {
+		t.Fatalf("unexpected Connection header %q. Expecting %q", v, "Upgrade")
+	}
+
+	// The server rejects unknown protocols.
+	req.Header.Set(HeaderUpgrade, "foo")
+	conn, resp, err = c.Upgrade(req)
+	if err != ErrUpgradeRejected {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrUpgradeRejected)
+	}
+	if conn != nil {
+		t.Fatal("unexpected connection")
+	}
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+
+	// Do mustn't return the upgraded connection to the pool.
+	req.Header.Set(HeaderUpgrade, "echo")
+	req.Header.Set(HeaderConnection, "Upgrade")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), StatusSwitchingProtocols)
+	}
+	if n := c.ConnsCount(); n != 0 {
+		t.Fatalf("unexpected connections count %d. Expecting 0", n)
+	}
+	ReleaseResponse(resp)
+}
+
+func TestHostClientUpgradeTimeout(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			time.Sleep(time.Second)
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.SetRequestURI("http://foobar/")
+	req.Header.Set(HeaderUpgrade, "echo")
+	req.SetTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, _, err := c.Upgrade(req); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("too long upgrade timeout: %s", d)
+	}
+}
+
+func TestHostClientMaxResponseHeaderSize(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/big" {
+				ctx.Response.Header.Set("X-Big", strings.Repeat("a", 2048))
+			}
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	var dials int32
+	c := &HostClient{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return ln.Dial()
+		},
+		ReadBufferSize:        64 * 1024,
+		MaxResponseHeaderSize: 1024,
+	}
+
+	statusCode, body, err := c.Get(nil, "http://foobar/small")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if statusCode != StatusOK || string(body) != "OK" {
+		t.Fatalf("unexpected response %d %q. Expecting %d %q", statusCode, body, StatusOK, "OK")
+	}
+
+	if _, _, err = c.Get(nil, "http://foobar/big"); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrHeaderTooLarge)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("unexpected number of dials %d. Expecting 1 without retries", n)
+	}
+}
+
+func TestHostClientHostHeader(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/redirect-same-host":
+				ctx.Redirect("/", StatusFound)
+			case "/redirect-other-host":
+				ctx.Redirect("http://other.com/", StatusFound)
+			default:
+				ctx.Write(ctx.Request.Header.Host()) //nolint:errcheck
+			}
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "127.0.0.1",
+		Dial: func(addr string) (net.Conn, error) {
+			if addr != "127.0.0.1" {
+				t.Errorf("unexpected addr %q. Expecting %q", addr, "127.0.0.1")
+			}
+			return ln.Dial()
+		},
+	}
+
+	// The explicitly set Host header takes precedence over the uri host.
+	for _, tc := range []struct {
+		uri          string
+		host         string
+		expectedHost string
+	}{
+		{"http://127.0.0.1/", "example.com", "example.com"},
+		{"http://127.0.0.1/", "", "127.0.0.1"},
+		{"http://127.0.0.1/redirect-same-host", "example.com", "example.com"},
+		{"http://127.0.0.1/redirect-other-host", "example.com", "other.com"},
+	} {
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.SetRequestURI(tc.uri)
+		req.Header.SetHost(tc.host)
+		if err := c.DoRedirects(req, resp, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(resp.Body()) != tc.expectedHost {
+			t.Fatalf("unexpected host for %q: %q. Expecting %q", tc.uri, resp.Body(), tc.expectedHost)
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+
+	// The Host header filled in from the uri must follow the uri changes.
+	req := AcquireRequest()
+	resp := AcquireResponse()
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		req.SetRequestURI("http://" + host + "/")
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(resp.Body()) != host {
+			t.Fatalf("unexpected host %q. Expecting %q", resp.Body(), host)
+		}
+	}
+	ReleaseRequest(req)
+	ReleaseResponse(resp)
+}
+
+func TestHostClientSignRequest(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	var serverHits uint32
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			atomic.AddUint32(&serverHits, 1)
+			expectedSignature := testRequestSignature(&ctx.Request)
+			signature := string(ctx.Request.Header.Peek(HeaderAuthorization))
+			if signature != expectedSignature {
+				ctx.Error(fmt.Sprintf("unexpected signature %q. Expecting %q", signature, expectedSignature), StatusForbidden)
+			}
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		SignRequest: func(req *Request) error {
+			if len(req.Header.Host()) == 0 {
+				t.Errorf("Host header must be set before signing")
+			}
+			if len(req.Header.UserAgent()) == 0 {
+				t.Errorf("User-Agent header must be set before signing")
+			}
+			if req.Header.IsPost() && req.Header.ContentLength() != len(req.Body()) {
+				t.Errorf("unexpected Content-Length %d. Expecting %d", req.Header.ContentLength(), len(req.Body()))
+			}
+			if req.Header.IsGet() && len(req.Header.Peek(HeaderContentLength)) > 0 {
+				t.Errorf("unexpected Content-Length %q for GET request", req.Header.Peek(HeaderContentLength))
+			}
+			req.Header.Set(HeaderAuthorization, testRequestSignature(req))
+			return nil
+		},
+	}
+
+	for _, method := range []string{MethodGet, MethodPost} {
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.Header.SetMethod(method)
+		req.SetRequestURI("http://foobar.com/baz?a=b")
+		if method == MethodPost {
+			req.SetBodyString("signed body")
+		}
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode() != StatusOK {
+			t.Fatalf("unexpected status code for %s: %d. Expecting %d. Body: %q", method, resp.StatusCode(), StatusOK, resp.Body())
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+
+	// The request mustn't be sent if signing fails.
+	errSign := errors.New("cannot sign request")
+	c.SignRequest = func(req *Request) error {
+		return errSign
+	}
+	req := AcquireRequest()
+	resp := AcquireResponse()
+	req.SetRequestURI("http://foobar.com/baz")
+	if err := c.Do(req, resp); err != errSign {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, errSign)
+	}
+	ReleaseRequest(req)
+	ReleaseResponse(resp)
+	if n := atomic.LoadUint32(&serverHits); n != 2 {
+		t.Fatalf("unexpected number of requests received by the server: %d. Expecting %d", n, 2)
+	}
+}
+
+func testRequestSignature(req *Request) string {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	// Sign the Content-Length header as it is sent over the wire,
+	// since requests without body have no Content-Length header.
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", req.Header.Method(), req.Header.RequestURI(),
+		req.Header.Host(), req.Header.UserAgent(), req.Header.Peek(HeaderContentLength))
+	mac.Write(req.Body()) //nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHostClientMaxDecompressedBodySize(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	body := bytes.Repeat([]byte("a"), 1024*1024)
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Response.Header.Set(HeaderContentEncoding, "gzip")
+			ctx.SetBody(AppendGzipBytes(nil, body))
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	for _, timeout := range []time.Duration{0, time.Second} {
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.SetRequestURI("http://foobar.com/baz")
+		resp.MaxDecompressedBodySize = 64 * 1024
+
+		var err error
+		if timeout > 0 {
+			err = c.DoTimeout(req, resp, timeout)
+		} else {
+			err = c.Do(req, resp)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.MaxDecompressedBodySize != 64*1024 {
+			t.Fatalf("unexpected MaxDecompressedBodySize %d. Expecting %d", resp.MaxDecompressedBodySize, 64*1024)
+		}
+		if _, err := resp.BodyGunzip(); err != ErrBodyTooLarge {
+			t.Fatalf("unexpected error: %v. Expecting %v", err, ErrBodyTooLarge)
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+}
+
+func TestHostClientPartialBodyOnTimeout(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var req Request
+				if err := req.Read(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				// Send only a part of the declared body and then stall.
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n1234")) //nolint:errcheck
+				time.Sleep(time.Second)
+			}()
+		}
+	}()
+
+	c := &HostClient{
+		Addr: "foobar.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	for _, useReadTimeout := range []bool{true, false} {
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.SetRequestURI("http://foobar.com/baz")
+		resp.PartialBodyOnTimeout = true
+		if useReadTimeout {
+			c.ReadTimeout = 100 * time.Millisecond
+		} else {
+			c.ReadTimeout = 0
+			req.SetTimeout(100 * time.Millisecond)
+		}
+
+		err := c.Do(req, resp)
+		pErr, ok := err.(*ErrPartialBody)
+		if !ok {
+			t.Fatalf("unexpected error: %v. Expecting *ErrPartialBody", err)
+		}
+		if pErr.BodySize != 4 || pErr.ContentLength != 10 {
+			t.Fatalf("unexpected body sizes %d, %d. Expecting %d, %d", pErr.BodySize, pErr.ContentLength, 4, 10)
+		}
+		if string(resp.Body()) != "1234" {
+			t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "1234")
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+}
+
+func TestHostClientOnResponse(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/signed" {
+				ctx.Response.Header.Set("X-Signature", "foobar")
+			}
+			ctx.WriteString("body") //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	errMissingSignature := errors.New("missing X-Signature header")
+	c := &HostClient{
+		Addr: "foobar.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		OnResponse: func(req *Request, resp *Response) error {
+			if len(resp.Header.Peek("X-Signature")) == 0 {
+				return errMissingSignature
+			}
+			resp.AppendBodyString(" verified")
+			return nil
+		},
+	}
+
+	for _, tc := range []struct {
+		path         string
+		expectedErr  error
+		expectedBody string
+	}{
+		{"/signed", nil, "body verified"},
+		{"/unsigned", errMissingSignature, "body"},
+		{"/signed", nil, "body verified"},
+	} {
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.SetRequestURI("http://foobar.com" + tc.path)
+		err := c.Do(req, resp)
+		if err != tc.expectedErr {
+			t.Fatalf("unexpected error for %q: %v. Expecting %v", tc.path, err, tc.expectedErr)
+		}
+		if string(resp.Body()) != tc.expectedBody {
+			t.Fatalf("unexpected body for %q: %q. Expecting %q", tc.path, resp.Body(), tc.expectedBody)
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+}
+
+func TestHostClientPostUnknownLengthStream(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			raw := ctx.Request.Header.RawHeaders()
+			if !bytes.Contains(raw, []byte("Transfer-Encoding: chunked\r\n")) {
+				ctx.Error(fmt.Sprintf("missing chunked Transfer-Encoding in %q", raw), StatusBadRequest)
+				return
+			}
+			ctx.Write(ctx.PostBody()) //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	c := &HostClient{
+		Addr: "foobar.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	body := strings.Repeat("foobar", 10000)
+	req := AcquireRequest()
+	resp := AcquireResponse()
+	req.Header.SetMethod(MethodPost)
+	req.SetRequestURI("http://foobar.com/upload")
+	req.SetBodyStream(io.MultiReader(strings.NewReader(body[:100]), strings.NewReader(body[100:])), -1)
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d. Body: %q", resp.StatusCode(), StatusOK, resp.Body())
+	}
+	if string(resp.Body()) != body {
+		t.Fatalf("unexpected body length: %d. Expecting %d", len(resp.Body()), len(body))
+	}
+	ReleaseRequest(req)
+	ReleaseResponse(resp)
+}
+
+func TestAddMissingPort(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		addr     string
+		isTLS    bool
+		expected string
+	}{
+		{"foobar.com", false, "foobar.com:80"},
+		{"foobar.com", true, "foobar.com:443"},
+		{"foobar.com:8080", false, "foobar.com:8080"},
+		{"[::1]", false, "[::1]:80"},
+		{"[::1]", true, "[::1]:443"},
+		{"[::1]:8080", false, "[::1]:8080"},
+		{"[fe80::1%25en0]:8080", false, "[fe80::1%25en0]:8080"},
+	} {
+		if addr := addMissingPort(tc.addr, tc.isTLS); addr != tc.expected {
+			t.Fatalf("unexpected addr for %q: %q. Expecting %q", tc.addr, addr, tc.expected)
+		}
+	}
+}
+
+func TestClientIPv6LiteralHost(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Write(ctx.Request.Header.Host()) //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	var dialedAddr string
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			dialedAddr = addr
+			return ln.Dial()
+		},
+	}
+
+	for _, tc := range []struct {
+		uri          string
+		expectedHost string
+		expectedAddr string
+	}{
+		{"http://[::1]:8080/path", "[::1]:8080", "[::1]:8080"},
+		{"http://[::1]/path", "[::1]", "[::1]:80"},
+	} {
+		var u URI
+		if err := u.Parse(nil, []byte(tc.uri)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(u.Host()) != tc.expectedHost {
+			t.Fatalf("unexpected host %q. Expecting %q", u.Host(), tc.expectedHost)
+		}
+		if string(u.Path()) != "/path" {
+			t.Fatalf("unexpected path %q. Expecting %q", u.Path(), "/path")
+		}
+
+		statusCode, body, err := c.Get(nil, tc.uri)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if statusCode != StatusOK {
+			t.Fatalf("unexpected status code %d. Expecting %d", statusCode, StatusOK)
+		}
+		if string(body) != tc.expectedHost {
+			t.Fatalf("unexpected Host header %q. Expecting %q", body, tc.expectedHost)
+		}
+		if dialedAddr != tc.expectedAddr {
+			t.Fatalf("unexpected dialed addr %q. Expecting %q", dialedAddr, tc.expectedAddr)
+		}
+	}
+}
+
 func TestPipelineClientSetUserAgent(t *testing.T) {
 	t.Parallel()
 
@@ -204,6 +957,137 @@ func TestClientInvalidURI(t *testing.T) {
 	}
 }
 
+func TestClientServerDisableKeepalive(t *testing.T) {
+	t.Parallel()
+
+	var conns uint32
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		ConnState: func(conn net.Conn, state ConnState) {
+			if state == StateNew {
+				atomic.AddUint32(&conns, 1)
+			}
+		},
+		DisableKeepalive: true,
+	}
+	go s.Serve(ln) //nolint:errcheck
+	c := &HostClient{
+		Addr: "example.com",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	const n = 3
+	for i := 0; i < n; i++ {
+		req, res := AcquireRequest(), AcquireResponse()
+		req.SetRequestURI("http://example.com/")
+		if err := c.Do(req, res); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !res.ConnectionClose() {
+			t.Fatal("expecting 'Connection: close' response header")
+		}
+		if string(res.Body()) != "OK" {
+			t.Fatalf("unexpected body: %q. Expecting %q", res.Body(), "OK")
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(res)
+	}
+
+	// Every request must be served over a fresh connection,
+	// since the server closes the socket after each response.
+	if v := atomic.LoadUint32(&conns); v != n {
+		t.Fatalf("unexpected number of connections: %d. Expecting %d", v, n)
+	}
+	if v := c.ConnsCount(); v != 0 {
+		t.Fatalf("unexpected number of idle client connections: %d. Expecting 0", v)
+	}
+}
+
+func TestClientTCPKeepalive(t *testing.T) {
+	t.Parallel()
+
+	// Disable tcp keep-alive enabled by default on accepted connections,
+	// so the server must enable it itself.
+	lc := net.ListenConfig{KeepAlive: -1}
+	ln, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if ok, err := tcpKeepaliveEnabled(ctx.Conn()); err != nil || !ok {
+				ctx.Error(fmt.Sprintf("tcp keep-alive isn't enabled: %v", err), StatusInternalServerError)
+				return
+			}
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		TCPKeepalive:       true,
+		TCPKeepalivePeriod: time.Second,
+	}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	clients := []*HostClient{
+		{
+			Addr:               ln.Addr().String(),
+			TCPKeepalive:       true,
+			TCPKeepalivePeriod: time.Second,
+		},
+		{
+			Addr: ln.Addr().String(),
+			Dial: (&TCPDialer{
+				TCPKeepalive:       true,
+				TCPKeepalivePeriod: time.Second,
+			}).Dial,
+		},
+	}
+	for _, c := range clients {
+		statusCode, body, err := c.Get(nil, "http://"+ln.Addr().String()+"/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if statusCode != StatusOK {
+			t.Fatalf("unexpected status code: %d. Expecting %d", statusCode, StatusOK)
+		}
+		if string(body) != "OK" {
+			t.Fatalf("unexpected body: %q. Expecting %q", body, "OK")
+		}
+
+		c.connsLock.Lock()
+		conn := c.conns[0].c
+		c.connsLock.Unlock()
+		ok, err := tcpKeepaliveEnabled(conn)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok {
+			t.Fatalf("tcp keep-alive must be enabled on client connection")
+		}
+	}
+
+	pc := &PipelineClient{
+		Addr:               ln.Addr().String(),
+		TCPKeepalive:       true,
+		TCPKeepalivePeriod: time.Second,
+	}
+	req := AcquireRequest()
+	resp := AcquireResponse()
+	req.SetRequestURI("http://" + ln.Addr().String() + "/")
+	if err := pc.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "OK" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "OK")
+	}
+	ReleaseRequest(req)
+	ReleaseResponse(resp)
+}
+
 func TestClientGetWithBody(t *testing.T) {
 	t.Parallel()
 
@@ -1757,6 +2641,86 @@ func (r *readTimeoutConn) RemoteAddr() net.Addr {
 	return nil
 }
 
+func TestClientDoTimeoutConnsPool(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			ctx.WriteString("ok") //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	maxConns := 4
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+		MaxConnsPerHost:    maxConns,
+		MaxConnWaitTimeout: time.Second,
+		ReadTimeout:        50 * time.Millisecond,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var req Request
+			var resp Response
+			req.SetRequestURI("http://foobar.com/slow")
+			if err := c.DoTimeout(&req, &resp, 10*time.Millisecond); err != ErrTimeout {
+				t.Errorf("unexpected error: %v. Expecting %v", err, ErrTimeout)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mLock.Lock()
+	hc := c.m["foobar.com"]
+	hostsCount := len(c.m)
+	c.mLock.Unlock()
+	if hostsCount != 1 || hc == nil {
+		t.Fatalf("unexpected number of host clients: %d. Expecting 1", hostsCount)
+	}
+
+	// Timed out requests continue in the background until ReadTimeout,
+	// then their connections must be closed instead of returning to the pool.
+	deadline := time.Now().Add(3 * time.Second)
+	for hc.ConnsCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections count %d. Expecting 0", hc.ConnsCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The pool must be usable after timeouts.
+	for i := 0; i < 5*maxConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var req Request
+			var resp Response
+			req.SetRequestURI("http://foobar.com/fast")
+			if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			if string(resp.Body()) != "ok" {
+				t.Errorf("unexpected body %q. Expecting %q", resp.Body(), "ok")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hc.ConnsCount(); n > maxConns {
+		t.Fatalf("unexpected connections count %d. Expecting at most %d", n, maxConns)
+	}
+}
+
 func TestClientNonIdempotentRetry(t *testing.T) {
 	t.Parallel()
 
@@ -2273,6 +3237,34 @@ func skipIfNotUnix(tb testing.TB) {
 	}
 }
 
+func TestClientUnixSocketPaths(t *testing.T) {
+	t.Parallel()
+
+	skipIfNotUnix(t)
+	addr := "./TestClientUnixSocketPaths.unix"
+	s := startEchoServer(t, "unix", addr)
+	defer s.Stop()
+
+	c := &Client{
+		UnixSocketPaths: map[string]string{
+			"foobar.com": addr,
+		},
+	}
+	for i := 0; i < 3; i++ {
+		uri := fmt.Sprintf("http://foobar.com/baz?i=%d", i)
+		statusCode, body, err := c.Get(nil, uri)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if statusCode != StatusOK {
+			t.Fatalf("unexpected status code: %d. Expecting %d", statusCode, StatusOK)
+		}
+		if string(body) != uri {
+			t.Fatalf("unexpected body: %q. Expecting %q", body, uri)
+		}
+	}
+}
+
 func TestHostClientGet(t *testing.T) {
 	t.Parallel()
 
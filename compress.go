@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"strings"
 	"sync"
 
 	"github.com/klauspost/compress/flate"
@@ -329,6 +329,33 @@ func (w *byteSliceWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// decompressWriter returns ErrBodyTooLarge when more than
+// maxBodySize bytes are written to w.
+type decompressWriter struct {
+	w           io.Writer
+	maxBodySize int
+	n           int
+}
+
+func newDecompressWriter(w io.Writer, maxBodySize int) io.Writer {
+	if maxBodySize <= 0 {
+		return w
+	}
+	return &decompressWriter{
+		w:           w,
+		maxBodySize: maxBodySize,
+	}
+}
+
+func (w *decompressWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.maxBodySize {
+		return 0, ErrBodyTooLarge
+	}
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
 type byteSliceReader struct {
 	b []byte
 }
@@ -412,7 +439,7 @@ func newCompressWriterPoolMap() []*sync.Pool {
 	return m
 }
 
-func isFileCompressible(f *os.File, minCompressRatio float64) bool {
+func isFileCompressible(f io.ReadSeeker, minCompressRatio float64) bool {
 	// Try compressing the first 4kb of of the file
 	// and see if it can be compressed by more than
 	// the given minCompressRatio.
@@ -445,3 +472,158 @@ func normalizeCompressLevel(level int) int {
 	}
 	return level + 2
 }
+
+// CompressEncoder returns a writer compressing the data written to it into w.
+//
+// Close must write all the remaining compressed data to w. The returned
+// writer may implement Flush() error, so streamed response bodies are sent
+// to the client as soon as they are produced.
+type CompressEncoder func(w io.Writer) io.WriteCloser
+
+// RegisterCompressEncoder registers enc for the given content-coding,
+// so RequestCtx.Compress and CompressHandler* may select it according
+// to the request's Accept-Encoding header.
+//
+// 'br', 'gzip' and 'deflate' content-codings are registered by default.
+// They may be overridden with custom encoders. Pass nil enc for removing
+// the content-coding from the registry. Content-codings registered earlier
+// are preferred if the client accepts them with equal q-values.
+//
+// RegisterCompressEncoder is usually called during program initialization.
+func RegisterCompressEncoder(contentCoding string, enc CompressEncoder) {
+	contentCoding = strings.ToLower(contentCoding)
+	compressEncodersLock.Lock()
+	_, registered := compressEncoders[contentCoding]
+	if enc == nil {
+		if registered {
+			delete(compressEncoders, contentCoding)
+			for i, coding := range compressEncodersOrder {
+				if coding == contentCoding {
+					compressEncodersOrder = append(compressEncodersOrder[:i], compressEncodersOrder[i+1:]...)
+					break
+				}
+			}
+		}
+	} else {
+		coding := []byte(contentCoding)
+		compressEncoders[contentCoding] = func(resp *Response, level, brotliLevel int) error {
+			return resp.encodeBody(coding, enc)
+		}
+		if !registered {
+			compressEncodersOrder = append(compressEncodersOrder, contentCoding)
+		}
+	}
+	compressEncodersLock.Unlock()
+}
+
+// compressEncoder compresses the response body. The given levels are used
+// by the built-in content-codings.
+type compressEncoder func(resp *Response, level, brotliLevel int) error
+
+var (
+	compressEncodersLock sync.RWMutex
+	compressEncoders     = map[string]compressEncoder{
+		"br": func(resp *Response, level, brotliLevel int) error {
+			return resp.brotliBody(brotliLevel)
+		},
+		"gzip": func(resp *Response, level, brotliLevel int) error {
+			return resp.gzipBody(level)
+		},
+		"deflate": func(resp *Response, level, brotliLevel int) error {
+			return resp.deflateBody(level)
+		},
+	}
+
+	// compressEncodersOrder contains the registered content-codings
+	// in the order of preference.
+	compressEncodersOrder = []string{"br", "gzip", "deflate"}
+)
+
+// selectCompressEncoder returns the encoder for the registered content-coding
+// with the highest q-value in the given Accept-Encoding header value.
+//
+// The content-coding registered first wins if q-values are equal, so 'br'
+// is preferred over 'gzip' and 'deflate'. The '*' item matches
+// the content-codings, which aren't listed explicitly.
+// nil is returned if none of the registered content-codings is acceptable
+// or if the identity content-coding, i.e. no compression, has higher q-value.
+//
+// 'br' content-coding is skipped unless withBrotli is set.
+func selectCompressEncoder(acceptEncoding []byte, withBrotli bool) compressEncoder {
+	var (
+		bestEnc compressEncoder
+		bestQ   float64
+	)
+
+	compressEncodersLock.RLock()
+	defer compressEncodersLock.RUnlock()
+
+	for _, coding := range compressEncodersOrder {
+		if !withBrotli && coding == "br" {
+			continue
+		}
+		if q := acceptEncodingQ(acceptEncoding, coding); q > bestQ {
+			bestEnc = compressEncoders[coding]
+			bestQ = q
+		}
+	}
+	if bestEnc != nil && acceptEncodingQ(acceptEncoding, "identity") > bestQ {
+		return nil
+	}
+	return bestEnc
+}
+
+// acceptEncodingQ returns the q-value of the given content-coding
+// in the Accept-Encoding header value.
+//
+// The q-value of the '*' item is returned if the content-coding isn't listed
+// explicitly. 0 is returned if neither of them is listed.
+func acceptEncodingQ(acceptEncoding []byte, contentCoding string) float64 {
+	q, anyQ := -1.0, 0.0
+	visitAcceptEncoding(acceptEncoding, func(coding []byte, v float64) {
+		if caseInsensitiveCompare(coding, s2b(contentCoding)) {
+			if q < 0 {
+				q = v
+			}
+		} else if len(coding) == 1 && coding[0] == '*' {
+			anyQ = v
+		}
+	})
+	if q < 0 {
+		return anyQ
+	}
+	return q
+}
+
+// visitAcceptEncoding calls f for each content-coding with a valid q-value
+// in the given Accept-Encoding header value.
+func visitAcceptEncoding(acceptEncoding []byte, f func(coding []byte, q float64)) {
+	b := acceptEncoding
+	for len(b) > 0 {
+		var item []byte
+		n := bytes.IndexByte(b, ',')
+		if n < 0 {
+			item, b = b, b[len(b):]
+		} else {
+			item, b = b[:n], b[n+1:]
+		}
+
+		coding := item
+		q := 1.0
+		if i := bytes.IndexByte(item, ';'); i >= 0 {
+			coding = item[:i]
+			param := bytes.TrimSpace(item[i+1:])
+			if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+				v, err := ParseUfloat(param[2:])
+				if err != nil {
+					continue
+				}
+				q = v
+			}
+		}
+		coding = bytes.TrimSpace(coding)
+		if len(coding) > 0 {
+			f(coding, q)
+		}
+	}
+}
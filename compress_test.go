@@ -3,6 +3,7 @@ package fasthttp
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -214,3 +215,139 @@ func testConcurrent(concurrency int, f func() error) error {
 	}
 	return nil
 }
+
+type testCompressWriter struct {
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (w *testCompressWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *testCompressWriter) Close() error {
+	_, err := fmt.Fprintf(w.w, "%s%d", w.prefix, w.buf.Len())
+	return err
+}
+
+func newTestCompressEncoder(prefix string) CompressEncoder {
+	return func(w io.Writer) io.WriteCloser {
+		return &testCompressWriter{
+			w:      w,
+			prefix: prefix,
+		}
+	}
+}
+
+func TestRequestCtxCompressEncoders(t *testing.T) {
+	t.Parallel()
+
+	RegisterCompressEncoder("x-foo", newTestCompressEncoder("foo:"))
+	RegisterCompressEncoder("X-Bar", newTestCompressEncoder("bar:"))
+	defer RegisterCompressEncoder("x-foo", nil)
+	defer RegisterCompressEncoder("x-bar", nil)
+
+	body := string(createFixedBody(1000))
+
+	testRequestCtxCompressEncoders(t, "x-foo", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "x-foo, x-bar", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, x-bar", "x-bar", "bar:1000")
+	testRequestCtxCompressEncoders(t, "X-FOO; q=0.8,x-bar;q=0.3", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0, x-bar;q=0.1", "x-bar", "bar:1000")
+	testRequestCtxCompressEncoders(t, "x-baz, x-foo;q=0.1", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0, identity", "", body)
+	testRequestCtxCompressEncoders(t, "x-baz", "", body)
+	testRequestCtxCompressEncoders(t, "", "", body)
+
+	// Built-in content-codings must be selected by q-values too.
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.1, gzip;q=0.5, x-bar;q=0.2", "gzip", "")
+
+	// '*' matches the content-codings, which aren't listed explicitly.
+	testRequestCtxCompressEncoders(t, "*", "br", "")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, *;q=0.1", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "br;q=0, gzip;q=0, deflate;q=0, *;q=0.1, x-foo;q=0.2", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "*;q=0", "", body)
+
+	// identity is preferred if it has higher q-value.
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, identity", "", body)
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, identity;q=0.1", "x-foo", "foo:1000")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, *;q=0.8", "br", "")
+	testRequestCtxCompressEncoders(t, "x-foo;q=0.5, identity;q=0, *;q=0", "x-foo", "foo:1000")
+}
+
+func testRequestCtxCompressEncoders(t *testing.T, acceptEncoding, expectedEncoding, expectedBody string) {
+	var ctx RequestCtx
+	ctx.Request.Header.Set(HeaderAcceptEncoding, acceptEncoding)
+	ctx.Response.Header.Set(HeaderVary, "Origin")
+	ctx.SetBody(createFixedBody(1000))
+
+	if err := ctx.Compress(); err != nil {
+		t.Fatalf("unexpected error: %s. acceptEncoding=%q", err, acceptEncoding)
+	}
+	ce := ctx.Response.Header.Peek(HeaderContentEncoding)
+	if string(ce) != expectedEncoding {
+		t.Fatalf("unexpected content-encoding %q. Expecting %q. acceptEncoding=%q", ce, expectedEncoding, acceptEncoding)
+	}
+	if v := ctx.Response.Header.Peek(HeaderVary); string(v) != "Origin, Accept-Encoding" {
+		t.Fatalf("unexpected vary %q. Expecting %q. acceptEncoding=%q", v, "Origin, Accept-Encoding", acceptEncoding)
+	}
+	if expectedEncoding == "gzip" || expectedEncoding == "br" {
+		var body []byte
+		var err error
+		if expectedEncoding == "gzip" {
+			body, err = ctx.Response.BodyGunzip()
+		} else {
+			body, err = ctx.Response.BodyUnbrotli()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != string(createFixedBody(1000)) {
+			t.Fatalf("unexpected body %q. Expecting %q", body, createFixedBody(1000))
+		}
+	} else if string(ctx.Response.Body()) != expectedBody {
+		t.Fatalf("unexpected body %q. Expecting %q. acceptEncoding=%q", ctx.Response.Body(), expectedBody, acceptEncoding)
+	}
+
+	// Repeated calls mustn't compress the body twice or duplicate Vary.
+	if err := ctx.Compress(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := ctx.Response.Header.Peek(HeaderVary); string(v) != "Origin, Accept-Encoding" {
+		t.Fatalf("unexpected vary %q. Expecting %q", v, "Origin, Accept-Encoding")
+	}
+}
+
+func TestCompressHandlerAcceptEncoding(t *testing.T) {
+	t.Parallel()
+
+	RegisterCompressEncoder("x-qux", newTestCompressEncoder("qux:"))
+	defer RegisterCompressEncoder("x-qux", nil)
+
+	h := func(ctx *RequestCtx) {
+		ctx.SetBody(createFixedBody(1000))
+	}
+
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "deflate;q=0.5, gzip", "gzip")
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "gzip;q=0, deflate", "deflate")
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "br", "")
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "x-qux", "x-qux")
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "*", "gzip")
+	testCompressHandlerAcceptEncoding(t, CompressHandler(h), "gzip;q=0.5, identity", "")
+
+	hb := CompressHandlerBrotliLevel(h, CompressBrotliBestSpeed, CompressBestSpeed)
+	testCompressHandlerAcceptEncoding(t, hb, "gzip, br", "br")
+	testCompressHandlerAcceptEncoding(t, hb, "br;q=0.5, gzip", "gzip")
+	testCompressHandlerAcceptEncoding(t, hb, "br;q=0, *", "gzip")
+	testCompressHandlerAcceptEncoding(t, hb, "x-qux;q=0.9, br;q=0.5", "x-qux")
+}
+
+func testCompressHandlerAcceptEncoding(t *testing.T, h RequestHandler, acceptEncoding, expectedEncoding string) {
+	var ctx RequestCtx
+	ctx.Request.Header.Set(HeaderAcceptEncoding, acceptEncoding)
+	h(&ctx)
+	if ce := ctx.Response.Header.Peek(HeaderContentEncoding); string(ce) != expectedEncoding {
+		t.Fatalf("unexpected content-encoding %q. Expecting %q. acceptEncoding=%q", ce, expectedEncoding, acceptEncoding)
+	}
+}
@@ -1,6 +1,8 @@
 package fasthttp
 
 import (
+	"bufio"
+	"bytes"
 	"strings"
 	"testing"
 	"time"
@@ -356,6 +358,94 @@ func testCookieAppendBytes(t *testing.T, c *Cookie, key, value, expectedS string
 	}
 }
 
+func TestCookieResponseRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	expire := time.Date(2030, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	// Expires is serialized only if max-age isn't set.
+	testCookieResponseRoundTrip(t, expire, 0)
+	testCookieResponseRoundTrip(t, time.Time{}, 3600)
+}
+
+func testCookieResponseRoundTrip(t *testing.T, expire time.Time, maxAge int) {
+	var c Cookie
+	c.SetKey("session")
+	c.SetValue("abc123")
+	c.SetPath("/app")
+	c.SetDomain("example.com")
+	c.SetSecure(true)
+	c.SetHTTPOnly(true)
+	c.SetSameSite(CookieSameSiteStrictMode)
+	if !expire.IsZero() {
+		c.SetExpire(expire)
+	}
+	c.SetMaxAge(maxAge)
+
+	var resp Response
+	resp.Header.SetCookie(&c)
+	resp.SetBodyString("body")
+
+	var b bytes.Buffer
+	bw := bufio.NewWriter(&b)
+	if err := resp.Write(bw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var resp1 Response
+	if err := resp1.Read(bufio.NewReader(&b)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var setCookie []byte
+	resp1.Header.VisitAllCookie(func(key, value []byte) {
+		if string(key) == "session" {
+			setCookie = append(setCookie[:0], value...)
+		}
+	})
+	if setCookie == nil {
+		t.Fatalf("missing Set-Cookie header in response %q", &resp1)
+	}
+
+	var c1 Cookie
+	if err := c1.ParseBytes(setCookie); err != nil {
+		t.Fatalf("unexpected error when parsing %q: %s", setCookie, err)
+	}
+	if string(c1.Key()) != "session" {
+		t.Fatalf("unexpected key %q. Expecting %q", c1.Key(), "session")
+	}
+	if string(c1.Value()) != "abc123" {
+		t.Fatalf("unexpected value %q. Expecting %q", c1.Value(), "abc123")
+	}
+	if string(c1.Path()) != "/app" {
+		t.Fatalf("unexpected path %q. Expecting %q", c1.Path(), "/app")
+	}
+	if string(c1.Domain()) != "example.com" {
+		t.Fatalf("unexpected domain %q. Expecting %q", c1.Domain(), "example.com")
+	}
+	if !c1.Secure() {
+		t.Fatalf("secure flag must be set in %q", setCookie)
+	}
+	if !c1.HTTPOnly() {
+		t.Fatalf("httponly flag must be set in %q", setCookie)
+	}
+	if c1.SameSite() != CookieSameSiteStrictMode {
+		t.Fatalf("unexpected samesite %d. Expecting %d", c1.SameSite(), CookieSameSiteStrictMode)
+	}
+	if c1.MaxAge() != maxAge {
+		t.Fatalf("unexpected max-age %d. Expecting %d", c1.MaxAge(), maxAge)
+	}
+	if !expire.IsZero() && !c1.Expire().Equal(expire) {
+		t.Fatalf("unexpected expire %s. Expecting %s", c1.Expire(), expire)
+	}
+	if expire.IsZero() && c1.Expire() != CookieExpireUnlimited {
+		t.Fatalf("unexpected expire %s. Expecting unlimited", c1.Expire())
+	}
+}
+
 func TestParseRequestCookies(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,25 @@
+// +build fasthttp_ctxguard
+
+package fasthttp
+
+import "sync/atomic"
+
+// ctxGuard detects concurrent use of RequestCtx.
+//
+// It is enabled with the fasthttp_ctxguard build tag and is intended
+// for catching bugs during development, since it slows down
+// RequestCtx methods.
+type ctxGuard struct {
+	n int32
+}
+
+func (g *ctxGuard) enter() {
+	if atomic.AddInt32(&g.n, 1) != 1 {
+		atomic.AddInt32(&g.n, -1)
+		panic("BUG: RequestCtx is used concurrently from multiple goroutines")
+	}
+}
+
+func (g *ctxGuard) leave() {
+	atomic.AddInt32(&g.n, -1)
+}
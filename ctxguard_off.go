@@ -0,0 +1,10 @@
+// +build !fasthttp_ctxguard
+
+package fasthttp
+
+// ctxGuard is a no-op without the fasthttp_ctxguard build tag.
+type ctxGuard struct{}
+
+func (g *ctxGuard) enter() {}
+
+func (g *ctxGuard) leave() {}
@@ -0,0 +1,30 @@
+// +build fasthttp_ctxguard
+
+package fasthttp
+
+import "testing"
+
+func TestRequestCtxGuardConcurrentWrite(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+
+	// Simulate a write running concurrently in another goroutine.
+	ctx.guard.enter()
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expecting panic on concurrent write")
+			}
+		}()
+		ctx.WriteString("foo") //nolint:errcheck
+	}()
+	ctx.guard.leave()
+
+	// Sequential writes must pass.
+	ctx.WriteString("foo") //nolint:errcheck
+	ctx.SetStatusCode(StatusOK)
+	if string(ctx.Response.Body()) != "foo" {
+		t.Fatalf("unexpected body %q. Expecting %q", ctx.Response.Body(), "foo")
+	}
+}
@@ -0,0 +1,264 @@
+// Package fasthttpadaptor provides helper functions for converting net/http
+// request handlers to fasthttp request handlers and vice versa.
+package fasthttpadaptor
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	fasthttp "github.com/caser789/justhttp"
+)
+
+// NewFastHTTPHandlerFunc wraps net/http handler func to fasthttp
+// request handler, so it can be passed to fasthttp server.
+//
+// See NewFastHTTPHandler for details.
+func NewFastHTTPHandlerFunc(h http.HandlerFunc) fasthttp.RequestHandler {
+	return NewFastHTTPHandler(h)
+}
+
+// NewFastHTTPHandler wraps net/http handler to fasthttp request handler,
+// so it can be passed to fasthttp server.
+//
+// The response written by h is buffered and sent after h returns.
+// h may stream the response by calling Flush via http.Flusher.
+// The buffered response is sent to the client on each Flush call
+// if the server supports RequestCtx.Flush.
+//
+// While this function may be used for easy switching from net/http to fasthttp,
+// it has the following drawbacks comparing to using manually written fasthttp
+// request handler:
+//
+//     * A lot of useful functionality provided by fasthttp is missing
+//       from net/http handler.
+//     * net/http -> fasthttp handler conversion has some overhead,
+//       so the returned handler will be always slower than manually written
+//       fasthttp handler.
+//
+// So it is advisable using this function only for quick net/http -> fasthttp
+// switching and for reusing net/http middleware.
+func NewFastHTTPHandler(h http.Handler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		var r http.Request
+		if err := convertRequest(ctx, &r); err != nil {
+			ctx.Logger().Printf("cannot convert request: %s", err)
+			ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+			return
+		}
+
+		w := netHTTPResponseWriter{
+			ctx: ctx,
+			h:   make(http.Header),
+		}
+		h.ServeHTTP(&w, r.WithContext(ctx))
+		w.writeHeader()
+		ctx.Write(w.body) //nolint:errcheck
+	}
+}
+
+func convertRequest(ctx *fasthttp.RequestCtx, r *http.Request) error {
+	body := ctx.PostBody()
+	r.Method = string(ctx.Method())
+	r.Proto = string(ctx.Request.Header.Protocol())
+	if major, minor, ok := http.ParseHTTPVersion(r.Proto); ok {
+		r.ProtoMajor, r.ProtoMinor = major, minor
+	} else {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	r.RequestURI = string(ctx.RequestURI())
+	r.ContentLength = int64(len(body))
+	r.Host = string(ctx.Host())
+	r.RemoteAddr = ctx.RemoteAddr().String()
+	if ctx.IsTLS() {
+		r.TLS = ctx.TLSConnectionState()
+	}
+
+	hdr := make(http.Header)
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		sk := string(k)
+		sv := string(v)
+		switch sk {
+		case fasthttp.HeaderHost:
+			// net/http moves Host header to http.Request.Host.
+		case fasthttp.HeaderTransferEncoding:
+			r.TransferEncoding = append(r.TransferEncoding, sv)
+		default:
+			hdr.Add(sk, sv)
+		}
+	})
+	r.Header = hdr
+	r.Body = &netHTTPBody{body}
+
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return err
+	}
+	r.URL = u
+	return nil
+}
+
+// NewNetHTTPHandler wraps fasthttp request handler to net/http handler,
+// so it can be mounted inside net/http server.
+//
+// Each net/http request is copied to a fresh RequestCtx initialized
+// via RequestCtx.Init. The response is written to http.ResponseWriter
+// after h returns. Hijack and RequestCtx.Flush aren't supported.
+//
+// This function is intended for gradual net/http -> fasthttp migration.
+// Use fasthttp server for serving fasthttp handlers whenever possible.
+func NewNetHTTPHandler(h fasthttp.RequestHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req fasthttp.Request
+		if err := convertNetHTTPRequest(r, &req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var remoteAddr net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remoteAddr = addr
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, remoteAddr, nil)
+		h(&ctx)
+
+		resp := &ctx.Response
+		hdr := w.Header()
+		resp.Header.VisitAll(func(k, v []byte) {
+			sk := string(k)
+			switch sk {
+			case fasthttp.HeaderContentLength, fasthttp.HeaderConnection:
+				// net/http manages these headers on its own.
+			default:
+				hdr.Add(sk, string(v))
+			}
+		})
+		if !resp.IsBodyStream() {
+			hdr.Set(fasthttp.HeaderContentLength, strconv.Itoa(len(resp.Body())))
+		}
+		w.WriteHeader(resp.StatusCode())
+		resp.BodyWriteTo(w) //nolint:errcheck
+	})
+}
+
+func convertNetHTTPRequest(r *http.Request, req *fasthttp.Request) error {
+	req.Header.SetMethod(r.Method)
+	requestURI := r.RequestURI
+	if len(requestURI) == 0 {
+		requestURI = r.URL.RequestURI()
+	}
+	req.Header.SetRequestURI(requestURI)
+	if !r.ProtoAtLeast(1, 1) {
+		req.Header.SetProtocol("HTTP/1.0")
+	}
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.SetHost(r.Host)
+
+	if r.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req.SetBody(body)
+	req.Header.SetContentLength(len(body))
+	return nil
+}
+
+type netHTTPBody struct {
+	b []byte
+}
+
+func (r *netHTTPBody) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func (r *netHTTPBody) Close() error {
+	r.b = r.b[:0]
+	return nil
+}
+
+type netHTTPResponseWriter struct {
+	ctx        *fasthttp.RequestCtx
+	statusCode int
+	h          http.Header
+	body       []byte
+
+	headerWritten bool
+}
+
+func (w *netHTTPResponseWriter) StatusCode() int {
+	if w.statusCode == 0 {
+		return http.StatusOK
+	}
+	return w.statusCode
+}
+
+func (w *netHTTPResponseWriter) Header() http.Header {
+	return w.h
+}
+
+func (w *netHTTPResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *netHTTPResponseWriter) Write(p []byte) (int, error) {
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+// Flush implements http.Flusher.
+func (w *netHTTPResponseWriter) Flush() {
+	w.writeHeader()
+	w.ctx.Write(w.body) //nolint:errcheck
+	w.body = w.body[:0]
+
+	// Buffer the response if the server doesn't support flushing.
+	w.ctx.Flush() //nolint:errcheck
+}
+
+// writeHeader copies the status code and the headers set by net/http
+// handler to ctx.Response.
+func (w *netHTTPResponseWriter) writeHeader() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+
+	w.ctx.SetStatusCode(w.StatusCode())
+	haveContentType := false
+	for k, vv := range w.h {
+		if k == fasthttp.HeaderContentType {
+			haveContentType = true
+		}
+		for _, v := range vv {
+			w.ctx.Response.Header.Add(k, v)
+		}
+	}
+	if !haveContentType {
+		// From net/http.ResponseWriter.Write:
+		// If the Header does not contain a Content-Type line, Write adds a Content-Type set
+		// to the result of passing the initial 512 bytes of written data to DetectContentType.
+		l := 512
+		if len(w.body) < 512 {
+			l = len(w.body)
+		}
+		w.ctx.Response.Header.Set(fasthttp.HeaderContentType, http.DetectContentType(w.body[:l]))
+	}
+}
@@ -0,0 +1,241 @@
+package fasthttpadaptor
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fasthttp "github.com/caser789/justhttp"
+)
+
+func TestNewFastHTTPHandler(t *testing.T) {
+	t.Parallel()
+
+	expectedMethod := fasthttp.MethodPost
+	expectedRequestURI := "/foo/bar?baz=123"
+	expectedBody := "body 123 foo bar baz"
+	expectedHost := "foobar.com"
+
+	callsCount := 0
+	nethttpH := func(w http.ResponseWriter, r *http.Request) {
+		callsCount++
+		if r.Method != expectedMethod {
+			t.Fatalf("unexpected method %q. Expecting %q", r.Method, expectedMethod)
+		}
+		if r.Proto != "HTTP/1.1" || r.ProtoMajor != 1 || r.ProtoMinor != 1 {
+			t.Fatalf("unexpected proto %q. Expecting %q", r.Proto, "HTTP/1.1")
+		}
+		if r.RequestURI != expectedRequestURI {
+			t.Fatalf("unexpected requestURI %q. Expecting %q", r.RequestURI, expectedRequestURI)
+		}
+		if r.URL.Path != "/foo/bar" {
+			t.Fatalf("unexpected path %q. Expecting %q", r.URL.Path, "/foo/bar")
+		}
+		if r.URL.Query().Get("baz") != "123" {
+			t.Fatalf("unexpected query arg %q. Expecting %q", r.URL.Query().Get("baz"), "123")
+		}
+		if r.ContentLength != int64(len(expectedBody)) {
+			t.Fatalf("unexpected contentLength %d. Expecting %d", r.ContentLength, len(expectedBody))
+		}
+		if r.Host != expectedHost {
+			t.Fatalf("unexpected host %q. Expecting %q", r.Host, expectedHost)
+		}
+		if v := r.Header.Get("Aaa"); v != "bbb" {
+			t.Fatalf("unexpected header value %q. Expecting %q", v, "bbb")
+		}
+		if vv := r.Header["Xxx"]; len(vv) != 2 || vv[0] != "yyy" || vv[1] != "zzz" {
+			t.Fatalf("unexpected header values %q. Expecting %q", vv, []string{"yyy", "zzz"})
+		}
+		if _, ok := r.Header["Host"]; ok {
+			t.Fatalf("unexpected Host header")
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error when reading request body: %s", err)
+		}
+		if string(body) != expectedBody {
+			t.Fatalf("unexpected body %q. Expecting %q", body, expectedBody)
+		}
+		if r.Context() == nil {
+			t.Fatalf("missing request context")
+		}
+
+		w.Header().Set("Header1", "value1")
+		w.Header().Add("Header2", "value2")
+		w.Header().Add("Header2", "value3")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Hello, world!")) //nolint:errcheck
+	}
+	fasthttpH := NewFastHTTPHandler(http.HandlerFunc(nethttpH))
+
+	ctx := fasthttp.NewTestRequestCtx(expectedMethod, "http://"+expectedHost+expectedRequestURI, expectedBody,
+		"aaa", "bbb")
+	ctx.Request.Header.Add("Xxx", "yyy")
+	ctx.Request.Header.Add("Xxx", "zzz")
+
+	fasthttpH(ctx)
+
+	if callsCount != 1 {
+		t.Fatalf("unexpected callsCount: %d. Expecting 1", callsCount)
+	}
+
+	resp := &ctx.Response
+	if resp.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("unexpected statusCode: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusBadRequest)
+	}
+	if string(resp.Header.Peek("Header1")) != "value1" {
+		t.Fatalf("unexpected header value: %q. Expecting %q", resp.Header.Peek("Header1"), "value1")
+	}
+	var header2 []string
+	resp.Header.VisitAll(func(k, v []byte) {
+		if string(k) == "Header2" {
+			header2 = append(header2, string(v))
+		}
+	})
+	if len(header2) != 2 || header2[0] != "value2" || header2[1] != "value3" {
+		t.Fatalf("unexpected header values: %q. Expecting %q", header2, []string{"value2", "value3"})
+	}
+	// Content-Type is detected from the body like in net/http.
+	if string(resp.Header.ContentType()) != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected content type: %q. Expecting %q", resp.Header.ContentType(), "text/plain; charset=utf-8")
+	}
+	if string(resp.Body()) != "Hello, world!" {
+		t.Fatalf("unexpected response body %q. Expecting %q", resp.Body(), "Hello, world!")
+	}
+}
+
+func TestNewFastHTTPHandlerFlush(t *testing.T) {
+	t.Parallel()
+
+	ch := make(chan struct{})
+	nethttpH := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: foo\n\n")) //nolint:errcheck
+		w.(http.Flusher).Flush()
+		// Wait until the client reads the flushed data.
+		<-ch
+		w.Write([]byte("data: bar\n\n")) //nolint:errcheck
+	}
+	s := &fasthttp.Server{
+		Handler: NewFastHTTPHandlerFunc(nethttpH),
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go s.Serve(ln) //nolint:errcheck
+
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("GET /events HTTP/1.1\r\nHost: foobar.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	br := bufio.NewReader(c)
+	var h fasthttp.ResponseHeader
+	if err := h.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(h.ContentType()) != "text/event-stream" {
+		t.Fatalf("unexpected content type: %q. Expecting %q", h.ContentType(), "text/event-stream")
+	}
+	expectData(t, br, "b\r\ndata: foo\n\n\r\n")
+	close(ch)
+	expectData(t, br, "b\r\ndata: bar\n\n\r\n0\r\n\r\n")
+}
+
+func TestNewNetHTTPHandler(t *testing.T) {
+	t.Parallel()
+
+	expectedBody := "body 123 foo bar baz"
+
+	callsCount := 0
+	fasthttpH := func(ctx *fasthttp.RequestCtx) {
+		callsCount++
+		if !ctx.IsPost() {
+			t.Fatalf("unexpected method %q. Expecting %q", ctx.Method(), fasthttp.MethodPost)
+		}
+		if string(ctx.RequestURI()) != "/foo/bar?baz=123" {
+			t.Fatalf("unexpected requestURI %q. Expecting %q", ctx.RequestURI(), "/foo/bar?baz=123")
+		}
+		if string(ctx.Path()) != "/foo/bar" {
+			t.Fatalf("unexpected path %q. Expecting %q", ctx.Path(), "/foo/bar")
+		}
+		if string(ctx.QueryArgs().Peek("baz")) != "123" {
+			t.Fatalf("unexpected query arg %q. Expecting %q", ctx.QueryArgs().Peek("baz"), "123")
+		}
+		if string(ctx.Host()) != "foobar.com" {
+			t.Fatalf("unexpected host %q. Expecting %q", ctx.Host(), "foobar.com")
+		}
+		if v := ctx.Request.Header.Peek("Aaa"); string(v) != "bbb" {
+			t.Fatalf("unexpected header value %q. Expecting %q", v, "bbb")
+		}
+		if string(ctx.PostBody()) != expectedBody {
+			t.Fatalf("unexpected body %q. Expecting %q", ctx.PostBody(), expectedBody)
+		}
+		if ctx.Request.Header.ContentLength() != len(expectedBody) {
+			t.Fatalf("unexpected contentLength %d. Expecting %d", ctx.Request.Header.ContentLength(), len(expectedBody))
+		}
+		if ctx.RemoteAddr().String() != "1.2.3.4:5678" {
+			t.Fatalf("unexpected remoteAddr %q. Expecting %q", ctx.RemoteAddr(), "1.2.3.4:5678")
+		}
+
+		ctx.Response.Header.Set("Header1", "value1")
+		ctx.Response.Header.Add("Header2", "value2")
+		ctx.Response.Header.Add("Header2", "value3")
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.SetStatusCode(fasthttp.StatusTeapot)
+		ctx.WriteString("response body") //nolint:errcheck
+	}
+	h := NewNetHTTPHandler(fasthttpH)
+
+	r := httptest.NewRequest(http.MethodPost, "/foo/bar?baz=123", strings.NewReader(expectedBody))
+	r.Host = "foobar.com"
+	r.RemoteAddr = "1.2.3.4:5678"
+	r.Header.Set("Aaa", "bbb")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if callsCount != 1 {
+		t.Fatalf("unexpected callsCount: %d. Expecting 1", callsCount)
+	}
+	if w.Code != fasthttp.StatusTeapot {
+		t.Fatalf("unexpected statusCode: %d. Expecting %d", w.Code, fasthttp.StatusTeapot)
+	}
+	if v := w.Header().Get("Header1"); v != "value1" {
+		t.Fatalf("unexpected header value %q. Expecting %q", v, "value1")
+	}
+	if vv := w.Header()["Header2"]; len(vv) != 2 || vv[0] != "value2" || vv[1] != "value3" {
+		t.Fatalf("unexpected header values %q. Expecting %q", vv, []string{"value2", "value3"})
+	}
+	if v := w.Header().Get("Content-Type"); v != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected content-type %q. Expecting %q", v, "text/plain; charset=utf-8")
+	}
+	if v := w.Header().Get("Content-Length"); v != "13" {
+		t.Fatalf("unexpected content-length %q. Expecting %q", v, "13")
+	}
+	if w.Body.String() != "response body" {
+		t.Fatalf("unexpected body %q. Expecting %q", w.Body.String(), "response body")
+	}
+}
+
+func expectData(t *testing.T, r io.Reader, expectedData string) {
+	data := make([]byte, len(expectedData))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != expectedData {
+		t.Fatalf("unexpected data: %q. Expecting %q", data, expectedData)
+	}
+}
@@ -195,8 +195,50 @@ func NewPathPrefixStripper(prefixSize int) PathRewriteFunc {
 	}
 }
 
-// FS represents settings for request handler serving static files
+// FileSystem is the interface for a file system FS serves files from.
+//
+// Paths passed to Open start with FS.Root, use slash separators and
+// are cleaned from '..' elements.
+type FileSystem interface {
+	// Open opens the named file or directory for reading.
+	//
+	// The returned error must satisfy os.IsNotExist if the file
+	// doesn't exist.
+	Open(name string) (File, error)
+}
+
+// File is the interface for a file opened by FileSystem.
+//
+// *os.File implements File.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+
+	// Stat returns the file info.
+	Stat() (os.FileInfo, error)
+
+	// Readdir reads the directory contents the same way as os.File.Readdir.
+	// It is used for directory index pages generation.
+	Readdir(count int) ([]os.FileInfo, error)
+}
+
+// osFileSystem is the default FileSystem serving files
 // from the local filesystem.
+type osFileSystem struct{}
+
+func (osFileSystem) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		// Do not return non-nil File holding nil *os.File.
+		return nil, err
+	}
+	return f, nil
+}
+
+// FS represents settings for request handler serving static files
+// from the local filesystem or from the given FileSystem.
 //
 // It is prohibited copying FS values. Create new values instead.
 type FS struct {
@@ -205,6 +247,15 @@ type FS struct {
 	// Path to the root directory to serve files from.
 	Root string
 
+	// FileSystem to serve files from.
+	//
+	// It may be used for serving embedded or generated assets.
+	// Compressed files are cached in memory instead of Root
+	// for FileSystem other than the local filesystem.
+	//
+	// By default files are served from the local filesystem.
+	FileSystem FileSystem
+
 	// List of index file names to try opening during directory access.
 	//
 	// For example:
@@ -245,6 +296,17 @@ type FS struct {
 	// Brotli encoding is disabled by default.
 	CompressBrotli bool
 
+	// Serves pre-compressed gzip siblings of the requested files,
+	// e.g. 'file.css.gz' for 'file.css', with 'Content-Encoding: gzip'
+	// to clients accepting gzip if set to true. The original file
+	// is served if the sibling doesn't exist.
+	//
+	// Unlike Compress, files aren't compressed by the server.
+	// Compress takes precedence if both are set.
+	//
+	// Pre-compressed siblings aren't served by default.
+	ServeGzipSiblings bool
+
 	// Enables byte range requests if set to true.
 	//
 	// Byte range requests are disabled by default.
@@ -386,13 +448,20 @@ func (fs *FS) initRequestHandler() {
 		compressedFileSuffixes["br"] = FSCompressedFileSuffixes["br"]
 	}
 
+	filesystem := fs.FileSystem
+	if filesystem == nil {
+		filesystem = osFileSystem{}
+	}
+
 	h := &fsHandler{
+		filesystem:             filesystem,
 		root:                   root,
 		indexNames:             fs.IndexNames,
 		pathRewrite:            fs.PathRewrite,
 		generateIndexPages:     fs.GenerateIndexPages,
 		compress:               fs.Compress,
 		compressBrotli:         fs.CompressBrotli,
+		serveGzipSiblings:      fs.ServeGzipSiblings,
 		pathNotFound:           fs.PathNotFound,
 		acceptByteRange:        fs.AcceptByteRange,
 		cacheDuration:          cacheDuration,
@@ -434,6 +503,7 @@ func (fs *FS) initRequestHandler() {
 }
 
 type fsHandler struct {
+	filesystem             FileSystem
 	root                   string
 	indexNames             []string
 	pathRewrite            PathRewriteFunc
@@ -441,6 +511,7 @@ type fsHandler struct {
 	generateIndexPages     bool
 	compress               bool
 	compressBrotli         bool
+	serveGzipSiblings      bool
 	acceptByteRange        bool
 	cacheDuration          time.Duration
 	compressedFileSuffixes map[string]string
@@ -455,7 +526,8 @@ type fsHandler struct {
 
 type fsFile struct {
 	h             *fsHandler
-	f             *os.File
+	f             File
+	filePath      string
 	dirIndex      []byte
 	contentType   string
 	contentLength int
@@ -522,7 +594,7 @@ func (ff *fsFile) bigFileReader() (io.Reader, error) {
 		return r, nil
 	}
 
-	f, err := os.Open(ff.f.Name())
+	f, err := ff.h.filesystem.Open(ff.filePath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open already opened file: %s", err)
 	}
@@ -559,7 +631,7 @@ func (ff *fsFile) decReadersCount() {
 // bigFileReader attempts to trigger sendfile
 // for sending big files over the wire.
 type bigFileReader struct {
-	f  *os.File
+	f  File
 	ff *fsFile
 	r  io.Reader
 	lr io.LimitedReader
@@ -783,6 +855,13 @@ func (h *fsHandler) handleRequest(ctx *RequestCtx) {
 			fileEncoding = "gzip"
 		}
 	}
+	gzipSibling := false
+	if len(byteRange) == 0 && !mustCompress && h.serveGzipSiblings &&
+		ctx.Request.Header.HasAcceptEncodingBytes(strGzip) {
+		gzipSibling = true
+		fileCache = h.cacheGzip
+		fileEncoding = "gzip"
+	}
 
 	h.cacheLock.Lock()
 	ff, ok := fileCache[string(path)]
@@ -795,7 +874,11 @@ func (h *fsHandler) handleRequest(ctx *RequestCtx) {
 		pathStr := string(path)
 		filePath := h.root + pathStr
 		var err error
-		ff, err = h.openFSFile(filePath, mustCompress, fileEncoding)
+		if gzipSibling {
+			ff, err = h.openGzipSiblingFSFile(filePath)
+		} else {
+			ff, err = h.openFSFile(filePath, mustCompress, fileEncoding)
+		}
 		if mustCompress && err == errNoCreatePermission {
 			ctx.Logger().Printf("insufficient permissions for saving compressed file for %q. Serving uncompressed file. "+
 				"Allow write access to the directory with this file in order to improve fasthttp performance", filePath)
@@ -1013,7 +1096,7 @@ func (h *fsHandler) createDirIndex(base *URI, dirPath string, mustCompress bool,
 		fmt.Fprintf(w, `<li><a href="%s" class="dir">..</a></li>`, parentPathEscaped)
 	}
 
-	f, err := os.Open(dirPath)
+	f, err := h.filesystem.Open(dirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -1092,7 +1175,7 @@ const (
 )
 
 func (h *fsHandler) compressAndOpenFSFile(filePath string, fileEncoding string) (*fsFile, error) {
-	f, err := os.Open(filePath)
+	f, err := h.filesystem.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
@@ -1111,7 +1194,11 @@ func (h *fsHandler) compressAndOpenFSFile(filePath string, fileEncoding string)
 	if strings.HasSuffix(filePath, h.compressedFileSuffixes[fileEncoding]) ||
 		fileInfo.Size() > fsMaxCompressibleFileSize ||
 		!isFileCompressible(f, fsMinCompressRatio) {
-		return h.newFSFile(f, fileInfo, false, "")
+		return h.newFSFile(f, filePath, fileInfo, false, "", "")
+	}
+
+	if _, ok := h.filesystem.(osFileSystem); !ok {
+		return h.compressFileInMemory(f, fileInfo, filePath, fileEncoding)
 	}
 
 	compressedFilePath := filePath + h.compressedFileSuffixes[fileEncoding]
@@ -1129,7 +1216,7 @@ func (h *fsHandler) compressAndOpenFSFile(filePath string, fileEncoding string)
 	return ff, err
 }
 
-func (h *fsHandler) compressFileNolock(f *os.File, fileInfo os.FileInfo, filePath, compressedFilePath string, fileEncoding string) (*fsFile, error) {
+func (h *fsHandler) compressFileNolock(f File, fileInfo os.FileInfo, filePath, compressedFilePath string, fileEncoding string) (*fsFile, error) {
 	// Attempt to open compressed file created by another concurrent
 	// goroutine.
 	// It is safe opening such a file, since the file creation
@@ -1180,8 +1267,59 @@ func (h *fsHandler) compressFileNolock(f *os.File, fileInfo os.FileInfo, filePat
 	return h.newCompressedFSFile(compressedFilePath, fileEncoding)
 }
 
+// compressFileInMemory compresses f into memory, since FileSystem
+// other than the local filesystem may be read-only.
+func (h *fsHandler) compressFileInMemory(f File, fileInfo os.FileInfo, filePath string, fileEncoding string) (*fsFile, error) {
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(fileExtension(fileInfo.Name(), false, ""))
+	if len(contentType) == 0 {
+		data, err := readFileHeader(f, false, "")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read header of the file %q: %s", filePath, err)
+		}
+		contentType = http.DetectContentType(data)
+	}
+
+	var w bytebufferpool.ByteBuffer
+	var err error
+	if fileEncoding == "br" {
+		zw := acquireStacklessBrotliWriter(&w, CompressDefaultCompression)
+		_, err = copyZeroAlloc(zw, f)
+		if err1 := zw.Flush(); err == nil {
+			err = err1
+		}
+		releaseStacklessBrotliWriter(zw, CompressDefaultCompression)
+	} else if fileEncoding == "gzip" {
+		zw := acquireStacklessGzipWriter(&w, CompressDefaultCompression)
+		_, err = copyZeroAlloc(zw, f)
+		if err1 := zw.Flush(); err == nil {
+			err = err1
+		}
+		releaseStacklessGzipWriter(zw, CompressDefaultCompression)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when compressing file %q: %s", filePath, err)
+	}
+
+	// The compressed contents is served the same way as directory index.
+	lastModified := fileInfo.ModTime()
+	ff := &fsFile{
+		h:               h,
+		dirIndex:        w.B,
+		contentType:     contentType,
+		contentLength:   len(w.B),
+		compressed:      true,
+		lastModified:    lastModified,
+		lastModifiedStr: AppendHTTPDate(nil, lastModified),
+
+		t: time.Now(),
+	}
+	return ff, nil
+}
+
 func (h *fsHandler) newCompressedFSFile(filePath string, fileEncoding string) (*fsFile, error) {
-	f, err := os.Open(filePath)
+	f, err := h.filesystem.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open compressed file %q: %s", filePath, err)
 	}
@@ -1190,7 +1328,7 @@ func (h *fsHandler) newCompressedFSFile(filePath string, fileEncoding string) (*
 		f.Close()
 		return nil, fmt.Errorf("cannot obtain info for compressed file %q: %s", filePath, err)
 	}
-	return h.newFSFile(f, fileInfo, true, fileEncoding)
+	return h.newFSFile(f, filePath, fileInfo, true, fileEncoding, h.compressedFileSuffixes[fileEncoding])
 }
 
 func (h *fsHandler) openFSFile(filePath string, mustCompress bool, fileEncoding string) (*fsFile, error) {
@@ -1199,7 +1337,7 @@ func (h *fsHandler) openFSFile(filePath string, mustCompress bool, fileEncoding
 		filePath += h.compressedFileSuffixes[fileEncoding]
 	}
 
-	f, err := os.Open(filePath)
+	f, err := h.filesystem.Open(filePath)
 	if err != nil {
 		if mustCompress && os.IsNotExist(err) {
 			return h.compressAndOpenFSFile(filePathOriginal, fileEncoding)
@@ -1223,7 +1361,7 @@ func (h *fsHandler) openFSFile(filePath string, mustCompress bool, fileEncoding
 	}
 
 	if mustCompress {
-		fileInfoOriginal, err := os.Stat(filePathOriginal)
+		fileInfoOriginal, err := h.statFile(filePathOriginal)
 		if err != nil {
 			f.Close()
 			return nil, fmt.Errorf("cannot obtain info for original file %q: %s", filePathOriginal, err)
@@ -1235,15 +1373,56 @@ func (h *fsHandler) openFSFile(filePath string, mustCompress bool, fileEncoding
 		if fileInfoOriginal.ModTime().Sub(fileInfo.ModTime()) >= time.Second {
 			// The compressed file became stale. Re-create it.
 			f.Close()
-			os.Remove(filePath)
+			if _, ok := h.filesystem.(osFileSystem); ok {
+				os.Remove(filePath)
+			}
 			return h.compressAndOpenFSFile(filePathOriginal, fileEncoding)
 		}
 	}
 
-	return h.newFSFile(f, fileInfo, mustCompress, fileEncoding)
+	return h.newFSFile(f, filePath, fileInfo, mustCompress, fileEncoding, h.compressedFileSuffixes[fileEncoding])
+}
+
+// fsGzipSiblingSuffix is the suffix of pre-compressed gzip siblings
+// served if FS.ServeGzipSiblings is set.
+const fsGzipSiblingSuffix = ".gz"
+
+// openGzipSiblingFSFile opens pre-compressed gzip sibling of the given file
+// or the file itself if the sibling doesn't exist.
+func (h *fsHandler) openGzipSiblingFSFile(filePath string) (*fsFile, error) {
+	siblingPath := filePath + fsGzipSiblingSuffix
+	f, err := h.filesystem.Open(siblingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h.openFSFile(filePath, false, "")
+		}
+		return nil, err
+	}
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot obtain info for file %q: %s", siblingPath, err)
+	}
+	if fileInfo.IsDir() {
+		f.Close()
+		return h.openFSFile(filePath, false, "")
+	}
+
+	return h.newFSFile(f, siblingPath, fileInfo, true, "gzip", fsGzipSiblingSuffix)
+}
+
+func (h *fsHandler) statFile(filePath string) (os.FileInfo, error) {
+	f, err := h.filesystem.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := f.Stat()
+	f.Close()
+	return fileInfo, err
 }
 
-func (h *fsHandler) newFSFile(f *os.File, fileInfo os.FileInfo, compressed bool, fileEncoding string) (*fsFile, error) {
+func (h *fsHandler) newFSFile(f File, filePath string, fileInfo os.FileInfo, compressed bool, fileEncoding, compressedFileSuffix string) (*fsFile, error) {
 	n := fileInfo.Size()
 	contentLength := int(n)
 	if n != int64(contentLength) {
@@ -1252,12 +1431,12 @@ func (h *fsHandler) newFSFile(f *os.File, fileInfo os.FileInfo, compressed bool,
 	}
 
 	// detect content-type
-	ext := fileExtension(fileInfo.Name(), compressed, h.compressedFileSuffixes[fileEncoding])
+	ext := fileExtension(fileInfo.Name(), compressed, compressedFileSuffix)
 	contentType := mime.TypeByExtension(ext)
 	if len(contentType) == 0 {
 		data, err := readFileHeader(f, compressed, fileEncoding)
 		if err != nil {
-			return nil, fmt.Errorf("cannot read header of the file %q: %s", f.Name(), err)
+			return nil, fmt.Errorf("cannot read header of the file %q: %s", filePath, err)
 		}
 		contentType = http.DetectContentType(data)
 	}
@@ -1266,6 +1445,7 @@ func (h *fsHandler) newFSFile(f *os.File, fileInfo os.FileInfo, compressed bool,
 	ff := &fsFile{
 		h:               h,
 		f:               f,
+		filePath:        filePath,
 		contentType:     contentType,
 		contentLength:   contentLength,
 		compressed:      compressed,
@@ -1277,7 +1457,7 @@ func (h *fsHandler) newFSFile(f *os.File, fileInfo os.FileInfo, compressed bool,
 	return ff, nil
 }
 
-func readFileHeader(f *os.File, compressed bool, fileEncoding string) ([]byte, error) {
+func readFileHeader(f File, compressed bool, fileEncoding string) ([]byte, error) {
 	r := io.Reader(f)
 	var (
 		br *brotli.Reader
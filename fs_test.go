@@ -11,6 +11,7 @@ import (
 	"path"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -267,6 +268,222 @@ func TestServeFileCompressed(t *testing.T) {
 	}
 }
 
+type testMemFS map[string]string
+
+func (fs testMemFS) Open(name string) (File, error) {
+	if data, ok := fs[name]; ok {
+		return &testMemFile{
+			Reader: strings.NewReader(data),
+			info:   testMemFileInfo{name: path.Base(name), size: int64(len(data))},
+		}, nil
+	}
+
+	// Directories are implied by file names.
+	prefix := name + "/"
+	var entries []os.FileInfo
+	seen := make(map[string]bool)
+	for k, data := range fs {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		entry := k[len(prefix):]
+		isDir := false
+		if n := strings.IndexByte(entry, '/'); n >= 0 {
+			entry = entry[:n]
+			isDir = true
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, testMemFileInfo{name: entry, size: int64(len(data)), isDir: isDir})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &testMemFile{
+		Reader:  strings.NewReader(""),
+		info:    testMemFileInfo{name: path.Base(name), isDir: true},
+		entries: entries,
+	}, nil
+}
+
+type testMemFile struct {
+	*strings.Reader
+	info    testMemFileInfo
+	entries []os.FileInfo
+}
+
+func (f *testMemFile) Close() error                             { return nil }
+func (f *testMemFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *testMemFile) Readdir(count int) ([]os.FileInfo, error) { return f.entries, nil }
+
+type testMemFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi testMemFileInfo) Name() string       { return fi.name }
+func (fi testMemFileInfo) Size() int64        { return fi.size }
+func (fi testMemFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi testMemFileInfo) ModTime() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+func (fi testMemFileInfo) IsDir() bool        { return fi.isDir }
+func (fi testMemFileInfo) Sys() interface{}   { return nil }
+
+func TestFSFileSystem(t *testing.T) {
+	t.Parallel()
+
+	bigBody := strings.Repeat("big file contents ", 1000)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	fs := &FS{
+		Root: "/assets",
+		FileSystem: testMemFS{
+			"/assets/foo.txt":     "foobar",
+			"/assets/big.txt":     bigBody,
+			"/assets/dir/bar.txt": "bar",
+		},
+		GenerateIndexPages: true,
+		Compress:           true,
+		AcceptByteRange:    true,
+		CleanStop:          stop,
+	}
+	h := fs.NewRequestHandler()
+
+	serve := func(uri, acceptEncoding string, byteRange bool) *Response {
+		var ctx RequestCtx
+		ctx.Init(&Request{}, nil, TestLogger{t})
+		ctx.Request.SetRequestURI(uri)
+		if acceptEncoding != "" {
+			ctx.Request.Header.Set(HeaderAcceptEncoding, acceptEncoding)
+		}
+		if byteRange {
+			ctx.Request.Header.SetByteRange(0, 2)
+		}
+		h(&ctx)
+
+		var resp Response
+		br := bufio.NewReader(bytes.NewBufferString(ctx.Response.String()))
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error for %q: %s", uri, err)
+		}
+		return &resp
+	}
+
+	resp := serve("http://foobar.com/foo.txt", "", false)
+	if resp.StatusCode() != StatusOK || string(resp.Body()) != "foobar" {
+		t.Fatalf("unexpected response %d %q. Expecting %d %q", resp.StatusCode(), resp.Body(), StatusOK, "foobar")
+	}
+	if ct := string(resp.Header.ContentType()); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected content-type %q", ct)
+	}
+
+	resp = serve("http://foobar.com/big.txt", "", false)
+	if string(resp.Body()) != bigBody {
+		t.Fatalf("unexpected body for big file")
+	}
+
+	resp = serve("http://foobar.com/big.txt", "", true)
+	if resp.StatusCode() != StatusPartialContent || string(resp.Body()) != "big" {
+		t.Fatalf("unexpected response %d %q. Expecting %d %q", resp.StatusCode(), resp.Body(), StatusPartialContent, "big")
+	}
+
+	resp = serve("http://foobar.com/big.txt", "gzip", false)
+	if ce := string(resp.Header.Peek(HeaderContentEncoding)); ce != "gzip" {
+		t.Fatalf("unexpected Content-Encoding %q. Expecting %q", ce, "gzip")
+	}
+	body, err := resp.BodyGunzip()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != bigBody {
+		t.Fatalf("unexpected body for compressed big file")
+	}
+
+	resp = serve("http://foobar.com/dir/", "", false)
+	if resp.StatusCode() != StatusOK || !strings.Contains(string(resp.Body()), "bar.txt") {
+		t.Fatalf("unexpected directory index %d %q", resp.StatusCode(), resp.Body())
+	}
+
+	resp = serve("http://foobar.com/missing.txt", "", false)
+	if resp.StatusCode() != StatusNotFound {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), StatusNotFound)
+	}
+}
+
+func TestFSServeGzipSiblings(t *testing.T) {
+	t.Parallel()
+
+	css := "body { color: red; }"
+	stop := make(chan struct{})
+	defer close(stop)
+
+	fs := &FS{
+		Root: "/assets",
+		FileSystem: testMemFS{
+			"/assets/style.css":    css,
+			"/assets/style.css.gz": string(AppendGzipBytes(nil, []byte(css))),
+			"/assets/plain.txt":    "plain",
+		},
+		ServeGzipSiblings: true,
+		CleanStop:         stop,
+	}
+	h := fs.NewRequestHandler()
+
+	serve := func(uri, acceptEncoding string) *Response {
+		var ctx RequestCtx
+		ctx.Init(&Request{}, nil, TestLogger{t})
+		ctx.Request.SetRequestURI(uri)
+		if acceptEncoding != "" {
+			ctx.Request.Header.Set(HeaderAcceptEncoding, acceptEncoding)
+		}
+		h(&ctx)
+
+		var resp Response
+		br := bufio.NewReader(bytes.NewBufferString(ctx.Response.String()))
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error for %q: %s", uri, err)
+		}
+		return &resp
+	}
+
+	// Repeat requests for serving cached files.
+	for i := 0; i < 2; i++ {
+		resp := serve("http://foobar.com/style.css", "gzip, deflate")
+		if ce := string(resp.Header.Peek(HeaderContentEncoding)); ce != "gzip" {
+			t.Fatalf("unexpected Content-Encoding %q. Expecting %q", ce, "gzip")
+		}
+		if ct := string(resp.Header.ContentType()); !strings.HasPrefix(ct, "text/css") {
+			t.Fatalf("unexpected Content-Type %q. Expecting %q", ct, "text/css")
+		}
+		body, err := resp.BodyGunzip()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(body) != css {
+			t.Fatalf("unexpected body %q. Expecting %q", body, css)
+		}
+
+		resp = serve("http://foobar.com/style.css", "")
+		if ce := string(resp.Header.Peek(HeaderContentEncoding)); ce != "" {
+			t.Fatalf("unexpected Content-Encoding %q", ce)
+		}
+		if string(resp.Body()) != css {
+			t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), css)
+		}
+
+		// The original file is served if the sibling doesn't exist.
+		resp = serve("http://foobar.com/plain.txt", "gzip")
+		if ce := string(resp.Header.Peek(HeaderContentEncoding)); ce != "" {
+			t.Fatalf("unexpected Content-Encoding %q", ce)
+		}
+		if string(resp.Body()) != "plain" {
+			t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "plain")
+		}
+	}
+}
+
 func TestServeFileUncompressed(t *testing.T) {
 	t.Parallel()
 
@@ -609,6 +826,49 @@ func testFSCompress(t *testing.T, h RequestHandler, filePath string) {
 	}
 }
 
+func TestFSCompressBrotliDisabled(t *testing.T) {
+	// This test can't run parallel as files in / might by changed by other tests.
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	fs := &FS{
+		Root:      ".",
+		Compress:  true,
+		CleanStop: stop,
+	}
+	h := fs.NewRequestHandler()
+
+	var ctx RequestCtx
+	ctx.Init(&Request{}, nil, nil)
+
+	// brotli is disabled, so gzip must be served instead.
+	ctx.Request.SetRequestURI("/fs.go")
+	ctx.Request.Header.Set(HeaderAcceptEncoding, "br, gzip")
+	h(&ctx)
+	if ctx.Response.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), StatusOK)
+	}
+	ce := ctx.Response.Header.Peek(HeaderContentEncoding)
+	if string(ce) != "gzip" {
+		t.Fatalf("unexpected content-encoding %q. Expecting %q", ce, "gzip")
+	}
+
+	// Uncompressed file must be served if gzip isn't advertised.
+	ctx.Request.Reset()
+	ctx.Response.Reset()
+	ctx.Request.SetRequestURI("/fs.go")
+	ctx.Request.Header.Set(HeaderAcceptEncoding, "br")
+	h(&ctx)
+	if ctx.Response.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), StatusOK)
+	}
+	ce = ctx.Response.Header.Peek(HeaderContentEncoding)
+	if len(ce) > 0 {
+		t.Fatalf("unexpected content-encoding %q. Expecting empty string", ce)
+	}
+}
+
 func TestFileLock(t *testing.T) {
 	t.Parallel()
 
@@ -3,6 +3,7 @@ package fasthttp
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -37,6 +38,10 @@ type ResponseHeader struct {
 	contentLengthBytes    []byte
 	secureErrorLogMessage bool
 
+	// Maximum size of response headers read by Read.
+	// if <= 0, means not limited besides the read buffer size.
+	maxHeaderSize int
+
 	contentType []byte
 	server      []byte
 
@@ -44,6 +49,7 @@ type ResponseHeader struct {
 	bufKV argsKV
 
 	cookies []argsKV
+	trailer []argsKV
 }
 
 // RequestHeader represents HTTP request header.
@@ -64,10 +70,22 @@ type RequestHeader struct {
 	// for reducing RequestHeader object size.
 	cookiesCollected bool
 
+	// hostFromURI is set if the Host header has been filled in
+	// from the request uri instead of being set explicitly.
+	hostFromURI bool
+
 	contentLength         int
 	contentLengthBytes    []byte
 	secureErrorLogMessage bool
 
+	// Maximum size of request headers read by Read.
+	// if <= 0, means not limited besides the read buffer size.
+	maxHeaderSize int
+
+	// Maximum number of request header lines read by Read.
+	// if <= 0, means not limited.
+	maxHeaderCount int
+
 	method      []byte
 	requestURI  []byte
 	proto       []byte
@@ -79,6 +97,7 @@ type RequestHeader struct {
 	bufKV argsKV
 
 	cookies []argsKV
+	trailer []argsKV
 
 	// stores an immutable copy of headers as they were received from the
 	// wire.
@@ -136,12 +155,44 @@ func (h *ResponseHeader) SetStatusCode(statusCode int) {
 	h.statusCode = statusCode
 }
 
+// IsSuccess returns true if response status code is 2xx.
+func (h *ResponseHeader) IsSuccess() bool {
+	statusCode := h.StatusCode()
+	return statusCode >= 200 && statusCode < 300
+}
+
+// IsRedirect returns true if response status code is 3xx.
+func (h *ResponseHeader) IsRedirect() bool {
+	statusCode := h.StatusCode()
+	return statusCode >= 300 && statusCode < 400
+}
+
+// IsClientError returns true if response status code is 4xx.
+func (h *ResponseHeader) IsClientError() bool {
+	statusCode := h.StatusCode()
+	return statusCode >= 400 && statusCode < 500
+}
+
+// IsServerError returns true if response status code is 5xx.
+func (h *ResponseHeader) IsServerError() bool {
+	statusCode := h.StatusCode()
+	return statusCode >= 500 && statusCode < 600
+}
+
 // SetLastModified sets 'Last-Modified' header to the given value.
 func (h *ResponseHeader) SetLastModified(t time.Time) {
 	h.bufKV.value = AppendHTTPDate(h.bufKV.value[:0], t)
 	h.SetCanonical(strLastModified, h.bufKV.value)
 }
 
+// SetDate sets 'Date' header to the given value.
+//
+// The explicitly set Date is written instead of the current server date.
+func (h *ResponseHeader) SetDate(t time.Time) {
+	h.bufKV.value = AppendHTTPDate(h.bufKV.value[:0], t)
+	h.SetCanonical(strDate, h.bufKV.value)
+}
+
 // ConnectionClose returns true if 'Connection: close' header is set.
 func (h *ResponseHeader) ConnectionClose() bool {
 	return h.connectionClose
@@ -178,6 +229,12 @@ func (h *RequestHeader) ResetConnectionClose() {
 	}
 }
 
+// AcceptsTrailers returns true if the client advertises trailers support
+// via 'TE: trailers' request header.
+func (h *RequestHeader) AcceptsTrailers() bool {
+	return hasHeaderValue(h.Peek(HeaderTE), strTrailers)
+}
+
 // ConnectionUpgrade returns true if 'Connection: Upgrade' header is set.
 func (h *ResponseHeader) ConnectionUpgrade() bool {
 	return hasHeaderValue(h.Peek(HeaderConnection), strUpgrade)
@@ -258,11 +315,16 @@ func (h *RequestHeader) realContentLength() int {
 //
 // Negative content-length sets 'Transfer-Encoding: chunked' header.
 func (h *RequestHeader) SetContentLength(contentLength int) {
-	h.contentLength = contentLength
 	if contentLength >= 0 {
-		h.contentLengthBytes = AppendUint(h.contentLengthBytes[:0], contentLength)
+		// Avoid re-formatting the value already parsed from the header,
+		// e.g. when setting the length of the body read off the wire.
+		if contentLength != h.contentLength || len(h.contentLengthBytes) == 0 {
+			h.contentLengthBytes = AppendUint(h.contentLengthBytes[:0], contentLength)
+		}
+		h.contentLength = contentLength
 		h.h = delAllArgsBytes(h.h, strTransferEncoding)
 	} else {
+		h.contentLength = contentLength
 		h.contentLengthBytes = h.contentLengthBytes[:0]
 		h.h = setArgBytes(h.h, strTransferEncoding, strChunked, argsHasValue)
 	}
@@ -283,6 +345,21 @@ func (h *ResponseHeader) ContentType() []byte {
 	return contentType
 }
 
+// ContentTypeMediaType returns the media type from Content-Type header
+// value without parameters, e.g. 'text/html' for 'text/html; charset=utf-8'.
+func (h *ResponseHeader) ContentTypeMediaType() []byte {
+	return contentTypeMediaType(h.ContentType())
+}
+
+// ContentTypeParam returns the value of the given Content-Type parameter,
+// e.g. 'utf-8' for 'charset' in 'text/html; charset=utf-8'.
+//
+// Parameter names are matched case-insensitively. nil is returned
+// if the parameter is missing.
+func (h *ResponseHeader) ContentTypeParam(name string) []byte {
+	return contentTypeParam(h.ContentType(), name)
+}
+
 // SetContentType sets Content-Type header value.
 func (h *ResponseHeader) SetContentType(contentType string) {
 	h.contentType = append(h.contentType[:0], contentType...)
@@ -313,6 +390,21 @@ func (h *RequestHeader) ContentType() []byte {
 	return h.contentType
 }
 
+// ContentTypeMediaType returns the media type from Content-Type header
+// value without parameters, e.g. 'text/html' for 'text/html; charset=utf-8'.
+func (h *RequestHeader) ContentTypeMediaType() []byte {
+	return contentTypeMediaType(h.ContentType())
+}
+
+// ContentTypeParam returns the value of the given Content-Type parameter,
+// e.g. 'utf-8' for 'charset' in 'text/html; charset=utf-8'.
+//
+// Parameter names are matched case-insensitively. nil is returned
+// if the parameter is missing.
+func (h *RequestHeader) ContentTypeParam(name string) []byte {
+	return contentTypeParam(h.ContentType(), name)
+}
+
 // SetContentType sets Content-Type header value.
 func (h *RequestHeader) SetContentType(contentType string) {
 	h.contentType = append(h.contentType[:0], contentType...)
@@ -401,13 +493,26 @@ func (h *RequestHeader) Host() []byte {
 }
 
 // SetHost sets Host header value.
+//
+// The explicitly set Host header takes precedence over the host
+// from the absolute request uri when the request is sent by the client.
 func (h *RequestHeader) SetHost(host string) {
 	h.host = append(h.host[:0], host...)
+	h.hostFromURI = false
 }
 
 // SetHostBytes sets Host header value.
+//
+// The explicitly set Host header takes precedence over the host
+// from the absolute request uri when the request is sent by the client.
 func (h *RequestHeader) SetHostBytes(host []byte) {
 	h.host = append(h.host[:0], host...)
+	h.hostFromURI = false
+}
+
+func (h *RequestHeader) setHostFromURI(host []byte) {
+	h.host = append(h.host[:0], host...)
+	h.hostFromURI = true
 }
 
 // UserAgent returns User-Agent header value.
@@ -440,6 +545,70 @@ func (h *RequestHeader) SetRefererBytes(referer []byte) {
 	h.SetCanonical(strReferer, referer)
 }
 
+// Authorization returns Authorization header value.
+func (h *RequestHeader) Authorization() []byte {
+	return h.peek(strAuthorization)
+}
+
+// BasicAuth returns username and password from 'Authorization: Basic ...'
+// request header.
+//
+// ok is false if the header is missing, uses another auth scheme
+// or is malformed.
+//
+// The returned username and password are valid until the next
+// RequestHeader call.
+func (h *RequestHeader) BasicAuth() (username, password []byte, ok bool) {
+	auth := h.peek(strAuthorization)
+	if len(auth) <= len(strBasicSpace) || !caseInsensitiveCompare(auth[:len(strBasicSpace)], strBasicSpace) {
+		return nil, nil, false
+	}
+	encoded := auth[len(strBasicSpace):]
+
+	n := base64.StdEncoding.DecodedLen(len(encoded))
+	if n > cap(h.bufKV.value) {
+		h.bufKV.value = make([]byte, 0, n)
+	}
+	buf := h.bufKV.value[:n]
+	n, err := base64.StdEncoding.Decode(buf, encoded)
+	if err != nil {
+		return nil, nil, false
+	}
+	buf = buf[:n]
+
+	i := bytes.IndexByte(buf, ':')
+	if i < 0 {
+		return nil, nil, false
+	}
+	return buf[:i], buf[i+1:], true
+}
+
+// SetBasicAuth sets 'Authorization: Basic ...' request header
+// with the given username and password.
+func (h *RequestHeader) SetBasicAuth(username, password string) {
+	h.setBasicAuthBytes(s2b(username), s2b(password))
+}
+
+func (h *RequestHeader) setBasicAuthBytes(username, password []byte) {
+	// RequestHeader.SetCanonical doesn't use RequestHeader.bufKV,
+	// so we are free to use RequestHeader.bufKV.value as a scratch pad for
+	// the base64 encoding.
+	nl := len(username) + len(password) + 1
+	nb := nl + len(strBasicSpace)
+	tl := nb + base64.StdEncoding.EncodedLen(nl)
+	if tl > cap(h.bufKV.value) {
+		h.bufKV.value = make([]byte, 0, tl)
+	}
+	buf := h.bufKV.value[:0]
+	buf = append(buf, username...)
+	buf = append(buf, strColon...)
+	buf = append(buf, password...)
+	buf = append(buf, strBasicSpace...)
+	buf = buf[:tl]
+	base64.StdEncoding.Encode(buf[nb:tl], buf[:nl])
+	h.SetCanonical(strAuthorization, buf[nl:tl])
+}
+
 // Method returns HTTP request method.
 func (h *RequestHeader) Method() []byte {
 	if len(h.method) == 0 {
@@ -671,6 +840,8 @@ func (h *ResponseHeader) Reset() {
 	h.disableNormalizing = false
 	h.SetNoDefaultContentType(false)
 	h.noDefaultDate = false
+	h.secureErrorLogMessage = false
+	h.maxHeaderSize = 0
 	h.resetSkipNormalize()
 }
 
@@ -687,11 +858,15 @@ func (h *ResponseHeader) resetSkipNormalize() {
 
 	h.h = h.h[:0]
 	h.cookies = h.cookies[:0]
+	h.trailer = h.trailer[:0]
 }
 
 // Reset clears request header.
 func (h *RequestHeader) Reset() {
 	h.disableNormalizing = false
+	h.secureErrorLogMessage = false
+	h.maxHeaderSize = 0
+	h.maxHeaderCount = 0
 	h.resetSkipNormalize()
 }
 
@@ -706,12 +881,14 @@ func (h *RequestHeader) resetSkipNormalize() {
 	h.proto = h.proto[:0]
 	h.requestURI = h.requestURI[:0]
 	h.host = h.host[:0]
+	h.hostFromURI = false
 	h.contentType = h.contentType[:0]
 	h.userAgent = h.userAgent[:0]
 
 	h.h = h.h[:0]
 	h.cookies = h.cookies[:0]
 	h.cookiesCollected = false
+	h.trailer = h.trailer[:0]
 
 	h.rawHeaders = h.rawHeaders[:0]
 }
@@ -733,6 +910,7 @@ func (h *ResponseHeader) CopyTo(dst *ResponseHeader) {
 	dst.server = append(dst.server[:0], h.server...)
 	dst.h = copyArgs(dst.h, h.h)
 	dst.cookies = copyArgs(dst.cookies, h.cookies)
+	dst.trailer = copyArgs(dst.trailer, h.trailer)
 }
 
 // CopyTo copies all the headers to dst.
@@ -749,11 +927,13 @@ func (h *RequestHeader) CopyTo(dst *RequestHeader) {
 	dst.proto = append(dst.proto[:0], h.proto...)
 	dst.requestURI = append(dst.requestURI[:0], h.requestURI...)
 	dst.host = append(dst.host[:0], h.host...)
+	dst.hostFromURI = h.hostFromURI
 	dst.contentType = append(dst.contentType[:0], h.contentType...)
 	dst.userAgent = append(dst.userAgent[:0], h.userAgent...)
 	dst.h = copyArgs(dst.h, h.h)
 	dst.cookies = copyArgs(dst.cookies, h.cookies)
 	dst.cookiesCollected = h.cookiesCollected
+	dst.trailer = copyArgs(dst.trailer, h.trailer)
 	dst.rawHeaders = append(dst.rawHeaders[:0], h.rawHeaders...)
 }
 
@@ -784,6 +964,72 @@ func (h *ResponseHeader) VisitAll(f func(key, value []byte)) {
 	}
 }
 
+// VisitAllWritten calls f for each header line in the order
+// it is written by Write, AppendBytes and WriteTo.
+//
+// Unlike VisitAll it includes the Date header added on write
+// and the Trailer header announcing trailers, and it skips
+// Content-Type for empty responses without explicit Content-Type.
+//
+// f must not retain references to key and/or value after returning.
+func (h *ResponseHeader) VisitAllWritten(f func(key, value []byte)) {
+	h.visitAllWritten(f)
+}
+
+// visitAllWritten calls f for each header line written by AppendBytes.
+// It is shared by VisitAllWritten and AppendBytes, so they never diverge.
+func (h *ResponseHeader) visitAllWritten(f func(key, value []byte)) {
+	server := h.Server()
+	if len(server) != 0 {
+		f(strServer, server)
+	}
+
+	if !h.noDefaultDate {
+		f(strDate, h.date())
+	}
+
+	// Append Content-Type only for non-zero responses
+	// or if it is explicitly set.
+	// See https://github.com/valyala/fasthttp/issues/28 .
+	if h.ContentLength() != 0 || len(h.contentType) > 0 {
+		contentType := h.ContentType()
+		if len(contentType) > 0 {
+			f(strContentType, contentType)
+		}
+	}
+
+	if len(h.contentLengthBytes) > 0 {
+		f(strContentLength, h.contentLengthBytes)
+	}
+
+	for i, n := 0, len(h.h); i < n; i++ {
+		kv := &h.h[i]
+		if h.noDefaultDate || !bytes.Equal(kv.key, strDate) {
+			f(kv.key, kv.value)
+		}
+	}
+
+	for i, n := 0, len(h.cookies); i < n; i++ {
+		f(strSetCookie, h.cookies[i].value)
+	}
+
+	if h.ConnectionClose() {
+		f(strConnection, strClose)
+	}
+
+	if len(h.trailer) > 0 && h.ContentLength() == -1 {
+		trailer := h.bufKV.value[:0]
+		for i := range h.trailer {
+			if i > 0 {
+				trailer = append(trailer, ',', ' ')
+			}
+			trailer = append(trailer, h.trailer[i].key...)
+		}
+		h.bufKV.value = trailer
+		f(strTrailer, trailer)
+	}
+}
+
 // VisitAllCookie calls f for each response cookie.
 //
 // Cookie name is passed in key and the whole Set-Cookie header value
@@ -795,6 +1041,13 @@ func (h *ResponseHeader) VisitAllCookie(f func(key, value []byte)) {
 	visitArgs(h.cookies, f)
 }
 
+// VisitAllTrailer calls f for each response trailer.
+//
+// f must not retain references to key and/or value after returning.
+func (h *ResponseHeader) VisitAllTrailer(f func(key, value []byte)) {
+	visitArgs(h.trailer, f)
+}
+
 // VisitAllCookie calls f for each request cookie.
 //
 // f must not retain references to key and/or value after returning.
@@ -803,6 +1056,16 @@ func (h *RequestHeader) VisitAllCookie(f func(key, value []byte)) {
 	visitArgs(h.cookies, f)
 }
 
+// VisitAllTrailer calls f for each request trailer.
+//
+// Trailers are read after the last chunk of chunked request body,
+// so they are available only after the body has been read.
+//
+// f must not retain references to key and/or value after returning.
+func (h *RequestHeader) VisitAllTrailer(f func(key, value []byte)) {
+	visitArgs(h.trailer, f)
+}
+
 // VisitAll calls f for each header.
 //
 // f must not retain references to key and/or value after returning.
@@ -929,13 +1192,13 @@ func (h *ResponseHeader) setSpecialHeader(key, value []byte) bool {
 			h.SetContentTypeBytes(value)
 			return true
 		} else if caseInsensitiveCompare(strContentLength, key) {
-			if contentLength, err := parseContentLength(value); err == nil {
+			if contentLength, v, err := parseContentLength(value); err == nil {
 				h.contentLength = contentLength
-				h.contentLengthBytes = append(h.contentLengthBytes[:0], value...)
+				h.contentLengthBytes = append(h.contentLengthBytes[:0], v...)
 			}
 			return true
 		} else if caseInsensitiveCompare(strConnection, key) {
-			if bytes.Equal(strClose, value) {
+			if hasHeaderValue(value, strClose) {
 				h.SetConnectionClose()
 			} else {
 				h.ResetConnectionClose()
@@ -961,7 +1224,8 @@ func (h *ResponseHeader) setSpecialHeader(key, value []byte) bool {
 		}
 	case 'd':
 		if caseInsensitiveCompare(strDate, key) {
-			// Date is managed automatically.
+			// An explicitly set Date overrides the automatic one.
+			h.h = setArgBytes(h.h, strDate, value, argsHasValue)
 			return true
 		}
 	}
@@ -981,13 +1245,13 @@ func (h *RequestHeader) setSpecialHeader(key, value []byte) bool {
 			h.SetContentTypeBytes(value)
 			return true
 		} else if caseInsensitiveCompare(strContentLength, key) {
-			if contentLength, err := parseContentLength(value); err == nil {
+			if contentLength, v, err := parseContentLength(value); err == nil {
 				h.contentLength = contentLength
-				h.contentLengthBytes = append(h.contentLengthBytes[:0], value...)
+				h.contentLengthBytes = append(h.contentLengthBytes[:0], v...)
 			}
 			return true
 		} else if caseInsensitiveCompare(strConnection, key) {
-			if bytes.Equal(strClose, value) {
+			if hasHeaderValue(value, strClose) {
 				h.SetConnectionClose()
 			} else {
 				h.ResetConnectionClose()
@@ -1210,6 +1474,53 @@ func (h *ResponseHeader) DelAllCookies() {
 	h.cookies = h.cookies[:0]
 }
 
+// SetTrailer sets the given 'key: value' trailer, which is sent
+// after the response body.
+//
+// Trailers are sent only for chunked responses, i.e. for responses
+// with body stream of unknown size, and only to clients advertising
+// 'TE: trailers' request header. Trailer names are announced
+// in 'Trailer' response header, so all the trailers must be set before
+// the response body is written. Trailer values may be updated
+// while the body stream is being read.
+func (h *ResponseHeader) SetTrailer(key, value string) {
+	initHeaderKV(&h.bufKV, key, value, h.disableNormalizing)
+	h.trailer = setArgBytes(h.trailer, h.bufKV.key, h.bufKV.value, argsHasValue)
+}
+
+// SetTrailerBytesKV sets the given 'key: value' trailer.
+//
+// See SetTrailer for details.
+func (h *ResponseHeader) SetTrailerBytesKV(key, value []byte) {
+	h.SetTrailer(b2s(key), b2s(value))
+}
+
+// PeekTrailer returns trailer value for the given key.
+//
+// Returned value is valid until the next call to ResponseHeader.
+// Do not store references to returned value. Make copies instead.
+func (h *ResponseHeader) PeekTrailer(key string) []byte {
+	k := getHeaderKeyBytes(&h.bufKV, key, h.disableNormalizing)
+	return peekArgBytes(h.trailer, k)
+}
+
+// PeekTrailer returns request trailer value for the given key.
+//
+// Trailers are read after the last chunk of chunked request body,
+// so they are available only after the body has been read.
+//
+// Returned value is valid until the next call to RequestHeader.
+// Do not store references to returned value. Make copies instead.
+func (h *RequestHeader) PeekTrailer(key string) []byte {
+	k := getHeaderKeyBytes(&h.bufKV, key, h.disableNormalizing)
+	return peekArgBytes(h.trailer, k)
+}
+
+// DelAllTrailers removes all the trailers from response header.
+func (h *ResponseHeader) DelAllTrailers() {
+	h.trailer = h.trailer[:0]
+}
+
 // DelAllCookies removes all the cookies from request headers.
 func (h *RequestHeader) DelAllCookies() {
 	h.collectCookies()
@@ -1338,6 +1649,29 @@ func (h *RequestHeader) PeekBytes(key []byte) []byte {
 	return h.peek(h.bufKV.key)
 }
 
+// Has returns true if the header with the given key exists.
+//
+// Unlike Peek it allows distinguishing missing header from the header
+// with empty value. Special headers such as Content-Type or Server
+// are reported only if they have non-empty value.
+func (h *ResponseHeader) Has(key string) bool {
+	k := getHeaderKeyBytes(&h.bufKV, key, h.disableNormalizing)
+	switch string(k) {
+	case HeaderContentType:
+		return len(h.ContentType()) > 0
+	case HeaderServer:
+		return len(h.server) > 0
+	case HeaderConnection:
+		return h.ConnectionClose() || hasArg(h.h, b2s(k))
+	case HeaderContentLength:
+		return len(h.contentLengthBytes) > 0
+	case HeaderSetCookie:
+		return len(h.cookies) > 0
+	default:
+		return hasArg(h.h, b2s(k))
+	}
+}
+
 func (h *ResponseHeader) peek(key []byte) []byte {
 	switch string(key) {
 	case HeaderContentType:
@@ -1358,6 +1692,34 @@ func (h *ResponseHeader) peek(key []byte) []byte {
 	}
 }
 
+// Has returns true if the header with the given key exists.
+//
+// Unlike Peek it allows distinguishing missing header from the header
+// with empty value. Special headers such as Host or Content-Type
+// are reported only if they have non-empty value.
+func (h *RequestHeader) Has(key string) bool {
+	k := getHeaderKeyBytes(&h.bufKV, key, h.disableNormalizing)
+	switch string(k) {
+	case HeaderHost:
+		return len(h.host) > 0
+	case HeaderContentType:
+		return len(h.contentType) > 0
+	case HeaderUserAgent:
+		return len(h.userAgent) > 0
+	case HeaderConnection:
+		return h.ConnectionClose() || hasArg(h.h, b2s(k))
+	case HeaderContentLength:
+		return len(h.contentLengthBytes) > 0
+	case HeaderCookie:
+		if h.cookiesCollected {
+			return len(h.cookies) > 0
+		}
+		return hasArg(h.h, b2s(k))
+	default:
+		return hasArg(h.h, b2s(k))
+	}
+}
+
 func (h *RequestHeader) peek(key []byte) []byte {
 	switch string(key) {
 	case HeaderHost:
@@ -1422,6 +1784,10 @@ func (h *ResponseHeader) Read(r *bufio.Reader) error {
 			return err
 		}
 		n = r.Buffered() + 1
+		if h.maxHeaderSize > 0 && n > h.maxHeaderSize {
+			h.resetSkipNormalize()
+			return ErrHeaderTooLarge
+		}
 	}
 }
 
@@ -1457,6 +1823,9 @@ func (h *ResponseHeader) tryRead(r *bufio.Reader, n int) error {
 	if errParse != nil {
 		return headerError("response", err, errParse, b, h.secureErrorLogMessage)
 	}
+	if h.maxHeaderSize > 0 && headersLen > h.maxHeaderSize {
+		return ErrHeaderTooLarge
+	}
 	mustDiscard(r, headersLen)
 	return nil
 }
@@ -1494,17 +1863,28 @@ func headerErrorMsg(typ string, err error, b []byte, secureErrorLogMessage bool)
 //
 // io.EOF is returned if r is closed before reading the first header byte.
 func (h *RequestHeader) Read(r *bufio.Reader) error {
+	return h.readLoop(r, true)
+}
+
+// readLoop reads request header from r. It doesn't wait for more data
+// and returns errNeedMore if waitForMore is false and the buffered data
+// doesn't contain the whole header.
+func (h *RequestHeader) readLoop(r *bufio.Reader, waitForMore bool) error {
 	n := 1
 	for {
 		err := h.tryRead(r, n)
 		if err == nil {
 			return nil
 		}
-		if err != errNeedMore {
+		if !waitForMore || err != errNeedMore {
 			h.resetSkipNormalize()
 			return err
 		}
 		n = r.Buffered() + 1
+		if h.maxHeaderSize > 0 && n > h.maxHeaderSize {
+			h.resetSkipNormalize()
+			return ErrHeaderTooLarge
+		}
 	}
 }
 
@@ -1538,8 +1918,14 @@ func (h *RequestHeader) tryRead(r *bufio.Reader, n int) error {
 	b = mustPeekBuffered(r)
 	headersLen, errParse := h.parse(b)
 	if errParse != nil {
+		if errParse == ErrHTTP2Preface || errParse == ErrTooManyHeaders {
+			return errParse
+		}
 		return headerError("request", err, errParse, b, h.secureErrorLogMessage)
 	}
+	if h.maxHeaderSize > 0 && headersLen > h.maxHeaderSize {
+		return ErrHeaderTooLarge
+	}
 	mustDiscard(r, headersLen)
 	return nil
 }
@@ -1624,50 +2010,31 @@ func (h *ResponseHeader) AppendBytes(dst []byte) []byte {
 	}
 	dst = append(dst, statusLine(statusCode)...)
 
-	server := h.Server()
-	if len(server) != 0 {
-		dst = appendHeaderLine(dst, strServer, server)
-	}
-
-	if !h.noDefaultDate {
-		serverDateOnce.Do(updateServerDate)
-		dst = appendHeaderLine(dst, strDate, serverDate.Load().([]byte))
-	}
-
-	// Append Content-Type only for non-zero responses
-	// or if it is explicitly set.
-	// See https://github.com/valyala/fasthttp/issues/28 .
-	if h.ContentLength() != 0 || len(h.contentType) > 0 {
-		contentType := h.ContentType()
-		if len(contentType) > 0 {
-			dst = appendHeaderLine(dst, strContentType, contentType)
-		}
-	}
-
-	if len(h.contentLengthBytes) > 0 {
-		dst = appendHeaderLine(dst, strContentLength, h.contentLengthBytes)
-	}
+	h.visitAllWritten(func(key, value []byte) {
+		dst = appendHeaderLine(dst, key, value)
+	})
 
-	for i, n := 0, len(h.h); i < n; i++ {
-		kv := &h.h[i]
-		if h.noDefaultDate || !bytes.Equal(kv.key, strDate) {
-			dst = appendHeaderLine(dst, kv.key, kv.value)
-		}
-	}
+	return append(dst, strCRLF...)
+}
 
-	n := len(h.cookies)
-	if n > 0 {
-		for i := 0; i < n; i++ {
-			kv := &h.cookies[i]
-			dst = appendHeaderLine(dst, strSetCookie, kv.value)
-		}
+// date returns the explicitly set Date header value
+// or the current server date if Date isn't set.
+func (h *ResponseHeader) date() []byte {
+	if date := peekArgBytes(h.h, strDate); date != nil {
+		return date
 	}
+	serverDateOnce.Do(updateServerDate)
+	return serverDate.Load().([]byte)
+}
 
-	if h.ConnectionClose() {
-		dst = appendHeaderLine(dst, strConnection, strClose)
+// appendTrailer appends trailer lines, which follow the last chunk
+// of chunked response body, to dst and returns the extended dst.
+func (h *ResponseHeader) appendTrailer(dst []byte) []byte {
+	for i := range h.trailer {
+		kv := &h.trailer[i]
+		dst = appendHeaderLine(dst, kv.key, kv.value)
 	}
-
-	return append(dst, strCRLF...)
+	return dst
 }
 
 // Write writes request header to w.
@@ -1826,7 +2193,15 @@ func (h *ResponseHeader) parseFirstLine(buf []byte) (int, error) {
 	h.noHTTP11 = !bytes.Equal(b[:n], strHTTP11)
 	b = b[n+1:]
 
-	// parse status code
+	// Some servers put extra spaces between the protocol
+	// and the status code.
+	for len(b) > 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+
+	// parse status code.
+	// The reason phrase after the status code is optional
+	// and may be separated by multiple spaces.
 	h.statusCode, n, err = parseUintBuf(b)
 	if err != nil {
 		if h.secureErrorLogMessage {
@@ -1885,9 +2260,19 @@ func (h *RequestHeader) parseFirstLine(buf []byte) (int, error) {
 	h.proto = append(h.proto[:0], protoStr...)
 	h.requestURI = append(h.requestURI[:0], b[:n]...)
 
+	if isHTTP2Preface(h.method, h.requestURI, h.proto) {
+		return 0, ErrHTTP2Preface
+	}
+
 	return len(buf) - len(bNext), nil
 }
 
+// isHTTP2Preface returns true if the request line is the start
+// of HTTP/2 connection preface 'PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n'.
+func isHTTP2Preface(method, requestURI, proto []byte) bool {
+	return string(method) == "PRI" && string(requestURI) == "*" && string(proto) == "HTTP/2.0"
+}
+
 func readRawHeaders(dst, buf []byte) ([]byte, int, error) {
 	n := bytes.IndexByte(buf, nChar)
 	if n < 0 {
@@ -1935,16 +2320,17 @@ func (h *ResponseHeader) parseHeaders(buf []byte) (int, error) {
 				}
 				if caseInsensitiveCompare(s.key, strContentLength) {
 					if h.contentLength != -1 {
-						if h.contentLength, err = parseContentLength(s.value); err != nil {
+						var v []byte
+						if h.contentLength, v, err = parseContentLength(s.value); err != nil {
 							h.contentLength = -2
 						} else {
-							h.contentLengthBytes = append(h.contentLengthBytes[:0], s.value...)
+							h.contentLengthBytes = append(h.contentLengthBytes[:0], v...)
 						}
 					}
 					continue
 				}
 				if caseInsensitiveCompare(s.key, strConnection) {
-					if bytes.Equal(s.value, strClose) {
+					if hasHeaderValue(s.value, strClose) {
 						h.connectionClose = true
 					} else {
 						h.connectionClose = false
@@ -1965,7 +2351,7 @@ func (h *ResponseHeader) parseHeaders(buf []byte) (int, error) {
 				}
 			case 't':
 				if caseInsensitiveCompare(s.key, strTransferEncoding) {
-					if len(s.value) > 0 && !bytes.Equal(s.value, strIdentity) {
+					if len(s.value) > 0 && !equalHeaderValue(s.value, strIdentity) {
 						h.contentLength = -1
 						h.h = setArgBytes(h.h, strTransferEncoding, strChunked, argsHasValue)
 					}
@@ -2003,7 +2389,15 @@ func (h *RequestHeader) parseHeaders(buf []byte) (int, error) {
 	s.b = buf
 	s.disableNormalizing = h.disableNormalizing
 	var err error
+	headersCount := 0
 	for s.next() {
+		// Check the limit before the whole header is received,
+		// so the partially received header isn't re-parsed over and over.
+		headersCount++
+		if h.maxHeaderCount > 0 && headersCount > h.maxHeaderCount {
+			h.connectionClose = true
+			return 0, ErrTooManyHeaders
+		}
 		if len(s.key) > 0 {
 			// Spaces between the header key and colon are not allowed.
 			// See RFC 7230, Section 3.2.4.
@@ -2030,20 +2424,23 @@ func (h *RequestHeader) parseHeaders(buf []byte) (int, error) {
 				}
 				if caseInsensitiveCompare(s.key, strContentLength) {
 					if h.contentLength != -1 {
-						var nerr error
-						if h.contentLength, nerr = parseContentLength(s.value); nerr != nil {
+						var (
+							v    []byte
+							nerr error
+						)
+						if h.contentLength, v, nerr = parseContentLength(s.value); nerr != nil {
 							if err == nil {
 								err = nerr
 							}
 							h.contentLength = -2
 						} else {
-							h.contentLengthBytes = append(h.contentLengthBytes[:0], s.value...)
+							h.contentLengthBytes = append(h.contentLengthBytes[:0], v...)
 						}
 					}
 					continue
 				}
 				if caseInsensitiveCompare(s.key, strConnection) {
-					if bytes.Equal(s.value, strClose) {
+					if hasHeaderValue(s.value, strClose) {
 						h.connectionClose = true
 					} else {
 						h.connectionClose = false
@@ -2053,7 +2450,7 @@ func (h *RequestHeader) parseHeaders(buf []byte) (int, error) {
 				}
 			case 't':
 				if caseInsensitiveCompare(s.key, strTransferEncoding) {
-					if !bytes.Equal(s.value, strIdentity) {
+					if !equalHeaderValue(s.value, strIdentity) {
 						h.contentLength = -1
 						h.h = setArgBytes(h.h, strTransferEncoding, strChunked, argsHasValue)
 					}
@@ -2102,15 +2499,20 @@ func (h *RequestHeader) collectCookies() {
 	h.cookiesCollected = true
 }
 
-func parseContentLength(b []byte) (int, error) {
+// parseContentLength parses Content-Length header value b ignoring
+// surrounding whitespace, which is sent by some clients.
+//
+// It returns the parsed value and b without the whitespace.
+func parseContentLength(b []byte) (int, []byte, error) {
+	b = stripSpace(b)
 	v, n, err := parseUintBuf(b)
 	if err != nil {
-		return -1, err
+		return -1, b, err
 	}
 	if n != len(b) {
-		return -1, fmt.Errorf("non-numeric chars at the end of Content-Length")
+		return -1, b, fmt.Errorf("non-numeric chars at the end of Content-Length")
 	}
-	return v, nil
+	return v, b, nil
 }
 
 type headerScanner struct {
@@ -2265,16 +2667,24 @@ func (s *headerValueScanner) next() bool {
 	return true
 }
 
+// stripSpace strips optional whitespace, i.e. spaces and tabs,
+// surrounding b. See RFC 7230, Section 3.2.3.
 func stripSpace(b []byte) []byte {
-	for len(b) > 0 && b[0] == ' ' {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
 		b = b[1:]
 	}
-	for len(b) > 0 && b[len(b)-1] == ' ' {
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
 		b = b[:len(b)-1]
 	}
 	return b
 }
 
+// equalHeaderValue returns true if the header value s equals to value
+// ignoring case and surrounding whitespace.
+func equalHeaderValue(s, value []byte) bool {
+	return caseInsensitiveCompare(stripSpace(s), value)
+}
+
 func hasHeaderValue(s, value []byte) bool {
 	var vs headerValueScanner
 	vs.b = s
@@ -2448,6 +2858,20 @@ var (
 	errSmallBuffer = errors.New("small read buffer. Increase ReadBufferSize")
 )
 
+// ErrHTTP2Preface is returned when the client sends HTTP/2 connection preface
+// ('PRI * HTTP/2.0') instead of HTTP/1.x request, i.e. it attempts HTTP/2
+// with prior knowledge, which isn't supported.
+var ErrHTTP2Preface = errors.New("HTTP/2 connection preface received. HTTP/2 with prior knowledge isn't supported")
+
+// ErrHeaderTooLarge is returned when request or response headers exceed
+// the configured maximum size, e.g. Server.MaxRequestHeaderSize
+// or HostClient.MaxResponseHeaderSize.
+var ErrHeaderTooLarge = errors.New("headers exceed the maximum size")
+
+// ErrTooManyHeaders is returned when the number of request header lines
+// exceeds Server.MaxRequestHeaderCount.
+var ErrTooManyHeaders = errors.New("too many headers")
+
 // ErrNothingRead is returned when a keep-alive connection is closed,
 // either because the remote closed it or because of a read timeout.
 type ErrNothingRead struct {
@@ -2476,3 +2900,65 @@ func mustDiscard(r *bufio.Reader, n int) {
 		panic(fmt.Sprintf("bufio.Reader.Discard(%d) failed: %s", n, err))
 	}
 }
+
+// hasMediaType returns true if the media type of the given Content-Type
+// value equals mediaType, ignoring case and parameters,
+// e.g. 'Application/JSON; charset=utf-8' has 'application/json' media type.
+func hasMediaType(contentType, mediaType []byte) bool {
+	return caseInsensitiveCompare(contentTypeMediaType(contentType), mediaType)
+}
+
+func contentTypeMediaType(b []byte) []byte {
+	if n := bytes.IndexByte(b, ';'); n >= 0 {
+		b = b[:n]
+	}
+	return bytes.TrimSpace(b)
+}
+
+func contentTypeParam(b []byte, name string) []byte {
+	n := bytes.IndexByte(b, ';')
+	if n < 0 {
+		return nil
+	}
+	b = b[n+1:]
+	for len(b) > 0 {
+		// Find the end of the parameter. Quoted-string values
+		// such as boundary="a;b" may contain semicolons.
+		n = 0
+		quoted := false
+		for n < len(b) {
+			c := b[n]
+			if quoted {
+				if c == '\\' {
+					n++
+				} else if c == '"' {
+					quoted = false
+				}
+			} else if c == '"' {
+				quoted = true
+			} else if c == ';' {
+				break
+			}
+			n++
+		}
+		if n > len(b) {
+			n = len(b)
+		}
+		kv := b[:n]
+		if n < len(b) {
+			n++
+		}
+		b = b[n:]
+
+		eq := bytes.IndexByte(kv, '=')
+		if eq < 0 || !caseInsensitiveCompare(bytes.TrimSpace(kv[:eq]), s2b(name)) {
+			continue
+		}
+		v := bytes.TrimSpace(kv[eq+1:])
+		if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		return v
+	}
+	return nil
+}
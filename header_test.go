@@ -9,8 +9,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestResponseHeaderAddContentType(t *testing.T) {
@@ -311,6 +313,56 @@ func TestRequestHeaderSetCookieWithSpecialChars(t *testing.T) {
 	}
 }
 
+func TestResponseHeaderStatusClass(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		statusCode    int
+		isSuccess     bool
+		isRedirect    bool
+		isClientError bool
+		isServerError bool
+	}{
+		{0, true, false, false, false}, // the default status code is 200
+		{StatusContinue, false, false, false, false},
+		{StatusOK, true, false, false, false},
+		{StatusNoContent, true, false, false, false},
+		{299, true, false, false, false},
+		{StatusMultipleChoices, false, true, false, false},
+		{StatusNotModified, false, true, false, false},
+		{StatusPermanentRedirect, false, true, false, false},
+		{StatusBadRequest, false, false, true, false},
+		{StatusNotFound, false, false, true, false},
+		{499, false, false, true, false},
+		{StatusInternalServerError, false, false, false, true},
+		{StatusServiceUnavailable, false, false, false, true},
+		{599, false, false, false, true},
+		{600, false, false, false, false},
+	} {
+		var h ResponseHeader
+		h.SetStatusCode(tc.statusCode)
+		if h.IsSuccess() != tc.isSuccess {
+			t.Fatalf("unexpected IsSuccess() for %d: %v. Expecting %v", tc.statusCode, h.IsSuccess(), tc.isSuccess)
+		}
+		if h.IsRedirect() != tc.isRedirect {
+			t.Fatalf("unexpected IsRedirect() for %d: %v. Expecting %v", tc.statusCode, h.IsRedirect(), tc.isRedirect)
+		}
+		if h.IsClientError() != tc.isClientError {
+			t.Fatalf("unexpected IsClientError() for %d: %v. Expecting %v", tc.statusCode, h.IsClientError(), tc.isClientError)
+		}
+		if h.IsServerError() != tc.isServerError {
+			t.Fatalf("unexpected IsServerError() for %d: %v. Expecting %v", tc.statusCode, h.IsServerError(), tc.isServerError)
+		}
+
+		var ctx RequestCtx
+		ctx.SetStatusCode(tc.statusCode)
+		if ctx.IsSuccess() != tc.isSuccess || ctx.IsRedirect() != tc.isRedirect ||
+			ctx.IsClientError() != tc.isClientError || ctx.IsServerError() != tc.isServerError {
+			t.Fatalf("unexpected RequestCtx status class for %d", tc.statusCode)
+		}
+	}
+}
+
 func TestResponseHeaderDefaultStatusCode(t *testing.T) {
 	t.Parallel()
 
@@ -629,6 +681,313 @@ func TestRequestHeaderHTTP10ConnectionClose(t *testing.T) {
 	}
 }
 
+func TestHeaderPaddedContentLength(t *testing.T) {
+	t.Parallel()
+
+	testRequestHeaderPaddedContentLength(t, "Content-Length: 5\r\n", 5)
+	testRequestHeaderPaddedContentLength(t, "Content-Length:  5 \r\n", 5)
+	testRequestHeaderPaddedContentLength(t, "Content-Length:\t5\t\r\n", 5)
+	testRequestHeaderPaddedContentLength(t, "Content-Length: \t 123 \t \r\n", 123)
+
+	var h ResponseHeader
+	s := "HTTP/1.1 200 OK\r\nContent-Length: \t 5 \r\n\r\n"
+	if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.ContentLength() != 5 {
+		t.Fatalf("unexpected content length %d. Expecting 5", h.ContentLength())
+	}
+	if v := string(h.Peek(HeaderContentLength)); v != "5" {
+		t.Fatalf("unexpected content length value %q. Expecting %q", v, "5")
+	}
+
+	h.Set(HeaderContentLength, " 7\t")
+	if h.ContentLength() != 7 {
+		t.Fatalf("unexpected content length %d. Expecting 7", h.ContentLength())
+	}
+	if v := string(h.Peek(HeaderContentLength)); v != "7" {
+		t.Fatalf("unexpected content length value %q. Expecting %q", v, "7")
+	}
+}
+
+func testRequestHeaderPaddedContentLength(t *testing.T, contentLength string, expected int) {
+	var h RequestHeader
+	s := "POST / HTTP/1.1\r\nHost: aaa.com\r\n" + contentLength + "\r\n"
+	if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.ContentLength() != expected {
+		t.Fatalf("unexpected content length %d for %q. Expecting %d", h.ContentLength(), contentLength, expected)
+	}
+	expectedS := strconv.Itoa(expected)
+	if v := string(h.Peek(HeaderContentLength)); v != expectedS {
+		t.Fatalf("unexpected content length value %q for %q. Expecting %q", v, contentLength, expectedS)
+	}
+
+	h.SetContentLength(expected)
+	if v := string(h.Peek(HeaderContentLength)); v != expectedS {
+		t.Fatalf("unexpected content length value %q. Expecting %q", v, expectedS)
+	}
+}
+
+func TestHeaderMixedCaseConnectionAndTransferEncoding(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []string{"close", "Close", "CLOSE", " close ", "Close\t"} {
+		var h RequestHeader
+		s := "GET / HTTP/1.1\r\nHost: aaa.com\r\nConnection: " + v + "\r\n\r\n"
+		if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !h.ConnectionClose() {
+			t.Fatalf("expecting connection close for %q", v)
+		}
+
+		var rh ResponseHeader
+		s = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: " + v + "\r\n\r\n"
+		if err := rh.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !rh.ConnectionClose() {
+			t.Fatalf("expecting connection close for %q", v)
+		}
+
+		rh.Reset()
+		rh.Set(HeaderConnection, v)
+		if !rh.ConnectionClose() {
+			t.Fatalf("expecting connection close for %q", v)
+		}
+	}
+
+	for _, v := range []string{"identity", "Identity", " IDENTITY "} {
+		var h RequestHeader
+		s := "POST / HTTP/1.1\r\nHost: aaa.com\r\nContent-Length: 3\r\nTransfer-Encoding: " + v + "\r\n\r\n"
+		if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if h.ContentLength() != 3 {
+			t.Fatalf("unexpected content length %d for %q. Expecting 3", h.ContentLength(), v)
+		}
+	}
+
+	for _, v := range []string{"chunked", "Chunked", " CHUNKED "} {
+		var h RequestHeader
+		s := "POST / HTTP/1.1\r\nHost: aaa.com\r\nContent-Length:  3 \r\nTransfer-Encoding: " + v + "\r\n\r\n"
+		if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if h.ContentLength() != -1 {
+			t.Fatalf("unexpected content length %d for %q. Expecting -1", h.ContentLength(), v)
+		}
+	}
+}
+
+func TestRequestHeaderHTTP2Preface(t *testing.T) {
+	t.Parallel()
+
+	var h RequestHeader
+	err := h.Read(bufio.NewReader(strings.NewReader("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")))
+	if err != ErrHTTP2Preface {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrHTTP2Preface)
+	}
+
+	// PRI method with HTTP/1.1 is a regular request.
+	if err := h.Read(bufio.NewReader(strings.NewReader("PRI * HTTP/1.1\r\nHost: aaa.com\r\n\r\n"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestRequestHeaderMethodPredicates(t *testing.T) {
+	t.Parallel()
+
+	methods := []string{
+		MethodGet, MethodHead, MethodPost, MethodPut, MethodDelete,
+		MethodConnect, MethodOptions, MethodTrace, MethodPatch,
+	}
+	for _, method := range methods {
+		var h RequestHeader
+		s := method + " / HTTP/1.1\r\nHost: aaa.com\r\n\r\n"
+		if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error for %s: %s", method, err)
+		}
+		predicates := map[string]bool{
+			MethodGet:     h.IsGet(),
+			MethodHead:    h.IsHead(),
+			MethodPost:    h.IsPost(),
+			MethodPut:     h.IsPut(),
+			MethodDelete:  h.IsDelete(),
+			MethodConnect: h.IsConnect(),
+			MethodOptions: h.IsOptions(),
+			MethodTrace:   h.IsTrace(),
+			MethodPatch:   h.IsPatch(),
+		}
+		for m, v := range predicates {
+			if v != (m == method) {
+				t.Fatalf("unexpected Is%s()=%v for %s request", m, v, method)
+			}
+		}
+
+		var ctx RequestCtx
+		h.CopyTo(&ctx.Request.Header)
+		ctxPredicates := map[string]bool{
+			MethodGet:     ctx.IsGet(),
+			MethodHead:    ctx.IsHead(),
+			MethodPost:    ctx.IsPost(),
+			MethodPut:     ctx.IsPut(),
+			MethodDelete:  ctx.IsDelete(),
+			MethodConnect: ctx.IsConnect(),
+			MethodOptions: ctx.IsOptions(),
+			MethodTrace:   ctx.IsTrace(),
+			MethodPatch:   ctx.IsPatch(),
+		}
+		for m, v := range ctxPredicates {
+			if v != (m == method) {
+				t.Fatalf("unexpected RequestCtx.Is%s()=%v for %s request", m, v, method)
+			}
+		}
+	}
+}
+
+func TestHeaderHas(t *testing.T) {
+	t.Parallel()
+
+	var h RequestHeader
+	s := "GET / HTTP/1.1\r\nHost: aaa.com\r\nAuthorization:\r\nX-Foo: bar\r\n\r\n"
+	if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for key, expected := range map[string]bool{
+		"Authorization": true,
+		"authorization": true,
+		"X-Foo":         true,
+		"Host":          true,
+		"X-Missing":     false,
+		"Content-Type":  false,
+		"User-Agent":    false,
+		"Cookie":        false,
+	} {
+		if h.Has(key) != expected {
+			t.Fatalf("unexpected RequestHeader.Has(%q)=%v. Expecting %v", key, !expected, expected)
+		}
+	}
+	if v := h.Peek("Authorization"); len(v) != 0 {
+		t.Fatalf("unexpected Authorization value %q", v)
+	}
+
+	var rh ResponseHeader
+	rh.Set("X-Empty", "")
+	rh.Set("X-Foo", "bar")
+	for key, expected := range map[string]bool{
+		"X-Empty":        true,
+		"X-Foo":          true,
+		"X-Missing":      false,
+		"Content-Length": false,
+		"Set-Cookie":     false,
+		"Connection":     false,
+	} {
+		if rh.Has(key) != expected {
+			t.Fatalf("unexpected ResponseHeader.Has(%q)=%v. Expecting %v", key, !expected, expected)
+		}
+	}
+	rh.SetConnectionClose()
+	rh.SetContentLength(10)
+	if !rh.Has("Connection") || !rh.Has("Content-Length") {
+		t.Fatal("expecting Connection and Content-Length headers")
+	}
+}
+
+func TestRequestHeaderConnectionValues(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		proto           string
+		value           string
+		connectionClose bool
+	}{
+		{"HTTP/1.1", "keep-alive", false},
+		{"HTTP/1.1", "Keep-Alive", false},
+		{"HTTP/1.1", "close", true},
+		{"HTTP/1.1", "Upgrade", false},
+		{"HTTP/1.1", "Upgrade, close", true},
+		{"HTTP/1.1", "keep-alive,\tClose", true},
+		{"HTTP/1.1", "closed", false},
+		{"HTTP/1.0", "keep-alive", false},
+		{"HTTP/1.0", "foo, Keep-Alive", false},
+		{"HTTP/1.0", "Upgrade", true},
+	} {
+		var h RequestHeader
+		s := "GET / " + tc.proto + "\r\nHost: aaa.com\r\nConnection: " + tc.value + "\r\n\r\n"
+		if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if h.ConnectionClose() != tc.connectionClose {
+			t.Fatalf("unexpected ConnectionClose() for %q. Expecting %v", s, tc.connectionClose)
+		}
+
+		var rh ResponseHeader
+		s = tc.proto + " 200 OK\r\nContent-Length: 0\r\nConnection: " + tc.value + "\r\n\r\n"
+		if err := rh.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rh.ConnectionClose() != tc.connectionClose {
+			t.Fatalf("unexpected ConnectionClose() for %q. Expecting %v", s, tc.connectionClose)
+		}
+	}
+}
+
+func TestRequestHeaderAcceptsTrailers(t *testing.T) {
+	t.Parallel()
+
+	testRequestHeaderAcceptsTrailers(t, "", false)
+	testRequestHeaderAcceptsTrailers(t, "TE: gzip\r\n", false)
+	testRequestHeaderAcceptsTrailers(t, "TE: trailers\r\n", true)
+	testRequestHeaderAcceptsTrailers(t, "te: deflate, Trailers\r\n", true)
+}
+
+func testRequestHeaderAcceptsTrailers(t *testing.T, te string, expected bool) {
+	var h RequestHeader
+	s := "GET / HTTP/1.1\r\nHost: aaa.com\r\n" + te + "\r\n"
+	if err := h.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.AcceptsTrailers() != expected {
+		t.Fatalf("unexpected AcceptsTrailers()=%v for %q. Expecting %v", !expected, s, expected)
+	}
+}
+
+func TestResponseHeaderTrailer(t *testing.T) {
+	t.Parallel()
+
+	var h ResponseHeader
+	h.SetTrailer("x-checksum", "abcd")
+	h.SetTrailer("X-Checksum", "efgh")
+	h.SetContentLength(-1)
+	if v := string(h.PeekTrailer("X-Checksum")); v != "efgh" {
+		t.Fatalf("unexpected trailer value %q. Expecting %q", v, "efgh")
+	}
+	s := h.String()
+	if !strings.Contains(s, "\r\nTrailer: X-Checksum\r\n") {
+		t.Fatalf("missing Trailer header in %q", s)
+	}
+
+	var h1 ResponseHeader
+	h.CopyTo(&h1)
+	if v := string(h1.PeekTrailer("X-Checksum")); v != "efgh" {
+		t.Fatalf("unexpected trailer value %q. Expecting %q", v, "efgh")
+	}
+
+	// Trailers cannot be sent with fixed size body.
+	h.SetContentLength(10)
+	if s := h.String(); strings.Contains(s, "Trailer") {
+		t.Fatalf("unexpected Trailer header in %q", s)
+	}
+
+	h.DelAllTrailers()
+	if v := h.PeekTrailer("X-Checksum"); v != nil {
+		t.Fatalf("unexpected trailer value %q. Expecting nil", v)
+	}
+}
+
 func TestRequestHeaderHTTP10ConnectionKeepAlive(t *testing.T) {
 	t.Parallel()
 
@@ -938,6 +1297,77 @@ func testRequestMultipartFormBoundary(t *testing.T, s, boundary string) {
 	}
 }
 
+func TestHasMediaType(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		contentType string
+		mediaType   string
+		expected    bool
+	}{
+		{"application/x-www-form-urlencoded", "application/x-www-form-urlencoded", true},
+		{"application/x-www-form-urlencoded; charset=UTF-8", "application/x-www-form-urlencoded", true},
+		{" Application/X-WWW-Form-Urlencoded ; charset=utf-8", "application/x-www-form-urlencoded", true},
+		{"application/x-www-form-urlencodedfoo", "application/x-www-form-urlencoded", false},
+		{"application/json", "application/x-www-form-urlencoded", false},
+		{"", "application/x-www-form-urlencoded", false},
+	} {
+		if hasMediaType([]byte(tc.contentType), []byte(tc.mediaType)) != tc.expected {
+			t.Fatalf("unexpected hasMediaType(%q, %q). Expecting %v", tc.contentType, tc.mediaType, tc.expected)
+		}
+	}
+}
+
+func TestHeaderContentTypeParams(t *testing.T) {
+	t.Parallel()
+
+	var h RequestHeader
+	h.SetContentType("multipart/form-data; boundary=abc")
+	if mt := h.ContentTypeMediaType(); string(mt) != "multipart/form-data" {
+		t.Fatalf("unexpected media type %q. Expecting %q", mt, "multipart/form-data")
+	}
+	if v := h.ContentTypeParam("boundary"); string(v) != "abc" {
+		t.Fatalf("unexpected boundary %q. Expecting %q", v, "abc")
+	}
+	if v := h.ContentTypeParam("charset"); v != nil {
+		t.Fatalf("unexpected charset %q. Expecting nil", v)
+	}
+
+	var rh ResponseHeader
+	rh.SetContentType("text/html; charset=utf-8")
+	if mt := rh.ContentTypeMediaType(); string(mt) != "text/html" {
+		t.Fatalf("unexpected media type %q. Expecting %q", mt, "text/html")
+	}
+	if v := rh.ContentTypeParam("charset"); string(v) != "utf-8" {
+		t.Fatalf("unexpected charset %q. Expecting %q", v, "utf-8")
+	}
+
+	// case-insensitive names, quoted values and extra spaces
+	rh.SetContentType(" text/plain ;  foo=bar;CharSet=\"iso-8859-1\" ; baz")
+	if mt := rh.ContentTypeMediaType(); string(mt) != "text/plain" {
+		t.Fatalf("unexpected media type %q. Expecting %q", mt, "text/plain")
+	}
+	if v := rh.ContentTypeParam("charset"); string(v) != "iso-8859-1" {
+		t.Fatalf("unexpected charset %q. Expecting %q", v, "iso-8859-1")
+	}
+	if v := rh.ContentTypeParam("baz"); v != nil {
+		t.Fatalf("unexpected baz %q. Expecting nil", v)
+	}
+
+	// semicolons inside quoted-string values
+	h.SetContentType("multipart/form-data; boundary=\"a;b\"; charset=utf-8")
+	if v := h.ContentTypeParam("boundary"); string(v) != "a;b" {
+		t.Fatalf("unexpected boundary %q. Expecting %q", v, "a;b")
+	}
+	if v := h.ContentTypeParam("charset"); string(v) != "utf-8" {
+		t.Fatalf("unexpected charset %q. Expecting %q", v, "utf-8")
+	}
+	h.SetContentType("multipart/form-data; foo=\"x\\\";boundary=y\"; BOUNDARY=z")
+	if v := h.ContentTypeParam("boundary"); string(v) != "z" {
+		t.Fatalf("unexpected boundary %q. Expecting %q", v, "z")
+	}
+}
+
 func TestResponseHeaderConnectionUpgrade(t *testing.T) {
 	t.Parallel()
 
@@ -1269,6 +1699,37 @@ func TestRequestContentTypeDefaultNotEmpty(t *testing.T) {
 	}
 }
 
+func TestResponseHeaderSetDate(t *testing.T) {
+	t.Parallel()
+
+	const date = "Tue, 10 Nov 2009 23:00:00 GMT"
+
+	var h ResponseHeader
+	h.Set(HeaderDate, date)
+	h.Set("X-Foo", "bar")
+	expected := "HTTP/1.1 200 OK\r\nDate: " + date + "\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 0\r\nX-Foo: bar\r\n\r\n"
+	h.SetContentType("text/plain; charset=utf-8")
+	h.SetContentLength(0)
+	if s := h.String(); s != expected {
+		t.Fatalf("unexpected response header %q. Expecting %q", s, expected)
+	}
+	if v := string(h.Peek(HeaderDate)); v != date {
+		t.Fatalf("unexpected Date %q. Expecting %q", v, date)
+	}
+
+	h.Reset()
+	h.SetDate(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+	if s := h.String(); !strings.Contains(s, "\r\nDate: "+date+"\r\n") {
+		t.Fatalf("cannot find Date %q in %q", date, s)
+	}
+
+	// The server date is used if Date isn't set.
+	h.Reset()
+	if s := h.String(); strings.Contains(s, date) || !strings.Contains(s, "\r\nDate: ") {
+		t.Fatalf("unexpected response header %q. Expecting the server date", s)
+	}
+}
+
 func TestResponseDateNoDefaultNotEmpty(t *testing.T) {
 	t.Parallel()
 
@@ -1318,6 +1779,61 @@ func TestRequestHeaderConnectionClose(t *testing.T) {
 
 }
 
+func TestHeaderResetConnectionClose(t *testing.T) {
+	t.Parallel()
+
+	var h RequestHeader
+	h.SetHost("foobar")
+	h.SetConnectionClose()
+	if s := h.String(); !strings.Contains(s, "\r\nConnection: close\r\n") {
+		t.Fatalf("missing 'Connection: close' in %q", s)
+	}
+	h.ResetConnectionClose()
+	if h.ConnectionClose() {
+		t.Fatal("unexpected connection close")
+	}
+	if s := h.String(); strings.Contains(s, "Connection") {
+		t.Fatalf("unexpected Connection header in %q", s)
+	}
+
+	// Re-enable connection close after the reset.
+	h.Set(HeaderConnection, "close")
+	if !h.ConnectionClose() {
+		t.Fatal("expecting connection close")
+	}
+	h.ResetConnectionClose()
+	if s := h.String(); strings.Contains(s, "Connection") {
+		t.Fatalf("unexpected Connection header in %q", s)
+	}
+
+	// Other Connection values are kept.
+	h.Set(HeaderConnection, "keep-alive")
+	h.ResetConnectionClose()
+	if v := string(h.Peek(HeaderConnection)); v != "keep-alive" {
+		t.Fatalf("unexpected Connection header %q. Expecting %q", v, "keep-alive")
+	}
+
+	var rh ResponseHeader
+	s := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	if err := rh.Read(bufio.NewReader(strings.NewReader(s))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !rh.ConnectionClose() {
+		t.Fatal("expecting connection close")
+	}
+	rh.ResetConnectionClose()
+	if rh.ConnectionClose() {
+		t.Fatal("unexpected connection close")
+	}
+	if s := rh.String(); strings.Contains(s, "Connection") {
+		t.Fatalf("unexpected Connection header in %q", s)
+	}
+	rh.SetConnectionClose()
+	if s := rh.String(); !strings.Contains(s, "\r\nConnection: close\r\n") {
+		t.Fatalf("missing 'Connection: close' in %q", s)
+	}
+}
+
 func TestRequestHeaderSetCookie(t *testing.T) {
 	t.Parallel()
 
@@ -1477,6 +1993,51 @@ func TestRequestHeaderVisitAll(t *testing.T) {
 	}
 }
 
+func TestResponseHeaderVisitAllWritten(t *testing.T) {
+	t.Parallel()
+
+	var h ResponseHeader
+	h.SetServer("foobar")
+	h.Set("X-Foo", "bar")
+	h.Set(HeaderDate, "Tue, 10 Nov 2009 23:00:00 GMT")
+	h.SetContentLength(-1)
+	h.SetTrailer("X-Checksum", "abcd")
+	h.SetConnectionClose()
+	var c Cookie
+	c.SetKey("a")
+	c.SetValue("b")
+	h.SetCookie(&c)
+	testResponseHeaderVisitAllWritten(t, &h)
+
+	// Content-Type isn't written for empty responses
+	// without explicit Content-Type.
+	h.Reset()
+	h.noDefaultDate = true
+	h.Set(HeaderDate, "Thu, 01 Jan 1970 00:00:00 GMT")
+	h.SetContentLength(0)
+	testResponseHeaderVisitAllWritten(t, &h)
+}
+
+func testResponseHeaderVisitAllWritten(t *testing.T, h *ResponseHeader) {
+	// The Date header may be updated between the calls.
+	for i := 0; i < 3; i++ {
+		written := string(h.Header())
+
+		visited := string(statusLine(h.StatusCode()))
+		h.VisitAllWritten(func(key, value []byte) {
+			visited += string(key) + ": " + string(value) + "\r\n"
+		})
+		visited += "\r\n"
+
+		if visited == written {
+			return
+		}
+		if i == 2 {
+			t.Fatalf("unexpected visited headers %q. Expecting %q", visited, written)
+		}
+	}
+}
+
 func TestResponseHeaderVisitAllInOrder(t *testing.T) {
 	t.Parallel()
 
@@ -2024,6 +2585,116 @@ func TestResponseHeaderTooBig(t *testing.T) {
 	}
 }
 
+func TestRequestHeaderBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		username string
+		password string
+	}{
+		{"user", "pass"},
+		{"user", "pa:ss:word"},
+		{"", ""},
+		{"юзер", "пароль\x00\xff"},
+	} {
+		var h RequestHeader
+		h.SetBasicAuth(tc.username, tc.password)
+		expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(tc.username+":"+tc.password))
+		if auth := string(h.Peek(HeaderAuthorization)); auth != expectedAuth {
+			t.Fatalf("unexpected Authorization header: %q. Expecting %q", auth, expectedAuth)
+		}
+		username, password, ok := h.BasicAuth()
+		if !ok {
+			t.Fatalf("cannot obtain basic auth from %q", h.Peek(HeaderAuthorization))
+		}
+		if string(username) != tc.username {
+			t.Fatalf("unexpected username: %q. Expecting %q", username, tc.username)
+		}
+		if string(password) != tc.password {
+			t.Fatalf("unexpected password: %q. Expecting %q", password, tc.password)
+		}
+	}
+
+	// the auth scheme is case-insensitive
+	var h RequestHeader
+	h.Set(HeaderAuthorization, "basic "+base64.StdEncoding.EncodeToString([]byte("foo:bar")))
+	if username, password, ok := h.BasicAuth(); !ok || string(username) != "foo" || string(password) != "bar" {
+		t.Fatalf("unexpected basic auth: %q, %q, %v. Expecting %q, %q, true", username, password, ok, "foo", "bar")
+	}
+
+	for _, auth := range []string{
+		"",
+		"Basic",
+		"Basic ",
+		"Basic !!!invalid base64",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("no colon")),
+		"Bearer " + base64.StdEncoding.EncodeToString([]byte("foo:bar")),
+		"Basicfoo:bar",
+	} {
+		var h RequestHeader
+		if auth != "" {
+			h.Set(HeaderAuthorization, auth)
+		}
+		if username, password, ok := h.BasicAuth(); ok {
+			t.Fatalf("unexpected basic auth for %q: %q, %q", auth, username, password)
+		}
+	}
+}
+
+func TestRequestHeaderMaxHeaderSize(t *testing.T) {
+	t.Parallel()
+
+	s := "GET / HTTP/1.1\r\nHost: aaa.com\r\n" + getHeaders(100) + "\r\n"
+
+	// The whole header is buffered.
+	h := &RequestHeader{maxHeaderSize: 1024}
+	if err := h.Read(bufio.NewReaderSize(strings.NewReader(s), 64*1024)); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrHeaderTooLarge)
+	}
+
+	// The header is read in small chunks.
+	h = &RequestHeader{maxHeaderSize: 1024}
+	if err := h.Read(bufio.NewReaderSize(&bufioPeekReader{s: s}, 64*1024)); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrHeaderTooLarge)
+	}
+
+	// The header fits the limit.
+	h = &RequestHeader{maxHeaderSize: len(s)}
+	if err := h.Read(bufio.NewReaderSize(strings.NewReader(s), 64*1024)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(h.Host()) != "aaa.com" {
+		t.Fatalf("unexpected host %q. Expecting %q", h.Host(), "aaa.com")
+	}
+}
+
+func TestRequestHeaderMaxHeaderCount(t *testing.T) {
+	t.Parallel()
+
+	s := "GET / HTTP/1.1\r\nHost: aaa.com\r\n" + strings.Repeat("a:b\r\n", 5000) + "\r\n"
+
+	// The whole header is buffered.
+	h := &RequestHeader{maxHeaderCount: 100}
+	if err := h.Read(bufio.NewReaderSize(strings.NewReader(s), 64*1024)); err != ErrTooManyHeaders {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrTooManyHeaders)
+	}
+
+	// The header is read in small chunks.
+	h = &RequestHeader{maxHeaderCount: 100}
+	if err := h.Read(bufio.NewReaderSize(&bufioPeekReader{s: s}, 64*1024)); err != ErrTooManyHeaders {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrTooManyHeaders)
+	}
+
+	// The header fits the limit.
+	h = &RequestHeader{maxHeaderCount: 5001}
+	if err := h.Read(bufio.NewReaderSize(strings.NewReader(s), 64*1024)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(h.Host()) != "aaa.com" {
+		t.Fatalf("unexpected host %q. Expecting %q", h.Host(), "aaa.com")
+	}
+}
+
 type bufioPeekReader struct {
 	s string
 	n int
@@ -2121,6 +2792,18 @@ func TestResponseHeaderReadSuccess(t *testing.T) {
 	testResponseHeaderReadSuccess(t, h, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 32245\r\n\r\nqwert aaa",
 		200, 32245, "text/plain", "qwert aaa")
 
+	// missing reason phrase
+	testResponseHeaderReadSuccess(t, h, "HTTP/1.1 200\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n",
+		200, 123, "text/html", "")
+	testResponseHeaderReadSuccess(t, h, "HTTP/1.1 404 \r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n",
+		404, 0, "text/plain", "")
+
+	// extra spaces in the status line
+	testResponseHeaderReadSuccess(t, h, "HTTP/1.1 200  OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n",
+		200, 123, "text/html", "")
+	testResponseHeaderReadSuccess(t, h, "HTTP/1.1  301   Moved Permanently\r\nContent-Length: 5\r\nContent-Type: text/html\r\n\r\n",
+		301, 5, "text/html", "")
+
 	// ancient http protocol
 	testResponseHeaderReadSuccess(t, h, "HTTP/0.9 300 OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\nqqqq",
 		300, 123, "text/html", "qqqq")
@@ -2410,6 +3093,8 @@ func TestResponseHeaderReadError(t *testing.T) {
 	testResponseHeaderReadError(t, h, "HTTP/1.1 foobar OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n")
 	testResponseHeaderReadError(t, h, "HTTP/1.1 123foobar OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n")
 	testResponseHeaderReadError(t, h, "HTTP/1.1 foobar344 OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n")
+	testResponseHeaderReadError(t, h, "HTTP/1.1 20x OK\r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n")
+	testResponseHeaderReadError(t, h, "HTTP/1.1   \r\nContent-Length: 123\r\nContent-Type: text/html\r\n\r\n")
 
 	// no headers
 	testResponseHeaderReadError(t, h, "HTTP/1.1 200 OK\r\n")
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +14,7 @@ import (
 	"time"
 
 	"github.com/valyala/bytebufferpool"
+	"github.com/valyala/fasthttp/stackless"
 )
 
 // Request represents HTTP request.
@@ -47,6 +47,10 @@ type Request struct {
 	parsedURI      bool
 	parsedPostArgs bool
 
+	// absoluteRequestURI is set by parseURI if the uri host is taken
+	// from the request uri instead of the Host header.
+	absoluteRequestURI bool
+
 	keepBodyBuffer bool
 
 	// Used by Server to indicate the request was received on a HTTPS endpoint.
@@ -56,6 +60,10 @@ type Request struct {
 	// Request timeout. Usually set by DoDealine or DoTimeout
 	// if <= 0, means not set
 	timeout time.Duration
+
+	// Connection read and write timeout set by SetTimeout.
+	// if <= 0, means not set
+	connTimeout time.Duration
 }
 
 // Response represents HTTP response.
@@ -88,6 +96,26 @@ type Response struct {
 	// Use it for writing HEAD responses.
 	SkipBody bool
 
+	// MaxDecompressedBodySize is the maximum body size returned by
+	// BodyGunzip, BodyUnbrotli and BodyInflate.
+	//
+	// ErrBodyTooLarge is returned if the decompressed body exceeds this
+	// limit, so a small compressed body cannot expand to huge sizes.
+	//
+	// By default the decompressed body size is unlimited.
+	MaxDecompressedBodySize int
+
+	// Response.Read() returns *ErrPartialBody instead of the timeout error
+	// if the body with known Content-Length wasn't read in full before
+	// the read deadline. The body read so far is available via Body().
+	// This may be useful for proxies, which prefer partial data over nothing.
+	//
+	// HostClient and Client return *ErrPartialBody instead of ErrTimeout
+	// in this case.
+	//
+	// By default the timeout error is returned and the body mustn't be used.
+	PartialBodyOnTimeout bool
+
 	keepBodyBuffer        bool
 	secureErrorLogMessage bool
 
@@ -127,7 +155,7 @@ func (req *Request) SetRequestURIBytes(requestURI []byte) {
 // RequestURI returns request's URI.
 func (req *Request) RequestURI() []byte {
 	if req.parsedURI {
-		requestURI := req.uri.RequestURI()
+		requestURI := req.requestTarget()
 		req.SetRequestURIBytes(requestURI)
 	}
 	return req.Header.RequestURI()
@@ -163,6 +191,22 @@ func (req *Request) SetConnectionClose() {
 	req.Header.SetConnectionClose()
 }
 
+// SetTimeout sets the timeout for writing the request and reading
+// the response by HostClient.Do, including retries.
+//
+// Unlike DoTimeout the deadline is set on the underlying connection,
+// so the request is aborted when the timeout exceeds. ErrTimeout
+// is returned in this case.
+//
+// Zero timeout means no limit besides HostClient.ReadTimeout
+// and HostClient.WriteTimeout.
+//
+// The timeout is ignored if HostClient.Transport is set, since
+// the connection is managed by the Transport then.
+func (req *Request) SetTimeout(timeout time.Duration) {
+	req.connTimeout = timeout
+}
+
 // SendFile registers file on the given path to be used as response body
 // when Write is called.
 //
@@ -194,7 +238,8 @@ func (resp *Response) SendFile(path string) error {
 // If bodySize is >= 0, then the bodyStream must provide exactly bodySize bytes
 // before returning io.EOF.
 //
-// If bodySize < 0, then bodyStream is read until io.EOF.
+// If bodySize < 0, then bodyStream is read until io.EOF and the body
+// is sent with chunked Transfer-Encoding.
 //
 // bodyStream.Close() is called after finishing reading all body data
 // if it implements io.Closer.
@@ -246,10 +291,36 @@ func (resp *Response) IsBodyStream() bool {
 //
 // Note that GET and HEAD requests cannot have body.
 //
-/// See also SetBodyStream.
+// The body is sent with chunked transfer-encoding, since its size
+// is unknown in advance. Write calls sw directly, so every w.Flush call
+// in sw sends the buffered data to the server as a chunk.
+//
+// See also SetBodyStream.
 func (req *Request) SetBodyStreamWriter(sw StreamWriter) {
-	sr := NewStreamReader(sw)
-	req.SetBodyStream(sr, -1)
+	req.SetBodyStream(&streamWriterReader{sw: sw}, -1)
+}
+
+// streamWriterReader is the request body stream set via SetBodyStreamWriter.
+//
+// Request.Write calls sw directly on the writer, while the other readers
+// of the body obtain the data generated by sw via NewStreamReader.
+type streamWriterReader struct {
+	sw StreamWriter
+	r  io.ReadCloser
+}
+
+func (r *streamWriterReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		r.r = NewStreamReader(r.sw)
+	}
+	return r.r.Read(p)
+}
+
+func (r *streamWriterReader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+	return r.r.Close()
 }
 
 // SetBodyStreamWriter registers the given sw for populating response body.
@@ -278,6 +349,9 @@ func (resp *Response) BodyWriter() io.Writer {
 }
 
 // BodyWriter returns writer for populating request body.
+//
+// Every write appends data to the request body, so the writer may be
+// passed to io-based code such as json.NewEncoder.
 func (req *Request) BodyWriter() io.Writer {
 	req.w.r = req
 	return &req.w
@@ -390,7 +464,7 @@ var (
 // 'Content-Encoding: gzip' for reading un-gzipped body.
 // Use Body for reading gzipped request body.
 func (req *Request) BodyGunzip() ([]byte, error) {
-	return gunzipData(req.Body())
+	return gunzipData(req.Body(), 0)
 }
 
 // BodyGunzip returns un-gzipped body data.
@@ -398,13 +472,16 @@ func (req *Request) BodyGunzip() ([]byte, error) {
 // This method may be used if the response header contains
 // 'Content-Encoding: gzip' for reading un-gzipped body.
 // Use Body for reading gzipped response body.
+//
+// ErrBodyTooLarge is returned if the un-gzipped body exceeds
+// MaxDecompressedBodySize.
 func (resp *Response) BodyGunzip() ([]byte, error) {
-	return gunzipData(resp.Body())
+	return gunzipData(resp.Body(), resp.MaxDecompressedBodySize)
 }
 
-func gunzipData(p []byte) ([]byte, error) {
+func gunzipData(p []byte, maxBodySize int) ([]byte, error) {
 	var bb bytebufferpool.ByteBuffer
-	_, err := WriteGunzip(&bb, p)
+	_, err := WriteGunzip(newDecompressWriter(&bb, maxBodySize), p)
 	if err != nil {
 		return nil, err
 	}
@@ -417,7 +494,7 @@ func gunzipData(p []byte) ([]byte, error) {
 // 'Content-Encoding: br' for reading un-brotlied body.
 // Use Body for reading brotlied request body.
 func (req *Request) BodyUnbrotli() ([]byte, error) {
-	return unBrotliData(req.Body())
+	return unBrotliData(req.Body(), 0)
 }
 
 // BodyUnbrotli returns un-brotlied body data.
@@ -425,13 +502,16 @@ func (req *Request) BodyUnbrotli() ([]byte, error) {
 // This method may be used if the response header contains
 // 'Content-Encoding: br' for reading un-brotlied body.
 // Use Body for reading brotlied response body.
+//
+// ErrBodyTooLarge is returned if the un-brotlied body exceeds
+// MaxDecompressedBodySize.
 func (resp *Response) BodyUnbrotli() ([]byte, error) {
-	return unBrotliData(resp.Body())
+	return unBrotliData(resp.Body(), resp.MaxDecompressedBodySize)
 }
 
-func unBrotliData(p []byte) ([]byte, error) {
+func unBrotliData(p []byte, maxBodySize int) ([]byte, error) {
 	var bb bytebufferpool.ByteBuffer
-	_, err := WriteUnbrotli(&bb, p)
+	_, err := WriteUnbrotli(newDecompressWriter(&bb, maxBodySize), p)
 	if err != nil {
 		return nil, err
 	}
@@ -444,7 +524,7 @@ func unBrotliData(p []byte) ([]byte, error) {
 // 'Content-Encoding: deflate' for reading inflated request body.
 // Use Body for reading deflated request body.
 func (req *Request) BodyInflate() ([]byte, error) {
-	return inflateData(req.Body())
+	return inflateData(req.Body(), 0)
 }
 
 // BodyInflate returns inflated body data.
@@ -452,17 +532,20 @@ func (req *Request) BodyInflate() ([]byte, error) {
 // This method may be used if the response header contains
 // 'Content-Encoding: deflate' for reading inflated response body.
 // Use Body for reading deflated response body.
+//
+// ErrBodyTooLarge is returned if the inflated body exceeds
+// MaxDecompressedBodySize.
 func (resp *Response) BodyInflate() ([]byte, error) {
-	return inflateData(resp.Body())
+	return inflateData(resp.Body(), resp.MaxDecompressedBodySize)
 }
 
 func (ctx *RequestCtx) RequestBodyStream() io.Reader {
 	return ctx.Request.bodyStream
 }
 
-func inflateData(p []byte) ([]byte, error) {
+func inflateData(p []byte, maxBodySize int) ([]byte, error) {
 	var bb bytebufferpool.ByteBuffer
-	_, err := WriteInflate(&bb, p)
+	_, err := WriteInflate(newDecompressWriter(&bb, maxBodySize), p)
 	if err != nil {
 		return nil, err
 	}
@@ -720,10 +803,12 @@ func (req *Request) copyToSkipBody(dst *Request) {
 
 	req.uri.CopyTo(&dst.uri)
 	dst.parsedURI = req.parsedURI
+	dst.absoluteRequestURI = req.absoluteRequestURI
 
 	req.postArgs.CopyTo(&dst.postArgs)
 	dst.parsedPostArgs = req.parsedPostArgs
 	dst.isTLS = req.isTLS
+	dst.connTimeout = req.connTimeout
 
 	// do not copy multipartForm - it will be automatically
 	// re-created on the first call to MultipartForm.
@@ -748,6 +833,8 @@ func (resp *Response) copyToSkipBody(dst *Response) {
 	dst.Reset()
 	resp.Header.CopyTo(&dst.Header)
 	dst.SkipBody = resp.SkipBody
+	dst.MaxDecompressedBodySize = resp.MaxDecompressedBodySize
+	dst.PartialBodyOnTimeout = resp.PartialBodyOnTimeout
 	dst.raddr = resp.raddr
 	dst.laddr = resp.laddr
 }
@@ -776,7 +863,25 @@ func (req *Request) parseURI() error {
 	}
 	req.parsedURI = true
 
-	return req.uri.parse(req.Header.Host(), req.Header.RequestURI(), req.isTLS)
+	requestURI := req.Header.RequestURI()
+	req.absoluteRequestURI = isAbsoluteURI(requestURI)
+	if req.Header.IsConnect() && !req.absoluteRequestURI {
+		// The authority-form request target (RFC 7230, 5.3.3)
+		// contains only host and port, so it isn't a path.
+		req.absoluteRequestURI = true
+		return req.uri.parse(requestURI, nil, req.isTLS)
+	}
+	return req.uri.parse(req.Header.Host(), requestURI, req.isTLS)
+}
+
+// requestTarget returns request target for the parsed uri.
+//
+// CONNECT requests use the authority-form request target, i.e. 'host:port'.
+func (req *Request) requestTarget() []byte {
+	if req.Header.IsConnect() {
+		return req.uri.Host()
+	}
+	return req.uri.RequestURI()
 }
 
 // PostArgs returns POST arguments.
@@ -791,7 +896,7 @@ func (req *Request) parsePostArgs() {
 	}
 	req.parsedPostArgs = true
 
-	if !bytes.HasPrefix(req.Header.ContentType(), strPostArgsContentType) {
+	if !hasMediaType(req.Header.ContentType(), strPostArgsContentType) {
 		return
 	}
 	req.postArgs.ParseBytes(req.bodyBytes())
@@ -808,7 +913,40 @@ var ErrNoMultipartForm = errors.New("request has no multipart/form-data Content-
 //
 // RemoveMultipartFormFiles must be called after returned multipart form
 // is processed.
+//
+// See also MultipartFormWithLimit.
 func (req *Request) MultipartForm() (*multipart.Form, error) {
+	return req.multipartFormWithLimit(-1)
+}
+
+// MultipartFormWithLimit returns requests's multipart form.
+//
+// Up to maxMemory bytes of the uploaded files are kept in memory.
+// The remaining files are stored in temporary files on disk, so large
+// uploads aren't fully buffered in RAM when reading the request body
+// stream. The size of the request body itself is limited by
+// Server.MaxRequestBodySize.
+//
+// The form is parsed only once, so maxMemory is ignored if the form
+// has been already obtained via MultipartForm or MultipartFormWithLimit.
+//
+// Returns ErrNoMultipartForm if request's Content-Type
+// isn't 'multipart/form-data'.
+//
+// RemoveMultipartFormFiles must be called after returned multipart form
+// is processed. It removes the temporary files.
+func (req *Request) MultipartFormWithLimit(maxMemory int64) (*multipart.Form, error) {
+	if maxMemory < 0 {
+		maxMemory = 0
+	}
+	return req.multipartFormWithLimit(maxMemory)
+}
+
+// multipartFormWithLimit reads multipart form keeping up to maxMemory bytes
+// of uploaded files in memory.
+//
+// The default limit is used if maxMemory is negative.
+func (req *Request) multipartFormWithLimit(maxMemory int64) (*multipart.Form, error) {
 	if req.multipartForm != nil {
 		return req.multipartForm, nil
 	}
@@ -832,8 +970,11 @@ func (req *Request) MultipartForm() (*multipart.Form, error) {
 			return nil, fmt.Errorf("unsupported Content-Encoding: %q", ce)
 		}
 
+		if maxMemory < 0 {
+			maxMemory = 8 * 1024
+		}
 		mr := multipart.NewReader(bodyStream, req.multipartFormBoundary)
-		req.multipartForm, err = mr.ReadForm(8 * 1024)
+		req.multipartForm, err = mr.ReadForm(maxMemory)
 		if err != nil {
 			return nil, fmt.Errorf("cannot read multipart/form-data body: %s", err)
 		}
@@ -848,7 +989,11 @@ func (req *Request) MultipartForm() (*multipart.Form, error) {
 			return nil, fmt.Errorf("unsupported Content-Encoding: %q", ce)
 		}
 
-		req.multipartForm, err = readMultipartForm(bytes.NewReader(body), req.multipartFormBoundary, len(body), len(body))
+		maxInMemoryFileSize := len(body)
+		if maxMemory >= 0 && maxMemory < int64(maxInMemoryFileSize) {
+			maxInMemoryFileSize = int(maxMemory)
+		}
+		req.multipartForm, err = readMultipartForm(bytes.NewReader(body), req.multipartFormBoundary, len(body), maxInMemoryFileSize)
 		if err != nil {
 			return nil, err
 		}
@@ -937,6 +1082,8 @@ func (req *Request) Reset() {
 	req.Header.Reset()
 	req.resetSkipHeader()
 	req.timeout = 0
+	req.connTimeout = 0
+	req.secureErrorLogMessage = false
 }
 
 func (req *Request) resetSkipHeader() {
@@ -961,13 +1108,22 @@ func (req *Request) RemoveMultipartFormFiles() {
 }
 
 // Reset clears response contents.
+//
+// The underlying header buffers are retained for reuse. The body buffer
+// is returned to the pool and is taken from the pool again when the body
+// is set, so filling the response after Reset doesn't allocate memory
+// in the steady state. Server retains the body buffer instead
+// unless Server.ReduceMemoryUsage is set.
 func (resp *Response) Reset() {
 	resp.Header.Reset()
 	resp.resetSkipHeader()
 	resp.SkipBody = false
+	resp.MaxDecompressedBodySize = 0
+	resp.PartialBodyOnTimeout = false
 	resp.raddr = nil
 	resp.laddr = nil
 	resp.ImmediateHeaderFlush = false
+	resp.secureErrorLogMessage = false
 }
 
 func (resp *Response) resetSkipHeader() {
@@ -1121,6 +1277,9 @@ func (req *Request) ContinueReadBody(r *bufio.Reader, maxBodySize int, preParseM
 	bodyBuf := req.bodyBuffer()
 	bodyBuf.Reset()
 	bodyBuf.B, err = readBody(r, contentLength, maxBodySize, bodyBuf.B)
+	if err == nil && contentLength == -1 {
+		req.Header.trailer, err = readTrailer(r, req.Header.trailer[:0], req.Header.disableNormalizing)
+	}
 	if err != nil {
 		req.Reset()
 		return err
@@ -1171,12 +1330,12 @@ func (req *Request) ContinueReadBodyStream(r *bufio.Reader, maxBodySize int, pre
 		if err == ErrBodyTooLarge {
 			req.Header.SetContentLength(contentLength)
 			req.body = bodyBuf
-			req.bodyStream = acquireRequestStream(bodyBuf, r, contentLength)
+			req.bodyStream = acquireRequestStream(bodyBuf, r, &req.Header, contentLength)
 			return nil
 		}
 		if err == errChunkedStream {
 			req.body = bodyBuf
-			req.bodyStream = acquireRequestStream(bodyBuf, r, -1)
+			req.bodyStream = acquireRequestStream(bodyBuf, r, &req.Header, -1)
 			return nil
 		}
 		req.Reset()
@@ -1184,7 +1343,7 @@ func (req *Request) ContinueReadBodyStream(r *bufio.Reader, maxBodySize int, pre
 	}
 
 	req.body = bodyBuf
-	req.bodyStream = acquireRequestStream(bodyBuf, r, contentLength)
+	req.bodyStream = acquireRequestStream(bodyBuf, r, &req.Header, contentLength)
 	req.Header.SetContentLength(contentLength)
 	return nil
 }
@@ -1218,8 +1377,20 @@ func (resp *Response) ReadLimitBody(r *bufio.Reader, maxBodySize int) error {
 	if !resp.mustSkipBody() {
 		bodyBuf := resp.bodyBuffer()
 		bodyBuf.Reset()
-		bodyBuf.B, err = readBody(r, resp.Header.ContentLength(), maxBodySize, bodyBuf.B)
+		contentLength := resp.Header.ContentLength()
+		bodyBuf.B, err = readBody(r, contentLength, maxBodySize, bodyBuf.B)
+		if err == nil && contentLength == -1 {
+			resp.Header.trailer, err = readTrailer(r, resp.Header.trailer[:0], resp.Header.disableNormalizing)
+		}
 		if err != nil {
+			if x, ok := err.(interface{ Timeout() bool }); ok && x.Timeout() &&
+				resp.PartialBodyOnTimeout && contentLength >= 0 {
+				return &ErrPartialBody{
+					error:         err,
+					BodySize:      len(bodyBuf.B),
+					ContentLength: contentLength,
+				}
+			}
 			return err
 		}
 		resp.Header.SetContentLength(len(bodyBuf.B))
@@ -1259,6 +1430,65 @@ func writeBufio(hw httpWriter, w io.Writer) (int64, error) {
 	return n, err
 }
 
+// ReadFrom reads request (including body) from r. It implements io.ReaderFrom.
+//
+// Only a single request is read. r may be read past the end of the request
+// due to buffering. The bytes read past the end of the request are discarded,
+// so use Read with a bufio.Reader for reading pipelined requests.
+// The returned byte count is the size of the read request and doesn't
+// include the discarded bytes.
+func (req *Request) ReadFrom(r io.Reader) (int64, error) {
+	return readBufio(req, r)
+}
+
+// ReadFrom reads response (including body) from r. It implements io.ReaderFrom.
+//
+// Only a single response is read. r may be read past the end of the response
+// due to buffering. The bytes read past the end of the response are discarded,
+// so use Read with a bufio.Reader for reading pipelined responses.
+// The returned byte count is the size of the read response and doesn't
+// include the discarded bytes.
+func (resp *Response) ReadFrom(r io.Reader) (int64, error) {
+	return readBufio(resp, r)
+}
+
+func readBufio(hr httpReader, r io.Reader) (int64, error) {
+	sr := &statsReader{r: r}
+	br := acquireBufioReader(sr)
+	err := hr.Read(br)
+	n := sr.bytesRead - int64(br.Buffered())
+	releaseBufioReader(br)
+	return n, err
+}
+
+type statsReader struct {
+	r         io.Reader
+	bytesRead int64
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.bytesRead += int64(n)
+	return n, err
+}
+
+func acquireBufioReader(r io.Reader) *bufio.Reader {
+	v := bufioReaderPool.Get()
+	if v == nil {
+		return bufio.NewReader(r)
+	}
+	br := v.(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func releaseBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+var bufioReaderPool sync.Pool
+
 type statsWriter struct {
 	w            io.Writer
 	bytesWritten int64
@@ -1316,69 +1546,102 @@ func (req *Request) onlyMultipartForm() bool {
 //
 // See also WriteTo.
 func (req *Request) Write(w *bufio.Writer) error {
+	if err := req.prepareURIHeaders(); err != nil {
+		return err
+	}
+
+	if req.bodyStream != nil {
+		return req.writeBodyStream(w)
+	}
+
+	body, hasBody, err := req.prepareBody()
+	if err != nil {
+		return err
+	}
+	if err = req.Header.Write(w); err != nil {
+		return err
+	}
+	if hasBody && req.Header.ContentLength() == -1 {
+		if len(body) > 0 {
+			if err = writeChunk(w, body); err != nil {
+				return err
+			}
+		}
+		err = writeChunk(w, body[:0])
+	} else if hasBody {
+		_, err = w.Write(body)
+	} else if len(body) > 0 {
+		if req.secureErrorLogMessage {
+			return fmt.Errorf("non-zero body for non-POST request")
+		}
+		return fmt.Errorf("non-zero body for non-POST request. body=%q", body)
+	}
+	return err
+}
+
+// prepareURIHeaders fills in Host header, request uri and basic auth
+// Authorization header from the parsed uri.
+func (req *Request) prepareURIHeaders() error {
 	if len(req.Header.Host()) == 0 || req.parsedURI {
 		uri := req.URI()
 		host := uri.Host()
 		if len(host) == 0 {
 			return errRequestHostRequired
 		}
-		req.Header.SetHostBytes(host)
-		req.Header.SetRequestURIBytes(uri.RequestURI())
+		if len(req.Header.Host()) == 0 || req.Header.hostFromURI {
+			req.Header.setHostFromURI(host)
+		} else if !req.absoluteRequestURI {
+			// The uri host has been taken from the Host header,
+			// so the Host header must follow the uri host changes.
+			req.Header.SetHostBytes(host)
+		}
+		// Otherwise the explicitly set Host header takes precedence over
+		// the uri host, e.g. for connecting to HostClient.Addr while
+		// sending another Host header for virtual hosting.
+		req.Header.SetRequestURIBytes(req.requestTarget())
 
 		if len(uri.username) > 0 {
-			// RequestHeader.SetBytesKV only uses RequestHeader.bufKV.key
-			// So we are free to use RequestHeader.bufKV.value as a scratch pad for
-			// the base64 encoding.
-			nl := len(uri.username) + len(uri.password) + 1
-			nb := nl + len(strBasicSpace)
-			tl := nb + base64.StdEncoding.EncodedLen(nl)
-			if tl > cap(req.Header.bufKV.value) {
-				req.Header.bufKV.value = make([]byte, 0, tl)
-			}
-			buf := req.Header.bufKV.value[:0]
-			buf = append(buf, uri.username...)
-			buf = append(buf, strColon...)
-			buf = append(buf, uri.password...)
-			buf = append(buf, strBasicSpace...)
-			base64.StdEncoding.Encode(buf[nb:tl], buf[:nl])
-			req.Header.SetBytesKV(strAuthorization, buf[nl:tl])
+			req.Header.setBasicAuthBytes(uri.username, uri.password)
 		}
 	}
+	return nil
+}
 
-	if req.bodyStream != nil {
-		return req.writeBodyStream(w)
-	}
-
-	body := req.bodyBytes()
-	var err error
+// prepareBody returns the body to be written and sets Content-Length
+// header for it.
+//
+// The body is sent with chunked Transfer-Encoding if Content-Length
+// is set to -1, i.e. the body size is unknown, unless the request method
+// doesn't carry a body such as GET and HEAD.
+//
+// hasBody is false if the body mustn't be written for the request method.
+func (req *Request) prepareBody() (body []byte, hasBody bool, err error) {
+	body = req.bodyBytes()
 	if req.onlyMultipartForm() {
 		body, err = marshalMultipartForm(req.multipartForm, req.multipartFormBoundary)
 		if err != nil {
-			return fmt.Errorf("error when marshaling multipart form: %s", err)
+			return nil, false, fmt.Errorf("error when marshaling multipart form: %s", err)
 		}
 		req.Header.SetMultipartFormBoundary(req.multipartFormBoundary)
 	}
 
-	hasBody := false
 	if len(body) == 0 {
 		body = req.postArgs.QueryString()
 	}
+	if req.Header.ContentLength() == -1 {
+		if !req.Header.ignoreBody() {
+			return body, true, nil
+		}
+		// GET and HEAD requests have no body to be sent
+		// with chunked Transfer-Encoding.
+		req.Header.SetContentLength(0)
+		req.Header.contentLengthBytes = req.Header.contentLengthBytes[:0]
+	}
 	if len(body) != 0 || !req.Header.ignoreBody() {
 		hasBody = true
 		req.Header.SetContentLength(len(body))
 	}
-	if err = req.Header.Write(w); err != nil {
-		return err
-	}
-	if hasBody {
-		_, err = w.Write(body)
-	} else if len(body) > 0 {
-		if req.secureErrorLogMessage {
-			return fmt.Errorf("non-zero body for non-POST request")
-		}
-		return fmt.Errorf("non-zero body for non-POST request. body=%q", body)
-	}
-	return err
+	return body, hasBody, nil
 }
 
 // WriteGzip writes response with gzipped body to w.
@@ -1444,116 +1707,51 @@ func (resp *Response) WriteDeflateLevel(w *bufio.Writer, level int) error {
 }
 
 func (resp *Response) brotliBody(level int) error {
-	if len(resp.Header.peek(strContentEncoding)) > 0 {
-		// It looks like the body is already compressed.
-		// Do not compress it again.
-		return nil
-	}
-
-	if !resp.Header.isCompressibleContentType() {
-		// The content-type cannot be compressed.
-		return nil
-	}
-
-	if resp.bodyStream != nil {
-		// Reset Content-Length to -1, since it is impossible
-		// to determine body size beforehand of streamed compression.
-		// For https://github.com/valyala/fasthttp/issues/176 .
-		resp.Header.SetContentLength(-1)
-
-		// Do not care about memory allocations here, since brotli is slow
-		// and allocates a lot of memory by itself.
-		bs := resp.bodyStream
-		resp.bodyStream = NewStreamReader(func(sw *bufio.Writer) {
-			zw := acquireStacklessBrotliWriter(sw, level)
-			fw := &flushWriter{
-				wf: zw,
-				bw: sw,
-			}
-			copyZeroAlloc(fw, bs) //nolint:errcheck
-			releaseStacklessBrotliWriter(zw, level)
-			if bsc, ok := bs.(io.Closer); ok {
-				bsc.Close()
-			}
-		})
-	} else {
-		bodyBytes := resp.bodyBytes()
-		if len(bodyBytes) < minCompressLen {
-			// There is no sense in spending CPU time on small body compression,
-			// since there is a very high probability that the compressed
-			// body size will be bigger than the original body size.
-			return nil
+	return resp.encodeBody(strBr, func(w io.Writer) io.WriteCloser {
+		return &stacklessCompressWriter{
+			Writer:  acquireStacklessBrotliWriter(w, level),
+			level:   level,
+			release: releaseStacklessBrotliWriter,
 		}
-		w := responseBodyPool.Get()
-		w.B = AppendBrotliBytesLevel(w.B, bodyBytes, level)
-
-		// Hack: swap resp.body with w.
-		if resp.body != nil {
-			responseBodyPool.Put(resp.body)
-		}
-		resp.body = w
-		resp.bodyRaw = nil
-	}
-	resp.Header.SetCanonical(strContentEncoding, strBr)
-	return nil
+	})
 }
 
 func (resp *Response) gzipBody(level int) error {
-	if len(resp.Header.peek(strContentEncoding)) > 0 {
-		// It looks like the body is already compressed.
-		// Do not compress it again.
-		return nil
-	}
-
-	if !resp.Header.isCompressibleContentType() {
-		// The content-type cannot be compressed.
-		return nil
-	}
-
-	if resp.bodyStream != nil {
-		// Reset Content-Length to -1, since it is impossible
-		// to determine body size beforehand of streamed compression.
-		// For https://github.com/valyala/fasthttp/issues/176 .
-		resp.Header.SetContentLength(-1)
-
-		// Do not care about memory allocations here, since gzip is slow
-		// and allocates a lot of memory by itself.
-		bs := resp.bodyStream
-		resp.bodyStream = NewStreamReader(func(sw *bufio.Writer) {
-			zw := acquireStacklessGzipWriter(sw, level)
-			fw := &flushWriter{
-				wf: zw,
-				bw: sw,
-			}
-			copyZeroAlloc(fw, bs) //nolint:errcheck
-			releaseStacklessGzipWriter(zw, level)
-			if bsc, ok := bs.(io.Closer); ok {
-				bsc.Close()
-			}
-		})
-	} else {
-		bodyBytes := resp.bodyBytes()
-		if len(bodyBytes) < minCompressLen {
-			// There is no sense in spending CPU time on small body compression,
-			// since there is a very high probability that the compressed
-			// body size will be bigger than the original body size.
-			return nil
+	return resp.encodeBody(strGzip, func(w io.Writer) io.WriteCloser {
+		return &stacklessCompressWriter{
+			Writer:  acquireStacklessGzipWriter(w, level),
+			level:   level,
+			release: releaseStacklessGzipWriter,
 		}
-		w := responseBodyPool.Get()
-		w.B = AppendGzipBytesLevel(w.B, bodyBytes, level)
+	})
+}
 
-		// Hack: swap resp.body with w.
-		if resp.body != nil {
-			responseBodyPool.Put(resp.body)
+func (resp *Response) deflateBody(level int) error {
+	return resp.encodeBody(strDeflate, func(w io.Writer) io.WriteCloser {
+		return &stacklessCompressWriter{
+			Writer:  acquireStacklessDeflateWriter(w, level),
+			level:   level,
+			release: releaseStacklessDeflateWriter,
 		}
-		resp.body = w
-		resp.bodyRaw = nil
-	}
-	resp.Header.SetCanonical(strContentEncoding, strGzip)
+	})
+}
+
+// stacklessCompressWriter is a CompressEncoder writer for the built-in
+// content-codings. Close returns the pooled writer to the pool.
+type stacklessCompressWriter struct {
+	stackless.Writer
+	level   int
+	release func(sw stackless.Writer, level int)
+}
+
+func (w *stacklessCompressWriter) Close() error {
+	w.release(w.Writer, w.level)
 	return nil
 }
 
-func (resp *Response) deflateBody(level int) error {
+// encodeBody compresses the response body with the writer returned by enc
+// and sets 'Content-Encoding: contentCoding' response header.
+func (resp *Response) encodeBody(contentCoding []byte, enc CompressEncoder) error {
 	if len(resp.Header.peek(strContentEncoding)) > 0 {
 		// It looks like the body is already compressed.
 		// Do not compress it again.
@@ -1571,17 +1769,21 @@ func (resp *Response) deflateBody(level int) error {
 		// For https://github.com/valyala/fasthttp/issues/176 .
 		resp.Header.SetContentLength(-1)
 
-		// Do not care about memory allocations here, since flate is slow
-		// and allocates a lot of memory by itself.
+		// Do not care about memory allocations here, since compression
+		// is slow and allocates a lot of memory by itself.
 		bs := resp.bodyStream
 		resp.bodyStream = NewStreamReader(func(sw *bufio.Writer) {
-			zw := acquireStacklessDeflateWriter(sw, level)
-			fw := &flushWriter{
-				wf: zw,
-				bw: sw,
+			zw := enc(sw)
+			var w io.Writer = zw
+			if wf, ok := zw.(writeFlusher); ok {
+				// Send the compressed data to the client as soon as possible.
+				w = &flushWriter{
+					wf: wf,
+					bw: sw,
+				}
 			}
-			copyZeroAlloc(fw, bs) //nolint:errcheck
-			releaseStacklessDeflateWriter(zw, level)
+			copyZeroAlloc(w, bs) //nolint:errcheck
+			zw.Close()           //nolint:errcheck
 			if bsc, ok := bs.(io.Closer); ok {
 				bsc.Close()
 			}
@@ -1595,7 +1797,15 @@ func (resp *Response) deflateBody(level int) error {
 			return nil
 		}
 		w := responseBodyPool.Get()
-		w.B = AppendDeflateBytesLevel(w.B, bodyBytes, level)
+		zw := enc(w)
+		_, err := zw.Write(bodyBytes)
+		if err1 := zw.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			responseBodyPool.Put(w)
+			return err
+		}
 
 		// Hack: swap resp.body with w.
 		if resp.body != nil {
@@ -1604,7 +1814,7 @@ func (resp *Response) deflateBody(level int) error {
 		resp.body = w
 		resp.bodyRaw = nil
 	}
-	resp.Header.SetCanonical(strContentEncoding, strDeflate)
+	resp.Header.SetCanonical(strContentEncoding, contentCoding)
 	return nil
 }
 
@@ -1663,6 +1873,32 @@ func (resp *Response) Write(w *bufio.Writer) error {
 	return nil
 }
 
+// writeVectored writes the response directly to c with a single vectored
+// write (writev) if the response body is fully buffered and doesn't fit
+// the free space in w. Writing such a response via w would require
+// a separate write for the header and the body.
+//
+// c must support vectored writes, otherwise the header and the body
+// are written separately.
+//
+// false is returned if the response hasn't been written,
+// so it must be written via Response.Write.
+func (resp *Response) writeVectored(w *bufio.Writer, c net.Conn) (bool, error) {
+	// Buffered data in w must be sent before the response.
+	if resp.bodyStream != nil || resp.mustSkipBody() || w.Buffered() > 0 {
+		return false, nil
+	}
+	body := resp.bodyBytes()
+	if len(body) <= w.Available() {
+		// w already sends the response in a single write on flush.
+		return false, nil
+	}
+	resp.Header.SetContentLength(len(body))
+	bufs := net.Buffers{resp.Header.Header(), body}
+	_, err := bufs.WriteTo(c)
+	return true, err
+}
+
 func (req *Request) writeBodyStream(w *bufio.Writer) error {
 	var err error
 
@@ -1686,7 +1922,11 @@ func (req *Request) writeBodyStream(w *bufio.Writer) error {
 	} else {
 		req.Header.SetContentLength(-1)
 		if err = req.Header.Write(w); err == nil {
-			err = writeBodyChunked(w, req.bodyStream)
+			if sr, ok := req.bodyStream.(*streamWriterReader); ok && sr.r == nil {
+				err = writeStreamWriterChunked(w, sr.sw)
+			} else {
+				err = writeBodyChunked(w, req.bodyStream, nil)
+			}
 		}
 	}
 	err1 := req.closeBodyStream()
@@ -1739,7 +1979,7 @@ func (resp *Response) writeBodyStream(w *bufio.Writer, sendBody bool) (err error
 				err = w.Flush()
 			}
 			if err == nil && sendBody {
-				err = writeBodyChunked(w, resp.bodyStream)
+				err = writeBodyChunked(w, resp.bodyStream, &resp.Header)
 			}
 		}
 	}
@@ -1810,7 +2050,14 @@ type httpWriter interface {
 	Write(w *bufio.Writer) error
 }
 
-func writeBodyChunked(w *bufio.Writer, r io.Reader) error {
+type httpReader interface {
+	Read(r *bufio.Reader) error
+}
+
+// writeBodyChunked writes r to w in chunked encoding.
+//
+// Trailers from h are written after the last chunk if h isn't nil.
+func writeBodyChunked(w *bufio.Writer, r io.Reader, h *ResponseHeader) error {
 	vbuf := copyBufPool.Get()
 	buf := vbuf.([]byte)
 
@@ -1823,7 +2070,12 @@ func writeBodyChunked(w *bufio.Writer, r io.Reader) error {
 				panic("BUG: io.Reader returned 0, nil")
 			}
 			if err == io.EOF {
-				if err = writeChunk(w, buf[:0]); err != nil {
+				if h != nil && len(h.trailer) > 0 {
+					err = writeLastChunk(w, h, buf[:0])
+				} else {
+					err = writeChunk(w, buf[:0])
+				}
+				if err != nil {
 					break
 				}
 				err = nil
@@ -1839,6 +2091,51 @@ func writeBodyChunked(w *bufio.Writer, r io.Reader) error {
 	return err
 }
 
+// writeStreamWriterChunked calls sw with a writer, which sends the data
+// written by sw to w in chunked encoding. Every flush of the writer
+// sends a chunk.
+func writeStreamWriterChunked(w *bufio.Writer, sw StreamWriter) (err error) {
+	cw := &chunkWriter{w: w}
+	var bw *bufio.Writer
+	v := streamWriterBufPool.Get()
+	if v == nil {
+		bw = bufio.NewWriter(cw)
+	} else {
+		bw = v.(*bufio.Writer)
+		bw.Reset(cw)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &ErrBodyStreamWritePanic{
+				error: fmt.Errorf("panic while writing body stream: %+v", r),
+			}
+		}
+	}()
+
+	sw(bw)
+	err = bw.Flush()
+	streamWriterBufPool.Put(bw)
+	if err != nil {
+		return err
+	}
+	return writeChunk(w, nil)
+}
+
+// chunkWriter writes every non-empty p to w as a chunk.
+type chunkWriter struct {
+	w *bufio.Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := writeChunk(cw.w, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func limitedReaderSize(r io.Reader) int64 {
 	lr, ok := r.(*io.LimitedReader)
 	if !ok {
@@ -1897,6 +2194,21 @@ func writeChunk(w *bufio.Writer, b []byte) error {
 	return err
 }
 
+// writeLastChunk writes the last zero-length chunk followed by trailers
+// from h to w. buf is used as a scratch space.
+func writeLastChunk(w *bufio.Writer, h *ResponseHeader, buf []byte) error {
+	buf = append(buf[:0], '0')
+	buf = append(buf, strCRLF...)
+	buf = h.appendTrailer(buf)
+	buf = append(buf, strCRLF...)
+	_, err := w.Write(buf)
+	err1 := w.Flush()
+	if err == nil {
+		err = err1
+	}
+	return err
+}
+
 // ErrBodyTooLarge is returned if either request or response body exceeds
 // the given limit.
 var ErrBodyTooLarge = errors.New("body size exceeds the given limit")
@@ -2013,6 +2325,34 @@ func appendBodyFixedSize(r *bufio.Reader, dst []byte, n int) ([]byte, error) {
 	}
 }
 
+// ErrPartialBody is returned from Response.Read if Response.PartialBodyOnTimeout
+// is set and the body wasn't read in full before the read deadline.
+//
+// The embedded error is the original timeout error.
+type ErrPartialBody struct {
+	error
+
+	// BodySize is the number of body bytes read before the timeout.
+	BodySize int
+
+	// ContentLength is the body size declared in the response header.
+	ContentLength int
+}
+
+func (e *ErrPartialBody) Error() string {
+	return fmt.Sprintf("read only %d out of %d body bytes: %s", e.BodySize, e.ContentLength, e.error)
+}
+
+// Timeout always returns true, so the error is treated as a timeout
+// by checks like:
+//
+//   if x, ok := err.(interface{ Timeout() bool }); ok && x.Timeout() {
+//
+// Only the Timeout() function of the net.Error interface is implemented.
+func (e *ErrPartialBody) Timeout() bool {
+	return true
+}
+
 // ErrBrokenChunk is returned when server receives a broken chunked body (Transfer-Encoding: chunked).
 type ErrBrokenChunk struct {
 	error
@@ -2029,6 +2369,11 @@ func readBodyChunked(r *bufio.Reader, maxBodySize int, dst []byte) ([]byte, erro
 		if err != nil {
 			return dst, err
 		}
+		if chunkSize == 0 {
+			// The last chunk is followed by optional trailer,
+			// which must be read by the caller via readTrailer.
+			return dst, nil
+		}
 		if maxBodySize > 0 && len(dst)+chunkSize > maxBodySize {
 			return dst, ErrBodyTooLarge
 		}
@@ -2042,15 +2387,59 @@ func readBodyChunked(r *bufio.Reader, maxBodySize int, dst []byte) ([]byte, erro
 			}
 		}
 		dst = dst[:len(dst)-strCRLFLen]
-		if chunkSize == 0 {
+	}
+}
+
+// readTrailer reads trailer fields following the last chunk of chunked body
+// up to the terminating empty line and appends them to dst.
+//
+// The total trailer size is limited by the size of r buffer.
+func readTrailer(r *bufio.Reader, dst []argsKV, disableNormalizing bool) ([]argsKV, error) {
+	n := 0
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				err = errTrailerTooLarge
+			}
+			return dst, ErrBrokenChunk{
+				error: fmt.Errorf("cannot read trailer: %s", err),
+			}
+		}
+		n += len(line)
+		if n > r.Size() {
+			return dst, ErrBrokenChunk{
+				error: fmt.Errorf("cannot read trailer: %s", errTrailerTooLarge),
+			}
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) == 0 {
 			return dst, nil
 		}
+		k := bytes.IndexByte(line, ':')
+		if k <= 0 || bytes.IndexAny(line[:k], " \t") >= 0 {
+			return dst, ErrBrokenChunk{
+				error: fmt.Errorf("invalid trailer line %q", line),
+			}
+		}
+		dst = appendArgBytes(dst, line[:k], stripSpace(line[k+1:]), argsHasValue)
+		normalizeHeaderKey(dst[len(dst)-1].key, disableNormalizing)
 	}
 }
 
+var errTrailerTooLarge = errors.New("trailer size exceeds buffer size")
+
 func parseChunkSize(r *bufio.Reader) (int, error) {
 	n, err := readHexInt(r)
 	if err != nil {
+		if err == io.EOF {
+			// The connection has been closed before the last chunk,
+			// so the body is truncated.
+			err = io.ErrUnexpectedEOF
+		}
 		return -1, err
 	}
 	for {
@@ -0,0 +1,75 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func BenchmarkResponseReset(b *testing.B) {
+	var resp Response
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp.SetStatusCode(StatusNotFound)
+		resp.Header.Set("X-Foo", "bar")
+		resp.SetBodyString("not found")
+		resp.Reset()
+	}
+}
+
+func BenchmarkResponseWriteLargeBody(b *testing.B) {
+	benchmarkResponseWriteLargeBody(b, false)
+}
+
+func BenchmarkResponseWriteVectoredLargeBody(b *testing.B) {
+	benchmarkResponseWriteLargeBody(b, true)
+}
+
+func benchmarkResponseWriteLargeBody(b *testing.B, vectored bool) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, c) //nolint:errcheck
+		c.Close()
+	}()
+
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("x"), 2*defaultWriteBufferSize)
+	bw := bufio.NewWriterSize(c, defaultWriteBufferSize)
+	var resp Response
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp.SetBody(body)
+		written := false
+		if vectored {
+			if written, err = resp.writeVectored(bw, c); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if !written {
+			if err = resp.Write(bw); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if err = bw.Flush(); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+		resp.Reset()
+	}
+}
@@ -5,8 +5,8 @@ import (
 	rtp "runtime/pprof"
 	"strings"
 
-	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttpadaptor"
+	fasthttp "github.com/caser789/justhttp"
+	"github.com/caser789/justhttp/fasthttpadaptor"
 )
 
 var (
@@ -0,0 +1,74 @@
+package fasthttp
+
+// ResponseWriter is the subset of RequestCtx methods used for writing
+// the response.
+//
+// Code depending on ResponseWriter instead of RequestCtx may be tested
+// with fake ResponseWriter implementations or with the ResponseWriter
+// returned from NewResponseWriter, which doesn't require RequestCtx:
+//
+//     func helloHandler(w fasthttp.ResponseWriter, req *fasthttp.Request) {
+//         w.SetContentType("text/plain")
+//         fmt.Fprintf(w, "Hello, %s!", req.URI().QueryArgs().Peek("name"))
+//     }
+//
+//     // in RequestHandler
+//     helloHandler(ctx, &ctx.Request)
+//
+//     // in tests
+//     var resp fasthttp.Response
+//     helloHandler(fasthttp.NewResponseWriter(&resp), req)
+//
+// RequestCtx implements ResponseWriter.
+type ResponseWriter interface {
+	// ResponseHeader returns the response header, which may be modified
+	// before writing the response.
+	ResponseHeader() *ResponseHeader
+
+	// SetStatusCode sets response status code.
+	SetStatusCode(statusCode int)
+
+	// SetContentType sets response Content-Type.
+	SetContentType(contentType string)
+
+	// Write appends p to response body.
+	Write(p []byte) (int, error)
+
+	// WriteString appends s to response body.
+	WriteString(s string) (int, error)
+}
+
+var _ ResponseWriter = &RequestCtx{}
+
+// NewResponseWriter returns ResponseWriter writing to resp.
+func NewResponseWriter(resp *Response) ResponseWriter {
+	return &responseWriter{
+		resp: resp,
+	}
+}
+
+type responseWriter struct {
+	resp *Response
+}
+
+func (w *responseWriter) ResponseHeader() *ResponseHeader {
+	return &w.resp.Header
+}
+
+func (w *responseWriter) SetStatusCode(statusCode int) {
+	w.resp.SetStatusCode(statusCode)
+}
+
+func (w *responseWriter) SetContentType(contentType string) {
+	w.resp.Header.SetContentType(contentType)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.resp.AppendBody(p)
+	return len(p), nil
+}
+
+func (w *responseWriter) WriteString(s string) (int, error) {
+	w.resp.AppendBodyString(s)
+	return len(s), nil
+}
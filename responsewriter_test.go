@@ -0,0 +1,69 @@
+package fasthttp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testResponseWriterHandler(w ResponseWriter, req *Request) {
+	name := req.URI().QueryArgs().Peek("name")
+	if len(name) == 0 {
+		w.SetStatusCode(StatusBadRequest)
+		w.WriteString("missing name") //nolint:errcheck
+		return
+	}
+	w.SetContentType("text/plain")
+	w.ResponseHeader().Set("X-Name", string(name))
+	fmt.Fprintf(w, "Hello, %s!", name) //nolint:errcheck
+}
+
+func TestNewResponseWriter(t *testing.T) {
+	t.Parallel()
+
+	// The handler is driven without RequestCtx.
+	var req Request
+	req.SetRequestURI("http://foobar.com/hello?name=bob")
+	var resp Response
+	testResponseWriterHandler(NewResponseWriter(&resp), &req)
+
+	if resp.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
+	}
+	if string(resp.Header.ContentType()) != "text/plain" {
+		t.Fatalf("unexpected content type: %q. Expecting %q", resp.Header.ContentType(), "text/plain")
+	}
+	if string(resp.Header.Peek("X-Name")) != "bob" {
+		t.Fatalf("unexpected header: %q. Expecting %q", resp.Header.Peek("X-Name"), "bob")
+	}
+	if string(resp.Body()) != "Hello, bob!" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "Hello, bob!")
+	}
+
+	req.SetRequestURI("http://foobar.com/hello")
+	resp.Reset()
+	testResponseWriterHandler(NewResponseWriter(&resp), &req)
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+	if string(resp.Body()) != "missing name" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "missing name")
+	}
+}
+
+func TestRequestCtxResponseWriter(t *testing.T) {
+	t.Parallel()
+
+	// The same handler is driven by RequestCtx.
+	ctx := NewTestRequestCtx("GET", "http://foobar.com/hello?name=alice", "")
+	if _, err := ServeTestRequestCtx(ctx, func(ctx *RequestCtx) {
+		testResponseWriterHandler(ctx, &ctx.Request)
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(ctx.Response.Header.Peek("X-Name")) != "alice" {
+		t.Fatalf("unexpected header: %q. Expecting %q", ctx.Response.Header.Peek("X-Name"), "alice")
+	}
+	if string(ctx.Response.Body()) != "Hello, alice!" {
+		t.Fatalf("unexpected body: %q. Expecting %q", ctx.Response.Body(), "Hello, alice!")
+	}
+}
@@ -2,6 +2,7 @@ package fasthttp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"mime/multipart"
 	"net"
 	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -150,12 +152,41 @@ type ServeHandler func(c net.Conn) error
 type Server struct {
 	noCopy noCopy //nolint:unused,structcheck
 
+	// The total size of request bodies being read and handled.
+	// Accessed atomically, so it must be the first field for 64-bit
+	// alignment on 32-bit platforms.
+	requestBodyBytesInFlight int64
+
 	// Handler for processing incoming requests.
 	//
-	// Take into account that no `panic` recovery is done by `fasthttp` (thus any `panic` will take down the entire server).
-	// Instead the user should use `recover` to handle these situations.
+	// Panics in Handler are recovered by the server, see PanicHandler.
+	// Take into account that panics in goroutines started by Handler
+	// aren't recovered and will take down the entire server.
 	Handler RequestHandler
 
+	// PanicHandler is called when Handler panics. err is the value
+	// passed to panic.
+	//
+	// The response is reset to 500 Internal Server Error before calling
+	// PanicHandler, so it may be overridden by PanicHandler unless
+	// it has been already flushed via RequestCtx.Flush.
+	// The connection is closed after sending the response.
+	// Panics in PanicHandler are logged via Logger and the response
+	// falls back to 500 Internal Server Error.
+	//
+	// By default the panic is logged with its stack trace via Logger.
+	PanicHandler func(ctx *RequestCtx, err interface{})
+
+	// OptionsHandler is called for OPTIONS requests after Handler
+	// if Handler set neither the response status code nor the body.
+	//
+	// Use OptionsAllowHandler for responding with the Allow header
+	// listing the methods supported by the server. This includes
+	// the server-wide "OPTIONS *" requests.
+	//
+	// By default OPTIONS requests are handled by Handler only.
+	OptionsHandler RequestHandler
+
 	// ErrorHandler for returning a response in case of an error while receiving or parsing the request.
 	//
 	// The following is a non-exhaustive list of errors that can be expected as argument:
@@ -163,8 +194,16 @@ type Server struct {
 	//   * io.ErrUnexpectedEOF
 	//   * ErrGetOnly
 	//   * ErrSmallBuffer
+	//   * ErrHeaderTooLarge
+	//   * ErrTooManyHeaders
 	//   * ErrBodyTooLarge
 	//   * ErrBrokenChunks
+	//   * ErrRequestBodyBytesInFlightExceeded
+	//   * ErrHTTP2Preface
+	//
+	// The response set by ErrorHandler is sent to the client before closing
+	// the connection. By default 413 Request Entity Too Large is sent
+	// for ErrBodyTooLarge and 400 Bad Request is sent for malformed requests.
 	ErrorHandler func(ctx *RequestCtx, err error)
 
 	// HeaderReceived is called after receiving the header
@@ -186,6 +225,8 @@ type Server struct {
 	// Server name for sending in response headers.
 	//
 	// Default server name is used if left blank.
+	//
+	// Use SetName for changing the name of the running server.
 	Name string
 
 	// The maximum number of concurrent connections the server may serve.
@@ -226,6 +267,15 @@ type Server struct {
 	// By default request read timeout is unlimited.
 	ReadTimeout time.Duration
 
+	// ReadHeaderTimeout is the amount of time allowed to read
+	// request headers. The connection is closed if the client
+	// doesn't send the headers in time, which protects against
+	// slowloris attacks. The rest of the request is still limited
+	// by ReadTimeout.
+	//
+	// ReadTimeout is used if ReadHeaderTimeout is zero.
+	ReadHeaderTimeout time.Duration
+
 	// WriteTimeout is the maximum duration before timing out
 	// writes of the response. It is reset after the request handler
 	// has returned.
@@ -238,6 +288,16 @@ type Server struct {
 	// is zero, the value of ReadTimeout is used.
 	IdleTimeout time.Duration
 
+	// Maximum number of simultaneous client connections accepted by Serve.
+	//
+	// Excess connections are rejected with 503 Service Unavailable
+	// and closed, so the number of connections doesn't depend
+	// on Concurrency and worker availability.
+	// Hijacked connections aren't counted.
+	//
+	// By default the number of connections is unlimited.
+	MaxConns int
+
 	// Maximum number of concurrent client connections allowed per IP.
 	//
 	// By default unlimited number of concurrent connections
@@ -252,8 +312,22 @@ type Server struct {
 	// By default unlimited number of requests may be served per connection.
 	MaxRequestsPerConn int
 
+	// Maximum duration for connection lifetime.
+	//
+	// The server closes the connection after the duration passes since
+	// the connection has been accepted regardless of keep-alive state.
+	// Requests being read or responses being written at the moment
+	// are interrupted, since connection read and write deadlines never
+	// exceed the connection lifetime. This limits the impact of clients
+	// holding connections for too long.
+	//
+	// Hijacked connections aren't limited.
+	//
+	// By default connection lifetime is unlimited.
+	MaxConnDuration time.Duration
+
 	// MaxKeepaliveDuration is a no-op and only left here for backwards compatibility.
-	// Deprecated: Use IdleTimeout instead.
+	// Deprecated: Use MaxConnDuration instead.
 	MaxKeepaliveDuration time.Duration
 
 	// Whether to enable tcp keep-alive connections.
@@ -268,6 +342,22 @@ type Server struct {
 	// TCP keep-alive period is determined by operation system by default.
 	TCPKeepalivePeriod time.Duration
 
+	// Whether to enable Nagle's algorithm on accepted tcp connections.
+	//
+	// TCP_NODELAY is enabled on tcp connections by default,
+	// so small responses are sent without delay. Set this to true
+	// for letting the operating system coalesce small writes
+	// into fewer packets at the cost of higher latency.
+	DisableTCPNoDelay bool
+
+	// Whether to flush every response immediately.
+	//
+	// By default responses to pipelined requests are buffered and flushed
+	// to the connection at once after the last buffered request
+	// is served. This reduces the number of write syscalls when clients
+	// pipeline many small requests.
+	DisablePipelineCoalescing bool
+
 	// Maximum request body size.
 	//
 	// The server rejects requests with bodies exceeding this limit.
@@ -275,6 +365,41 @@ type Server struct {
 	// Request body size is limited by DefaultMaxRequestBodySize by default.
 	MaxRequestBodySize int
 
+	// Maximum request header size.
+	//
+	// The server rejects requests with headers exceeding this limit
+	// with ErrHeaderTooLarge, which is responded with
+	// 431 Request Header Fields Too Large by default.
+	//
+	// By default request header size is limited only by ReadBufferSize.
+	MaxRequestHeaderSize int
+
+	// Maximum number of request header lines.
+	//
+	// The server rejects requests with more header lines
+	// with ErrTooManyHeaders, which is responded with
+	// 431 Request Header Fields Too Large by default.
+	// This protects from requests with many tiny headers,
+	// which fit MaxRequestHeaderSize.
+	//
+	// By default the number of request header lines is unlimited.
+	MaxRequestHeaderCount int
+
+	// Maximum total size of request bodies, which may be read and handled
+	// concurrently by the server.
+	//
+	// The server rejects requests with StatusServiceUnavailable if their bodies
+	// don't fit the limit. The declared Content-Length is accounted
+	// for requests with known body size, while MaxRequestBodySize is accounted
+	// for chunked requests. The accounted size is released after the request
+	// handler returns.
+	//
+	// This protects the server from running out of memory under many
+	// concurrent large uploads.
+	//
+	// By default the total size of in-flight request bodies is unlimited.
+	MaxRequestBodyBytesInFlight int
+
 	// Aggressively reduces memory usage at the cost of higher CPU usage
 	// if set to true.
 	//
@@ -320,6 +445,18 @@ type Server struct {
 	// Server logs all full errors by default.
 	SecureErrorLogMessage bool
 
+	// Proxies, which are trusted to set X-Forwarded-For and X-Real-IP
+	// request headers. See RequestCtx.RealIP for details.
+	//
+	// Example:
+	//
+	//     _, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	//     s.TrustedProxies = []*net.IPNet{ipNet}
+	//
+	// By default no proxies are trusted, so RequestCtx.RealIP always
+	// returns RequestCtx.RemoteIP.
+	TrustedProxies []*net.IPNet
+
 	// Header names are passed as-is without normalization
 	// if this option is set.
 	//
@@ -343,6 +480,15 @@ type Server struct {
 	// and accept new connections immidiatelly).
 	SleepWhenConcurrencyLimitsExceeded time.Duration
 
+	// WaitWhenConcurrencyLimitsExceeded is the maximum duration Serve waits
+	// for a busy connection to finish before rejecting the incoming
+	// connection if the concurrency limit is exceeded. New connections
+	// aren't accepted while waiting, so they are queued by the listener.
+	//
+	// By default incoming connections are rejected immediately
+	// if the concurrency limit is exceeded.
+	WaitWhenConcurrencyLimitsExceeded time.Duration
+
 	// NoDefaultServerHeader, when set to true, causes the default Server header
 	// to be excluded from the Response.
 	//
@@ -366,6 +512,25 @@ type Server struct {
 	// set to true, the Content-Type will not be present.
 	NoDefaultContentType bool
 
+	// PostHandlerHeaders contains headers, which are added to every
+	// response after the handler returns. The headers are added
+	// in the given order.
+	//
+	// Headers already set by the handler take precedence, so handlers
+	// may override any of these values. Headers explicitly set to empty
+	// value by the handler are left as is. This is useful for headers,
+	// which must be present on every response such as security or CORS
+	// headers.
+	//
+	// Content-Type is applied only if NoDefaultContentType is set,
+	// since otherwise the response always has the default Content-Type.
+	//
+	// The headers are applied to error responses sent for malformed
+	// requests too.
+	//
+	// PostHandlerHeaders mustn't be changed after the server is started.
+	PostHandlerHeaders []PostHandlerHeader
+
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state. See the
 	// ConnState type and associated constants for details.
@@ -386,11 +551,35 @@ type Server struct {
 	// CloseOnShutdown when true adds a `Connection: close` header when when the server is shutting down.
 	CloseOnShutdown bool
 
+	// EchoRequestID enables X-Request-ID response header.
+	//
+	// The header echoes X-Request-ID request header if present,
+	// otherwise a request ID is generated from RequestCtx.ID.
+	// See RequestCtx.RequestID for details.
+	//
+	// The handler may override the header value. The header isn't set
+	// on responses generated by TimeoutHandler on timeout.
+	EchoRequestID bool
+
 	// StreamRequestBody enables request body streaming,
 	// and calls the handler sooner when given body is
 	// larger then the current limit.
 	StreamRequestBody bool
 
+	// StreamRequestBodyIdleTimeout is the maximum duration for waiting
+	// for the next chunk of the streamed request body.
+	//
+	// Reading from RequestCtx.RequestBodyStream fails with timeout error
+	// if the client stalls for longer than StreamRequestBodyIdleTimeout
+	// while uploading the body. The connection is closed after
+	// the response is sent in this case. ReadTimeout still limits
+	// the overall request reading time.
+	//
+	// The timeout is applied only if StreamRequestBody is set.
+	//
+	// By default there is no idle timeout for the streamed body.
+	StreamRequestBodyIdleTimeout time.Duration
+
 	tlsConfig  *tls.Config
 	nextProtos map[string]ServeHandler
 
@@ -399,6 +588,9 @@ type Server struct {
 	perIPConnCounter perIPConnCounter
 	serverName       atomic.Value
 
+	postHandlerHeaders     []argsKV
+	postHandlerHeadersOnce sync.Once
+
 	ctxPool        sync.Pool
 	readerPool     sync.Pool
 	writerPool     sync.Pool
@@ -411,6 +603,27 @@ type Server struct {
 	open int32
 	stop int32
 	done chan struct{}
+
+	// maxConnsCh limits the number of connections accepted by Serve
+	// to MaxConns.
+	maxConnsCh chan struct{}
+}
+
+// PostHandlerHeader is a response header added by Server.PostHandlerHeaders.
+type PostHandlerHeader struct {
+	Key   string
+	Value string
+}
+
+// OptionsAllowHandler returns RequestHandler, which responds with
+// StatusNoContent and the Allow header containing the given methods
+// via RequestCtx.AllowMethods.
+//
+// The returned handler is intended for Server.OptionsHandler.
+func OptionsAllowHandler(methods ...string) RequestHandler {
+	return func(ctx *RequestCtx) {
+		ctx.AllowMethods(methods...)
+	}
 }
 
 // TimeoutHandler creates RequestHandler, which returns StatusRequestTimeout
@@ -420,6 +633,9 @@ type Server struct {
 // The returned handler may return StatusTooManyRequests error with the given
 // msg to the client if there are more than Server.Concurrency concurrent
 // handlers h are running at the moment.
+//
+// The RequestCtx passed to h is cancelled on timeout. See TimeoutWithCodeHandler
+// for details.
 func TimeoutHandler(h RequestHandler, timeout time.Duration, msg string) RequestHandler {
 	return TimeoutWithCodeHandler(h, timeout, msg, StatusRequestTimeout)
 }
@@ -431,6 +647,12 @@ func TimeoutHandler(h RequestHandler, timeout time.Duration, msg string) Request
 // The returned handler may return StatusTooManyRequests error with the given
 // msg to the client if there are more than Server.Concurrency concurrent
 // handlers h are running at the moment.
+//
+// The RequestCtx passed to h is cancelled when the timeout fires, i.e.
+// ctx.Done() is closed and ctx.Err() returns context.DeadlineExceeded.
+// h keeps running after the timeout until it returns, so h must respect
+// the cancellation in order to abort long-running work and free
+// the underlying goroutine.
 func TimeoutWithCodeHandler(h RequestHandler, timeout time.Duration, msg string, statusCode int) RequestHandler {
 	if timeout <= 0 {
 		return h
@@ -445,24 +667,85 @@ func TimeoutWithCodeHandler(h RequestHandler, timeout time.Duration, msg string,
 			return
 		}
 
-		ch := ctx.timeoutCh
-		if ch == nil {
+		// Nested TimeoutHandler mustn't clobber the state of the outer one,
+		// so it is saved and restored when h returns in time.
+		prevTimeout := ctx.timeout
+		nested := prevTimeout != nil
+
+		ts := &timeoutState{
+			doneCh:   make(chan struct{}),
+			deadline: time.Now().Add(timeout),
+		}
+		if nested && prevTimeout.deadline.Before(ts.deadline) {
+			ts.deadline = prevTimeout.deadline
+		}
+
+		// The outer handler already waits on ctx.timeoutCh
+		// and ctx.timeoutTimer, so nested handlers use their own.
+		var ch chan struct{}
+		var timer *time.Timer
+		if nested {
 			ch = make(chan struct{}, 1)
-			ctx.timeoutCh = ch
+			timer = AcquireTimer(timeout)
+		} else {
+			if ctx.timeoutCh == nil {
+				ctx.timeoutCh = make(chan struct{}, 1)
+			}
+			ch = ctx.timeoutCh
+			ctx.timeoutTimer = initTimer(ctx.timeoutTimer, timeout)
+			timer = ctx.timeoutTimer
 		}
+
+		ctx.timeout = ts
 		go func() {
 			h(ctx)
 			ch <- struct{}{}
 			<-concurrencyCh
 		}()
-		ctx.timeoutTimer = initTimer(ctx.timeoutTimer, timeout)
+		timedOut := false
 		select {
 		case <-ch:
-		case <-ctx.timeoutTimer.C:
+		case <-timer.C:
+			timedOut = true
+		case <-ctx.s.done:
+			// Propagate server shutdown to h, but still honor the timeout.
+			ts.cancel(context.Canceled)
+			select {
+			case <-ch:
+			case <-timer.C:
+				timedOut = true
+			}
+		}
+		if nested {
+			ReleaseTimer(timer)
+		} else {
+			stopTimer(timer)
+		}
+		if timedOut {
+			ts.cancel(context.DeadlineExceeded)
 			ctx.TimeoutErrorWithCode(msg, statusCode)
+			return
 		}
-		stopTimer(ctx.timeoutTimer)
+		ctx.timeout = prevTimeout
+	}
+}
+
+// timeoutState holds the context state of a handler wrapped
+// by TimeoutHandler.
+type timeoutState struct {
+	doneCh   chan struct{}
+	err      error
+	deadline time.Time
+}
+
+// cancel closes the channel returned by RequestCtx.Done.
+// Subsequent calls are no-op.
+func (ts *timeoutState) cancel(err error) {
+	if ts.err != nil {
+		return
 	}
+	ts.err = err
+	close(ts.doneCh)
 }
 
 //RequestConfig configure the per request deadline and body limits
@@ -481,15 +764,18 @@ type RequestConfig struct {
 }
 
 // CompressHandler returns RequestHandler that transparently compresses
-// response body generated by h if the request contains 'gzip' or 'deflate'
-// 'Accept-Encoding' header.
+// response body generated by h if the request contains 'gzip', 'deflate'
+// or another registered content-coding in 'Accept-Encoding' header.
 func CompressHandler(h RequestHandler) RequestHandler {
 	return CompressHandlerLevel(h, CompressDefaultCompression)
 }
 
 // CompressHandlerLevel returns RequestHandler that transparently compresses
-// response body generated by h if the request contains a 'gzip' or 'deflate'
-// 'Accept-Encoding' header.
+// response body generated by h if the request contains a 'gzip', 'deflate'
+// or another registered content-coding in 'Accept-Encoding' header.
+//
+// The content-coding is selected by q-values as in RequestCtx.Compress,
+// except for 'br', which isn't used.
 //
 // Level is the desired compression level:
 //
@@ -501,17 +787,17 @@ func CompressHandler(h RequestHandler) RequestHandler {
 func CompressHandlerLevel(h RequestHandler, level int) RequestHandler {
 	return func(ctx *RequestCtx) {
 		h(ctx)
-		if ctx.Request.Header.HasAcceptEncodingBytes(strGzip) {
-			ctx.Response.gzipBody(level) //nolint:errcheck
-		} else if ctx.Request.Header.HasAcceptEncodingBytes(strDeflate) {
-			ctx.Response.deflateBody(level) //nolint:errcheck
+		if enc := selectCompressEncoder(ctx.Request.Header.peek(strAcceptEncoding), false); enc != nil {
+			enc(&ctx.Response, level, CompressBrotliDefaultCompression) //nolint:errcheck
 		}
 	}
 }
 
 // CompressHandlerBrotliLevel returns RequestHandler that transparently compresses
-// response body generated by h if the request contains a 'br', 'gzip' or 'deflate'
-// 'Accept-Encoding' header.
+// response body generated by h if the request contains a 'br', 'gzip', 'deflate'
+// or another registered content-coding in 'Accept-Encoding' header.
+//
+// The content-coding is selected by q-values as in RequestCtx.Compress.
 //
 // brotliLevel is the desired compression level for brotli.
 //
@@ -530,12 +816,8 @@ func CompressHandlerLevel(h RequestHandler, level int) RequestHandler {
 func CompressHandlerBrotliLevel(h RequestHandler, brotliLevel, otherLevel int) RequestHandler {
 	return func(ctx *RequestCtx) {
 		h(ctx)
-		if ctx.Request.Header.HasAcceptEncodingBytes(strBr) {
-			ctx.Response.brotliBody(brotliLevel) //nolint:errcheck
-		} else if ctx.Request.Header.HasAcceptEncodingBytes(strGzip) {
-			ctx.Response.gzipBody(otherLevel) //nolint:errcheck
-		} else if ctx.Request.Header.HasAcceptEncodingBytes(strDeflate) {
-			ctx.Response.deflateBody(otherLevel) //nolint:errcheck
+		if enc := selectCompressEncoder(ctx.Request.Header.peek(strAcceptEncoding), true); enc != nil {
+			enc(&ctx.Response, otherLevel, brotliLevel) //nolint:errcheck
 		}
 	}
 }
@@ -553,7 +835,8 @@ func CompressHandlerBrotliLevel(h RequestHandler, brotliLevel, otherLevel int) R
 //
 // It is unsafe modifying/reading RequestCtx instance from concurrently
 // running goroutines. The only exception is TimeoutError*, which may be called
-// while other goroutines accessing RequestCtx.
+// while other goroutines accessing RequestCtx. Build with the fasthttp_ctxguard
+// tag for panicking on concurrent calls to the response writing methods.
 type RequestCtx struct {
 	noCopy noCopy //nolint:unused,structcheck
 
@@ -584,9 +867,21 @@ type RequestCtx struct {
 	timeoutResponse *Response
 	timeoutCh       chan struct{}
 	timeoutTimer    *time.Timer
+	timeout         *timeoutState
 
 	hijackHandler    HijackHandler
 	hijackNoResponse bool
+
+	// Connection writer and write timeout for Flush.
+	// They are set by the Server only while the handler is running.
+	bw              *bufio.Writer
+	writeTimeout    time.Duration
+	canFlush        bool
+	responseFlushed bool
+
+	requestID []byte
+
+	guard ctxGuard
 }
 
 // HijackHandler must process the hijacked connection c.
@@ -800,6 +1095,31 @@ func (ctx *RequestCtx) ID() uint64 {
 	return (ctx.connID << 32) | ctx.connRequestNum
 }
 
+// RequestID returns the request ID, which may be used for log correlation
+// across services.
+//
+// The ID is taken from X-Request-ID request header if present, otherwise
+// it is generated from ID in hex form.
+//
+// The returned value is valid until RequestHandler return.
+func (ctx *RequestCtx) RequestID() []byte {
+	if len(ctx.requestID) == 0 {
+		if v := ctx.Request.Header.Peek(HeaderXRequestID); len(v) > 0 {
+			ctx.requestID = append(ctx.requestID[:0], v...)
+		} else {
+			ctx.requestID = appendRequestID(ctx.requestID[:0], ctx.ID())
+		}
+	}
+	return ctx.requestID
+}
+
+func appendRequestID(dst []byte, id uint64) []byte {
+	for i := 60; i >= 0; i -= 4 {
+		dst = append(dst, upperhex[(id>>uint(i))&0xf])
+	}
+	return dst
+}
+
 // ConnID returns unique connection ID.
 //
 // This ID may be used to match distinct requests to the same incoming
@@ -833,9 +1153,46 @@ func (ctx *RequestCtx) SetConnectionClose() {
 	ctx.Response.SetConnectionClose()
 }
 
+// ConnectionWillClose returns true if the connection will be closed
+// after sending the current response.
+//
+// The result depends on 'Connection' request and response headers,
+// Server.DisableKeepalive, Server.MaxRequestsPerConn and the connection
+// lifetime limited by Server.MaxConnDuration.
+// So it may change if the handler calls SetConnectionClose.
+func (ctx *RequestCtx) ConnectionWillClose() bool {
+	if ctx.Request.Header.ConnectionClose() || ctx.Response.ConnectionClose() {
+		return true
+	}
+	s := ctx.s
+	if s == nil {
+		return false
+	}
+	if s.DisableKeepalive {
+		return true
+	}
+	if s.MaxRequestsPerConn > 0 && ctx.connRequestNum >= uint64(s.MaxRequestsPerConn) {
+		return true
+	}
+	if d := s.MaxConnDuration; d > 0 && time.Since(ctx.connTime) >= d {
+		return true
+	}
+	return s.CloseOnShutdown && atomic.LoadInt32(&s.stop) == 1
+}
+
 // SetStatusCode sets response status code.
 func (ctx *RequestCtx) SetStatusCode(statusCode int) {
+	ctx.guard.enter()
 	ctx.Response.SetStatusCode(statusCode)
+	ctx.guard.leave()
+}
+
+// ResponseHeader returns the response header.
+//
+// It is a shortcut for &ctx.Response.Header, so RequestCtx
+// implements ResponseWriter.
+func (ctx *RequestCtx) ResponseHeader() *ResponseHeader {
+	return &ctx.Response.Header
 }
 
 // SetContentType sets response Content-Type.
@@ -876,6 +1233,29 @@ func (ctx *RequestCtx) UserAgent() []byte {
 	return ctx.Request.Header.UserAgent()
 }
 
+// BearerToken returns the token from 'Authorization: Bearer <token>'
+// request header.
+//
+// The auth scheme is matched case-insensitively. nil is returned
+// if the Authorization header is missing or uses another auth scheme.
+//
+// The token is valid until returning from RequestHandler.
+func (ctx *RequestCtx) BearerToken() []byte {
+	auth := ctx.Request.Header.Authorization()
+	n := len(strBearer)
+	if len(auth) <= n || !caseInsensitiveCompare(auth[:n], strBearer) {
+		return nil
+	}
+	if auth[n] != ' ' && auth[n] != '\t' {
+		return nil
+	}
+	token := bytes.Trim(auth[n:], " \t")
+	if len(token) == 0 {
+		return nil
+	}
+	return token
+}
+
 // Path returns requested path.
 //
 // The path is valid until returning from RequestHandler.
@@ -885,6 +1265,11 @@ func (ctx *RequestCtx) Path() []byte {
 
 // Host returns requested host.
 //
+// The host is taken from the request target if it is in absolute-form
+// (e.g. 'GET http://example.com/path HTTP/1.1'), so it may differ
+// from the Host header. Use ctx.Request.Header.Host() for obtaining
+// the Host header value.
+//
 // The host is valid until returning from RequestHandler.
 func (ctx *RequestCtx) Host() []byte {
 	return ctx.URI().Host()
@@ -930,6 +1315,23 @@ func (ctx *RequestCtx) MultipartForm() (*multipart.Form, error) {
 	return ctx.Request.MultipartForm()
 }
 
+// MultipartFormWithLimit returns requests's multipart form keeping
+// up to maxMemory bytes of uploaded files in memory. The remaining files
+// are stored in temporary files.
+//
+// Returns ErrNoMultipartForm if request's content-type
+// isn't 'multipart/form-data'.
+//
+// All uploaded temporary files are automatically deleted after
+// returning from RequestHandler.
+//
+// The returned form is valid until returning from RequestHandler.
+//
+// See also MultipartForm.
+func (ctx *RequestCtx) MultipartFormWithLimit(maxMemory int64) (*multipart.Form, error) {
+	return ctx.Request.MultipartFormWithLimit(maxMemory)
+}
+
 // FormFile returns uploaded file associated with the given multipart form key.
 //
 // The file is automatically deleted after returning from RequestHandler,
@@ -1009,10 +1411,14 @@ func SaveMultipartFile(fh *multipart.FileHeader, path string) (err error) {
 
 // FormValue returns form value associated with the given key.
 //
-// The value is searched in the following places:
+// The value is searched in the following places in the given order,
+// so query string values take precedence over body values:
 //
 //   * Query string.
 //   * POST or PUT body.
+//   * Multipart form values.
+//
+// Empty values are skipped, so the search continues in the next place.
 //
 // There are more fine-grained methods for obtaining form values:
 //
@@ -1041,6 +1447,26 @@ func (ctx *RequestCtx) FormValue(key string) []byte {
 	return nil
 }
 
+// IsSuccess returns true if response status code is 2xx.
+func (ctx *RequestCtx) IsSuccess() bool {
+	return ctx.Response.Header.IsSuccess()
+}
+
+// IsRedirect returns true if response status code is 3xx.
+func (ctx *RequestCtx) IsRedirect() bool {
+	return ctx.Response.Header.IsRedirect()
+}
+
+// IsClientError returns true if response status code is 4xx.
+func (ctx *RequestCtx) IsClientError() bool {
+	return ctx.Response.Header.IsClientError()
+}
+
+// IsServerError returns true if response status code is 5xx.
+func (ctx *RequestCtx) IsServerError() bool {
+	return ctx.Response.Header.IsServerError()
+}
+
 // IsGet returns true if request method is GET.
 func (ctx *RequestCtx) IsGet() bool {
 	return ctx.Request.Header.IsGet()
@@ -1062,10 +1488,41 @@ func (ctx *RequestCtx) IsDelete() bool {
 }
 
 // IsConnect returns true if request method is CONNECT.
+//
+// The request target of CONNECT requests is in authority-form,
+// i.e. 'host:port'. It may be obtained via ctx.Host().
+//
+// Proxies may establish a tunnel to the target by responding
+// with 200 OK and hijacking the connection:
+//
+//     if ctx.IsConnect() {
+//         target := string(ctx.Host())
+//         ctx.Hijack(func(c net.Conn) {
+//             tc, err := net.Dial("tcp", target)
+//             if err != nil {
+//                 return
+//             }
+//             defer tc.Close()
+//             go io.Copy(tc, c)
+//             io.Copy(c, tc)
+//         })
+//         return
+//     }
 func (ctx *RequestCtx) IsConnect() bool {
 	return ctx.Request.Header.IsConnect()
 }
 
+// IsProxyRequest returns true if the request is addressed to a proxy,
+// i.e. if the request target is in absolute-form
+// (e.g. 'GET http://example.com/path HTTP/1.1') or the request method
+// is CONNECT.
+//
+// The target host, scheme and path of the proxy request may be obtained
+// via ctx.URI().
+func (ctx *RequestCtx) IsProxyRequest() bool {
+	return ctx.IsConnect() || isAbsoluteURI(ctx.Request.Header.RequestURI())
+}
+
 // IsOptions returns true if request method is OPTIONS.
 func (ctx *RequestCtx) IsOptions() bool {
 	return ctx.Request.Header.IsOptions()
@@ -1139,6 +1596,69 @@ func (ctx *RequestCtx) RemoteIP() net.IP {
 	return addrToIP(ctx.RemoteAddr())
 }
 
+// RealIP returns the client ip the request came from taking into account
+// X-Forwarded-For and X-Real-IP request headers set by reverse proxies.
+//
+// The headers are honored only if the request came from a proxy listed
+// in Server.TrustedProxies. Otherwise RemoteIP is returned, since any client
+// may send arbitrary headers. X-Forwarded-For is scanned from left to right
+// skipping trusted proxies, and the left-most untrusted ip is returned,
+// i.e. the address of the original client. RemoteIP is returned if invalid
+// ip is met before that.
+//
+// Note that the left-most X-Forwarded-For entries may be spoofed by the client
+// if the trusted proxies append to the header sent by the client instead
+// of overwriting it. Do not rely on RealIP for access control then.
+//
+// Always returns non-nil result.
+func (ctx *RequestCtx) RealIP() net.IP {
+	ip := ctx.RemoteIP()
+	if !ctx.s.isTrustedProxy(ip) {
+		return ip
+	}
+
+	if xff := ctx.Request.Header.Peek(HeaderXForwardedFor); len(xff) > 0 {
+		var (
+			vs      headerValueScanner
+			firstIP net.IP
+		)
+		vs.b = xff
+		for vs.next() {
+			addr := net.ParseIP(b2s(vs.value))
+			if addr == nil {
+				return ip
+			}
+			if !ctx.s.isTrustedProxy(addr) {
+				return addr
+			}
+			if firstIP == nil {
+				firstIP = addr
+			}
+		}
+		// All the proxies are trusted.
+		if firstIP != nil {
+			return firstIP
+		}
+		return ip
+	}
+
+	if xri := ctx.Request.Header.Peek(HeaderXRealIP); len(xri) > 0 {
+		if addr := net.ParseIP(b2s(stripSpace(xri))); addr != nil {
+			return addr
+		}
+	}
+	return ip
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range s.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // LocalIP returns the server ip the request came to.
 //
 // Always returns non-nil result.
@@ -1250,23 +1770,33 @@ func getRedirectStatusCode(statusCode int) int {
 //
 // It is safe re-using body argument after the function returns.
 func (ctx *RequestCtx) SetBody(body []byte) {
+	ctx.guard.enter()
 	ctx.Response.SetBody(body)
+	ctx.guard.leave()
 }
 
 // SetBodyString sets response body to the given value.
 func (ctx *RequestCtx) SetBodyString(body string) {
+	ctx.guard.enter()
 	ctx.Response.SetBodyString(body)
+	ctx.guard.leave()
 }
 
 // ResetBody resets response body contents.
 func (ctx *RequestCtx) ResetBody() {
+	ctx.guard.enter()
 	ctx.Response.ResetBody()
+	ctx.guard.leave()
 }
 
 // SendFile sends local file contents from the given path as response body.
 //
 // This is a shortcut to ServeFile(ctx, path).
 //
+// Content-Type is set according to the file extension or contents.
+// 'Range' request header is honored, so interrupted downloads may be
+// resumed. The file is closed after the response is written.
+//
 // SendFile logs all the errors via ctx.Logger.
 //
 // See also ServeFile, FSHandler and FS.
@@ -1278,6 +1808,8 @@ func (ctx *RequestCtx) SendFile(path string) {
 //
 // This is a shortcut to ServeFileBytes(ctx, path).
 //
+// See SendFile for details.
+//
 // SendFileBytes logs all the errors via ctx.Logger.
 //
 // See also ServeFileBytes, FSHandler and FS.
@@ -1288,7 +1820,17 @@ func (ctx *RequestCtx) SendFileBytes(path []byte) {
 // IfModifiedSince returns true if lastModified exceeds 'If-Modified-Since'
 // value from the request header.
 //
-// The function returns true also 'If-Modified-Since' request header is missing.
+// The function returns true also if 'If-Modified-Since' request header
+// is missing or malformed, so the full response must be sent.
+// lastModified is truncated to seconds, since http dates have
+// one second resolution.
+//
+// Handlers may implement conditional responses this way:
+//
+//     if !ctx.IfModifiedSince(lastModified) {
+//         ctx.NotModified()
+//         return
+//     }
 func (ctx *RequestCtx) IfModifiedSince(lastModified time.Time) bool {
 	ifModStr := ctx.Request.Header.peek(strIfModifiedSince)
 	if len(ifModStr) == 0 {
@@ -1303,6 +1845,8 @@ func (ctx *RequestCtx) IfModifiedSince(lastModified time.Time) bool {
 }
 
 // NotModified resets response and sets '304 Not Modified' response status code.
+//
+// The response body is cleared, since 304 responses cannot have body.
 func (ctx *RequestCtx) NotModified() {
 	ctx.Response.Reset()
 	ctx.SetStatusCode(StatusNotModified)
@@ -1315,15 +1859,32 @@ func (ctx *RequestCtx) NotFound() {
 	ctx.SetBodyString("404 Page not found")
 }
 
+// AllowMethods resets response and sets '204 No Content' response status
+// code and the Allow header containing the given methods.
+//
+// This is the standard response for OPTIONS requests.
+// Content-Length header isn't sent for 204 responses.
+//
+// See also OptionsAllowHandler.
+func (ctx *RequestCtx) AllowMethods(methods ...string) {
+	ctx.Response.Reset()
+	ctx.SetStatusCode(StatusNoContent)
+	ctx.Response.Header.Set(HeaderAllow, strings.Join(methods, ", "))
+}
+
 // Write writes p into response body.
 func (ctx *RequestCtx) Write(p []byte) (int, error) {
+	ctx.guard.enter()
 	ctx.Response.AppendBody(p)
+	ctx.guard.leave()
 	return len(p), nil
 }
 
 // WriteString appends s to response body.
 func (ctx *RequestCtx) WriteString(s string) (int, error) {
+	ctx.guard.enter()
 	ctx.Response.AppendBodyString(s)
+	ctx.guard.leave()
 	return len(s), nil
 }
 
@@ -1346,7 +1907,9 @@ func (ctx *RequestCtx) PostBody() []byte {
 //
 // See also SetBodyStreamWriter.
 func (ctx *RequestCtx) SetBodyStream(bodyStream io.Reader, bodySize int) {
+	ctx.guard.enter()
 	ctx.Response.SetBodyStream(bodyStream, bodySize)
+	ctx.guard.leave()
 }
 
 // SetBodyStreamWriter registers the given stream writer for populating
@@ -1361,7 +1924,41 @@ func (ctx *RequestCtx) SetBodyStream(bodyStream io.Reader, bodySize int) {
 //     * if response body must be streamed to the client in chunks.
 //     (aka `http server push`).
 func (ctx *RequestCtx) SetBodyStreamWriter(sw StreamWriter) {
+	ctx.guard.enter()
 	ctx.Response.SetBodyStreamWriter(sw)
+	ctx.guard.leave()
+}
+
+// Compress compresses the response body with the content-coding
+// preferred by the client according to the request's Accept-Encoding header.
+//
+// Only content-codings registered via RegisterCompressEncoder are used.
+// Content-Encoding and Vary response headers are set accordingly.
+// The response is left as is if it is already compressed.
+//
+// Compress must be called after the response body is set.
+func (ctx *RequestCtx) Compress() error {
+	ctx.guard.enter()
+	defer ctx.guard.leave()
+
+	h := &ctx.Response.Header
+	if len(h.peek(strContentEncoding)) > 0 {
+		return nil
+	}
+
+	// The response depends on Accept-Encoding even if it isn't compressed.
+	vary := h.Peek(HeaderVary)
+	if len(vary) == 0 {
+		h.Set(HeaderVary, HeaderAcceptEncoding)
+	} else if string(vary) != "*" && !bytes.Contains(bytes.ToLower(vary), []byte("accept-encoding")) {
+		h.Set(HeaderVary, string(vary)+", "+HeaderAcceptEncoding)
+	}
+
+	enc := selectCompressEncoder(ctx.Request.Header.peek(strAcceptEncoding), true)
+	if enc == nil {
+		return nil
+	}
+	return enc(&ctx.Response, CompressDefaultCompression, CompressBrotliDefaultCompression)
 }
 
 // IsBodyStream returns true if response body is set via SetBodyStream*.
@@ -1369,6 +1966,82 @@ func (ctx *RequestCtx) IsBodyStream() bool {
 	return ctx.Response.IsBodyStream()
 }
 
+// ErrFlushNotSupported is returned from RequestCtx.Flush if the response
+// cannot be flushed to the client before returning from RequestHandler.
+var ErrFlushNotSupported = errors.New("response flushing is not supported for this RequestCtx")
+
+// Flush sends the response header and the response body written so far
+// to the client without returning from RequestHandler.
+//
+// The response is sent with chunked transfer encoding. The handler may
+// continue writing the response body via ctx.Write and the like after
+// Flush and call Flush again for sending the next body portion,
+// e.g. for server-sent events. The rest of the body is sent after
+// returning from RequestHandler. Response headers cannot be changed
+// after the first Flush call.
+//
+// The response body may be set via SetBodyStream* after the last Flush
+// call. The body stream is then sent as the rest of the response body.
+// The response is finished before calling the handler passed to Hijack,
+// even if HijackSetNoResponse(true) is called.
+//
+// ErrFlushNotSupported is returned if ctx isn't served by Server,
+// if the response body is set via SetBodyStream* or if the handler
+// is wrapped into TimeoutHandler.
+func (ctx *RequestCtx) Flush() error {
+	ctx.guard.enter()
+	defer ctx.guard.leave()
+
+	resp := &ctx.Response
+	if !ctx.canFlush || ctx.timeout != nil || resp.bodyStream != nil {
+		return ErrFlushNotSupported
+	}
+	s := ctx.s
+	if ctx.bw == nil {
+		ctx.bw = acquireWriter(ctx)
+	}
+	if ctx.writeTimeout > 0 {
+		deadline := time.Now().Add(ctx.writeTimeout)
+		if d := s.MaxConnDuration; d > 0 {
+			deadline = limitDeadline(deadline, ctx.connTime.Add(d))
+		}
+		if err := ctx.c.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	if !ctx.responseFlushed {
+		h := &ctx.Request.Header
+		if !ctx.IsGet() && ctx.IsHead() {
+			resp.SkipBody = true
+		}
+		if s.MaxRequestsPerConn > 0 && ctx.connRequestNum >= uint64(s.MaxRequestsPerConn) {
+			ctx.SetConnectionClose()
+		}
+		var serverName []byte
+		if !s.NoDefaultServerHeader {
+			serverName = s.getServerName()
+		}
+		s.prepareResponseHeader(ctx, s.DisableKeepalive || h.ConnectionClose(), h.IsHTTP11(), h.AcceptsTrailers(), s.EchoRequestID, serverName)
+		resp.Header.SetContentLength(-1)
+		if err := resp.Header.Write(ctx.bw); err != nil {
+			return err
+		}
+		ctx.responseFlushed = true
+	}
+
+	if !resp.mustSkipBody() {
+		if body := resp.bodyBytes(); len(body) > 0 {
+			// writeChunk flushes the writer.
+			err := writeChunk(ctx.bw, body)
+			resp.ResetBody()
+			return err
+		}
+	}
+	resp.ResetBody()
+	return ctx.bw.Flush()
+}
+
 // Logger returns logger, which may be used for logging arbitrary
 // request-specific messages inside RequestHandler.
 //
@@ -1487,16 +2160,10 @@ func (ln tcpKeepaliveListener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := tc.SetKeepAlive(ln.keepalive); err != nil {
+	if err := setTCPKeepalive(tc, ln.keepalive, ln.keepalivePeriod); err != nil {
 		tc.Close() //nolint:errcheck
 		return nil, err
 	}
-	if ln.keepalivePeriod > 0 {
-		if err := tc.SetKeepAlivePeriod(ln.keepalivePeriod); err != nil {
-			tc.Close() //nolint:errcheck
-			return nil, err
-		}
-	}
 	return tc, nil
 }
 
@@ -1707,6 +2374,7 @@ const DefaultConcurrency = 256 * 1024
 func (s *Server) Serve(ln net.Listener) error {
 	var lastOverflowErrorTime time.Time
 	var lastPerIPErrorTime time.Time
+	var lastMaxConnsErrorTime time.Time
 	var c net.Conn
 	var err error
 
@@ -1722,15 +2390,31 @@ func (s *Server) Serve(ln net.Listener) error {
 		if s.concurrencyCh == nil {
 			s.concurrencyCh = make(chan struct{}, maxWorkersCount)
 		}
+		if s.MaxConns > 0 && s.maxConnsCh == nil {
+			s.maxConnsCh = make(chan struct{}, s.MaxConns)
+		}
 	}
+	maxConnsCh := s.maxConnsCh
+	done := s.done
 	s.mu.Unlock()
 
+	workerFunc := s.serveConn
+	if maxConnsCh != nil {
+		workerFunc = func(c net.Conn) error {
+			// Free the slot for the next incoming connection.
+			defer func() { <-maxConnsCh }()
+			return s.serveConn(c)
+		}
+	}
+
 	wp := &workerPool{
-		WorkerFunc:      s.serveConn,
+		WorkerFunc:      workerFunc,
 		MaxWorkersCount: maxWorkersCount,
+		MaxWaitDuration: s.WaitWhenConcurrencyLimitsExceeded,
 		LogAllErrors:    s.LogAllErrors,
 		Logger:          s.logger(),
 		connState:       s.setState,
+		doneCh:          done,
 	}
 	wp.Start()
 
@@ -1750,8 +2434,30 @@ func (s *Server) Serve(ln net.Listener) error {
 			return err
 		}
 		s.setState(c, StateNew)
+		if maxConnsCh != nil {
+			// The slot is acquired after Accept, so Serve doesn't block
+			// and notices the closed listener while at the limit.
+			select {
+			case maxConnsCh <- struct{}{}:
+			default:
+				s.writeFastError(c, StatusServiceUnavailable,
+					"The connection cannot be served because Server.MaxConns limit exceeded")
+				c.Close()
+				s.setState(c, StateClosed)
+				if time.Since(lastMaxConnsErrorTime) > time.Minute {
+					s.logger().Printf("The incoming connection cannot be served, because %d connections are open. "+
+						"Try increasing Server.MaxConns", s.MaxConns)
+					lastMaxConnsErrorTime = time.Now()
+				}
+				c = nil
+				continue
+			}
+		}
 		atomic.AddInt32(&s.open, 1)
 		if !wp.Serve(c) {
+			if maxConnsCh != nil {
+				<-maxConnsCh
+			}
 			atomic.AddInt32(&s.open, -1)
 			s.writeFastError(c, StatusServiceUnavailable,
 				"The connection cannot be served because Server.Concurrency limit exceeded")
@@ -1846,6 +2552,21 @@ func acceptConn(s *Server, ln net.Listener, lastPerIPErrorTime *time.Time) (net.
 		if c == nil {
 			panic("BUG: net.Listener returned (nil, nil)")
 		}
+		// tcpKeepaliveListener already sets up tcp keep-alive.
+		if _, ok := ln.(tcpKeepaliveListener); !ok && s.TCPKeepalive {
+			if err = setTCPKeepalive(c, true, s.TCPKeepalivePeriod); err != nil {
+				s.logger().Printf("Cannot enable TCP keep-alive for %s: %s", c.RemoteAddr(), err)
+				c.Close() //nolint:errcheck
+				continue
+			}
+		}
+		if s.DisableTCPNoDelay {
+			if err = setTCPNoDelay(c, false); err != nil {
+				s.logger().Printf("Cannot disable TCP_NODELAY for %s: %s", c.RemoteAddr(), err)
+				c.Close() //nolint:errcheck
+				continue
+			}
+		}
 		if s.MaxConnsPerIP > 0 {
 			pic := wrapPerIPConn(s, c)
 			if pic == nil {
@@ -1993,6 +2714,16 @@ func (s *Server) idleTimeout() time.Duration {
 	return s.ReadTimeout
 }
 
+// limitDeadline returns t limited by the given connection deadline.
+//
+// Zero connection deadline means no limit.
+func limitDeadline(t, connDeadline time.Time) time.Time {
+	if !connDeadline.IsZero() && t.After(connDeadline) {
+		return connDeadline
+	}
+	return t
+}
+
 func (s *Server) serveConnCleanup() {
 	atomic.AddInt32(&s.open, -1)
 	atomic.AddUint32(&s.concurrency, ^uint32(0))
@@ -2023,6 +2754,14 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 	}
 	writeTimeout := s.WriteTimeout
 
+	var connDeadline time.Time
+	if d := s.MaxConnDuration; d > 0 {
+		connDeadline = connTime.Add(d)
+		if err = c.SetDeadline(connDeadline); err != nil {
+			return
+		}
+	}
+
 	ctx := s.acquireCtx(c)
 	ctx.connTime = connTime
 	isTLS := ctx.IsTLS()
@@ -2033,20 +2772,27 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		timeoutResponse  *Response
 		hijackHandler    HijackHandler
 		hijackNoResponse bool
+		responseFlushed  bool
 
 		connectionClose bool
 		isHTTP11        bool
+		acceptsTrailers bool
 
 		reqReset               bool
+		handlerPanicked        bool
 		continueReadingRequest bool = true
+
+		bodyBytesReserved int64
+		readDeadline      time.Time
 	)
 	for {
 		connRequestNum++
+		readDeadline = connDeadline
 
 		// If this is a keep-alive connection set the idle timeout.
 		if connRequestNum > 1 {
 			if d := s.idleTimeout(); d > 0 {
-				if err := c.SetReadDeadline(time.Now().Add(d)); err != nil {
+				if err := c.SetReadDeadline(limitDeadline(time.Now().Add(d), connDeadline)); err != nil {
 					panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", d, err))
 				}
 			}
@@ -2079,6 +2825,8 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		ctx.Request.isTLS = isTLS
 		ctx.Response.Header.noDefaultContentType = s.NoDefaultContentType
 		ctx.Response.Header.noDefaultDate = s.NoDefaultDate
+		ctx.Request.Header.maxHeaderSize = s.MaxRequestHeaderSize
+		ctx.Request.Header.maxHeaderCount = s.MaxRequestHeaderCount
 
 		// Secure header error logs configuration
 		ctx.Request.Header.secureErrorLogMessage = s.SecureErrorLogMessage
@@ -2087,8 +2835,17 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		ctx.Response.secureErrorLogMessage = s.SecureErrorLogMessage
 
 		if err == nil {
+			readStart := time.Now()
 			if s.ReadTimeout > 0 {
-				if err := c.SetReadDeadline(time.Now().Add(s.ReadTimeout)); err != nil {
+				readDeadline = limitDeadline(readStart.Add(s.ReadTimeout), connDeadline)
+			}
+			if s.ReadHeaderTimeout > 0 {
+				headerDeadline := limitDeadline(readStart.Add(s.ReadHeaderTimeout), readDeadline)
+				if err := c.SetReadDeadline(headerDeadline); err != nil {
+					panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", s.ReadHeaderTimeout, err))
+				}
+			} else if s.ReadTimeout > 0 {
+				if err := c.SetReadDeadline(readDeadline); err != nil {
 					panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", s.ReadTimeout, err))
 				}
 			}
@@ -2118,12 +2875,18 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 			}
 
 			if err == nil {
+				if s.ReadHeaderTimeout > 0 {
+					// Headers are read, so extend the deadline for reading the body.
+					if err := c.SetReadDeadline(readDeadline); err != nil {
+						panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", readDeadline, err))
+					}
+				}
 				if onHdrRecv := s.HeaderReceived; onHdrRecv != nil {
 					reqConf := onHdrRecv(&ctx.Request.Header)
 					if reqConf.ReadTimeout > 0 {
-						deadline := time.Now().Add(reqConf.ReadTimeout)
-						if err := c.SetReadDeadline(deadline); err != nil {
-							panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", deadline, err))
+						readDeadline = limitDeadline(time.Now().Add(reqConf.ReadTimeout), connDeadline)
+						if err := c.SetReadDeadline(readDeadline); err != nil {
+							panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", readDeadline, err))
 						}
 					}
 					if reqConf.MaxRequestBodySize > 0 {
@@ -2133,11 +2896,16 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 						writeTimeout = reqConf.WriteTimeout
 					}
 				}
+				if s.MaxRequestBodyBytesInFlight > 0 {
+					bodyBytesReserved, err = s.reserveRequestBodyBytes(ctx.Request.Header.realContentLength(), maxRequestBodySize)
+				}
 				//read body
-				if s.StreamRequestBody {
-					err = ctx.Request.readBodyStream(br, maxRequestBodySize, s.GetOnly, !s.DisablePreParseMultipartForm)
-				} else {
-					err = ctx.Request.readLimitBody(br, maxRequestBodySize, s.GetOnly, !s.DisablePreParseMultipartForm)
+				if err == nil {
+					if s.StreamRequestBody {
+						err = ctx.Request.readBodyStream(br, maxRequestBodySize, s.GetOnly, !s.DisablePreParseMultipartForm)
+					} else {
+						err = ctx.Request.readLimitBody(br, maxRequestBodySize, s.GetOnly, !s.DisablePreParseMultipartForm)
+					}
 				}
 			}
 
@@ -2231,17 +2999,49 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 
 		connectionClose = s.DisableKeepalive || ctx.Request.Header.ConnectionClose()
 		isHTTP11 = ctx.Request.Header.IsHTTP11()
+		acceptsTrailers = ctx.Request.Header.AcceptsTrailers()
 
 		if serverName != nil {
+			// Re-read the name, since it may be changed via SetName.
+			serverName = s.getServerName()
 			ctx.Response.Header.SetServerBytes(serverName)
 		}
 		ctx.connID = connID
 		ctx.connRequestNum = connRequestNum
 		ctx.time = time.Now()
 
+		if s.StreamRequestBodyIdleTimeout > 0 {
+			if rs, ok := ctx.Request.bodyStream.(*requestStream); ok {
+				rs.setIdleTimeout(c, s.StreamRequestBodyIdleTimeout, readDeadline)
+			}
+		}
+
 		// If a client denies a request the handler should not be called
 		if continueReadingRequest {
-			s.Handler(ctx)
+			// Let the handler flush the response via RequestCtx.Flush.
+			ctx.bw = bw
+			ctx.writeTimeout = writeTimeout
+			ctx.canFlush = true
+
+			handlerPanicked = s.callHandler(ctx)
+			if s.OptionsHandler != nil && ctx.IsOptions() && !handlerResponded(ctx) {
+				s.OptionsHandler(ctx)
+			}
+
+			ctx.canFlush = false
+			bw = ctx.bw
+			ctx.bw = nil
+		}
+		responseFlushed = ctx.responseFlushed
+		ctx.responseFlushed = false
+
+		if handlerPanicked && responseFlushed {
+			// The response has been partially sent, so it cannot be replaced
+			// with the error response. Close the connection instead of
+			// finishing the response, so the client notices the failure.
+			// The request, including multipart form files, is reset below.
+			reqReset = false
+			break
 		}
 
 		timeoutResponse = ctx.timeoutResponse
@@ -2249,17 +3049,26 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 			// Acquire a new ctx because the old one will still be in use by the timeout out handler.
 			ctx = s.acquireCtx(c)
 			timeoutResponse.CopyTo(&ctx.Response)
+		} else {
+			if rs, ok := ctx.Request.bodyStream.(*requestStream); ok && rs.idleTimeout > 0 {
+				// The rest of the stalled request body cannot be skipped.
+				if rs.idleTimedOut {
+					ctx.SetConnectionClose()
+				}
+				if err := c.SetReadDeadline(readDeadline); err != nil {
+					panic(fmt.Sprintf("BUG: error in SetReadDeadline(%s): %s", readDeadline, err))
+				}
+			}
 		}
 
 		if !ctx.IsGet() && ctx.IsHead() {
 			ctx.Response.SkipBody = true
 		}
-		reqReset = true
-		ctx.Request.Reset()
-
 		hijackHandler = ctx.hijackHandler
 		ctx.hijackHandler = nil
-		hijackNoResponse = ctx.hijackNoResponse && hijackHandler != nil
+		// The flushed response must be finished before hijacking,
+		// since the client already received a part of it.
+		hijackNoResponse = ctx.hijackNoResponse && hijackHandler != nil && !responseFlushed
 		ctx.hijackNoResponse = false
 
 		if s.MaxRequestsPerConn > 0 && connRequestNum >= uint64(s.MaxRequestsPerConn) {
@@ -2267,31 +3076,32 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		}
 
 		if writeTimeout > 0 {
-			if err := c.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			if err := c.SetWriteDeadline(limitDeadline(time.Now().Add(writeTimeout), connDeadline)); err != nil {
 				panic(fmt.Sprintf("BUG: error in SetWriteDeadline(%s): %s", writeTimeout, err))
 			}
 		}
 
-		connectionClose = connectionClose || ctx.Response.ConnectionClose()
-		connectionClose = connectionClose || ctx.Response.ConnectionClose() || (s.CloseOnShutdown && atomic.LoadInt32(&s.stop) == 1)
-		if connectionClose {
-			ctx.Response.Header.SetCanonical(strConnection, strClose)
-		} else if !isHTTP11 {
-			// Set 'Connection: keep-alive' response header for non-HTTP/1.1 request.
-			// There is no need in setting this header for http/1.1, since in http/1.1
-			// connections are keep-alive by default.
-			ctx.Response.Header.SetCanonical(strConnection, strKeepAlive)
-		}
+		// The request ID is echoed only for the handler's response,
+		// since the timeout response is sent via a new RequestCtx.
+		connectionClose = s.prepareResponseHeader(ctx, connectionClose, isHTTP11, acceptsTrailers, s.EchoRequestID && timeoutResponse == nil, serverName)
 
-		if serverName != nil && len(ctx.Response.Header.Server()) == 0 {
-			ctx.Response.Header.SetServerBytes(serverName)
-		}
+		reqReset = true
+		ctx.Request.Reset()
+		s.releaseRequestBodyBytes(bodyBytesReserved)
+		bodyBytesReserved = 0
 
 		if !hijackNoResponse {
 			if bw == nil {
 				bw = acquireWriter(ctx)
 			}
-			if err = writeResponse(ctx, bw); err != nil {
+			if responseFlushed {
+				err = writeFlushedResponse(ctx, bw)
+			} else {
+				err = writeResponse(ctx, bw)
+			}
+			if err != nil {
+				// The response may be partially written, e.g. if its body
+				// stream failed, so the connection cannot be reused.
 				break
 			}
 
@@ -2299,8 +3109,9 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 			// This is a big of an ugly optimization for https://www.techempower.com/benchmarks/
 			// This benchmark will send 16 pipelined requests. It is faster to pack as many responses
 			// in a TCP packet and send it back at once than waiting for a flush every request.
-			// In real world circumstances this behaviour could be argued as being wrong.
-			if br == nil || br.Buffered() == 0 || connectionClose {
+			// In real world circumstances this behaviour could be argued as being wrong,
+			// so it may be disabled via Server.DisablePipelineCoalescing.
+			if br == nil || br.Buffered() == 0 || connectionClose || s.DisablePipelineCoalescing {
 				err = bw.Flush()
 				if err != nil {
 					break
@@ -2309,7 +3120,8 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 			if connectionClose {
 				break
 			}
-			if s.ReduceMemoryUsage && hijackHandler == nil {
+			// Do not release the writer holding coalesced responses.
+			if s.ReduceMemoryUsage && hijackHandler == nil && bw.Buffered() == 0 {
 				releaseWriter(s, bw)
 				bw = nil
 			}
@@ -2353,6 +3165,7 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 
 		s.setState(c, StateIdle)
 		ctx.userValues.Reset()
+		ctx.requestID = ctx.requestID[:0]
 
 		if atomic.LoadInt32(&s.stop) == 1 {
 			err = nil
@@ -2360,6 +3173,7 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		}
 	}
 
+	s.releaseRequestBodyBytes(bodyBytesReserved)
 	if br != nil {
 		releaseReader(s, br)
 	}
@@ -2378,12 +3192,93 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 	return
 }
 
+// ErrRequestBodyBytesInFlightExceeded is returned when the request body
+// doesn't fit Server.MaxRequestBodyBytesInFlight limit.
+var ErrRequestBodyBytesInFlightExceeded = errors.New("total size of in-flight request bodies exceeds the limit")
+
+// reserveRequestBodyBytes accounts the request body with the given
+// content length in Server.MaxRequestBodyBytesInFlight limit.
+//
+// The returned number of bytes must be passed to releaseRequestBodyBytes
+// after the request is handled.
+func (s *Server) reserveRequestBodyBytes(contentLength, maxRequestBodySize int) (int64, error) {
+	n := int64(contentLength)
+	switch {
+	case contentLength == -1:
+		// Chunked body of unknown size.
+		n = int64(maxRequestBodySize)
+	case contentLength <= 0:
+		return 0, nil
+	case contentLength > maxRequestBodySize:
+		// The body is going to be rejected with ErrBodyTooLarge.
+		return 0, nil
+	}
+	if atomic.AddInt64(&s.requestBodyBytesInFlight, n) > int64(s.MaxRequestBodyBytesInFlight) {
+		atomic.AddInt64(&s.requestBodyBytesInFlight, -n)
+		return 0, ErrRequestBodyBytesInFlightExceeded
+	}
+	return n, nil
+}
+
+func (s *Server) releaseRequestBodyBytes(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&s.requestBodyBytesInFlight, -n)
+	}
+}
+
 func (s *Server) setState(nc net.Conn, state ConnState) {
 	if hook := s.ConnState; hook != nil {
 		hook(nc, state)
 	}
 }
 
+// callHandler calls s.Handler and recovers from its panic, so a single
+// faulty request cannot crash the whole server.
+//
+// The response is replaced with 500 Internal Server Error unless it has
+// already been flushed, and then the panic is passed to s.PanicHandler.
+// The connection is closed after the response.
+func (s *Server) callHandler(ctx *RequestCtx) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			if !ctx.responseFlushed {
+				ctx.Error("Internal Server Error", StatusInternalServerError)
+			}
+			if s.PanicHandler != nil {
+				s.callPanicHandler(ctx, r)
+			} else {
+				ctx.Logger().Printf("panic in request handler: %v\n%s", r, debug.Stack())
+			}
+			ctx.SetConnectionClose()
+		}
+	}()
+	s.Handler(ctx)
+	return false
+}
+
+// handlerResponded returns true if the handler has set the response
+// status code or body, so OptionsHandler mustn't be called.
+func handlerResponded(ctx *RequestCtx) bool {
+	resp := &ctx.Response
+	return ctx.timeoutResponse != nil || ctx.responseFlushed || resp.Header.statusCode != 0 ||
+		resp.IsBodyStream() || len(resp.bodyBytes()) > 0
+}
+
+// callPanicHandler calls s.PanicHandler and recovers from its panic.
+// The response falls back to plain 500 Internal Server Error in this case.
+func (s *Server) callPanicHandler(ctx *RequestCtx, err interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !ctx.responseFlushed {
+				ctx.Error("Internal Server Error", StatusInternalServerError)
+			}
+			ctx.Logger().Printf("panic in PanicHandler: %v\n%s\nwhen handling panic in request handler: %v", r, debug.Stack(), err)
+		}
+	}()
+	s.PanicHandler(ctx, err)
+}
+
 func hijackConnHandler(r io.Reader, c net.Conn, s *Server, h HijackHandler) {
 	hjc := s.acquireHijackConn(r, c)
 	h(hjc)
@@ -2453,15 +3348,124 @@ func (ctx *RequestCtx) LastTimeoutErrorResponse() *Response {
 	return ctx.timeoutResponse
 }
 
+// setPostHandlerHeaders sets Server.PostHandlerHeaders missing in h.
+func (s *Server) setPostHandlerHeaders(h *ResponseHeader) {
+	s.postHandlerHeadersOnce.Do(s.initPostHandlerHeaders)
+	for i := range s.postHandlerHeaders {
+		kv := &s.postHandlerHeaders[i]
+		// Use Has instead of Peek, since Peek doesn't distinguish
+		// missing headers from headers set to empty value.
+		if !h.Has(b2s(kv.key)) {
+			h.SetCanonical(kv.key, kv.value)
+		}
+	}
+}
+
+// initPostHandlerHeaders converts Server.PostHandlerHeaders
+// to normalized byte slices, so they aren't converted on every response.
+func (s *Server) initPostHandlerHeaders() {
+	for _, hdr := range s.PostHandlerHeaders {
+		var kv *argsKV
+		s.postHandlerHeaders, kv = allocArg(s.postHandlerHeaders)
+		kv.key = append(kv.key[:0], hdr.Key...)
+		normalizeHeaderKey(kv.key, s.DisableHeaderNamesNormalizing)
+		kv.value = append(kv.value[:0], hdr.Value...)
+	}
+}
+
+// prepareResponseHeader sets the response headers controlled by the server
+// before writing the response to the client.
+//
+// The request must be still available if echoRequestID is set.
+//
+// It returns whether the connection must be closed after the response.
+func (s *Server) prepareResponseHeader(ctx *RequestCtx, connectionClose, isHTTP11, acceptsTrailers, echoRequestID bool, serverName []byte) bool {
+	connectionClose = connectionClose || ctx.Response.ConnectionClose() || (s.CloseOnShutdown && atomic.LoadInt32(&s.stop) == 1)
+	if connectionClose {
+		ctx.Response.Header.SetCanonical(strConnection, strClose)
+	} else if !isHTTP11 {
+		// Set 'Connection: keep-alive' response header for non-HTTP/1.1 request.
+		// There is no need in setting this header for http/1.1, since in http/1.1
+		// connections are keep-alive by default.
+		ctx.Response.Header.SetCanonical(strConnection, strKeepAlive)
+	}
+
+	if serverName != nil && len(ctx.Response.Header.Server()) == 0 {
+		ctx.Response.Header.SetServerBytes(serverName)
+	}
+
+	if echoRequestID && len(ctx.Response.Header.Peek(HeaderXRequestID)) == 0 {
+		ctx.Response.Header.SetBytesV(HeaderXRequestID, ctx.RequestID())
+	}
+
+	s.setPostHandlerHeaders(&ctx.Response.Header)
+
+	// Do not send trailers to clients, which may fail parsing them.
+	if !acceptsTrailers {
+		ctx.Response.Header.DelAllTrailers()
+	}
+	return connectionClose
+}
+
+// writeFlushedResponse finishes the chunked response, which has been
+// partially written to the client via RequestCtx.Flush.
+func writeFlushedResponse(ctx *RequestCtx, w *bufio.Writer) error {
+	resp := &ctx.Response
+	var err error
+	if !resp.mustSkipBody() {
+		if resp.bodyStream != nil {
+			// The body stream set after Flush is sent as the rest
+			// of the chunked body.
+			err = writeBodyChunked(w, resp.bodyStream, &resp.Header)
+			if err1 := resp.closeBodyStream(); err == nil {
+				err = err1
+			}
+		} else {
+			if body := resp.bodyBytes(); len(body) > 0 {
+				err = writeChunk(w, body)
+			}
+			if err == nil {
+				if len(resp.Header.trailer) > 0 {
+					err = writeLastChunk(w, &resp.Header, nil)
+				} else {
+					err = writeChunk(w, nil)
+				}
+			}
+		}
+	}
+	resp.Reset()
+	return err
+}
+
 func writeResponse(ctx *RequestCtx, w *bufio.Writer) error {
 	if ctx.timeoutResponse != nil {
 		panic("BUG: cannot write timed out response")
 	}
-	err := ctx.Response.Write(w)
+	var written bool
+	var err error
+	if vc := vectoredWriteConn(ctx.c); vc != nil {
+		written, err = ctx.Response.writeVectored(w, vc)
+	}
+	if !written {
+		err = ctx.Response.Write(w)
+	}
 	ctx.Response.Reset()
 	return err
 }
 
+// vectoredWriteConn returns the underlying connection of c
+// if it supports vectored writes (writev). Otherwise nil is returned.
+func vectoredWriteConn(c net.Conn) net.Conn {
+	if pic, ok := c.(*perIPConn); ok {
+		c = pic.Conn
+	}
+	switch c.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return c
+	}
+	return nil
+}
+
 const (
 	defaultReadBufferSize  = 4096
 	defaultWriteBufferSize = 4096
@@ -2566,6 +3570,7 @@ func (ctx *RequestCtx) Init2(conn net.Conn, logger Logger, reduceMemoryUsage boo
 	ctx.s = fakeServer
 	ctx.connRequestNum = 0
 	ctx.connTime = time.Now()
+	ctx.requestID = ctx.requestID[:0]
 
 	keepBodyBuffer := !reduceMemoryUsage
 	ctx.Request.keepBodyBuffer = keepBodyBuffer
@@ -2596,9 +3601,12 @@ func (ctx *RequestCtx) Init(req *Request, remoteAddr net.Addr, logger Logger) {
 // should be canceled. Deadline returns ok==false when no deadline is
 // set. Successive calls to Deadline return the same results.
 //
-// This method always returns 0, false and is only present to make
-// RequestCtx implement the context interface.
+// The deadline is set only for handlers wrapped by TimeoutHandler
+// or TimeoutWithCodeHandler.
 func (ctx *RequestCtx) Deadline() (deadline time.Time, ok bool) {
+	if ctx.timeout != nil {
+		return ctx.timeout.deadline, true
+	}
 	return
 }
 
@@ -2606,6 +3614,9 @@ func (ctx *RequestCtx) Deadline() (deadline time.Time, ok bool) {
 // context should be canceled. Done may return nil if this context can
 // never be canceled. Successive calls to Done return the same value.
 func (ctx *RequestCtx) Done() <-chan struct{} {
+	if ctx.timeout != nil {
+		return ctx.timeout.doneCh
+	}
 	return ctx.s.done
 }
 
@@ -2616,6 +3627,14 @@ func (ctx *RequestCtx) Done() <-chan struct{} {
 // Canceled if the context was canceled (via server Shutdown)
 // or DeadlineExceeded if the context's deadline passed.
 func (ctx *RequestCtx) Err() error {
+	if ts := ctx.timeout; ts != nil {
+		select {
+		case <-ts.doneCh:
+			return ts.err
+		default:
+			return nil
+		}
+	}
 	select {
 	case <-ctx.s.done:
 		return context.Canceled
@@ -2676,9 +3695,25 @@ func (s *Server) releaseCtx(ctx *RequestCtx) {
 	ctx.remoteAddr = nil
 	ctx.fbr.c = nil
 	ctx.userValues.Reset()
+	ctx.requestID = ctx.requestID[:0]
 	s.ctxPool.Put(ctx)
 }
 
+// SetName sets server name for sending in response headers.
+//
+// The name is used for subsequent responses, including responses
+// on already established keep-alive connections.
+// Default server name is used if name is blank.
+//
+// It is safe calling SetName while the server is running.
+func (s *Server) SetName(name string) {
+	serverName := []byte(name)
+	if len(serverName) == 0 {
+		serverName = defaultServerName
+	}
+	s.serverName.Store(serverName)
+}
+
 func (s *Server) getServerName() []byte {
 	v := s.serverName.Load()
 	var serverName []byte
@@ -2719,10 +3754,16 @@ func (s *Server) writeFastError(w io.Writer, statusCode int, msg string) {
 }
 
 func defaultErrorHandler(ctx *RequestCtx, err error) {
-	if _, ok := err.(*ErrSmallBuffer); ok {
+	if _, ok := err.(*ErrSmallBuffer); ok || err == ErrHeaderTooLarge || err == ErrTooManyHeaders {
 		ctx.Error("Too big request header", StatusRequestHeaderFieldsTooLarge)
 	} else if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
 		ctx.Error("Request timeout", StatusRequestTimeout)
+	} else if err == ErrBodyTooLarge {
+		ctx.Error("Request body too large", StatusRequestEntityTooLarge)
+	} else if err == ErrRequestBodyBytesInFlightExceeded {
+		ctx.Error("Too many concurrent request bodies", StatusServiceUnavailable)
+	} else if err == ErrHTTP2Preface {
+		ctx.Error("HTTP/2 with prior knowledge is not supported", StatusHTTPVersionNotSupported)
 	} else {
 		ctx.Error("Error when parsing request", StatusBadRequest)
 	}
@@ -2739,6 +3780,7 @@ func (s *Server) writeErrorResponse(bw *bufio.Writer, ctx *RequestCtx, serverNam
 	if serverName != nil {
 		ctx.Response.Header.SetServerBytes(serverName)
 	}
+	s.setPostHandlerHeaders(&ctx.Response.Header)
 	ctx.SetConnectionClose()
 	if bw == nil {
 		bw = acquireWriter(ctx)
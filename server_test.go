@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +15,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -172,20 +174,32 @@ func TestServerPipelineFlush(t *testing.T) {
 	}
 }
 
-func TestServerInvalidHeader(t *testing.T) {
+func TestRequestCtxFlush(t *testing.T) {
 	t.Parallel()
 
+	ch := make(chan struct{})
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
-			if ctx.Request.Header.Peek("Foo") != nil || ctx.Request.Header.Peek("Foo ") != nil {
-				t.Error("expected Foo header")
+			if string(ctx.Path()) != "/stream" {
+				ctx.WriteString("regular") //nolint:errcheck
+				return
+			}
+			ctx.SetContentType("text/event-stream")
+			ctx.WriteString("data: foo\n\n") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			// Wait until the client reads the flushed data.
+			<-ch
+			ctx.WriteString("data: bar\n\n") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Errorf("unexpected error: %s", err)
 			}
+			<-ch
+			ctx.WriteString("data: baz\n\n") //nolint:errcheck
 		},
-		Logger: &testLogger{},
 	}
-
 	ln := fasthttputil.NewInmemoryListener()
-
 	go func() {
 		if err := s.Serve(ln); err != nil {
 			t.Errorf("unexpected error: %s", err)
@@ -196,293 +210,351 @@ func TestServerInvalidHeader(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	if _, err = c.Write([]byte("POST /foo HTTP/1.1\r\nHost: gle.com\r\nFoo : bar\r\nContent-Length: 5\r\n\r\n12345")); err != nil {
-		t.Fatal(err)
-	}
-
-	br := bufio.NewReader(c)
-	var resp Response
-	if err := resp.Read(br); err != nil {
+	defer c.Close()
+	if _, err = c.Write([]byte("GET /stream HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	if resp.StatusCode() != StatusBadRequest {
-		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
-	}
 
-	c, err = ln.Dial()
-	if err != nil {
+	br := bufio.NewReader(c)
+	var h ResponseHeader
+	if err := h.Read(br); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	if _, err = c.Write([]byte("GET /foo HTTP/1.1\r\nHost: gle.com\r\nFoo : bar\r\n\r\n")); err != nil {
-		t.Fatal(err)
+	if h.ContentLength() != -1 {
+		t.Fatalf("unexpected content length: %d. Expecting -1", h.ContentLength())
 	}
-
-	br = bufio.NewReader(c)
-	if err := resp.Read(br); err != nil {
-		t.Fatalf("unexpected error: %s", err)
+	if string(h.ContentType()) != "text/event-stream" {
+		t.Fatalf("unexpected content type: %q. Expecting %q", h.ContentType(), "text/event-stream")
 	}
 
-	if resp.StatusCode() != StatusBadRequest {
-		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	expectChunk := func(expectedChunk string) {
+		chunk := make([]byte, len(expectedChunk))
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(chunk) != expectedChunk {
+			t.Fatalf("unexpected chunk: %q. Expecting %q", chunk, expectedChunk)
+		}
 	}
+	expectChunk("b\r\ndata: foo\n\n\r\n")
+	ch <- struct{}{}
+	expectChunk("b\r\ndata: bar\n\n\r\n")
+	ch <- struct{}{}
+	expectChunk("b\r\ndata: baz\n\n\r\n0\r\n\r\n")
 
-	if err := c.Close(); err != nil {
+	// The connection must be reusable after the flushed response.
+	if _, err = c.Write([]byte("GET /regular HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	if err := ln.Close(); err != nil {
+	var resp Response
+	if err := resp.Read(br); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	if string(resp.Body()) != "regular" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "regular")
+	}
 }
 
-func TestServerConnState(t *testing.T) {
+func TestServerKeepAliveAfterBodyStream(t *testing.T) {
 	t.Parallel()
 
-	states := make([]string, 0)
 	s := &Server{
-		Handler: func(ctx *RequestCtx) {},
-		ConnState: func(conn net.Conn, state ConnState) {
-			states = append(states, state.String())
+		Handler: func(ctx *RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/fixed":
+				ctx.SetBodyStream(strings.NewReader("fixed body"), len("fixed body"))
+			case "/unknown":
+				ctx.SetBodyStream(strings.NewReader("unknown body"), -1)
+			case "/writer":
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.WriteString("stream ") //nolint:errcheck
+					w.Flush()                //nolint:errcheck
+					w.WriteString("writer")  //nolint:errcheck
+				})
+			default:
+				ctx.WriteString("regular") //nolint:errcheck
+			}
 		},
 	}
-
 	ln := fasthttputil.NewInmemoryListener()
-
-	serverCh := make(chan struct{})
 	go func() {
 		if err := s.Serve(ln); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
-		close(serverCh)
 	}()
 
-	clientCh := make(chan struct{})
-	go func() {
-		c, err := ln.Dial()
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	// Every request is sent only after reading the previous response,
+	// so streamed responses must be fully flushed to the client.
+	br := bufio.NewReader(c)
+	var resp Response
+	for _, tc := range []struct {
+		path         string
+		expectedBody string
+	}{
+		{"/fixed", "fixed body"},
+		{"/regular", "regular"},
+		{"/unknown", "unknown body"},
+		{"/regular", "regular"},
+		{"/writer", "stream writer"},
+		{"/regular", "regular"},
+	} {
+		if _, err = c.Write([]byte("GET " + tc.path + " HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
 		}
-		br := bufio.NewReader(c)
-		// Send 2 requests on the same connection.
-		for i := 0; i < 2; i++ {
-			if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
-				t.Errorf("unexpected error: %s", err)
-			}
-			var resp Response
-			if err := resp.Read(br); err != nil {
-				t.Errorf("unexpected error: %s", err)
-			}
-			if resp.StatusCode() != StatusOK {
-				t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
-			}
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error when reading response to %q: %s", tc.path, err)
 		}
-		if err := c.Close(); err != nil {
-			t.Errorf("unexpected error: %s", err)
+		if string(resp.Body()) != tc.expectedBody {
+			t.Fatalf("unexpected body for %q: %q. Expecting %q", tc.path, resp.Body(), tc.expectedBody)
 		}
-		// Give the server a little bit of time to transition the connection to the close state.
-		time.Sleep(time.Millisecond * 100)
-		close(clientCh)
-	}()
-
-	select {
-	case <-clientCh:
-	case <-time.After(time.Second):
-		t.Fatal("timeout")
 	}
+}
 
-	if err := ln.Close(); err != nil {
-		t.Fatalf("unexpected error: %s", err)
-	}
+func TestServerCloseAfterBodyStreamError(t *testing.T) {
+	t.Parallel()
 
-	select {
-	case <-serverCh:
-	case <-time.After(time.Second):
-		t.Fatal("timeout")
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/broken" {
+				r := io.MultiReader(strings.NewReader("foo"), &errorReader{err: errors.New("broken stream")})
+				ctx.SetBodyStream(r, 10)
+				return
+			}
+			ctx.WriteString("regular") //nolint:errcheck
+		},
+		Logger: &testLogger{},
 	}
 
-	// 2 requests so we go to active and idle twice.
-	expected := []string{"new", "active", "idle", "active", "idle", "closed"}
+	rw := &readWriter{}
+	rw.r.WriteString("GET /broken HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	rw.r.WriteString("GET /regular HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	if err := s.ServeConn(rw); err == nil {
+		t.Fatalf("expecting error")
+	}
 
-	if !reflect.DeepEqual(expected, states) {
-		t.Fatalf("wrong state, expected %s, got %s", expected, states)
+	// The response with the broken body stream must be the last one
+	// sent over the connection.
+	if strings.Contains(rw.w.String(), "regular") {
+		t.Fatalf("unexpected response after the broken body stream: %q", rw.w.String())
 	}
 }
 
-func TestSaveMultipartFile(t *testing.T) {
+func TestServerRequestConnectionClose(t *testing.T) {
 	t.Parallel()
 
-	filea := "This is a test file."
-	fileb := strings.Repeat("test", 64)
+	testServerRequestConnectionClose(t, func(ctx *RequestCtx) {
+		ctx.WriteString("foobar") //nolint:errcheck
+	}, "foobar")
 
-	mr := multipart.NewReader(strings.NewReader(""+
-		"--foo\r\n"+
-		"Content-Disposition: form-data; name=\"filea\"; filename=\"filea.txt\"\r\n"+
-		"Content-Type: text/plain\r\n"+
-		"\r\n"+
-		filea+"\r\n"+
-		"--foo\r\n"+
-		"Content-Disposition: form-data; name=\"fileb\"; filename=\"fileb.txt\"\r\n"+
-		"Content-Type: text/plain\r\n"+
-		"\r\n"+
-		fileb+"\r\n"+
-		"--foo--\r\n",
-	), "foo")
+	// The handler cannot keep the connection alive.
+	testServerRequestConnectionClose(t, func(ctx *RequestCtx) {
+		ctx.Response.Header.Set(HeaderConnection, "keep-alive")
+		ctx.WriteString("foobar") //nolint:errcheck
+	}, "foobar")
 
-	f, err := mr.ReadForm(64)
-	if err != nil {
-		t.Fatal(err)
-	}
+	// flushed response
+	testServerRequestConnectionClose(t, func(ctx *RequestCtx) {
+		ctx.WriteString("foo") //nolint:errcheck
+		if err := ctx.Flush(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		ctx.WriteString("bar") //nolint:errcheck
+	}, "foobar")
 
-	if err := SaveMultipartFile(f.File["filea"][0], "filea.txt"); err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove("filea.txt")
+	// timed out response
+	testServerRequestConnectionClose(t, func(ctx *RequestCtx) {
+		ctx.TimeoutError("timeout")
+	}, "timeout")
+}
 
-	if c, err := ioutil.ReadFile("filea.txt"); err != nil {
-		t.Fatal(err)
-	} else if string(c) != filea {
-		t.Fatalf("filea changed expected %q got %q", filea, c)
+func testServerRequestConnectionClose(t *testing.T, h RequestHandler, expectedBody string) {
+	s := &Server{
+		Handler: h,
 	}
 
-	// Make sure fileb was saved to a file.
-	if ff, err := f.File["fileb"][0].Open(); err != nil {
-		t.Fatal("expected FileHeader.Open to work")
-	} else if _, ok := ff.(*os.File); !ok {
-		t.Fatal("expected fileb to be an os.File")
-	} else {
-		ff.Close()
+	rw := &readWriter{}
+	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\nConnection: close\r\n\r\n")
+	rw.r.WriteString("GET /bar HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
-	if err := SaveMultipartFile(f.File["fileb"][0], "fileb.txt"); err != nil {
-		t.Fatal(err)
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-	defer os.Remove("fileb.txt")
-
-	if c, err := ioutil.ReadFile("fileb.txt"); err != nil {
-		t.Fatal(err)
-	} else if string(c) != fileb {
-		t.Fatalf("fileb changed expected %q got %q", fileb, c)
+	if !resp.ConnectionClose() {
+		t.Fatalf("expecting 'Connection: close' response header")
+	}
+	if string(resp.Body()) != expectedBody {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), expectedBody)
+	}
+	// The server must stop serving the connection after the response.
+	if br.Buffered() > 0 {
+		t.Fatalf("unexpected data after the response: %q", rw.w.String())
 	}
 }
 
-func TestServerName(t *testing.T) {
+func TestRequestCtxFlushBodyStream(t *testing.T) {
 	t.Parallel()
 
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("foo") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			switch string(ctx.Path()) {
+			case "/stream":
+				ctx.SetBodyStream(strings.NewReader("bar"), -1)
+			case "/writer":
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.WriteString("baz") //nolint:errcheck
+				})
+			}
 		},
 	}
 
-	getReponse := func() []byte {
-		rw := &readWriter{}
-		rw.r.WriteString("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")
-
-		ch := make(chan error)
-		go func() {
-			ch <- s.ServeConn(rw)
-		}()
+	rw := &readWriter{}
+	rw.r.WriteString("GET /stream HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	rw.r.WriteString("GET /writer HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 
-		select {
-		case err := <-ch:
-			if err != nil {
-				t.Fatalf("Unexpected error from serveConn: %s", err)
-			}
-		case <-time.After(100 * time.Millisecond):
-			t.Fatal("timeout")
+	// The body stream set after Flush must be sent as the rest of the body.
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	for _, expectedBody := range []string{"foobar", "foobaz"} {
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error: %s", err)
 		}
-
-		resp, err := ioutil.ReadAll(&rw.w)
-		if err != nil {
-			t.Fatalf("Unexpected error from ReadAll: %s", err)
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), expectedBody)
 		}
-
-		return resp
 	}
-
-	resp := getReponse()
-	if !bytes.Contains(resp, []byte("\r\nServer: "+string(defaultServerName)+"\r\n")) {
-		t.Fatalf("Unexpected response %q expected Server: "+string(defaultServerName), resp)
+	if br.Buffered() > 0 {
+		t.Fatalf("unexpected data after the responses: %q", rw.w.String())
 	}
+}
 
-	// We can't just overwrite s.Name as fasthttp caches the name in an atomic.Value
-	s = &Server{
+func TestRequestCtxFlushHijack(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
 		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("foo") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			ctx.WriteString("bar") //nolint:errcheck
+			// The flushed response must be finished anyway.
+			ctx.HijackSetNoResponse(true)
+			ctx.Hijack(func(c net.Conn) {
+				c.Write([]byte("hijacked")) //nolint:errcheck
+			})
 		},
-		Name: "foobar",
 	}
+	ln := fasthttputil.NewInmemoryListener()
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
 
-	resp = getReponse()
-	if !bytes.Contains(resp, []byte("\r\nServer: foobar\r\n")) {
-		t.Fatalf("Unexpected response %q expected Server: foobar", resp)
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-
-	s = &Server{
-		Handler: func(ctx *RequestCtx) {
-		},
-		NoDefaultServerHeader: true,
-		NoDefaultContentType:  true,
-		NoDefaultDate:         true,
+	defer c.Close()
+	if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
-	resp = getReponse()
-	if bytes.Contains(resp, []byte("\r\nServer: ")) {
-		t.Fatalf("Unexpected response %q expected no Server header", resp)
+	br := bufio.NewReader(c)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-
-	if bytes.Contains(resp, []byte("\r\nContent-Type: ")) {
-		t.Fatalf("Unexpected response %q expected no Content-Type header", resp)
+	if string(resp.Body()) != "foobar" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "foobar")
 	}
-
-	if bytes.Contains(resp, []byte("\r\nDate: ")) {
-		t.Fatalf("Unexpected response %q expected no Date header", resp)
+	data := make([]byte, len("hijacked"))
+	if _, err := io.ReadFull(br, data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != "hijacked" {
+		t.Fatalf("unexpected data from the hijacked connection: %q. Expecting %q", data, "hijacked")
 	}
 }
 
-func TestRequestCtxString(t *testing.T) {
+func TestRequestCtxFlushNotSupported(t *testing.T) {
 	t.Parallel()
 
-	var ctx RequestCtx
-
-	s := ctx.String()
-	expectedS := "#0000000000000000 - 0.0.0.0:0<->0.0.0.0:0 - GET http:///"
-	if s != expectedS {
-		t.Fatalf("unexpected ctx.String: %q. Expecting %q", s, expectedS)
+	ctx := NewTestRequestCtx("GET", "http://foobar.com/", "")
+	ctx.WriteString("foo") //nolint:errcheck
+	if err := ctx.Flush(); err != ErrFlushNotSupported {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrFlushNotSupported)
 	}
 
-	ctx.Request.SetRequestURI("https://foobar.com/aaa?bb=c")
-	s = ctx.String()
-	expectedS = "#0000000000000000 - 0.0.0.0:0<->0.0.0.0:0 - GET https://foobar.com/aaa?bb=c"
-	if s != expectedS {
-		t.Fatalf("unexpected ctx.String: %q. Expecting %q", s, expectedS)
+	var ctx1 RequestCtx
+	if err := ctx1.Flush(); err != ErrFlushNotSupported {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrFlushNotSupported)
 	}
 }
 
-func TestServerErrSmallBuffer(t *testing.T) {
+func TestServerHandlerPanic(t *testing.T) {
 	t.Parallel()
 
+	var tmpFileName string
+	logger := &testLogger{}
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
-			ctx.WriteString("shouldn't be never called") //nolint:errcheck
+			if ctx.IsPost() {
+				// Force storing the uploaded file on disk.
+				f, err := ctx.MultipartFormWithLimit(1)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				fr, err := f.File["file"][0].Open()
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				of, ok := fr.(*os.File)
+				if !ok {
+					t.Fatalf("expecting the uploaded file to be stored on disk")
+				}
+				tmpFileName = of.Name()
+				of.Close()
+			}
+			ctx.Response.Header.Set("X-Foo", "bar")
+			ctx.WriteString("partial response") //nolint:errcheck
+			panic("foobar")
 		},
-		ReadBufferSize: 20,
+		Logger:                       logger,
+		DisablePreParseMultipartForm: true,
 	}
 
+	body := "--foo\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"test.txt\"\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"file contents\r\n" +
+		"--foo--\r\n"
 	rw := &readWriter{}
-	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aabb.com\r\nVERY-long-Header: sdfdfsd dsf dsaf dsf df fsd\r\n\r\n")
-
-	ch := make(chan error)
-	go func() {
-		ch <- s.ServeConn(rw)
-	}()
-
-	var serverErr error
-	select {
-	case serverErr = <-ch:
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("timeout")
-	}
+	rw.r.WriteString(fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: google.com\r\n"+
+		"Content-Type: multipart/form-data; boundary=foo\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	rw.r.WriteString("GET /next HTTP/1.1\r\nHost: google.com\r\n\r\n")
 
-	if serverErr == nil {
-		t.Fatal("expected error")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
 	br := bufio.NewReader(&rw.w)
@@ -490,124 +562,212 @@ func TestServerErrSmallBuffer(t *testing.T) {
 	if err := resp.Read(br); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-	statusCode := resp.StatusCode()
-	if statusCode != StatusRequestHeaderFieldsTooLarge {
-		t.Fatalf("unexpected status code: %d. Expecting %d", statusCode, StatusRequestHeaderFieldsTooLarge)
+	if resp.StatusCode() != StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusInternalServerError)
+	}
+	if string(resp.Body()) != "Internal Server Error" {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "Internal Server Error")
+	}
+	if v := resp.Header.Peek("X-Foo"); len(v) > 0 {
+		t.Fatalf("unexpected header value %q. Expecting empty value", v)
 	}
 	if !resp.ConnectionClose() {
-		t.Fatal("missing 'Connection: close' response header")
+		t.Fatalf("expecting 'Connection: close' response header")
+	}
+	if br.Buffered() != 0 {
+		t.Fatalf("unexpected data after the response: %q. The second request mustn't be served", rw.w.Bytes())
 	}
 
-	expectedErr := errSmallBuffer.Error()
-	if !strings.Contains(serverErr.Error(), expectedErr) {
-		t.Fatalf("unexpected log output: %v. Expecting %q", serverErr, expectedErr)
+	if tmpFileName == "" {
+		t.Fatalf("the handler didn't store the uploaded file")
+	}
+	if _, err := os.Stat(tmpFileName); !os.IsNotExist(err) {
+		t.Fatalf("the uploaded file %q must be removed after the handler panic; stat error: %v", tmpFileName, err)
+	}
+	if !strings.Contains(logger.out, "panic in request handler: foobar") {
+		t.Fatalf("unexpected log output %q. Expecting the panic to be logged", logger.out)
+	}
+	if !strings.Contains(logger.out, "TestServerHandlerPanic") {
+		t.Fatalf("unexpected log output %q. Expecting the panic stack trace", logger.out)
 	}
 }
 
-func TestRequestCtxIsTLS(t *testing.T) {
+func TestServerPanicHandler(t *testing.T) {
 	t.Parallel()
 
-	var ctx RequestCtx
+	var panicErr interface{}
+	logger := &testLogger{}
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/ok" {
+				ctx.WriteString("ok") //nolint:errcheck
+				return
+			}
+			panic(fmt.Errorf("foobar"))
+		},
+		PanicHandler: func(ctx *RequestCtx, err interface{}) {
+			panicErr = err
+			if ctx.Response.StatusCode() != StatusInternalServerError {
+				t.Fatalf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), StatusInternalServerError)
+			}
+			if string(ctx.Path()) == "/custom" {
+				ctx.Error("custom error", StatusServiceUnavailable)
+			}
+		},
+		Logger: logger,
+	}
 
-	// tls.Conn
-	ctx.c = &tls.Conn{}
-	if !ctx.IsTLS() {
-		t.Fatal("IsTLS must return true")
+	testServerPanicHandler(t, s, "/ok", StatusOK, "ok", false)
+	testServerPanicHandler(t, s, "/default", StatusInternalServerError, "Internal Server Error", true)
+	testServerPanicHandler(t, s, "/custom", StatusServiceUnavailable, "custom error", true)
+
+	if err, ok := panicErr.(error); !ok || err.Error() != "foobar" {
+		t.Fatalf("unexpected panic value passed to PanicHandler: %v. Expecting %q", panicErr, "foobar")
+	}
+	if logger.out != "" {
+		t.Fatalf("unexpected log output %q. PanicHandler must replace the default logging", logger.out)
 	}
+}
 
-	// non-tls.Conn
-	ctx.c = &readWriter{}
-	if ctx.IsTLS() {
-		t.Fatal("IsTLS must return false")
+func testServerPanicHandler(t *testing.T, s *Server, path string, expectedStatusCode int, expectedBody string, expectedClose bool) {
+	rw := &readWriter{}
+	rw.r.WriteString("GET " + path + " HTTP/1.1\r\nHost: google.com\r\n\r\n")
+
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
-	// overridden tls.Conn
-	ctx.c = &struct {
-		*tls.Conn
-		fooBar bool
-	}{}
-	if !ctx.IsTLS() {
-		t.Fatal("IsTLS must return true")
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != expectedStatusCode {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), expectedStatusCode)
+	}
+	if string(resp.Body()) != expectedBody {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), expectedBody)
+	}
+	if resp.ConnectionClose() != expectedClose {
+		t.Fatalf("unexpected connection close: %v. Expecting %v", resp.ConnectionClose(), expectedClose)
 	}
 }
 
-func TestRequestCtxRedirectHTTPSSchemeless(t *testing.T) {
+func TestServerPanicHandlerPanic(t *testing.T) {
 	t.Parallel()
 
-	var ctx RequestCtx
+	logger := &testLogger{}
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			panic(fmt.Errorf("foobar"))
+		},
+		PanicHandler: func(ctx *RequestCtx, err interface{}) {
+			ctx.Error("custom error", StatusServiceUnavailable)
+			panic(fmt.Errorf("baz"))
+		},
+		Logger: logger,
+	}
 
-	s := "GET /foo/bar?baz HTTP/1.1\nHost: aaa.com\n\n"
-	br := bufio.NewReader(bytes.NewBufferString(s))
-	if err := ctx.Request.Read(br); err != nil {
-		t.Fatalf("cannot read request: %s", err)
+	// The server must survive the panic in PanicHandler
+	// and respond with the plain error.
+	testServerPanicHandler(t, s, "/", StatusInternalServerError, "Internal Server Error", true)
+
+	if !strings.Contains(logger.out, "panic in PanicHandler: baz") {
+		t.Fatalf("missing PanicHandler panic in the log output %q", logger.out)
 	}
-	ctx.Request.isTLS = true
+	if !strings.Contains(logger.out, "foobar") {
+		t.Fatalf("missing handler panic in the log output %q", logger.out)
+	}
+}
 
-	ctx.Redirect("//foobar.com/aa/bbb", StatusFound)
-	location := ctx.Response.Header.Peek(HeaderLocation)
-	expectedLocation := "https://foobar.com/aa/bbb"
-	if string(location) != expectedLocation {
-		t.Fatalf("Unexpected location: %q. Expecting %q", location, expectedLocation)
+func TestServerHandlerPanicAfterFlush(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("first chunk") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			ctx.WriteString("lost chunk") //nolint:errcheck
+			panic("foobar")
+		},
+		Logger: &testLogger{},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	rw.r.WriteString("GET /next HTTP/1.1\r\nHost: google.com\r\n\r\n")
+
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The connection must be closed without finishing the chunked response.
+	s1 := rw.w.String()
+	if !strings.HasSuffix(s1, "\r\n\r\nb\r\nfirst chunk\r\n") {
+		t.Fatalf("unexpected response %q. Expecting the unfinished chunked response", s1)
+	}
+	if strings.Contains(s1, "lost chunk") || strings.Contains(s1, "next") {
+		t.Fatalf("unexpected response %q", s1)
 	}
 }
 
-func TestRequestCtxRedirect(t *testing.T) {
+func TestServerPipelineCoalescing(t *testing.T) {
 	t.Parallel()
 
-	testRequestCtxRedirect(t, "http://qqq/", "", "http://qqq/")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "", "http://qqq/foo/bar?baz=111")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "#aaa", "http://qqq/foo/bar?baz=111#aaa")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "?abc=de&f", "http://qqq/foo/bar?abc=de&f")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "?abc=de&f#sf", "http://qqq/foo/bar?abc=de&f#sf")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html", "http://qqq/foo/x.html")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html?a=1", "http://qqq/foo/x.html?a=1")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html#aaa=bbb&cc=ddd", "http://qqq/foo/x.html#aaa=bbb&cc=ddd")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html?b=1#aaa=bbb&cc=ddd", "http://qqq/foo/x.html?b=1#aaa=bbb&cc=ddd")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "/x.html", "http://qqq/x.html")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "/x.html#aaa=bbb&cc=ddd", "http://qqq/x.html#aaa=bbb&cc=ddd")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "../x.html", "http://qqq/x.html")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "../../x.html", "http://qqq/x.html")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "./.././../x.html", "http://qqq/x.html")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "http://foo.bar/baz", "http://foo.bar/baz")
-	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "https://foo.bar/baz", "https://foo.bar/baz")
-	testRequestCtxRedirect(t, "https://foo.com/bar?aaa", "//google.com/aaa?bb", "https://google.com/aaa?bb")
+	testServerPipelineCoalescing(t, &Server{}, 1)
+	testServerPipelineCoalescing(t, &Server{ReduceMemoryUsage: true}, 1)
+	testServerPipelineCoalescing(t, &Server{DisablePipelineCoalescing: true}, 3)
 }
 
-func testRequestCtxRedirect(t *testing.T, origURL, redirectURL, expectedURL string) {
-	var ctx RequestCtx
-	var req Request
-	req.SetRequestURI(origURL)
-	ctx.Init(&req, nil, nil)
+func testServerPipelineCoalescing(t *testing.T, s *Server, expectedWrites int) {
+	s.Handler = func(ctx *RequestCtx) {
+		ctx.WriteString(string(ctx.Path())) //nolint:errcheck
+	}
 
-	ctx.Redirect(redirectURL, StatusFound)
-	loc := ctx.Response.Header.Peek(HeaderLocation)
-	if string(loc) != expectedURL {
-		t.Fatalf("unexpected redirect url %q. Expecting %q. origURL=%q, redirectURL=%q", loc, expectedURL, origURL, redirectURL)
+	rw := &writeCounter{}
+	rw.r.WriteString("GET /foo1 HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	rw.r.WriteString("GET /foo2 HTTP/1.1\r\nHost: google.com\r\n\r\n")
+	rw.r.WriteString("GET /foo3 HTTP/1.1\r\nHost: google.com\r\n\r\n")
+
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rw.writes != expectedWrites {
+		t.Fatalf("unexpected number of writes: %d. Expecting %d", rw.writes, expectedWrites)
+	}
+
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	for _, expectedBody := range []string{"/foo1", "/foo2", "/foo3"} {
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), expectedBody)
+		}
 	}
 }
 
-func TestServerResponseServerHeader(t *testing.T) {
+func TestServerVectoredWrite(t *testing.T) {
 	t.Parallel()
 
-	serverName := "foobar serv"
-
+	largeBody := strings.Repeat("x", 3*defaultWriteBufferSize)
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
-			name := ctx.Response.Header.Server()
-			if string(name) != serverName {
-				fmt.Fprintf(ctx, "unexpected server name: %q. Expecting %q", name, serverName)
+			if string(ctx.Path()) == "/large" {
+				ctx.SetBodyString(largeBody)
 			} else {
-				ctx.WriteString("OK") //nolint:errcheck
+				ctx.SetBodyString("small")
 			}
-
-			// make sure the server name is sent to the client after ctx.Response.Reset()
-			ctx.NotFound()
 		},
-		Name: serverName,
 	}
 
-	ln := fasthttputil.NewInmemoryListener()
-
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 	serverCh := make(chan struct{})
 	go func() {
 		if err := s.Serve(ln); err != nil {
@@ -616,152 +776,1634 @@ func TestServerResponseServerHeader(t *testing.T) {
 		close(serverCh)
 	}()
 
-	clientCh := make(chan struct{})
-	go func() {
-		c, err := ln.Dial()
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Large responses are written directly to the connection,
+	// so they mustn't overtake pipelined responses buffered before them.
+	if _, err = c.Write([]byte("GET /large HTTP/1.1\r\nHost: google.com\r\n\r\n" +
+		"GET /small HTTP/1.1\r\nHost: google.com\r\n\r\n" +
+		"GET /large HTTP/1.1\r\nHost: google.com\r\n\r\n" +
+		"HEAD /large HTTP/1.1\r\nHost: google.com\r\n\r\n" +
+		"GET /large HTTP/1.1\r\nHost: google.com\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	br := bufio.NewReader(c)
+	var resp Response
+	for _, expectedBody := range []string{largeBody, "small", largeBody, "", largeBody} {
+		resp.SkipBody = expectedBody == ""
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error: %s", err)
 		}
-		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
-			t.Errorf("unexpected error: %s", err)
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("unexpected body of length %d. Expecting length %d", len(resp.Body()), len(expectedBody))
 		}
-		br := bufio.NewReader(c)
-		var resp Response
-		if err = resp.Read(br); err != nil {
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("unexpected error: %v. Expecting io.EOF", err)
+	}
+
+	c.Close()
+	ln.Close()
+	<-serverCh
+}
+
+type writeCounter struct {
+	readWriter
+	writes int
+}
+
+func (rw *writeCounter) Write(b []byte) (int, error) {
+	rw.writes++
+	return rw.readWriter.Write(b)
+}
+
+func TestServerInvalidHeader(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if ctx.Request.Header.Peek("Foo") != nil || ctx.Request.Header.Peek("Foo ") != nil {
+				t.Error("expected Foo header")
+			}
+		},
+		Logger: &testLogger{},
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	go func() {
+		if err := s.Serve(ln); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = c.Write([]byte("POST /foo HTTP/1.1\r\nHost: gle.com\r\nFoo : bar\r\nContent-Length: 5\r\n\r\n12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(c)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+
+	c, err = ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = c.Write([]byte("GET /foo HTTP/1.1\r\nHost: gle.com\r\nFoo : bar\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	br = bufio.NewReader(c)
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestServerConnState(t *testing.T) {
+	t.Parallel()
+
+	states := make([]string, 0)
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {},
+		ConnState: func(conn net.Conn, state ConnState) {
+			states = append(states, state.String())
+		},
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	serverCh := make(chan struct{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	clientCh := make(chan struct{})
+	go func() {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		br := bufio.NewReader(c)
+		// Send 2 requests on the same connection.
+		for i := 0; i < 2; i++ {
+			if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			var resp Response
+			if err := resp.Read(br); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if resp.StatusCode() != StatusOK {
+				t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
+			}
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		// Give the server a little bit of time to transition the connection to the close state.
+		time.Sleep(time.Millisecond * 100)
+		close(clientCh)
+	}()
+
+	select {
+	case <-clientCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	// 2 requests so we go to active and idle twice.
+	expected := []string{"new", "active", "idle", "active", "idle", "closed"}
+
+	if !reflect.DeepEqual(expected, states) {
+		t.Fatalf("wrong state, expected %s, got %s", expected, states)
+	}
+}
+
+func TestSaveMultipartFile(t *testing.T) {
+	t.Parallel()
+
+	filea := "This is a test file."
+	fileb := strings.Repeat("test", 64)
+
+	mr := multipart.NewReader(strings.NewReader(""+
+		"--foo\r\n"+
+		"Content-Disposition: form-data; name=\"filea\"; filename=\"filea.txt\"\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		filea+"\r\n"+
+		"--foo\r\n"+
+		"Content-Disposition: form-data; name=\"fileb\"; filename=\"fileb.txt\"\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		fileb+"\r\n"+
+		"--foo--\r\n",
+	), "foo")
+
+	f, err := mr.ReadForm(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveMultipartFile(f.File["filea"][0], "filea.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("filea.txt")
+
+	if c, err := ioutil.ReadFile("filea.txt"); err != nil {
+		t.Fatal(err)
+	} else if string(c) != filea {
+		t.Fatalf("filea changed expected %q got %q", filea, c)
+	}
+
+	// Make sure fileb was saved to a file.
+	if ff, err := f.File["fileb"][0].Open(); err != nil {
+		t.Fatal("expected FileHeader.Open to work")
+	} else if _, ok := ff.(*os.File); !ok {
+		t.Fatal("expected fileb to be an os.File")
+	} else {
+		ff.Close()
+	}
+
+	if err := SaveMultipartFile(f.File["fileb"][0], "fileb.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("fileb.txt")
+
+	if c, err := ioutil.ReadFile("fileb.txt"); err != nil {
+		t.Fatal(err)
+	} else if string(c) != fileb {
+		t.Fatalf("fileb changed expected %q got %q", fileb, c)
+	}
+}
+
+func TestServerSetName(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{
+		Name: "foo",
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("ok") //nolint:errcheck
+		},
+	}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	var dials uint32
+	c := &HostClient{
+		Addr:     "foobar.com",
+		MaxConns: 1,
+		Dial: func(addr string) (net.Conn, error) {
+			atomic.AddUint32(&dials, 1)
+			return ln.Dial()
+		},
+	}
+
+	for _, name := range []string{"foo", "bar", "", "baz"} {
+		if name != "foo" {
+			s.SetName(name)
+		}
+		expectedName := name
+		if expectedName == "" {
+			expectedName = string(defaultServerName)
+		}
+
+		req := AcquireRequest()
+		resp := AcquireResponse()
+		req.SetRequestURI("http://foobar.com/")
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(resp.Header.Server()) != expectedName {
+			t.Fatalf("unexpected Server header: %q. Expecting %q", resp.Header.Server(), expectedName)
+		}
+		ReleaseRequest(req)
+		ReleaseResponse(resp)
+	}
+
+	// The name must be updated on the established keep-alive connection.
+	if n := atomic.LoadUint32(&dials); n != 1 {
+		t.Fatalf("unexpected number of dials: %d. Expecting %d", n, 1)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+		},
+	}
+
+	getReponse := func() []byte {
+		rw := &readWriter{}
+		rw.r.WriteString("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")
+
+		ch := make(chan error)
+		go func() {
+			ch <- s.ServeConn(rw)
+		}()
+
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatalf("Unexpected error from serveConn: %s", err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("timeout")
+		}
+
+		resp, err := ioutil.ReadAll(&rw.w)
+		if err != nil {
+			t.Fatalf("Unexpected error from ReadAll: %s", err)
+		}
+
+		return resp
+	}
+
+	resp := getReponse()
+	if !bytes.Contains(resp, []byte("\r\nServer: "+string(defaultServerName)+"\r\n")) {
+		t.Fatalf("Unexpected response %q expected Server: "+string(defaultServerName), resp)
+	}
+
+	// We can't just overwrite s.Name as fasthttp caches the name in an atomic.Value
+	s = &Server{
+		Handler: func(ctx *RequestCtx) {
+		},
+		Name: "foobar",
+	}
+
+	resp = getReponse()
+	if !bytes.Contains(resp, []byte("\r\nServer: foobar\r\n")) {
+		t.Fatalf("Unexpected response %q expected Server: foobar", resp)
+	}
+
+	s = &Server{
+		Handler: func(ctx *RequestCtx) {
+		},
+		NoDefaultServerHeader: true,
+		NoDefaultContentType:  true,
+		NoDefaultDate:         true,
+	}
+
+	resp = getReponse()
+	if bytes.Contains(resp, []byte("\r\nServer: ")) {
+		t.Fatalf("Unexpected response %q expected no Server header", resp)
+	}
+
+	if bytes.Contains(resp, []byte("\r\nContent-Type: ")) {
+		t.Fatalf("Unexpected response %q expected no Content-Type header", resp)
+	}
+
+	if bytes.Contains(resp, []byte("\r\nDate: ")) {
+		t.Fatalf("Unexpected response %q expected no Date header", resp)
+	}
+}
+
+func TestRequestCtxString(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+
+	s := ctx.String()
+	expectedS := "#0000000000000000 - 0.0.0.0:0<->0.0.0.0:0 - GET http:///"
+	if s != expectedS {
+		t.Fatalf("unexpected ctx.String: %q. Expecting %q", s, expectedS)
+	}
+
+	ctx.Request.SetRequestURI("https://foobar.com/aaa?bb=c")
+	s = ctx.String()
+	expectedS = "#0000000000000000 - 0.0.0.0:0<->0.0.0.0:0 - GET https://foobar.com/aaa?bb=c"
+	if s != expectedS {
+		t.Fatalf("unexpected ctx.String: %q. Expecting %q", s, expectedS)
+	}
+}
+
+func TestServerErrSmallBuffer(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("shouldn't be never called") //nolint:errcheck
+		},
+		ReadBufferSize: 20,
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aabb.com\r\nVERY-long-Header: sdfdfsd dsf dsaf dsf df fsd\r\n\r\n")
+
+	ch := make(chan error)
+	go func() {
+		ch <- s.ServeConn(rw)
+	}()
+
+	var serverErr error
+	select {
+	case serverErr = <-ch:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	if serverErr == nil {
+		t.Fatal("expected error")
+	}
+
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	statusCode := resp.StatusCode()
+	if statusCode != StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("unexpected status code: %d. Expecting %d", statusCode, StatusRequestHeaderFieldsTooLarge)
+	}
+	if !resp.ConnectionClose() {
+		t.Fatal("missing 'Connection: close' response header")
+	}
+
+	expectedErr := errSmallBuffer.Error()
+	if !strings.Contains(serverErr.Error(), expectedErr) {
+		t.Fatalf("unexpected log output: %v. Expecting %q", serverErr, expectedErr)
+	}
+}
+
+func TestRequestCtxIsTLS(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+
+	// tls.Conn
+	ctx.c = &tls.Conn{}
+	if !ctx.IsTLS() {
+		t.Fatal("IsTLS must return true")
+	}
+
+	// non-tls.Conn
+	ctx.c = &readWriter{}
+	if ctx.IsTLS() {
+		t.Fatal("IsTLS must return false")
+	}
+
+	// overridden tls.Conn
+	ctx.c = &struct {
+		*tls.Conn
+		fooBar bool
+	}{}
+	if !ctx.IsTLS() {
+		t.Fatal("IsTLS must return true")
+	}
+}
+
+func TestRequestCtxRedirectHTTPSSchemeless(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+
+	s := "GET /foo/bar?baz HTTP/1.1\nHost: aaa.com\n\n"
+	br := bufio.NewReader(bytes.NewBufferString(s))
+	if err := ctx.Request.Read(br); err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	ctx.Request.isTLS = true
+
+	ctx.Redirect("//foobar.com/aa/bbb", StatusFound)
+	location := ctx.Response.Header.Peek(HeaderLocation)
+	expectedLocation := "https://foobar.com/aa/bbb"
+	if string(location) != expectedLocation {
+		t.Fatalf("Unexpected location: %q. Expecting %q", location, expectedLocation)
+	}
+}
+
+func TestRequestCtxRedirect(t *testing.T) {
+	t.Parallel()
+
+	testRequestCtxRedirect(t, "http://qqq/", "", "http://qqq/")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "", "http://qqq/foo/bar?baz=111")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "#aaa", "http://qqq/foo/bar?baz=111#aaa")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "?abc=de&f", "http://qqq/foo/bar?abc=de&f")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "?abc=de&f#sf", "http://qqq/foo/bar?abc=de&f#sf")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html", "http://qqq/foo/x.html")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html?a=1", "http://qqq/foo/x.html?a=1")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html#aaa=bbb&cc=ddd", "http://qqq/foo/x.html#aaa=bbb&cc=ddd")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "x.html?b=1#aaa=bbb&cc=ddd", "http://qqq/foo/x.html?b=1#aaa=bbb&cc=ddd")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "/x.html", "http://qqq/x.html")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "/x.html#aaa=bbb&cc=ddd", "http://qqq/x.html#aaa=bbb&cc=ddd")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "../x.html", "http://qqq/x.html")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "../../x.html", "http://qqq/x.html")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "./.././../x.html", "http://qqq/x.html")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "http://foo.bar/baz", "http://foo.bar/baz")
+	testRequestCtxRedirect(t, "http://qqq/foo/bar?baz=111", "https://foo.bar/baz", "https://foo.bar/baz")
+	testRequestCtxRedirect(t, "https://foo.com/bar?aaa", "//google.com/aaa?bb", "https://google.com/aaa?bb")
+}
+
+func testRequestCtxRedirect(t *testing.T, origURL, redirectURL, expectedURL string) {
+	var ctx RequestCtx
+	var req Request
+	req.SetRequestURI(origURL)
+	ctx.Init(&req, nil, nil)
+
+	ctx.Redirect(redirectURL, StatusFound)
+	loc := ctx.Response.Header.Peek(HeaderLocation)
+	if string(loc) != expectedURL {
+		t.Fatalf("unexpected redirect url %q. Expecting %q. origURL=%q, redirectURL=%q", loc, expectedURL, origURL, redirectURL)
+	}
+}
+
+func TestServerResponseServerHeader(t *testing.T) {
+	t.Parallel()
+
+	serverName := "foobar serv"
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			name := ctx.Response.Header.Server()
+			if string(name) != serverName {
+				fmt.Fprintf(ctx, "unexpected server name: %q. Expecting %q", name, serverName)
+			} else {
+				ctx.WriteString("OK") //nolint:errcheck
+			}
+
+			// make sure the server name is sent to the client after ctx.Response.Reset()
+			ctx.NotFound()
+		},
+		Name: serverName,
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	serverCh := make(chan struct{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	clientCh := make(chan struct{})
+	go func() {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		br := bufio.NewReader(c)
+		var resp Response
+		if err = resp.Read(br); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		if resp.StatusCode() != StatusNotFound {
+			t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusNotFound)
+		}
+		if string(resp.Body()) != "404 Page not found" {
+			t.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "404 Page not found")
+		}
+		if string(resp.Header.Server()) != serverName {
+			t.Errorf("unexpected server header: %q. Expecting %q", resp.Header.Server(), serverName)
+		}
+		if err = c.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(clientCh)
+	}()
+
+	select {
+	case <-clientCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServerResponseBodyStream(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	readyCh := make(chan struct{})
+	h := func(ctx *RequestCtx) {
+		ctx.SetConnectionClose()
+		if ctx.IsBodyStream() {
+			t.Fatal("IsBodyStream must return false")
+		}
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			fmt.Fprintf(w, "first")
+			if err := w.Flush(); err != nil {
+				return
+			}
+			<-readyCh
+			fmt.Fprintf(w, "second")
+			// there is no need to flush w here, since it will
+			// be flushed automatically after returning from StreamWriter.
+		})
+		if !ctx.IsBodyStream() {
+			t.Fatal("IsBodyStream must return true")
+		}
+	}
+
+	serverCh := make(chan struct{})
+	go func() {
+		if err := Serve(ln, h); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	clientCh := make(chan struct{})
+	go func() {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		br := bufio.NewReader(c)
+		var respH ResponseHeader
+		if err = respH.Read(br); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if respH.StatusCode() != StatusOK {
+			t.Errorf("unexpected status code: %d. Expecting %d", respH.StatusCode(), StatusOK)
+		}
+
+		buf := make([]byte, 1024)
+		n, err := br.Read(buf)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		b := buf[:n]
+		if string(b) != "5\r\nfirst\r\n" {
+			t.Errorf("unexpected result %q. Expecting %q", b, "5\r\nfirst\r\n")
+		}
+		close(readyCh)
+
+		tail, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if string(tail) != "6\r\nsecond\r\n0\r\n\r\n" {
+			t.Errorf("unexpected tail %q. Expecting %q", tail, "6\r\nsecond\r\n0\r\n\r\n")
+		}
+
+		close(clientCh)
+	}()
+
+	select {
+	case <-clientCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServerDisableKeepalive(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		DisableKeepalive: true,
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	serverCh := make(chan struct{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	clientCh := make(chan struct{})
+	go func() {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		br := bufio.NewReader(c)
+		var resp Response
+		if err = resp.Read(br); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if resp.StatusCode() != StatusOK {
+			t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
+		}
+		if !resp.ConnectionClose() {
+			t.Error("expecting 'Connection: close' response header")
+		}
+		if string(resp.Body()) != "OK" {
+			t.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "OK")
+		}
+
+		// make sure the connection is closed
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if len(data) > 0 {
+			t.Errorf("unexpected data read from the connection: %q. Expecting empty data", data)
+		}
+
+		close(clientCh)
+	}()
+
+	select {
+	case <-clientCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServerMaxRequestBodyBytesInFlight(t *testing.T) {
+	t.Parallel()
+
+	const bodySize = 1000
+	body := strings.Repeat("x", bodySize)
+
+	var handled sync.WaitGroup
+	readyCh := make(chan struct{})
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			handled.Done()
+			<-readyCh
+			ctx.Write(ctx.PostBody()) //nolint:errcheck
+		},
+		MaxRequestBodyBytesInFlight: 2 * bodySize,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go s.Serve(ln) //nolint:errcheck
+
+	post := func() *bufio.Reader {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		req := fmt.Sprintf("POST / HTTP/1.1\r\nHost: aa\r\nContent-Length: %d\r\n\r\n%s", bodySize, body)
+		if _, err = c.Write([]byte(req)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return bufio.NewReader(c)
+	}
+
+	// The first two requests fit the limit and block in the handler.
+	handled.Add(2)
+	br1 := post()
+	br2 := post()
+	handled.Wait()
+
+	// The third request exceeds the limit.
+	br3 := post()
+	verifyResponse(t, br3, StatusServiceUnavailable, string(defaultContentType), "Too many concurrent request bodies")
+
+	close(readyCh)
+	verifyResponse(t, br1, StatusOK, string(defaultContentType), body)
+	verifyResponse(t, br2, StatusOK, string(defaultContentType), body)
+
+	// The limit must be released after the handlers return.
+	handled.Add(1)
+	br4 := post()
+	verifyResponse(t, br4, StatusOK, string(defaultContentType), body)
+	if n := atomic.LoadInt64(&s.requestBodyBytesInFlight); n != 0 {
+		t.Fatalf("unexpected in-flight body bytes: %d. Expecting 0", n)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestServerTrailersTE(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Response.Header.SetTrailer("X-Checksum", "abcd")
+			ctx.SetBodyStream(strings.NewReader("foobar"), -1)
+		},
+	}
+
+	// The client advertising trailers support receives them.
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\nTE: trailers\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp := rw.w.String()
+	if !strings.Contains(resp, "\r\nTrailer: X-Checksum\r\n") {
+		t.Fatalf("missing Trailer header in response %q", resp)
+	}
+	if !strings.HasSuffix(resp, "\r\n6\r\nfoobar\r\n0\r\nX-Checksum: abcd\r\n\r\n") {
+		t.Fatalf("missing trailers in response %q", resp)
+	}
+
+	// The client without trailers support receives the body only.
+	rw = &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp = rw.w.String()
+	if strings.Contains(resp, "Trailer") || strings.Contains(resp, "X-Checksum") {
+		t.Fatalf("unexpected trailers in response %q", resp)
+	}
+	br := bufio.NewReader(&rw.w)
+	verifyResponse(t, br, StatusOK, string(defaultContentType), "foobar")
+}
+
+func TestServerPostHandlerHeaders(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/override":
+				ctx.Response.Header.Set("X-Frame-Options", "SAMEORIGIN")
+			case "/empty":
+				ctx.Response.Header.Set("X-Frame-Options", "")
+			}
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		PostHandlerHeaders: []PostHandlerHeader{
+			{Key: "X-Frame-Options", Value: "DENY"},
+			{Key: "X-Content-Type-Options", Value: "nosniff"},
+			{Key: "X-Xss-Protection", Value: "0"},
+		},
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/", "DENY"},
+		{"/override", "SAMEORIGIN"},
+		{"/empty", ""},
+	} {
+		path := tc.path
+		rw := &readWriter{}
+		rw.r.WriteString("GET " + path + " HTTP/1.1\r\nHost: aa\r\n\r\n")
+		if err := s.ServeConn(rw); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// The headers must be added in the given order.
+		raw := rw.w.String()
+		if path == "/" && !strings.Contains(raw, "\r\nX-Frame-Options: DENY\r\nX-Content-Type-Options: nosniff\r\nX-Xss-Protection: 0\r\n") {
+			t.Fatalf("unexpected order of PostHandlerHeaders in %q", raw)
+		}
+
+		var resp Response
+		if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if v := string(resp.Header.Peek("X-Frame-Options")); v != tc.expected {
+			t.Fatalf("unexpected X-Frame-Options for %q: %q. Expecting %q", path, v, tc.expected)
+		}
+		if v := string(resp.Header.Peek("X-Content-Type-Options")); v != "nosniff" {
+			t.Fatalf("unexpected X-Content-Type-Options for %q: %q. Expecting %q", path, v, "nosniff")
+		}
+		if string(resp.Body()) != "OK" {
+			t.Fatalf("unexpected body for %q: %q. Expecting %q", path, resp.Body(), "OK")
+		}
+	}
+
+	// error response for malformed request
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\nContent-Length: foobar\r\n\r\n")
+	if err := s.ServeConn(rw); err == nil {
+		t.Fatalf("expecting error for malformed request")
+	}
+	var resp Response
+	if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+	if v := string(resp.Header.Peek("X-Frame-Options")); v != "DENY" {
+		t.Fatalf("unexpected X-Frame-Options for error response: %q. Expecting %q", v, "DENY")
+	}
+}
+
+func TestServerOptionsHandler(t *testing.T) {
+	t.Parallel()
+
+	var path string
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			path = string(ctx.Path())
+			if path == "/custom" {
+				ctx.SetStatusCode(StatusNoContent)
+				ctx.Response.Header.Set(HeaderAllow, "GET")
+				return
+			}
+			if !ctx.IsOptions() || path == "/body" {
+				ctx.WriteString("OK") //nolint:errcheck
+			}
+		},
+		OptionsHandler: OptionsAllowHandler(MethodGet, MethodPost, MethodOptions),
+	}
+
+	for _, test := range []struct {
+		request      string
+		path         string
+		statusCode   int
+		allow        string
+		expectedBody string
+	}{
+		{"OPTIONS * HTTP/1.1\r\nHost: aa\r\n\r\n", "*", StatusNoContent, "GET, POST, OPTIONS", ""},
+		{"OPTIONS /foo HTTP/1.1\r\nHost: aa\r\n\r\n", "/foo", StatusNoContent, "GET, POST, OPTIONS", ""},
+		{"OPTIONS /custom HTTP/1.1\r\nHost: aa\r\n\r\n", "/custom", StatusNoContent, "GET", ""},
+		{"OPTIONS /body HTTP/1.1\r\nHost: aa\r\n\r\n", "/body", StatusOK, "", "OK"},
+		{"GET /foo HTTP/1.1\r\nHost: aa\r\n\r\n", "/foo", StatusOK, "", "OK"},
+	} {
+		rw := &readWriter{}
+		rw.r.WriteString(test.request)
+		if err := s.ServeConn(rw); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var resp Response
+		if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if path != test.path {
+			t.Fatalf("unexpected path %q. Expecting %q", path, test.path)
+		}
+		if resp.StatusCode() != test.statusCode {
+			t.Fatalf("unexpected status code for %q: %d. Expecting %d", test.request, resp.StatusCode(), test.statusCode)
+		}
+		if v := string(resp.Header.Peek(HeaderAllow)); v != test.allow {
+			t.Fatalf("unexpected Allow header for %q: %q. Expecting %q", test.request, v, test.allow)
+		}
+		if string(resp.Body()) != test.expectedBody {
+			t.Fatalf("unexpected body for %q: %q. Expecting %q", test.request, resp.Body(), test.expectedBody)
+		}
+	}
+}
+
+func TestServerEchoRequestID(t *testing.T) {
+	t.Parallel()
+
+	var handlerID string
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			handlerID = string(ctx.RequestID())
+			if string(ctx.Path()) == "/override" {
+				ctx.Response.Header.Set(HeaderXRequestID, "custom")
+			}
+		},
+		EchoRequestID: true,
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\nX-Request-ID: abc-123\r\n\r\n")
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	rw.r.WriteString("GET /override HTTP/1.1\r\nHost: aa\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := string(resp.Header.Peek(HeaderXRequestID)); v != "abc-123" {
+		t.Fatalf("unexpected X-Request-ID %q. Expecting %q", v, "abc-123")
+	}
+
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	generated := string(resp.Header.Peek(HeaderXRequestID))
+	if len(generated) != 16 || generated == "abc-123" {
+		t.Fatalf("unexpected generated X-Request-ID %q", generated)
+	}
+
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := string(resp.Header.Peek(HeaderXRequestID)); v != "custom" {
+		t.Fatalf("unexpected X-Request-ID %q. Expecting %q", v, "custom")
+	}
+	if handlerID == generated || len(handlerID) != 16 {
+		t.Fatalf("unexpected request ID %q in the last request. Must differ from %q", handlerID, generated)
+	}
+}
+
+func TestServerEchoRequestIDFlush(t *testing.T) {
+	t.Parallel()
+
+	var handlerID string
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			handlerID = string(ctx.RequestID())
+			ctx.WriteString("foo") //nolint:errcheck
+			if err := ctx.Flush(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			ctx.WriteString("bar") //nolint:errcheck
+		},
+		EchoRequestID: true,
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\nX-Request-ID: abc-123\r\n\r\n")
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := string(resp.Header.Peek(HeaderXRequestID)); v != "abc-123" {
+		t.Fatalf("unexpected X-Request-ID %q. Expecting %q", v, "abc-123")
+	}
+	if string(resp.Body()) != "foobar" {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "foobar")
+	}
+
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := string(resp.Header.Peek(HeaderXRequestID)); v != handlerID || len(v) != 16 {
+		t.Fatalf("unexpected X-Request-ID %q. Expecting %q", v, handlerID)
+	}
+	if string(resp.Body()) != "foobar" {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "foobar")
+	}
+}
+
+func TestRequestCtxRequestID(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+	var req Request
+	ctx.Init(&req, nil, nil)
+	ctx.connID = 0x12
+	ctx.connRequestNum = 0x34
+	if v := string(ctx.RequestID()); v != "0000001200000034" {
+		t.Fatalf("unexpected request ID %q. Expecting %q", v, "0000001200000034")
+	}
+}
+
+func TestRequestCtxConnectionWillClose(t *testing.T) {
+	t.Parallel()
+
+	var results []bool
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if string(ctx.Path()) == "/close" {
+				results = append(results, ctx.ConnectionWillClose())
+				ctx.SetConnectionClose()
+			}
+			results = append(results, ctx.ConnectionWillClose())
+		},
+		MaxRequestsPerConn: 3,
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	rw.r.WriteString("GET /close HTTP/1.1\r\nHost: aa\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rw = &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rw = &readWriter{}
+	rw.r.WriteString("GET / HTTP/1.1\r\nHost: aa\r\nConnection: close\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []bool{false, false, true, false, false, true, true}
+	if fmt.Sprint(results) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected results %v. Expecting %v", results, expected)
+	}
+}
+
+func TestServerHTTP2Preface(t *testing.T) {
+	t.Parallel()
+
+	handlerCalled := false
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			handlerCalled = true
+		},
+		Logger: &testLogger{},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	err := s.ServeConn(rw)
+	if err != ErrHTTP2Preface {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, ErrHTTP2Preface)
+	}
+	if handlerCalled {
+		t.Fatal("the handler mustn't be called for HTTP/2 connection preface")
+	}
+
+	var resp Response
+	if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusHTTPVersionNotSupported {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), StatusHTTPVersionNotSupported)
+	}
+	if !resp.ConnectionClose() {
+		t.Fatal("expecting connection close")
+	}
+}
+
+func TestServerErrorHandlerStatusCodes(t *testing.T) {
+	t.Parallel()
+
+	// body too large
+	testServerErrorHandlerStatusCode(t, nil,
+		"POST / HTTP/1.1\r\nHost: aaa\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("a", 100),
+		StatusRequestEntityTooLarge, ErrBodyTooLarge)
+
+	// malformed request header
+	testServerErrorHandlerStatusCode(t, nil,
+		"GET / HTTP/1.1\r\nHost: aaa\r\nContent-Length: foobar\r\n\r\n",
+		StatusBadRequest, nil)
+
+	// request header too large
+	testServerErrorHandlerStatusCode(t, nil,
+		"GET / HTTP/1.1\r\nHost: aaa\r\nX-Foo: "+strings.Repeat("a", 2048)+"\r\n\r\n",
+		StatusRequestHeaderFieldsTooLarge, ErrHeaderTooLarge)
+
+	// too many request headers
+	testServerErrorHandlerStatusCode(t, nil,
+		"GET / HTTP/1.1\r\nHost: aaa\r\n"+strings.Repeat("a:b\r\n", 20)+"\r\n",
+		StatusRequestHeaderFieldsTooLarge, ErrTooManyHeaders)
+
+	// custom error handler
+	errorHandler := func(ctx *RequestCtx, err error) {
+		if err == ErrBodyTooLarge {
+			ctx.Error("custom too large", StatusRequestEntityTooLarge)
+		} else {
+			ctx.Error("custom bad request", StatusBadRequest)
+		}
+	}
+	body := testServerErrorHandlerStatusCode(t, errorHandler,
+		"POST / HTTP/1.1\r\nHost: aaa\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("a", 100),
+		StatusRequestEntityTooLarge, ErrBodyTooLarge)
+	if body != "custom too large" {
+		t.Fatalf("unexpected body %q. Expecting %q", body, "custom too large")
+	}
+	body = testServerErrorHandlerStatusCode(t, errorHandler,
+		"GET / HTTP/1.1\r\nHost: aaa\r\nContent-Length: foobar\r\n\r\n",
+		StatusBadRequest, nil)
+	if body != "custom bad request" {
+		t.Fatalf("unexpected body %q. Expecting %q", body, "custom bad request")
+	}
+}
+
+func testServerErrorHandlerStatusCode(t *testing.T, errorHandler func(ctx *RequestCtx, err error),
+	request string, expectedStatusCode int, expectedErr error) string {
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			t.Errorf("the handler mustn't be called for %q", request)
+		},
+		ErrorHandler:          errorHandler,
+		MaxRequestBodySize:    10,
+		MaxRequestHeaderSize:  1024,
+		MaxRequestHeaderCount: 10,
+		Logger:                &testLogger{},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString(request)
+	err := s.ServeConn(rw)
+	if err == nil {
+		t.Fatalf("expecting error for %q", request)
+	}
+	if expectedErr != nil && err != expectedErr {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, expectedErr)
+	}
+
+	var resp Response
+	if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != expectedStatusCode {
+		t.Fatalf("unexpected status code %d. Expecting %d", resp.StatusCode(), expectedStatusCode)
+	}
+	if !resp.ConnectionClose() {
+		t.Fatal("expecting connection close")
+	}
+	return string(resp.Body())
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Write(ctx.PostBody()) //nolint:errcheck
+		},
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       5 * time.Second,
+		Logger:            &testLogger{},
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	// The body may be sent slower than ReadHeaderTimeout.
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("POST / HTTP/1.1\r\nHost: aa\r\nContent-Length: 3\r\n\r\na")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(2 * s.ReadHeaderTimeout)
+	if _, err = c.Write([]byte("bc")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	br := bufio.NewReader(c)
+	verifyResponse(t, br, StatusOK, string(defaultContentType), "abc")
+
+	// Slow headers are rejected.
+	c, err = ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	br = bufio.NewReader(c)
+	var resp Response
+	if err = resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() == StatusOK || !resp.ConnectionClose() {
+		t.Fatalf("unexpected response %d. Expecting error response closing the connection", resp.StatusCode())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the slow headers have been rejected too late: %s", d)
+	}
+}
+
+func TestServerMaxConnDuration(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		MaxConnDuration: 100 * time.Millisecond,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	br := bufio.NewReader(c)
+	requests := 0
+	for {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the connection hasn't been closed after %d requests", requests)
+		}
+		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			break
+		}
+		var resp Response
+		if err = resp.Read(br); err != nil {
+			break
+		}
+		requests++
+	}
+	if requests == 0 {
+		t.Fatal("expecting at least a single served request")
+	}
+	if d := time.Since(start); d < s.MaxConnDuration/2 {
+		t.Fatalf("the connection has been closed too early: %s. Expecting about %s", d, s.MaxConnDuration)
+	}
+}
+
+func TestServerMaxKeepaliveDurationNoop(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		MaxKeepaliveDuration: 10 * time.Millisecond,
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(5 * s.MaxKeepaliveDuration)
+		}
+		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		verifyResponse(t, br, StatusOK, string(defaultContentType), "OK")
+	}
+}
+
+func TestServerMaxConnsPerIPLimit(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		MaxConnsPerIP: 1,
+		Logger:        &testLogger{},
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	serverCh := make(chan struct{})
+	go func() {
+		fakeLN := &fakeIPListener{
+			Listener: ln,
+		}
+		if err := s.Serve(fakeLN); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	clientCh := make(chan struct{})
+	go func() {
+		c1, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		c2, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		br := bufio.NewReader(c2)
+		var resp Response
+		if err = resp.Read(br); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if resp.StatusCode() != StatusTooManyRequests {
+			t.Errorf("unexpected status code for the second connection: %d. Expecting %d",
+				resp.StatusCode(), StatusTooManyRequests)
+		}
+
+		if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error when writing to the first connection: %s", err)
+		}
+		br = bufio.NewReader(c1)
+		if err = resp.Read(br); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if resp.StatusCode() != StatusOK {
+			t.Errorf("unexpected status code for the first connection: %d. Expecting %d",
+				resp.StatusCode(), StatusOK)
+		}
+		if string(resp.Body()) != "OK" {
+			t.Errorf("unexpected body for the first connection: %q. Expecting %q", resp.Body(), "OK")
+		}
+		close(clientCh)
+	}()
+
+	select {
+	case <-clientCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+type fakeIPListener struct {
+	net.Listener
+}
+
+func (ln *fakeIPListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeIPConn{
+		Conn: conn,
+	}, nil
+}
+
+type fakeIPConn struct {
+	net.Conn
+}
+
+func (conn *fakeIPConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp4", "1.2.3.4:5789")
+	if err != nil {
+		panic(fmt.Sprintf("BUG: unexpected error: %s", err))
+	}
+	return addr
+}
+
+func TestServerMaxConns(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		MaxConns: 2,
+		Logger:   &testLogger{},
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	serverCh := make(chan struct{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	c1, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c2, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testServerMaxConnsRequest(t, c1)
+	testServerMaxConnsRequest(t, c2)
+
+	// The third connection must be rejected, since the limit is reached.
+	c3, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var resp Response
+	if err = resp.Read(bufio.NewReader(c3)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusServiceUnavailable {
+		t.Fatalf("unexpected status code for the connection beyond MaxConns=%d: %d. Expecting %d",
+			s.MaxConns, resp.StatusCode(), StatusServiceUnavailable)
+	}
+	c3.Close()
 
-		if resp.StatusCode() != StatusNotFound {
-			t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusNotFound)
+	// New connections must be served once one of the connections is closed.
+	if err = c1.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; ; i++ {
+		if c3, err = ln.Dial(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
 		}
-		if string(resp.Body()) != "404 Page not found" {
-			t.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "404 Page not found")
+		// Write may fail if the server has already rejected the connection.
+		_, err = c3.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n"))
+		if err == nil {
+			err = resp.Read(bufio.NewReader(c3))
 		}
-		if string(resp.Header.Server()) != serverName {
-			t.Errorf("unexpected server header: %q. Expecting %q", resp.Header.Server(), serverName)
+		if err == nil && resp.StatusCode() == StatusOK {
+			break
 		}
-		if err = c.Close(); err != nil {
-			t.Errorf("unexpected error: %s", err)
+		c3.Close()
+		if i >= 100 {
+			t.Fatalf("the connection must be served after closing one of the connections")
 		}
-		close(clientCh)
-	}()
-
-	select {
-	case <-clientCh:
-	case <-time.After(time.Second):
-		t.Fatal("timeout")
+		// The slot is released asynchronously after the connection is closed.
+		time.Sleep(10 * time.Millisecond)
 	}
+	testServerMaxConnsRequest(t, c2)
 
-	if err := ln.Close(); err != nil {
+	if err = c2.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = c3.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = ln.Close(); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
 	select {
 	case <-serverCh:
 	case <-time.After(time.Second):
-		t.Fatal("timeout")
+		t.Fatalf("timeout")
 	}
 }
 
-func TestServerResponseBodyStream(t *testing.T) {
-	t.Parallel()
+func testServerMaxConnsRequest(t *testing.T, c net.Conn) {
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var resp Response
+	if err := resp.Read(bufio.NewReader(c)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
+	}
+	if string(resp.Body()) != "OK" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "OK")
+	}
+}
 
-	ln := fasthttputil.NewInmemoryListener()
+func TestServerMaxConnsCloseListener(t *testing.T) {
+	t.Parallel()
 
-	readyCh := make(chan struct{})
-	h := func(ctx *RequestCtx) {
-		ctx.SetConnectionClose()
-		if ctx.IsBodyStream() {
-			t.Fatal("IsBodyStream must return false")
-		}
-		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
-			fmt.Fprintf(w, "first")
-			if err := w.Flush(); err != nil {
-				return
-			}
-			<-readyCh
-			fmt.Fprintf(w, "second")
-			// there is no need to flush w here, since it will
-			// be flushed automatically after returning from StreamWriter.
-		})
-		if !ctx.IsBodyStream() {
-			t.Fatal("IsBodyStream must return true")
-		}
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.WriteString("OK") //nolint:errcheck
+		},
+		MaxConns: 1,
+		Logger:   &testLogger{},
 	}
 
+	ln := fasthttputil.NewInmemoryListener()
+
 	serverCh := make(chan struct{})
 	go func() {
-		if err := Serve(ln, h); err != nil {
+		if err := s.Serve(ln); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
 		close(serverCh)
 	}()
 
-	clientCh := make(chan struct{})
-	go func() {
-		c, err := ln.Dial()
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		br := bufio.NewReader(c)
-		var respH ResponseHeader
-		if err = respH.Read(br); err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		if respH.StatusCode() != StatusOK {
-			t.Errorf("unexpected status code: %d. Expecting %d", respH.StatusCode(), StatusOK)
-		}
-
-		buf := make([]byte, 1024)
-		n, err := br.Read(buf)
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		b := buf[:n]
-		if string(b) != "5\r\nfirst\r\n" {
-			t.Errorf("unexpected result %q. Expecting %q", b, "5\r\nfirst\r\n")
-		}
-		close(readyCh)
-
-		tail, err := ioutil.ReadAll(br)
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		if string(tail) != "6\r\nsecond\r\n0\r\n\r\n" {
-			t.Errorf("unexpected tail %q. Expecting %q", tail, "6\r\nsecond\r\n0\r\n\r\n")
-		}
-
-		close(clientCh)
-	}()
-
-	select {
-	case <-clientCh:
-	case <-time.After(time.Second):
-		t.Fatal("timeout")
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
+	defer c.Close()
+	testServerMaxConnsRequest(t, c)
 
-	if err := ln.Close(); err != nil {
+	// Serve must return after the listener is closed
+	// even if the limit is reached.
+	if err = ln.Close(); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
-
 	select {
 	case <-serverCh:
 	case <-time.After(time.Second):
-		t.Fatal("timeout")
+		t.Fatalf("timeout")
 	}
 }
 
-func TestServerDisableKeepalive(t *testing.T) {
+func TestServerConcurrencyLimit(t *testing.T) {
 	t.Parallel()
 
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
 			ctx.WriteString("OK") //nolint:errcheck
 		},
-		DisableKeepalive: true,
+		Concurrency: 1,
+		Logger:      &testLogger{},
 	}
 
 	ln := fasthttputil.NewInmemoryListener()
@@ -776,37 +2418,38 @@ func TestServerDisableKeepalive(t *testing.T) {
 
 	clientCh := make(chan struct{})
 	go func() {
-		c, err := ln.Dial()
+		c1, err := ln.Dial()
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
-		if _, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+		c2, err := ln.Dial()
+		if err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
-		br := bufio.NewReader(c)
+		br := bufio.NewReader(c2)
 		var resp Response
 		if err = resp.Read(br); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
-		if resp.StatusCode() != StatusOK {
-			t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
-		}
-		if !resp.ConnectionClose() {
-			t.Error("expecting 'Connection: close' response header")
-		}
-		if string(resp.Body()) != "OK" {
-			t.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "OK")
+		if resp.StatusCode() != StatusServiceUnavailable {
+			t.Errorf("unexpected status code for the second connection: %d. Expecting %d",
+				resp.StatusCode(), StatusServiceUnavailable)
 		}
 
-		// make sure the connection is closed
-		data, err := ioutil.ReadAll(br)
-		if err != nil {
+		if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error when writing to the first connection: %s", err)
+		}
+		br = bufio.NewReader(c1)
+		if err = resp.Read(br); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
-		if len(data) > 0 {
-			t.Errorf("unexpected data read from the connection: %q. Expecting empty data", data)
+		if resp.StatusCode() != StatusOK {
+			t.Errorf("unexpected status code for the first connection: %d. Expecting %d",
+				resp.StatusCode(), StatusOK)
+		}
+		if string(resp.Body()) != "OK" {
+			t.Errorf("unexpected body for the first connection: %q. Expecting %q", resp.Body(), "OK")
 		}
-
 		close(clientCh)
 	}()
 
@@ -827,25 +2470,23 @@ func TestServerDisableKeepalive(t *testing.T) {
 	}
 }
 
-func TestServerMaxConnsPerIPLimit(t *testing.T) {
+func TestServerWaitWhenConcurrencyLimitsExceeded(t *testing.T) {
 	t.Parallel()
 
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
 			ctx.WriteString("OK") //nolint:errcheck
 		},
-		MaxConnsPerIP: 1,
-		Logger:        &testLogger{},
+		Concurrency:                       1,
+		WaitWhenConcurrencyLimitsExceeded: 100 * time.Millisecond,
+		Logger:                            &testLogger{},
 	}
 
 	ln := fasthttputil.NewInmemoryListener()
 
 	serverCh := make(chan struct{})
 	go func() {
-		fakeLN := &fakeIPListener{
-			Listener: ln,
-		}
-		if err := s.Serve(fakeLN); err != nil {
+		if err := s.Serve(ln); err != nil {
 			t.Errorf("unexpected error: %s", err)
 		}
 		close(serverCh)
@@ -853,39 +2494,64 @@ func TestServerMaxConnsPerIPLimit(t *testing.T) {
 
 	clientCh := make(chan struct{})
 	go func() {
+		defer close(clientCh)
+
+		// The second connection must be rejected after the wait,
+		// since the first connection stays busy.
 		c1, err := ln.Dial()
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
+			return
 		}
 		c2, err := ln.Dial()
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
+			return
 		}
-		br := bufio.NewReader(c2)
 		var resp Response
-		if err = resp.Read(br); err != nil {
+		if err = resp.Read(bufio.NewReader(c2)); err != nil {
 			t.Errorf("unexpected error: %s", err)
+			return
 		}
-		if resp.StatusCode() != StatusTooManyRequests {
+		if resp.StatusCode() != StatusServiceUnavailable {
 			t.Errorf("unexpected status code for the second connection: %d. Expecting %d",
-				resp.StatusCode(), StatusTooManyRequests)
+				resp.StatusCode(), StatusServiceUnavailable)
 		}
 
-		if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+		// The third connection must be served once the first one is closed.
+		c3, err := ln.Dial()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			return
+		}
+		if _, err = c3.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+			t.Errorf("unexpected error when writing to the third connection: %s", err)
+			return
+		}
+		if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\nConnection: close\r\n\r\n")); err != nil {
 			t.Errorf("unexpected error when writing to the first connection: %s", err)
+			return
 		}
-		br = bufio.NewReader(c1)
-		if err = resp.Read(br); err != nil {
+		if err = resp.Read(bufio.NewReader(c1)); err != nil {
 			t.Errorf("unexpected error: %s", err)
+			return
 		}
 		if resp.StatusCode() != StatusOK {
 			t.Errorf("unexpected status code for the first connection: %d. Expecting %d",
 				resp.StatusCode(), StatusOK)
 		}
+		if err = resp.Read(bufio.NewReader(c3)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+			return
+		}
+		if resp.StatusCode() != StatusOK {
+			t.Errorf("unexpected status code for the third connection: %d. Expecting %d",
+				resp.StatusCode(), StatusOK)
+		}
 		if string(resp.Body()) != "OK" {
-			t.Errorf("unexpected body for the first connection: %q. Expecting %q", resp.Body(), "OK")
+			t.Errorf("unexpected body for the third connection: %q. Expecting %q", resp.Body(), "OK")
 		}
-		close(clientCh)
+		c3.Close()
 	}()
 
 	select {
@@ -894,7 +2560,7 @@ func TestServerMaxConnsPerIPLimit(t *testing.T) {
 		t.Fatal("timeout")
 	}
 
-	if err := ln.Close(); err != nil {
+	if err := s.Shutdown(); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
@@ -905,41 +2571,20 @@ func TestServerMaxConnsPerIPLimit(t *testing.T) {
 	}
 }
 
-type fakeIPListener struct {
-	net.Listener
-}
-
-func (ln *fakeIPListener) Accept() (net.Conn, error) {
-	conn, err := ln.Listener.Accept()
-	if err != nil {
-		return nil, err
-	}
-	return &fakeIPConn{
-		Conn: conn,
-	}, nil
-}
-
-type fakeIPConn struct {
-	net.Conn
-}
-
-func (conn *fakeIPConn) RemoteAddr() net.Addr {
-	addr, err := net.ResolveTCPAddr("tcp4", "1.2.3.4:5789")
-	if err != nil {
-		panic(fmt.Sprintf("BUG: unexpected error: %s", err))
-	}
-	return addr
-}
-
-func TestServerConcurrencyLimit(t *testing.T) {
+func TestServerWaitWhenConcurrencyLimitsExceededShutdown(t *testing.T) {
 	t.Parallel()
 
+	handlerCh := make(chan struct{})
+	releaseCh := make(chan struct{})
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
+			close(handlerCh)
+			<-releaseCh
 			ctx.WriteString("OK") //nolint:errcheck
 		},
-		Concurrency: 1,
-		Logger:      &testLogger{},
+		Concurrency:                       1,
+		WaitWhenConcurrencyLimitsExceeded: 10 * time.Second,
+		Logger:                            &testLogger{},
 	}
 
 	ln := fasthttputil.NewInmemoryListener()
@@ -952,53 +2597,60 @@ func TestServerConcurrencyLimit(t *testing.T) {
 		close(serverCh)
 	}()
 
-	clientCh := make(chan struct{})
-	go func() {
-		c1, err := ln.Dial()
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		c2, err := ln.Dial()
-		if err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		br := bufio.NewReader(c2)
+	c1, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-handlerCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	// The second connection waits for the busy worker.
+	c2, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	shutdownCh := make(chan error, 1)
+	go func() {
+		shutdownCh <- s.Shutdown()
+	}()
+
+	// Shutdown must stop the wait instead of letting it run
+	// for the whole WaitWhenConcurrencyLimitsExceeded.
+	clientCh := make(chan struct{})
+	go func() {
+		defer close(clientCh)
 		var resp Response
-		if err = resp.Read(br); err != nil {
+		if err := resp.Read(bufio.NewReader(c2)); err != nil {
 			t.Errorf("unexpected error: %s", err)
+			return
 		}
 		if resp.StatusCode() != StatusServiceUnavailable {
 			t.Errorf("unexpected status code for the second connection: %d. Expecting %d",
 				resp.StatusCode(), StatusServiceUnavailable)
 		}
-
-		if _, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: aa\r\n\r\n")); err != nil {
-			t.Errorf("unexpected error when writing to the first connection: %s", err)
-		}
-		br = bufio.NewReader(c1)
-		if err = resp.Read(br); err != nil {
-			t.Errorf("unexpected error: %s", err)
-		}
-		if resp.StatusCode() != StatusOK {
-			t.Errorf("unexpected status code for the first connection: %d. Expecting %d",
-				resp.StatusCode(), StatusOK)
-		}
-		if string(resp.Body()) != "OK" {
-			t.Errorf("unexpected body for the first connection: %q. Expecting %q", resp.Body(), "OK")
-		}
-		close(clientCh)
 	}()
-
 	select {
 	case <-clientCh:
 	case <-time.After(time.Second):
 		t.Fatal("timeout")
 	}
 
-	if err := ln.Close(); err != nil {
-		t.Fatalf("unexpected error: %s", err)
+	close(releaseCh)
+	select {
+	case err := <-shutdownCh:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
 	}
-
 	select {
 	case <-serverCh:
 	case <-time.After(time.Second):
@@ -1724,6 +3376,45 @@ func TestRequestCtxFormValue(t *testing.T) {
 	}
 }
 
+func TestRequestCtxFormValuePrecedence(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+	var req Request
+	req.SetRequestURI("/foo/bar?both=query&query=q&empty=")
+	req.SetBodyString("both=body&body=b&empty=body")
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+
+	ctx.Init(&req, nil, nil)
+
+	for key, expected := range map[string]string{
+		"both":  "query",
+		"query": "q",
+		"body":  "b",
+		"empty": "body",
+	} {
+		if v := ctx.FormValue(key); string(v) != expected {
+			t.Fatalf("unexpected value %q for key %q. Expecting %q", v, key, expected)
+		}
+	}
+
+	var mctx RequestCtx
+	var mreq Request
+	mreq.SetRequestURI("/upload?both=query")
+	mreq.Header.SetMethod(MethodPost)
+	mreq.Header.SetContentType("multipart/form-data; boundary=foo")
+	mreq.SetBodyString("--foo\r\nContent-Disposition: form-data; name=\"both\"\r\n\r\nform\r\n" +
+		"--foo\r\nContent-Disposition: form-data; name=\"form\"\r\n\r\nf\r\n--foo--\r\n")
+	mctx.Init(&mreq, nil, nil)
+
+	if v := mctx.FormValue("both"); string(v) != "query" {
+		t.Fatalf("unexpected value %q. Expecting %q", v, "query")
+	}
+	if v := mctx.FormValue("form"); string(v) != "f" {
+		t.Fatalf("unexpected value %q. Expecting %q", v, "f")
+	}
+}
+
 func TestRequestCtxUserValue(t *testing.T) {
 	t.Parallel()
 
@@ -2086,6 +3777,29 @@ func TestRequestCtxWriteString(t *testing.T) {
 	}
 }
 
+func TestRequestCtxWriteStringOverridesBodyStream(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+	closed := false
+	ctx.SetBodyStream(&testReader{onClose: func() error {
+		closed = true
+		return nil
+	}}, -1)
+	if _, err := ctx.WriteString("foo"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !closed {
+		t.Fatalf("body stream must be closed by WriteString")
+	}
+	if ctx.Response.IsBodyStream() {
+		t.Fatalf("body stream must be replaced by WriteString")
+	}
+	if s := ctx.Response.Body(); string(s) != "foo" {
+		t.Fatalf("unexpected response body %q. Expecting %q", s, "foo")
+	}
+}
+
 func TestServeConnNonHTTP11KeepAlive(t *testing.T) {
 	t.Parallel()
 
@@ -2217,6 +3931,66 @@ func TestRequestCtxIfModifiedSince(t *testing.T) {
 	if !ctx.IfModifiedSince(future) {
 		t.Fatal("If-Modified-Since future time must return true")
 	}
+
+	// sub-second modifications within the same second
+	if ctx.IfModifiedSince(lastModified.Truncate(time.Second).Add(999 * time.Millisecond)) {
+		t.Fatal("If-Modified-Since must ignore sub-second part of lastModified")
+	}
+
+	for _, v := range []string{"", "foobar", "2006-01-02T15:04:05Z", "Mon, 32 Jan 2006 15:04:05 GMT"} {
+		ctx.Request.Header.Set("If-Modified-Since", v)
+		if !ctx.IfModifiedSince(past) {
+			t.Fatalf("If-Modified-Since %q must return true", v)
+		}
+	}
+}
+
+func TestRequestCtxNotModified(t *testing.T) {
+	t.Parallel()
+
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Response.Header.Set("X-Foo", "bar")
+			ctx.WriteString("full body") //nolint:errcheck
+			if !ctx.IfModifiedSince(lastModified) {
+				ctx.NotModified()
+			}
+		},
+	}
+
+	for _, tc := range []struct {
+		ifModifiedSince    string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"", StatusOK, "full body"},
+		{"foobar", StatusOK, "full body"},
+		{string(AppendHTTPDate(nil, lastModified.Add(-time.Second))), StatusOK, "full body"},
+		{string(AppendHTTPDate(nil, lastModified)), StatusNotModified, ""},
+		{string(AppendHTTPDate(nil, lastModified.Add(time.Hour))), StatusNotModified, ""},
+	} {
+		rw := &readWriter{}
+		rw.r.WriteString("GET / HTTP/1.1\r\nHost: aaa.com\r\n")
+		if tc.ifModifiedSince != "" {
+			rw.r.WriteString("If-Modified-Since: " + tc.ifModifiedSince + "\r\n")
+		}
+		rw.r.WriteString("\r\n")
+		if err := s.ServeConn(rw); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var resp Response
+		if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.StatusCode() != tc.expectedStatusCode {
+			t.Fatalf("unexpected status code for %q: %d. Expecting %d", tc.ifModifiedSince, resp.StatusCode(), tc.expectedStatusCode)
+		}
+		if string(resp.Body()) != tc.expectedBody {
+			t.Fatalf("unexpected body for %q: %q. Expecting %q", tc.ifModifiedSince, resp.Body(), tc.expectedBody)
+		}
+	}
 }
 
 func TestRequestCtxSendFileNotModified(t *testing.T) {
@@ -2293,6 +4067,50 @@ func TestRequestCtxSendFileModified(t *testing.T) {
 	}
 }
 
+func TestRequestCtxSendFileByteRange(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+	var req Request
+	ctx.Init(&req, nil, defaultLogger)
+
+	filePath := "./server_test.go"
+	ctx.Request.Header.SetByteRange(7, 15)
+	ctx.SendFileBytes([]byte(filePath))
+
+	w := &bytes.Buffer{}
+	bw := bufio.NewWriter(w)
+	if err := ctx.Response.Write(bw); err != nil {
+		t.Fatalf("error when writing response: %s", err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatalf("error when flushing response: %s", err)
+	}
+
+	var resp Response
+	if err := resp.Read(bufio.NewReader(w)); err != nil {
+		t.Fatalf("error when reading response: %s", err)
+	}
+	if resp.StatusCode() != StatusPartialContent {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusPartialContent)
+	}
+
+	body, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("error when reading file: %s", err)
+	}
+	expectedRange := fmt.Sprintf("bytes 7-15/%d", len(body))
+	if v := string(resp.Header.Peek(HeaderContentRange)); v != expectedRange {
+		t.Fatalf("unexpected Content-Range %q. Expecting %q", v, expectedRange)
+	}
+	if !bytes.Equal(resp.Body(), body[7:16]) {
+		t.Fatalf("unexpected response body: %q. Expecting %q", resp.Body(), body[7:16])
+	}
+	if len(resp.Header.ContentType()) == 0 {
+		t.Fatal("missing Content-Type")
+	}
+}
+
 func TestRequestCtxSendFile(t *testing.T) {
 	t.Parallel()
 
@@ -2404,94 +4222,345 @@ func TestRequestCtxHijack(t *testing.T) {
 		t.Fatal("timeout")
 	}
 
-	data, err := ioutil.ReadAll(br)
-	if err != nil {
-		t.Fatalf("Unexpected error when reading remaining data: %s", err)
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Unexpected error when reading remaining data: %s", err)
+	}
+	if string(data) != hijackedString {
+		t.Fatalf("Unexpected data read after the first response %q. Expecting %q", data, hijackedString)
+	}
+}
+
+func TestRequestCtxHijackNoResponse(t *testing.T) {
+	t.Parallel()
+
+	hijackDone := make(chan error)
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Hijack(func(c net.Conn) {
+				_, err := c.Write([]byte("test"))
+				hijackDone <- err
+			})
+			ctx.HijackSetNoResponse(true)
+		},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\nContent-Length: 0\r\n\r\n")
+
+	ch := make(chan error)
+	go func() {
+		ch <- s.ServeConn(rw)
+	}()
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("Unexpected error from serveConn: %s", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case err := <-hijackDone:
+		if err != nil {
+			t.Fatalf("Unexpected error from hijack: %s", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	if got := rw.w.String(); got != "test" {
+		t.Errorf(`expected "test", got %q`, got)
+	}
+}
+
+func TestRequestCtxNoHijackNoResponse(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			io.WriteString(ctx, "test") //nolint:errcheck
+			ctx.HijackSetNoResponse(true)
+		},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\nContent-Length: 0\r\n\r\n")
+
+	ch := make(chan error)
+	go func() {
+		ch <- s.ServeConn(rw)
+	}()
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("Unexpected error from serveConn: %s", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	bf := bufio.NewReader(
+		strings.NewReader(rw.w.String()),
+	)
+	resp := AcquireResponse()
+	resp.Read(bf) //nolint:errcheck
+	if got := string(resp.Body()); got != "test" {
+		t.Errorf(`expected "test", got %q`, got)
+	}
+}
+
+func TestRequestCtxAllowMethods(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if !ctx.IsOptions() {
+				ctx.Error("expecting OPTIONS request", StatusBadRequest)
+				return
+			}
+			if string(ctx.PostBody()) != "options body" {
+				ctx.Error(fmt.Sprintf("unexpected body %q", ctx.PostBody()), StatusBadRequest)
+				return
+			}
+			ctx.WriteString("this body mustn't be sent") //nolint:errcheck
+			ctx.AllowMethods(MethodGet, MethodPost, MethodOptions)
+		},
+	}
+
+	rw := &readWriter{}
+	rw.r.WriteString("OPTIONS /foo HTTP/1.1\r\nHost: aaa.com\r\nContent-Type: text/plain\r\nContent-Length: 12\r\n\r\noptions body")
+	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: aaa.com\r\nConnection: close\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	respHeader := rw.w.String()
+	respHeader = respHeader[:strings.Index(respHeader, "\r\n\r\n")]
+	if strings.Contains(respHeader, HeaderContentLength) {
+		t.Fatalf("unexpected Content-Length in 204 response %q", respHeader)
+	}
+
+	br := bufio.NewReader(&rw.w)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusNoContent {
+		t.Fatalf("unexpected status code: %d. Expecting %d. Body: %q", resp.StatusCode(), StatusNoContent, resp.Body())
+	}
+	if allow := resp.Header.Peek(HeaderAllow); string(allow) != "GET, POST, OPTIONS" {
+		t.Fatalf("unexpected Allow header: %q. Expecting %q", allow, "GET, POST, OPTIONS")
+	}
+	if len(resp.Body()) != 0 {
+		t.Fatalf("unexpected body: %q. Expecting empty body", resp.Body())
+	}
+
+	// The response for the OPTIONS request mustn't break the next response.
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusBadRequest {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusBadRequest)
+	}
+}
+
+func TestRequestCtxBearerToken(t *testing.T) {
+	t.Parallel()
+
+	testRequestCtxBearerToken(t, "Bearer abc.def.ghi", "abc.def.ghi")
+	testRequestCtxBearerToken(t, "bearer abc.def.ghi", "abc.def.ghi")
+	testRequestCtxBearerToken(t, "BEARER abc", "abc")
+	testRequestCtxBearerToken(t, "Bearer    abc  ", "abc")
+	testRequestCtxBearerToken(t, "Bearer\tabc", "abc")
+
+	// missing header, other schemes and malformed values
+	testRequestCtxBearerToken(t, "", "")
+	testRequestCtxBearerToken(t, "Basic Zm9vOmJhcg==", "")
+	testRequestCtxBearerToken(t, "Bearer", "")
+	testRequestCtxBearerToken(t, "Bearer   ", "")
+	testRequestCtxBearerToken(t, "Bearerabc", "")
+}
+
+func testRequestCtxBearerToken(t *testing.T, auth, expectedToken string) {
+	var ctx RequestCtx
+	if auth != "" {
+		ctx.Request.Header.Set(HeaderAuthorization, auth)
+	}
+	if string(ctx.Request.Header.Authorization()) != auth {
+		t.Fatalf("unexpected Authorization header: %q. Expecting %q", ctx.Request.Header.Authorization(), auth)
+	}
+	token := ctx.BearerToken()
+	if string(token) != expectedToken {
+		t.Fatalf("unexpected bearer token for %q: %q. Expecting %q", auth, token, expectedToken)
+	}
+	if expectedToken == "" && token != nil {
+		t.Fatalf("expecting nil bearer token for %q. Got %q", auth, token)
+	}
+}
+
+func TestRequestCtxIsProxyRequest(t *testing.T) {
+	t.Parallel()
+
+	// origin-form
+	testRequestCtxIsProxyRequest(t, "GET /foo/bar?baz=1 HTTP/1.1\r\nHost: aaa.com\r\n\r\n",
+		false, "http", "aaa.com", "/foo/bar", "aaa.com")
+
+	// absolute-form
+	testRequestCtxIsProxyRequest(t, "GET http://example.com/foo/bar?baz=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		true, "http", "example.com", "/foo/bar", "example.com")
+	testRequestCtxIsProxyRequest(t, "GET HTTPS://Example.com:8443 HTTP/1.1\r\nHost: aaa.com\r\n\r\n",
+		true, "https", "example.com:8443", "/", "aaa.com")
+	testRequestCtxIsProxyRequest(t, "POST http://example.com/foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nabc",
+		true, "http", "example.com", "/foo", "example.com")
+
+	// CONNECT is always addressed to a proxy.
+	testRequestCtxIsProxyRequest(t, "CONNECT http://example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		true, "http", "example.com:443", "/", "example.com:443")
+}
+
+func testRequestCtxIsProxyRequest(t *testing.T, request string, expectedIsProxy bool,
+	expectedScheme, expectedHost, expectedPath, expectedHostHeader string) {
+	var ctx RequestCtx
+	br := bufio.NewReader(bytes.NewBufferString(request))
+	if err := ctx.Request.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-	if string(data) != hijackedString {
-		t.Fatalf("Unexpected data read after the first response %q. Expecting %q", data, hijackedString)
+	if ctx.IsProxyRequest() != expectedIsProxy {
+		t.Fatalf("unexpected IsProxyRequest() for %q: %v. Expecting %v", request, ctx.IsProxyRequest(), expectedIsProxy)
+	}
+	if string(ctx.URI().Scheme()) != expectedScheme {
+		t.Fatalf("unexpected scheme for %q: %q. Expecting %q", request, ctx.URI().Scheme(), expectedScheme)
+	}
+	if string(ctx.Host()) != expectedHost {
+		t.Fatalf("unexpected host for %q: %q. Expecting %q", request, ctx.Host(), expectedHost)
+	}
+	if string(ctx.Path()) != expectedPath {
+		t.Fatalf("unexpected path for %q: %q. Expecting %q", request, ctx.Path(), expectedPath)
+	}
+	if string(ctx.Request.Header.Host()) != expectedHostHeader {
+		t.Fatalf("unexpected Host header for %q: %q. Expecting %q", request, ctx.Request.Header.Host(), expectedHostHeader)
 	}
 }
 
-func TestRequestCtxHijackNoResponse(t *testing.T) {
+func TestServerConnectTunnel(t *testing.T) {
 	t.Parallel()
 
-	hijackDone := make(chan error)
+	hostCh := make(chan string, 1)
 	s := &Server{
 		Handler: func(ctx *RequestCtx) {
+			if !ctx.IsConnect() {
+				ctx.Error("expecting CONNECT request", StatusBadRequest)
+				return
+			}
+			hostCh <- string(ctx.Host())
 			ctx.Hijack(func(c net.Conn) {
-				_, err := c.Write([]byte("test"))
-				hijackDone <- err
+				io.Copy(c, c) //nolint:errcheck
 			})
-			ctx.HijackSetNoResponse(true)
 		},
 	}
 
-	rw := &readWriter{}
-	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\nContent-Length: 0\r\n\r\n")
-
-	ch := make(chan error)
+	ln := fasthttputil.NewInmemoryListener()
+	serverCh := make(chan struct{})
 	go func() {
-		ch <- s.ServeConn(rw)
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(serverCh)
 	}()
 
-	select {
-	case err := <-ch:
-		if err != nil {
-			t.Fatalf("Unexpected error from serveConn: %s", err)
-		}
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("timeout")
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
 
-	select {
-	case err := <-hijackDone:
-		if err != nil {
-			t.Fatalf("Unexpected error from hijack: %s", err)
-		}
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("timeout")
+	br := bufio.NewReader(c)
+	var resp Response
+	resp.SkipBody = true
+	if err = resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), StatusOK)
+	}
+	if host := <-hostCh; host != "example.com:443" {
+		t.Fatalf("unexpected host: %q. Expecting %q", host, "example.com:443")
 	}
 
-	if got := rw.w.String(); got != "test" {
-		t.Errorf(`expected "test", got %q`, got)
+	if _, err = c.Write([]byte("foobar")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := make([]byte, len("foobar"))
+	if _, err = io.ReadFull(br, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != "foobar" {
+		t.Fatalf("unexpected tunneled data: %q. Expecting %q", buf, "foobar")
+	}
+
+	c.Close()
+	if err = ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
 	}
 }
 
-func TestRequestCtxNoHijackNoResponse(t *testing.T) {
+func TestRequestCtxRealIP(t *testing.T) {
 	t.Parallel()
 
-	s := &Server{
-		Handler: func(ctx *RequestCtx) {
-			io.WriteString(ctx, "test") //nolint:errcheck
-			ctx.HijackSetNoResponse(true)
-		},
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
+	s := &Server{
+		TrustedProxies: []*net.IPNet{proxies},
+	}
+
+	// Headers from untrusted peers are ignored.
+	testRequestCtxRealIP(t, s, "1.2.3.4", "X-Forwarded-For: 5.6.7.8\r\n", "1.2.3.4")
+	testRequestCtxRealIP(t, s, "1.2.3.4", "X-Real-IP: 5.6.7.8\r\n", "1.2.3.4")
+
+	// Trusted peers.
+	testRequestCtxRealIP(t, s, "10.0.0.1", "", "10.0.0.1")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 5.6.7.8\r\n", "5.6.7.8")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 5.6.7.8, 10.1.1.1\r\n", "5.6.7.8")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 10.2.2.2, 10.1.1.1\r\n", "10.2.2.2")
+
+	// Multiple hops: the left-most untrusted ip is the client.
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 9.9.9.9, 5.6.7.8, 10.1.1.1\r\n", "9.9.9.9")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 10.2.2.2, 5.6.7.8, 9.9.9.9, 10.1.1.1\r\n", "5.6.7.8")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 5.6.7.8, foobar\r\n", "5.6.7.8")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: foobar, 5.6.7.8\r\n", "10.0.0.1")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Forwarded-For: 2001:db8::1\r\n", "2001:db8::1")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Real-IP: 5.6.7.8\r\n", "5.6.7.8")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Real-IP: foobar\r\n", "10.0.0.1")
+	testRequestCtxRealIP(t, s, "10.0.0.1", "X-Real-IP: 9.9.9.9\r\nX-Forwarded-For: 5.6.7.8\r\n", "5.6.7.8")
+
+	// No trusted proxies by default.
+	testRequestCtxRealIP(t, &Server{}, "10.0.0.1", "X-Forwarded-For: 5.6.7.8\r\n", "10.0.0.1")
+}
 
-	rw := &readWriter{}
-	rw.r.WriteString("GET /foo HTTP/1.1\r\nHost: google.com\r\nContent-Length: 0\r\n\r\n")
-
-	ch := make(chan error)
-	go func() {
-		ch <- s.ServeConn(rw)
-	}()
-
-	select {
-	case err := <-ch:
-		if err != nil {
-			t.Fatalf("Unexpected error from serveConn: %s", err)
-		}
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("timeout")
+func testRequestCtxRealIP(t *testing.T, s *Server, remoteIP, headers, expectedIP string) {
+	var req Request
+	r := "GET / HTTP/1.1\r\nHost: aaa.com\r\n" + headers + "\r\n"
+	if err := req.Read(bufio.NewReader(strings.NewReader(r))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
 	}
-
-	bf := bufio.NewReader(
-		strings.NewReader(rw.w.String()),
-	)
-	resp := AcquireResponse()
-	resp.Read(bf) //nolint:errcheck
-	if got := string(resp.Body()); got != "test" {
-		t.Errorf(`expected "test", got %q`, got)
+	var ctx RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 1234}, nil)
+	ctx.s = s
+	if ip := ctx.RealIP(); ip.String() != expectedIP {
+		t.Fatalf("unexpected ip %s for remote ip %s and headers %q. Expecting %s", ip, remoteIP, headers, expectedIP)
 	}
 }
 
@@ -2637,6 +4706,157 @@ func TestTimeoutHandlerTimeout(t *testing.T) {
 	}
 }
 
+func TestTimeoutWithCodeHandlerPerRoute(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	readyCh := make(chan struct{})
+	slow := TimeoutWithCodeHandler(func(ctx *RequestCtx) {
+		<-readyCh
+	}, 20*time.Millisecond, "upstream timeout", StatusGatewayTimeout)
+	fast := TimeoutHandler(func(ctx *RequestCtx) {
+		ctx.Success("aaa/bbb", []byte("fast response"))
+	}, 10*time.Second, "timeout!!!")
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/slow":
+				slow(ctx)
+			default:
+				fast(ctx)
+			}
+		},
+	}
+	serverCh := make(chan struct{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexepcted error: %s", err)
+		}
+		close(serverCh)
+	}()
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	if _, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	verifyResponse(t, br, StatusGatewayTimeout, string(defaultContentType), "upstream timeout")
+	close(readyCh)
+
+	if _, err = conn.Write([]byte("GET /fast HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	verifyResponse(t, br, StatusOK, "aaa/bbb", "fast response")
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-serverCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestTimeoutHandlerCancelsContext(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	errCh := make(chan error, 1)
+	h := func(ctx *RequestCtx) {
+		if _, ok := ctx.Deadline(); !ok {
+			errCh <- errors.New("missing deadline")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			errCh <- ctx.Err()
+		case <-time.After(time.Second):
+			errCh <- errors.New("handler context wasn't cancelled on timeout")
+		}
+	}
+	s := &Server{
+		Handler: TimeoutHandler(h, 20*time.Millisecond, "timeout!!!"),
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	verifyResponse(t, br, StatusRequestTimeout, string(defaultContentType), "timeout!!!")
+
+	select {
+	case err := <-errCh:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v. Expecting %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("handler didn't return promptly after the timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestTimeoutHandlerNested(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	errCh := make(chan error, 1)
+	inner := TimeoutHandler(func(ctx *RequestCtx) {}, time.Second, "inner timeout")
+	outer := func(ctx *RequestCtx) {
+		outerDeadline, _ := ctx.Deadline()
+		inner(ctx)
+		if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(outerDeadline) {
+			errCh <- fmt.Errorf("unexpected deadline after inner handler: %v, %v. Expecting %v", deadline, ok, outerDeadline)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			errCh <- ctx.Err()
+		case <-time.After(time.Second):
+			errCh <- errors.New("outer handler context wasn't cancelled on timeout")
+		}
+	}
+	s := &Server{
+		Handler: TimeoutHandler(outer, 50*time.Millisecond, "outer timeout"),
+	}
+	go s.Serve(ln) //nolint:errcheck
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	verifyResponse(t, br, StatusRequestTimeout, string(defaultContentType), "outer timeout")
+
+	select {
+	case err := <-errCh:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v. Expecting %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("handler didn't return promptly after the timeout")
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
 func TestTimeoutHandlerTimeoutReuse(t *testing.T) {
 	t.Parallel()
 
@@ -3786,6 +6006,67 @@ func TestStreamBodyReqestContentLength(t *testing.T) {
 	}
 }
 
+func TestStreamRequestBodyIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	part1 := strings.Repeat("1", 1<<15)
+	readErr := make(chan error, 1)
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			_, err := ioutil.ReadAll(ctx.RequestBodyStream())
+			readErr <- err
+		},
+		StreamRequestBody:            true,
+		StreamRequestBodyIdleTimeout: 50 * time.Millisecond,
+		ReadTimeout:                  5 * time.Second,
+	}
+
+	pipe := fasthttputil.NewPipeConns()
+	cc, sc := pipe.Conn1(), pipe.Conn2()
+	// Announce larger body than actually sent, so the upload stalls.
+	if _, err := cc.Write([]byte(fmt.Sprintf("POST /foo HTTP/1.1\r\nHost: aaa.com\r\nContent-Length: %d\r\n\r\n%s", 2*len(part1), part1))); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		ch <- s.ServeConn(sc)
+	}()
+
+	select {
+	case err := <-readErr:
+		x, ok := err.(interface{ Timeout() bool })
+		if !ok || !x.Timeout() {
+			t.Fatalf("unexpected error: %v. Expecting timeout error", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("too long idle timeout: %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stalled body read hasn't been aborted")
+	}
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("unexpected error from serveConn: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the connection hasn't been closed")
+	}
+
+	br := bufio.NewReader(cc)
+	var resp Response
+	if err := resp.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !resp.ConnectionClose() {
+		t.Fatal("expecting connection close")
+	}
+}
+
 func checkReader(t *testing.T, r io.Reader, expected string) {
 	b := make([]byte, len(expected))
 	if _, err := io.ReadFull(r, b); err != nil {
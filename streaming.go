@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/valyala/bytebufferpool"
 )
@@ -12,12 +14,42 @@ import (
 type requestStream struct {
 	prefetchedBytes *bytes.Reader
 	reader          *bufio.Reader
+	header          *RequestHeader
 	totalBytesRead  int
 	contentLength   int
 	chunkLeft       int
+
+	conn         net.Conn
+	idleTimeout  time.Duration
+	deadline     time.Time
+	idleTimedOut bool
+}
+
+// setIdleTimeout limits the time for waiting for the next body bytes from c
+// by idleTimeout. The read deadline never exceeds the given deadline.
+func (rs *requestStream) setIdleTimeout(c net.Conn, idleTimeout time.Duration, deadline time.Time) {
+	rs.conn = c
+	rs.idleTimeout = idleTimeout
+	rs.deadline = deadline
 }
 
 func (rs *requestStream) Read(p []byte) (int, error) {
+	if rs.idleTimeout <= 0 {
+		return rs.read(p)
+	}
+	if err := rs.conn.SetReadDeadline(limitDeadline(time.Now().Add(rs.idleTimeout), rs.deadline)); err != nil {
+		return 0, err
+	}
+	n, err := rs.read(p)
+	if err != nil {
+		if x, ok := err.(interface{ Timeout() bool }); ok && x.Timeout() {
+			rs.idleTimedOut = true
+		}
+	}
+	return n, err
+}
+
+func (rs *requestStream) read(p []byte) (int, error) {
 	var (
 		n   int
 		err error
@@ -29,7 +61,7 @@ func (rs *requestStream) Read(p []byte) (int, error) {
 				return 0, err
 			}
 			if chunkSize == 0 {
-				err = readCrLf(rs.reader)
+				rs.header.trailer, err = readTrailer(rs.reader, rs.header.trailer[:0], rs.header.disableNormalizing)
 				if err == nil {
 					err = io.EOF
 				}
@@ -85,10 +117,11 @@ func (rs *requestStream) Read(p []byte) (int, error) {
 	return n, err
 }
 
-func acquireRequestStream(b *bytebufferpool.ByteBuffer, r *bufio.Reader, contentLength int) *requestStream {
+func acquireRequestStream(b *bytebufferpool.ByteBuffer, r *bufio.Reader, h *RequestHeader, contentLength int) *requestStream {
 	rs := requestStreamPool.Get().(*requestStream)
 	rs.prefetchedBytes = bytes.NewReader(b.B)
 	rs.reader = r
+	rs.header = h
 	rs.contentLength = contentLength
 
 	return rs
@@ -99,6 +132,11 @@ func releaseRequestStream(rs *requestStream) {
 	rs.totalBytesRead = 0
 	rs.chunkLeft = 0
 	rs.reader = nil
+	rs.header = nil
+	rs.conn = nil
+	rs.idleTimeout = 0
+	rs.deadline = time.Time{}
+	rs.idleTimedOut = false
 	requestStreamPool.Put(rs)
 }
 
@@ -189,3 +189,29 @@ func BenchmarkRequestStreamE2E(b *testing.B) {
 
 	wg.Wait()
 }
+
+func TestRequestStreamChunkedTrailer(t *testing.T) {
+	t.Parallel()
+
+	s := "POST /foo HTTP/1.1\r\nHost: aaa.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Checksum: 123\r\n\r\nnext"
+	br := bufio.NewReader(bytes.NewBufferString(s))
+
+	var req Request
+	if err := req.Header.Read(br); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := req.ContinueReadBodyStream(br, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, err := ioutil.ReadAll(req.bodyStream)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(body) != "abc" {
+		t.Fatalf("unexpected body %q. Expecting %q", body, "abc")
+	}
+	if v := req.Header.PeekTrailer("X-Checksum"); string(v) != "123" {
+		t.Fatalf("unexpected trailer value %q. Expecting %q", v, "123")
+	}
+	verifyTrailer(t, br, "next")
+}
@@ -55,6 +55,7 @@ var (
 	strRange            = []byte(HeaderRange)
 	strContentRange     = []byte(HeaderContentRange)
 	strAuthorization    = []byte(HeaderAuthorization)
+	strTrailer          = []byte(HeaderTrailer)
 
 	strCookieExpires        = []byte("expires")
 	strCookieDomain         = []byte("domain")
@@ -74,6 +75,7 @@ var (
 	strKeepAlive           = []byte("keep-alive")
 	strUpgrade             = []byte("Upgrade")
 	strChunked             = []byte("chunked")
+	strTrailers            = []byte("trailers")
 	strIdentity            = []byte("identity")
 	str100Continue         = []byte("100-continue")
 	strPostArgsContentType = []byte("application/x-www-form-urlencoded")
@@ -84,4 +86,5 @@ var (
 	strTextSlash           = []byte("text/")
 	strApplicationSlash    = []byte("application/")
 	strBasicSpace          = []byte("Basic ")
+	strBearer              = []byte("Bearer")
 )
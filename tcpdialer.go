@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -156,6 +157,29 @@ type TCPDialer struct {
 	// DNSCacheDuration may be used to override the default DNS cache duration (DefaultDNSCacheDuration)
 	DNSCacheDuration time.Duration
 
+	// DisableDNSCache disables caching of resolved TCP addresses.
+	//
+	// The address is resolved on every dial if this option is set.
+	// This may be useful if DNS records change frequently
+	// or if DNS caching is performed by the Resolver itself.
+	//
+	// Set HostClient.Dial or Client.Dial to the Dial method of the TCPDialer
+	// with DisableDNSCache set in order to disable DNS caching in clients.
+	//
+	// By default resolved TCP addresses are cached for DNSCacheDuration.
+	DisableDNSCache bool
+
+	// Whether to enable tcp keep-alive on established connections.
+	//
+	// By default tcp keep-alive settings are left untouched.
+	TCPKeepalive bool
+
+	// Period between tcp keep-alive messages.
+	//
+	// TCP keep-alive period is determined by operation system by default.
+	// This option is used only if TCPKeepalive is set.
+	TCPKeepalivePeriod time.Duration
+
 	tcpAddrsLock sync.Mutex
 	tcpAddrsMap  map[string]*tcpAddrEntry
 
@@ -281,7 +305,9 @@ func (d *TCPDialer) dial(addr string, dualStack bool, timeout time.Duration) (ne
 		}
 
 		d.tcpAddrsMap = make(map[string]*tcpAddrEntry)
-		go d.tcpAddrsClean()
+		if !d.DisableDNSCache {
+			go d.tcpAddrsClean()
+		}
 	})
 
 	addrs, idx, err := d.getTCPAddrs(addr, dualStack)
@@ -289,7 +315,8 @@ func (d *TCPDialer) dial(addr string, dualStack bool, timeout time.Duration) (ne
 		return nil, err
 	}
 	network := "tcp4"
-	if dualStack {
+	if dualStack || addrs[0].IP.To4() == nil {
+		// IPv6 literals are dialed even if dualStack is disabled.
 		network = "tcp"
 	}
 
@@ -346,9 +373,41 @@ func (d *TCPDialer) tryDial(network string, addr *net.TCPAddr, deadline time.Tim
 	if err != nil && ctx.Err() == context.DeadlineExceeded {
 		return nil, ErrDialTimeout
 	}
+	if err == nil && d.TCPKeepalive {
+		if err = setTCPKeepalive(conn, true, d.TCPKeepalivePeriod); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
 	return conn, err
 }
 
+// setTCPKeepalive enables or disables tcp keep-alive messages on conn
+// if conn is a *net.TCPConn. Other connections are left untouched.
+//
+// The keep-alive period is determined by operating system if period <= 0.
+func setTCPKeepalive(conn net.Conn, keepalive bool, period time.Duration) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetKeepAlive(keepalive); err != nil {
+		return err
+	}
+	if keepalive && period > 0 {
+		return tc.SetKeepAlivePeriod(period)
+	}
+	return nil
+}
+
+func setTCPNoDelay(conn net.Conn, noDelay bool) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tc.SetNoDelay(noDelay)
+}
+
 // ErrDialTimeout is returned when TCP dialing is timed out.
 var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 
@@ -385,6 +444,11 @@ func (d *TCPDialer) tcpAddrsClean() {
 }
 
 func (d *TCPDialer) getTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, uint32, error) {
+	if d.DisableDNSCache {
+		addrs, err := resolveTCPAddrs(addr, dualStack, d.Resolver)
+		return addrs, 0, err
+	}
+
 	d.tcpAddrsLock.Lock()
 	e := d.tcpAddrsMap[addr]
 	if e != nil && !e.pending && time.Since(e.resolveTime) > d.DNSCacheDuration {
@@ -429,6 +493,16 @@ func resolveTCPAddrs(addr string, dualStack bool, resolver Resolver) ([]net.TCPA
 		return nil, err
 	}
 
+	// IP literals such as [::1]:80 are dialed as-is, since the caller
+	// explicitly asked for the given address family.
+	if ip, zone := parseIPZone(host); ip != nil {
+		return []net.TCPAddr{{
+			IP:   ip,
+			Port: port,
+			Zone: zone,
+		}}, nil
+	}
+
 	if resolver == nil {
 		resolver = net.DefaultResolver
 	}
@@ -459,3 +533,18 @@ func resolveTCPAddrs(addr string, dualStack bool, resolver Resolver) ([]net.TCPA
 }
 
 var errNoDNSEntries = errors.New("couldn't find DNS entries for the given domain. Try using DialDualStack")
+
+// parseIPZone parses IP literal with optional zone, e.g. fe80::1%en0.
+//
+// nil is returned if host isn't an IP literal.
+func parseIPZone(host string) (net.IP, string) {
+	zone := ""
+	if n := strings.LastIndexByte(host, '%'); n >= 0 {
+		host, zone = host[:n], host[n+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
@@ -0,0 +1,182 @@
+package fasthttp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testResolver struct {
+	lock  sync.Mutex
+	ip    net.IP
+	calls int
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls++
+	return []net.IPAddr{{IP: r.ip}}, nil
+}
+
+func (r *testResolver) setIP(ip net.IP) {
+	r.lock.Lock()
+	r.ip = ip
+	r.lock.Unlock()
+}
+
+func (r *testResolver) getCalls() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.calls
+}
+
+func TestTCPDialerDisableDNSCache(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	addr := net.JoinHostPort("foobar.com", port)
+
+	// The first answer points to the address nobody listens on.
+	r := &testResolver{ip: net.ParseIP("127.0.0.2")}
+	d := &TCPDialer{
+		Resolver:        r,
+		DisableDNSCache: true,
+	}
+	if c, err := d.Dial(addr); err == nil {
+		c.Close()
+		t.Fatalf("expecting error when dialing %q resolved to %s", addr, r.ip)
+	}
+
+	// The changed answer must be used on the next dial.
+	r.setIP(net.ParseIP("127.0.0.1"))
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial(addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.Close()
+	}
+	if calls := r.getCalls(); calls != 4 {
+		t.Fatalf("unexpected number of DNS lookups: %d. Expecting %d", calls, 4)
+	}
+}
+
+func TestTCPDialerDNSCache(t *testing.T) {
+	t.Parallel()
+
+	r := &testResolver{ip: net.ParseIP("127.0.0.2")}
+	d := &TCPDialer{
+		Resolver: r,
+	}
+	d.DNSCacheDuration = DefaultDNSCacheDuration
+	d.tcpAddrsMap = make(map[string]*tcpAddrEntry)
+
+	for i := 0; i < 3; i++ {
+		addrs, _, err := d.getTCPAddrs("foobar.com:80", false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("127.0.0.2")) {
+			t.Fatalf("unexpected addrs: %v. Expecting %s", addrs, "127.0.0.2:80")
+		}
+		r.setIP(net.ParseIP("127.0.0.1"))
+	}
+	if calls := r.getCalls(); calls != 1 {
+		t.Fatalf("unexpected number of DNS lookups: %d. Expecting %d", calls, 1)
+	}
+}
+
+func TestResolveTCPAddrsIPLiteral(t *testing.T) {
+	t.Parallel()
+
+	// IP literals mustn't be passed to the resolver.
+	r := &testResolver{ip: net.ParseIP("127.0.0.2")}
+	for _, tc := range []struct {
+		addr         string
+		dualStack    bool
+		expectedAddr string
+	}{
+		{"127.0.0.1:80", false, "127.0.0.1:80"},
+		{"[::1]:8080", false, "[::1]:8080"},
+		{"[::1]:8080", true, "[::1]:8080"},
+		{"[fe80::1%en0]:443", false, "[fe80::1%en0]:443"},
+		{"[::ffff:127.0.0.1]:80", false, "127.0.0.1:80"},
+	} {
+		addrs, err := resolveTCPAddrs(tc.addr, tc.dualStack, r)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tc.addr, err)
+		}
+		if len(addrs) != 1 {
+			t.Fatalf("unexpected number of addrs for %q: %d. Expecting 1", tc.addr, len(addrs))
+		}
+		if addr := addrs[0].String(); addr != tc.expectedAddr {
+			t.Fatalf("unexpected addr for %q: %q. Expecting %q", tc.addr, addr, tc.expectedAddr)
+		}
+	}
+	if calls := r.getCalls(); calls != 0 {
+		t.Fatalf("unexpected number of DNS lookups: %d. Expecting 0", calls)
+	}
+
+	// Malformed addresses are rejected.
+	for _, addr := range []string{"::1:8080", "[::1]", "[::1]:port"} {
+		if _, err := resolveTCPAddrs(addr, false, r); err == nil {
+			t.Fatalf("expecting error for %q", addr)
+		}
+	}
+}
+
+func TestDialIPv6Literal(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is unavailable: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	addr := ln.Addr().String()
+	if addr[0] != '[' {
+		t.Fatalf("unexpected listener addr %q. Expecting bracketed IPv6 literal", addr)
+	}
+	// IPv6 literals must be dialed without DialDualStack.
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("unexpected error when dialing %q: %s", addr, err)
+	}
+	c.Close()
+
+	c, err = DialDualStack(addr)
+	if err != nil {
+		t.Fatalf("unexpected error when dialing %q: %s", addr, err)
+	}
+	c.Close()
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package fasthttp
+
+import (
+	"net"
+	"syscall"
+)
+
+func tcpKeepaliveEnabled(conn net.Conn) (bool, error) {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var v int
+	var opErr error
+	if err := rc.Control(func(fd uintptr) {
+		v, opErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	}); err != nil {
+		return false, err
+	}
+	return v != 0, opErr
+}
@@ -0,0 +1,25 @@
+// +build windows
+
+package fasthttp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func tcpKeepaliveEnabled(conn net.Conn) (bool, error) {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var v int32
+	var opErr error
+	if err := rc.Control(func(fd uintptr) {
+		n := int32(unsafe.Sizeof(v))
+		opErr = syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, (*byte)(unsafe.Pointer(&v)), &n)
+	}); err != nil {
+		return false, err
+	}
+	return v != 0, opErr
+}
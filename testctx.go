@@ -0,0 +1,129 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+// NewTestRequestCtx returns RequestCtx for testing RequestHandler
+// without a socket.
+//
+// The request is built from the given method, uri, body and header
+// key-value pairs, e.g.
+//
+//     ctx := NewTestRequestCtx("POST", "http://foobar.com/upload", "body",
+//         "Content-Type", "text/plain", "X-Foo", "bar")
+//
+// The returned ctx is bound to an in-memory connection. Pass it
+// to ServeTestRequestCtx for calling the handler and capturing bytes
+// written to the connection.
+//
+// This function is intended for tests only.
+func NewTestRequestCtx(method, uri, body string, headers ...string) *RequestCtx {
+	if len(headers)%2 != 0 {
+		panic("BUG: headers must contain key-value pairs")
+	}
+
+	c := &testConn{
+		fakeAddrer: fakeAddrer{
+			laddr: zeroTCPAddr,
+			raddr: zeroTCPAddr,
+		},
+	}
+	ctx := &RequestCtx{}
+	ctx.Init2(c, defaultLogger, false)
+
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	if len(ctx.Request.URI().Host()) > 0 {
+		// Store the Host header and origin-form request uri
+		// like in the request received by the server.
+		ctx.Request.prepareURIHeaders() //nolint:errcheck
+	}
+	for i := 0; i < len(headers); i += 2 {
+		ctx.Request.Header.Set(headers[i], headers[i+1])
+	}
+	if len(body) > 0 {
+		ctx.Request.SetBodyString(body)
+	}
+	return ctx
+}
+
+// ServeTestRequestCtx calls h with the given ctx and returns all the bytes
+// written to the in-memory connection.
+//
+// The response is written to the connection unless the handler
+// hijacks the connection without response, so response body streams
+// set via SetBodyStream or SetBodyStreamWriter are captured
+// in the returned bytes. Hijack handlers are called synchronously
+// after writing the response. They read io.EOF from the connection.
+//
+// ctx.Response may be inspected after the call unless its body
+// has been streamed.
+//
+// ctx must be obtained via NewTestRequestCtx.
+//
+// This function is intended for tests only.
+func ServeTestRequestCtx(ctx *RequestCtx, h RequestHandler) ([]byte, error) {
+	c, ok := ctx.c.(*testConn)
+	if !ok {
+		panic("BUG: ctx must be obtained via NewTestRequestCtx")
+	}
+
+	h(ctx)
+
+	hijackHandler := ctx.hijackHandler
+	ctx.hijackHandler = nil
+	hijackNoResponse := ctx.hijackNoResponse && hijackHandler != nil
+	ctx.hijackNoResponse = false
+
+	if !hijackNoResponse {
+		if ctx.IsHead() {
+			ctx.Response.SkipBody = true
+		}
+		bw := bufio.NewWriter(c)
+		if err := ctx.Response.Write(bw); err != nil {
+			return c.w.Bytes(), err
+		}
+		if err := bw.Flush(); err != nil {
+			return c.w.Bytes(), err
+		}
+	}
+
+	if hijackHandler != nil {
+		hijackHandler(c)
+	}
+	return c.w.Bytes(), nil
+}
+
+// testConn is an in-memory net.Conn capturing written bytes.
+type testConn struct {
+	fakeAddrer
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *testConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *testConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
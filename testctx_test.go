@@ -0,0 +1,110 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServeTestRequestCtx(t *testing.T) {
+	t.Parallel()
+
+	ctx := NewTestRequestCtx("POST", "http://foobar.com/upload?x=1", "hello",
+		"Content-Type", "text/plain", "X-Foo", "bar")
+	out, err := ServeTestRequestCtx(ctx, func(ctx *RequestCtx) {
+		if !ctx.IsPost() {
+			t.Errorf("unexpected method %q. Expecting %q", ctx.Method(), "POST")
+		}
+		if string(ctx.Path()) != "/upload" {
+			t.Errorf("unexpected path %q. Expecting %q", ctx.Path(), "/upload")
+		}
+		if string(ctx.QueryArgs().Peek("x")) != "1" {
+			t.Errorf("unexpected query arg %q. Expecting %q", ctx.QueryArgs().Peek("x"), "1")
+		}
+		if string(ctx.RequestURI()) != "/upload?x=1" {
+			t.Errorf("unexpected request uri %q. Expecting %q", ctx.RequestURI(), "/upload?x=1")
+		}
+		if string(ctx.Host()) != "foobar.com" {
+			t.Errorf("unexpected host %q. Expecting %q", ctx.Host(), "foobar.com")
+		}
+		if string(ctx.Request.Header.Host()) != "foobar.com" {
+			t.Errorf("unexpected Host header %q. Expecting %q", ctx.Request.Header.Host(), "foobar.com")
+		}
+		if string(ctx.Request.Header.Peek("X-Foo")) != "bar" {
+			t.Errorf("unexpected header %q. Expecting %q", ctx.Request.Header.Peek("X-Foo"), "bar")
+		}
+		ctx.SetContentType("text/plain")
+		ctx.Write(ctx.PostBody()) //nolint:errcheck
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(ctx.Response.Body()) != "hello" {
+		t.Fatalf("unexpected body %q. Expecting %q", ctx.Response.Body(), "hello")
+	}
+
+	var resp Response
+	if err = resp.Read(bufio.NewReader(bytes.NewReader(out))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "hello" {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "hello")
+	}
+}
+
+func TestServeTestRequestCtxBodyStream(t *testing.T) {
+	t.Parallel()
+
+	ctx := NewTestRequestCtx("GET", "/", "")
+	out, err := ServeTestRequestCtx(ctx, func(ctx *RequestCtx) {
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			w.WriteString("foo") //nolint:errcheck
+			w.Flush()            //nolint:errcheck
+			w.WriteString("bar") //nolint:errcheck
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var resp Response
+	if err = resp.Read(bufio.NewReader(bytes.NewReader(out))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "foobar" {
+		t.Fatalf("unexpected body %q. Expecting %q", resp.Body(), "foobar")
+	}
+}
+
+func TestServeTestRequestCtxHijack(t *testing.T) {
+	t.Parallel()
+
+	ctx := NewTestRequestCtx("GET", "/", "")
+	out, err := ServeTestRequestCtx(ctx, func(ctx *RequestCtx) {
+		ctx.HijackSetNoResponse(true)
+		ctx.Hijack(func(c net.Conn) {
+			c.Write([]byte("hijacked")) //nolint:errcheck
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(out) != "hijacked" {
+		t.Fatalf("unexpected output %q. Expecting %q", out, "hijacked")
+	}
+
+	ctx = NewTestRequestCtx("GET", "/", "")
+	out, err = ServeTestRequestCtx(ctx, func(ctx *RequestCtx) {
+		ctx.Hijack(func(c net.Conn) {
+			c.Write([]byte("hijacked")) //nolint:errcheck
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(string(out), "\r\n\r\nhijacked") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
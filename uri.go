@@ -94,6 +94,8 @@ func (u *URI) Hash() []byte {
 }
 
 // SetHash sets URI hash.
+//
+// The hash is used as-is in FullURI, so it must be already encoded.
 func (u *URI) SetHash(hash string) {
 	u.hash = append(u.hash[:0], hash...)
 }
@@ -142,6 +144,9 @@ func (u *URI) QueryString() []byte {
 }
 
 // SetQueryString sets URI query string.
+//
+// The query string is used as-is in RequestURI, so it must be already
+// encoded. Use QueryArgs for building query strings from raw values.
 func (u *URI) SetQueryString(queryString string) {
 	u.queryString = append(u.queryString[:0], queryString...)
 	u.parsedQueryArgs = false
@@ -168,6 +173,9 @@ func (u *URI) Path() []byte {
 }
 
 // SetPath sets URI path.
+//
+// The path is urldecoded and normalized, so it may be passed either
+// in raw or in encoded form. RequestURI and FullURI encode the path.
 func (u *URI) SetPath(path string) {
 	u.pathOriginal = append(u.pathOriginal[:0], path...)
 	u.path = normalizePath(u.path, u.pathOriginal)
@@ -311,6 +319,12 @@ func (u *URI) parse(host, uri []byte, isTLS bool) error {
 
 	if queryIndex < 0 && fragmentIndex < 0 {
 		u.pathOriginal = append(u.pathOriginal, b...)
+		if len(b) == 1 && b[0] == '*' {
+			// The asterisk-form request target (RFC 7230, 5.3.4)
+			// applies to the whole server, so it isn't a path.
+			u.path = append(u.path[:0], '*')
+			return nil
+		}
 		u.path = normalizePath(u.path, u.pathOriginal)
 		return nil
 	}
@@ -399,22 +413,52 @@ func normalizePath(dst, src []byte) []byte {
 }
 
 // RequestURI returns RequestURI - i.e. URI without Scheme and Host.
+//
+// RequestURI is built from the current uri components on each call,
+// so it reflects all the changes made via URI setters and QueryArgs.
+// The path is encoded from the normalized path unless DisablePathNormalizing
+// is set. Then RequestURI matches AppendRequestURI.
+//
+// The returned value is valid until the next URI method call.
 func (u *URI) RequestURI() []byte {
-	var dst []byte
 	if u.DisablePathNormalizing {
-		dst = append(u.requestURI[:0], u.PathOriginal()...)
+		u.requestURI = u.AppendRequestURI(u.requestURI[:0])
 	} else {
-		dst = appendQuotedPath(u.requestURI[:0], u.Path())
+		dst := appendQuotedPath(u.requestURI[:0], u.Path())
+		u.requestURI = u.appendQuery(dst)
 	}
-	if u.parsedQueryArgs && u.queryArgs.Len() > 0 {
-		dst = append(dst, '?')
-		dst = u.queryArgs.AppendBytes(dst)
+	return u.requestURI
+}
+
+// AppendRequestURI appends RequestURI in origin form, i.e. '/path?query'
+// without scheme and host, to dst and returns the extended dst.
+//
+// The original path is appended as-is, so encoded path chars such as '%2F'
+// are preserved. The encoded normalized path, i.e. '/', is appended only
+// if the original path is empty.
+// The query string is appended verbatim unless QueryArgs were obtained.
+func (u *URI) AppendRequestURI(dst []byte) []byte {
+	if len(u.pathOriginal) > 0 {
+		dst = append(dst, u.pathOriginal...)
+	} else {
+		dst = appendQuotedPath(dst, u.Path())
+	}
+	return u.appendQuery(dst)
+}
+
+func (u *URI) appendQuery(dst []byte) []byte {
+	if u.parsedQueryArgs {
+		// Query args may be changed after parsing the query string,
+		// so they take precedence even if all of them were deleted.
+		if u.queryArgs.Len() > 0 {
+			dst = append(dst, '?')
+			dst = u.queryArgs.AppendBytes(dst)
+		}
 	} else if len(u.queryString) > 0 {
 		dst = append(dst, '?')
 		dst = append(dst, u.queryString...)
 	}
-	u.requestURI = dst
-	return u.requestURI
+	return dst
 }
 
 // LastPathSegment returns the last part of uri path after '/'.
@@ -525,6 +569,11 @@ func (u *URI) updateBytes(newURI, buf []byte) []byte {
 }
 
 // FullURI returns full uri in the form {Scheme}://{Host}{RequestURI}#{Hash}.
+//
+// FullURI is built from the current uri components on each call,
+// so it reflects all the changes made via URI setters and QueryArgs.
+//
+// The returned value is valid until the next URI method call.
 func (u *URI) FullURI() []byte {
 	u.fullURI = u.AppendBytes(u.fullURI[:0])
 	return u.fullURI
@@ -533,6 +582,11 @@ func (u *URI) FullURI() []byte {
 // AppendBytes appends full uri to dst and returns the extended dst.
 func (u *URI) AppendBytes(dst []byte) []byte {
 	dst = u.appendSchemeHost(dst)
+	if len(u.path) == 1 && u.path[0] == '*' {
+		// The full uri for the asterisk-form request target
+		// has no path and query (RFC 7230, 5.5).
+		return dst
+	}
 	dst = append(dst, u.RequestURI()...)
 	if len(u.hash) > 0 {
 		dst = append(dst, '#')
@@ -560,6 +614,13 @@ func (u *URI) String() string {
 	return string(u.FullURI())
 }
 
+// isAbsoluteURI returns true if uri is in absolute-form,
+// i.e. starts with 'scheme://'.
+func isAbsoluteURI(uri []byte) bool {
+	n := bytes.Index(uri, strColonSlashSlash)
+	return n > 0 && bytes.IndexByte(uri[:n], '/') < 0
+}
+
 func splitHostURI(host, uri []byte) ([]byte, []byte, []byte) {
 	n := bytes.Index(uri, strSlashSlash)
 	if n < 0 {
@@ -24,6 +24,12 @@ type workerPool struct {
 
 	MaxIdleWorkerDuration time.Duration
 
+	// MaxWaitDuration is the maximum duration Serve waits for a worker
+	// to become available if MaxWorkersCount workers are busy.
+	//
+	// Serve doesn't wait if MaxWaitDuration isn't set.
+	MaxWaitDuration time.Duration
+
 	Logger Logger
 
 	lock         sync.Mutex
@@ -34,6 +40,12 @@ type workerPool struct {
 
 	stopCh chan struct{}
 
+	// readyCh is notified when a worker becomes ready or exits.
+	readyCh chan struct{}
+
+	// doneCh is closed on server shutdown.
+	doneCh <-chan struct{}
+
 	workerChanPool sync.Pool
 
 	connState func(net.Conn, ConnState)
@@ -50,6 +62,7 @@ func (wp *workerPool) Start() {
 	}
 	wp.stopCh = make(chan struct{})
 	stopCh := wp.stopCh
+	wp.readyCh = make(chan struct{}, 1)
 	wp.workerChanPool.New = func() interface{} {
 		return &workerChan{
 			ch: make(chan net.Conn, workerChanCap),
@@ -73,8 +86,11 @@ func (wp *workerPool) Stop() {
 	if wp.stopCh == nil {
 		panic("BUG: workerPool wasn't started")
 	}
+	// Hold the lock, since waitCh may read wp.stopCh concurrently.
+	wp.lock.Lock()
 	close(wp.stopCh)
 	wp.stopCh = nil
+	wp.lock.Unlock()
 
 	// Stop all the workers waiting for incoming connections.
 	// Do not wait for busy workers - they will stop after
@@ -145,6 +161,9 @@ func (wp *workerPool) clean(scratch *[]*workerChan) {
 
 func (wp *workerPool) Serve(c net.Conn) bool {
 	ch := wp.getCh()
+	if ch == nil && wp.MaxWaitDuration > 0 {
+		ch = wp.waitCh()
+	}
 	if ch == nil {
 		return false
 	}
@@ -152,6 +171,43 @@ func (wp *workerPool) Serve(c net.Conn) bool {
 	return true
 }
 
+// waitCh waits up to MaxWaitDuration for a worker to become available.
+//
+// nil is returned if no worker becomes available in time
+// or if the pool is stopped or the server is shut down while waiting.
+func (wp *workerPool) waitCh() *workerChan {
+	wp.lock.Lock()
+	stopCh := wp.stopCh
+	wp.lock.Unlock()
+	if stopCh == nil {
+		return nil
+	}
+
+	t := AcquireTimer(wp.MaxWaitDuration)
+	defer ReleaseTimer(t)
+	for {
+		select {
+		case <-wp.readyCh:
+			if ch := wp.getCh(); ch != nil {
+				return ch
+			}
+		case <-stopCh:
+			return nil
+		case <-wp.doneCh:
+			return nil
+		case <-t.C:
+			return nil
+		}
+	}
+}
+
+func (wp *workerPool) notifyReady() {
+	select {
+	case wp.readyCh <- struct{}{}:
+	default:
+	}
+}
+
 var workerChanCap = func() int {
 	// Use blocking workerChan if GOMAXPROCS=1.
 	// This immediately switches Serve to WorkerFunc, which results
@@ -208,6 +264,7 @@ func (wp *workerPool) release(ch *workerChan) bool {
 	}
 	wp.ready = append(wp.ready, ch)
 	wp.lock.Unlock()
+	wp.notifyReady()
 	return true
 }
 
@@ -246,4 +303,5 @@ func (wp *workerPool) workerFunc(ch *workerChan) {
 	wp.lock.Lock()
 	wp.workersCount--
 	wp.lock.Unlock()
+	wp.notifyReady()
 }
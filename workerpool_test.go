@@ -167,3 +167,45 @@ func testWorkerPoolMaxWorkersCount(t *testing.T) {
 	}
 	wp.Stop()
 }
+
+func TestWorkerPoolStopWhileWaiting(t *testing.T) {
+	t.Parallel()
+
+	ready := make(chan struct{})
+	defer close(ready)
+
+	wp := &workerPool{
+		WorkerFunc: func(conn net.Conn) error {
+			<-ready
+			return nil
+		},
+		MaxWorkersCount: 1,
+		MaxWaitDuration: time.Hour,
+		Logger:          defaultLogger,
+		connState:       func(net.Conn, ConnState) {},
+	}
+	wp.Start()
+
+	// The first connection occupies the only worker.
+	if !wp.Serve(&readErrorConn{}) {
+		t.Fatalf("worker pool must have enough workers to serve the conn")
+	}
+
+	serveCh := make(chan bool, 1)
+	go func() {
+		serveCh <- wp.Serve(&readErrorConn{})
+	}()
+
+	// Give Serve a chance to start waiting for the busy worker.
+	time.Sleep(50 * time.Millisecond)
+	wp.Stop()
+
+	select {
+	case ok := <-serveCh:
+		if ok {
+			t.Fatalf("the conn mustn't be served after the worker pool is stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}